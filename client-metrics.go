@@ -0,0 +1,200 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/torrent/metrics"
+)
+
+// Accumulates the number and total duration of operations. Safe for concurrent use. Must be
+// 64-bit aligned.
+type durationSummary struct {
+	count int64
+	nanos int64
+}
+
+func (me *durationSummary) add(d time.Duration) {
+	atomic.AddInt64(&me.count, 1)
+	atomic.AddInt64(&me.nanos, int64(d))
+}
+
+// Records the time elapsed since started. Intended for use with defer.
+func (me *durationSummary) timeSince(started time.Time) {
+	me.add(time.Since(started))
+}
+
+func (me *durationSummary) family(name, help string, labels ...metrics.Label) metrics.Family {
+	return metrics.NewSummary(
+		name, help, "seconds",
+		float64(atomic.LoadInt64(&me.count)),
+		time.Duration(atomic.LoadInt64(&me.nanos)).Seconds(),
+		labels...,
+	)
+}
+
+var _ metrics.Collector = (*Client)(nil)
+
+// Collect implements metrics.Collector. Metrics are labelled with the Client's peer ID, and the
+// infohash for per-torrent metrics, so that several Clients can be collected together.
+func (cl *Client) Collect(emit func(metrics.Family)) {
+	cl.rLock()
+	defer cl.rUnlock()
+	clientLabel := metrics.Label{Name: "client", Value: hex.EncodeToString(cl.peerID[:])}
+	stats := &cl.stats
+	emit(metrics.NewCounter(
+		"torrent_client_bytes_read_data",
+		"Bytes of torrent data received from peers by the client.",
+		float64(stats.BytesReadData.Int64()), clientLabel))
+	emit(metrics.NewCounter(
+		"torrent_client_bytes_written_data",
+		"Bytes of torrent data sent to peers by the client.",
+		float64(stats.BytesWrittenData.Int64()), clientLabel))
+	emit(metrics.NewGauge(
+		"torrent_client_torrents",
+		"Torrents in the client.",
+		float64(len(cl.torrents)), clientLabel))
+	emit(metrics.NewGauge(
+		"torrent_client_half_open_conns",
+		"Outgoing peer connections that haven't completed handshaking.",
+		float64(cl.numHalfOpen), clientLabel))
+	if cl.readCache != nil {
+		rcs := cl.readCache.stats()
+		emit(metrics.NewCounter(
+			"torrent_client_read_cache_hits",
+			"Peer requests served from the read cache.",
+			float64(rcs.hits), clientLabel))
+		emit(metrics.NewCounter(
+			"torrent_client_read_cache_misses",
+			"Peer requests that read their piece into the read cache.",
+			float64(rcs.misses), clientLabel))
+		emit(metrics.NewGauge(
+			"torrent_client_read_cache_bytes",
+			"Bytes of piece data in the read cache.",
+			float64(rcs.bytes), clientLabel))
+	}
+	if cl.config.ScrubInterval != 0 {
+		emit(metrics.Family{
+			Name: "torrent_client_pieces_scrubbed",
+			Help: "Complete pieces hashed again by the scrubber, by whether they still matched the expected hash.",
+			Type: metrics.Counter,
+			Samples: []metrics.Sample{
+				{Suffix: "_total", Labels: []metrics.Label{clientLabel, {Name: "result", Value: "good"}}, Value: float64(cl.numPiecesScrubbedGood)},
+				{Suffix: "_total", Labels: []metrics.Label{clientLabel, {Name: "result", Value: "bad"}}, Value: float64(cl.numPiecesScrubbedBad)},
+			},
+		})
+	}
+	ts := cl.torrentsAsSlice()
+	sort.Slice(ts, func(i, j int) bool {
+		return ts[i].infoHash.AsString() < ts[j].infoHash.AsString()
+	})
+	for _, t := range ts {
+		t.collectMetrics(emit, clientLabel)
+	}
+}
+
+// Emits the Torrent's metrics. The Client lock must be held.
+func (t *Torrent) collectMetrics(emit func(metrics.Family), clientLabel metrics.Label) {
+	labels := func(extra ...metrics.Label) []metrics.Label {
+		return append([]metrics.Label{clientLabel, {Name: "infohash", Value: t.infoHash.HexString()}}, extra...)
+	}
+	emit(metrics.NewCounter(
+		"torrent_bytes_read_data",
+		"Bytes of torrent data received from peers.",
+		float64(t.stats.BytesReadData.Int64()), labels()...))
+	emit(metrics.NewCounter(
+		"torrent_bytes_read_useful_data",
+		"Bytes of torrent data received from peers that was wanted.",
+		float64(t.stats.BytesReadUsefulData.Int64()), labels()...))
+	emit(metrics.NewCounter(
+		"torrent_bytes_written_data",
+		"Bytes of torrent data sent to peers.",
+		float64(t.stats.BytesWrittenData.Int64()), labels()...))
+	emit(metrics.Family{
+		Name: "torrent_pieces_hashed",
+		Help: "Pieces hashed after being downloaded, by whether they matched the expected hash.",
+		Type: metrics.Counter,
+		Samples: []metrics.Sample{
+			{Suffix: "_total", Labels: labels(metrics.Label{Name: "result", Value: "good"}), Value: float64(t.numPiecesHashedGood)},
+			{Suffix: "_total", Labels: labels(metrics.Label{Name: "result", Value: "bad"}), Value: float64(t.numPiecesHashedBad)},
+		},
+	})
+	if t.haveInfo() {
+		emit(metrics.NewGauge(
+			"torrent_pieces_completed",
+			"Pieces that are complete in storage.",
+			float64(t.numPiecesCompleted()), labels()...))
+		emit(metrics.NewGauge(
+			"torrent_pieces",
+			"Pieces in the torrent.",
+			float64(t.numPieces()), labels()...))
+	}
+	emit(t.peersFamily(labels))
+	for _, f := range []struct {
+		op string
+		s  *durationSummary
+	}{
+		{"read", &t.storageReads},
+		{"write", &t.storageWrites},
+		{"hash", &t.storageHashes},
+	} {
+		emit(f.s.family(
+			"torrent_storage_op_duration_seconds",
+			"Time spent in storage operations.",
+			labels(metrics.Label{Name: "op", Value: f.op})...))
+	}
+	urls := make([]string, 0, len(t.trackerAnnouncers))
+	for u := range t.trackerAnnouncers {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	for _, u := range urls {
+		ts, ok := t.trackerAnnouncers[u].(*trackerScraper)
+		if !ok {
+			continue
+		}
+		emit(ts.announceDurations.family(
+			"torrent_tracker_announce_duration_seconds",
+			"Time spent announcing to trackers.",
+			labels(metrics.Label{Name: "tracker", Value: u})...))
+	}
+}
+
+// Returns a gauge family of connected peers by source and network.
+func (t *Torrent) peersFamily(labels func(...metrics.Label) []metrics.Label) metrics.Family {
+	type key struct {
+		source  PeerSource
+		network string
+	}
+	counts := make(map[key]int)
+	t.iterPeers(func(p *Peer) {
+		if p.closed.IsSet() {
+			return
+		}
+		counts[key{p.Discovery, p.Network}]++
+	})
+	keys := make([]key, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].source != keys[j].source {
+			return keys[i].source < keys[j].source
+		}
+		return keys[i].network < keys[j].network
+	})
+	f := metrics.Family{
+		Name: "torrent_peers",
+		Help: "Connected peers, by source and network.",
+		Type: metrics.Gauge,
+	}
+	for _, k := range keys {
+		f.Samples = append(f.Samples, metrics.Sample{
+			Labels: labels(metrics.Label{Name: "source", Value: string(k.source)}, metrics.Label{Name: "network", Value: k.network}),
+			Value:  float64(counts[k]),
+		})
+	}
+	return f
+}
@@ -0,0 +1,43 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/internal/testutil"
+	"github.com/anacrolix/torrent/metrics"
+)
+
+func TestClientCollectMetrics(t *testing.T) {
+	c := qt.New(t)
+	greetingDataDir, greetingMetainfo := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDataDir)
+	cfg := TestingConfig(t)
+	cfg.DataDir = greetingDataDir
+	cl, err := NewClient(cfg)
+	c.Assert(err, qt.IsNil)
+	defer cl.Close()
+	sub := cl.SubscribeEvents(100)
+	defer sub.Close()
+	tt, err := cl.AddTorrent(greetingMetainfo)
+	c.Assert(err, qt.IsNil)
+	for e := range sub.Events() {
+		if _, ok := e.(TorrentCompletedEvent); ok {
+			break
+		}
+	}
+	var buf bytes.Buffer
+	c.Assert(metrics.WriteOpenMetrics(&buf, cl), qt.IsNil)
+	labels := fmt.Sprintf(`client="%s",infohash="%s"`, hex.EncodeToString(cl.peerID[:]), tt.InfoHash().HexString())
+	out := buf.String()
+	c.Check(out, qt.Contains, fmt.Sprintf("torrent_client_torrents{client=\"%s\"} 1\n", hex.EncodeToString(cl.peerID[:])))
+	c.Check(out, qt.Contains, fmt.Sprintf("torrent_pieces_completed{%s} %d\n", labels, tt.NumPieces()))
+	c.Check(out, qt.Contains, fmt.Sprintf("torrent_storage_op_duration_seconds_count{%s,op=\"hash\"} %d\n", labels, tt.NumPieces()))
+	c.Check(out, qt.Contains, "# TYPE torrent_bytes_read_data counter\n")
+	c.Check(out, qt.Matches, `(?s).*# EOF\n$`)
+}
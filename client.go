@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/anacrolix/dht/v2"
@@ -24,8 +25,6 @@ import (
 	"github.com/anacrolix/missinggo/v2/bitmap"
 	"github.com/anacrolix/missinggo/v2/pproffd"
 	"github.com/anacrolix/sync"
-	"github.com/davecgh/go-spew/spew"
-	"github.com/dustin/go-humanize"
 	"github.com/google/btree"
 	"github.com/pion/datachannel"
 	"golang.org/x/time/rate"
@@ -65,6 +64,10 @@ type Client struct {
 	listeners      []Listener
 	dhtServers     []DhtServer
 	ipBlockList    iplist.Ranger
+	// Sockets opened from the config, and the DHT servers running on them. These are replaced
+	// when the listen port is changed with UpdateConfig.
+	sockets          []socket
+	socketDhtServers []*dht.Server
 
 	// Set of addresses that have our client ID. This intentionally will
 	// include ourselves if we end up trying to connect to our own address
@@ -75,13 +78,33 @@ type Client struct {
 
 	acceptLimiter   map[ipStr]int
 	dialRateLimiter *rate.Limiter
-	numHalfOpen     int
+	// Holds the *rate.Limiter from ClientConfig.DownloadRateLimiter. Connection readers load it
+	// without the Client lock, so it can be replaced by UpdateConfig.
+	downloadRateLimiter atomic.Value
+	numHalfOpen         int
 
 	websocketTrackers websocketTrackers
 
 	activeAnnounceLimiter limiter.Instance
 
 	updateRequests chansync.BroadcastCond
+	// Torrents that the request strategy runs over. See Torrent.updateRequesting.
+	requestingTorrents map[*Torrent]struct{}
+	// Signalled when torrents should announce to trackers again without waiting for the interval,
+	// such as after the listen port changes.
+	reannounce chansync.BroadcastCond
+	// Complete pieces by when they're due for scrubbing, and signalled when pieces are added.
+	scrubQueue  scrubQueue
+	scrubQueued chansync.BroadcastCond
+
+	eventSubscriptions map[*EventSubscription]struct{}
+
+	// Nil if ClientConfig.ReadCacheCapacity is zero.
+	readCache *readCache
+
+	// Results of hashing pieces in the scrubber.
+	numPiecesScrubbedGood int64
+	numPiecesScrubbedBad  int64
 }
 
 type ipStr string
@@ -111,54 +134,12 @@ func (cl *Client) LocalPort() (port int) {
 	return
 }
 
-func writeDhtServerStatus(w io.Writer, s DhtServer) {
-	dhtStats := s.Stats()
-	fmt.Fprintf(w, " ID: %x\n", s.ID())
-	spew.Fdump(w, dhtStats)
-}
-
 // Writes out a human readable status of the client, such as for writing to a
-// HTTP status page.
+// HTTP status page. See Client.Status for the same information in structured form.
 func (cl *Client) WriteStatus(_w io.Writer) {
-	cl.rLock()
-	defer cl.rUnlock()
 	w := bufio.NewWriter(_w)
 	defer w.Flush()
-	fmt.Fprintf(w, "Listen port: %d\n", cl.LocalPort())
-	fmt.Fprintf(w, "Peer ID: %+q\n", cl.PeerID())
-	fmt.Fprintf(w, "Extension bits: %v\n", cl.config.Extensions)
-	fmt.Fprintf(w, "Announce key: %x\n", cl.announceKey())
-	fmt.Fprintf(w, "Banned IPs: %d\n", len(cl.badPeerIPsLocked()))
-	cl.eachDhtServer(func(s DhtServer) {
-		fmt.Fprintf(w, "%s DHT server at %s:\n", s.Addr().Network(), s.Addr().String())
-		writeDhtServerStatus(w, s)
-	})
-	spew.Fdump(w, &cl.stats)
-	fmt.Fprintf(w, "# Torrents: %d\n", len(cl.torrentsAsSlice()))
-	fmt.Fprintln(w)
-	for _, t := range slices.Sort(cl.torrentsAsSlice(), func(l, r *Torrent) bool {
-		return l.InfoHash().AsString() < r.InfoHash().AsString()
-	}).([]*Torrent) {
-		if t.name() == "" {
-			fmt.Fprint(w, "<unknown name>")
-		} else {
-			fmt.Fprint(w, t.name())
-		}
-		fmt.Fprint(w, "\n")
-		if t.info != nil {
-			fmt.Fprintf(
-				w,
-				"%f%% of %d bytes (%s)",
-				100*(1-float64(t.bytesMissingLocked())/float64(t.info.TotalLength())),
-				*t.length,
-				humanize.Bytes(uint64(*t.length)))
-		} else {
-			w.WriteString("<missing metainfo>")
-		}
-		fmt.Fprint(w, "\n")
-		t.writeStatus(w)
-		fmt.Fprintln(w)
-	}
+	writeClientStatus(w, cl.Status())
 }
 
 // Filters things that are less than warning from UPnP discovery.
@@ -199,6 +180,10 @@ func NewClient(cfg *ClientConfig) (cl *Client, err error) {
 		dialRateLimiter:   rate.NewLimiter(10, 10),
 	}
 	cl.activeAnnounceLimiter.SlotsPerKey = 2
+	if cfg.ReadCacheCapacity != 0 {
+		cl.readCache = newReadCache(cfg.ReadCacheCapacity, cfg.ReadCachePolicy)
+	}
+	cl.downloadRateLimiter.Store(cfg.DownloadRateLimiter)
 	go cl.acceptLimitClearer()
 	cl.initLogger()
 	defer func() {
@@ -234,39 +219,16 @@ func NewClient(cfg *ClientConfig) (cl *Client, err error) {
 		}
 	}
 
-	sockets, err := listenAll(cl.listenNetworks(), cl.config.ListenHost, cl.config.ListenPort, cl.firewallCallback)
+	err = cl.listenSockets(cl.config.ListenPort)
 	if err != nil {
 		return
 	}
+	cl.onClose = append(cl.onClose, cl.closeSockets)
 
 	// Check for panics.
 	cl.LocalPort()
 
-	for _, _s := range sockets {
-		s := _s // Go is fucking retarded.
-		cl.onClose = append(cl.onClose, func() { s.Close() })
-		if peerNetworkEnabled(parseNetworkString(s.Addr().Network()), cl.config) {
-			cl.dialers = append(cl.dialers, s)
-			cl.listeners = append(cl.listeners, s)
-			if cl.config.AcceptPeerConnections {
-				go cl.acceptConnections(s)
-			}
-		}
-	}
-
 	go cl.forwardPort()
-	if !cfg.NoDHT {
-		for _, s := range sockets {
-			if pc, ok := s.(net.PacketConn); ok {
-				ds, err := cl.NewAnacrolixDhtServer(pc)
-				if err != nil {
-					panic(err)
-				}
-				cl.dhtServers = append(cl.dhtServers, AnacrolixDhtServerWrapper{ds})
-				cl.onClose = append(cl.onClose, func() { ds.Close() })
-			}
-		}
-	}
 
 	cl.websocketTrackers = websocketTrackers{
 		PeerId: cl.peerID,
@@ -297,7 +259,102 @@ func NewClient(cfg *ClientConfig) (cl *Client, err error) {
 	}
 
 	go cl.requester()
+	if cfg.ScrubInterval != 0 {
+		err = checkScrubRateLimiter(cfg.ScrubRateLimiter)
+		if err != nil {
+			return
+		}
+		go cl.scrubber()
+	}
+
+	return
+}
+
+// Opens sockets for the enabled networks on the given port, and starts accepting connections and
+// running DHT servers on them. The sockets are owned by the Client, see dropSockets. On error, the
+// Client has no sockets.
+func (cl *Client) listenSockets(port int) error {
+	sockets, err := listenAll(cl.listenNetworks(), cl.config.ListenHost, port, cl.firewallCallback)
+	if err != nil {
+		return err
+	}
+	for _, s := range sockets {
+		cl.sockets = append(cl.sockets, s)
+		if peerNetworkEnabled(parseNetworkString(s.Addr().Network()), cl.config) {
+			cl.dialers = append(cl.dialers, s)
+			cl.listeners = append(cl.listeners, s)
+			if cl.config.AcceptPeerConnections {
+				go cl.acceptConnections(s)
+			}
+		}
+	}
+	if !cl.config.NoDHT {
+		for _, s := range sockets {
+			if pc, ok := s.(net.PacketConn); ok {
+				ds, err := cl.NewAnacrolixDhtServer(pc)
+				if err != nil {
+					cl.dropSockets()
+					return fmt.Errorf("starting dht server: %w", err)
+				}
+				cl.socketDhtServers = append(cl.socketDhtServers, ds)
+				cl.dhtServers = append(cl.dhtServers, AnacrolixDhtServerWrapper{ds})
+			}
+		}
+	}
+	return nil
+}
+
+// Closes the sockets opened by listenSockets and the DHT servers running on them. The Client's
+// dialers, listeners and DHT servers are left alone, as they may be read without the Client lock.
+func (cl *Client) closeSockets() {
+	for _, ds := range cl.socketDhtServers {
+		ds.Close()
+	}
+	for _, s := range cl.sockets {
+		s.Close()
+	}
+}
+
+// Closes the sockets opened by listenSockets and the DHT servers running on them, and removes them
+// from the Client's dialers, listeners and DHT servers. The slices are replaced rather than
+// modified, so copies taken by readers stay valid.
+func (cl *Client) dropSockets() {
+	cl.closeSockets()
+	for _, ds := range cl.socketDhtServers {
+		cl.dhtServers = removeDhtServer(cl.dhtServers, AnacrolixDhtServerWrapper{ds})
+	}
+	cl.socketDhtServers = nil
+	for _, s := range cl.sockets {
+		cl.dialers = removeDialer(cl.dialers, s)
+		cl.listeners = removeListener(cl.listeners, s)
+	}
+	cl.sockets = nil
+}
+
+func removeDhtServer(ss []DhtServer, s DhtServer) (ret []DhtServer) {
+	for _, _s := range ss {
+		if _s != s {
+			ret = append(ret, _s)
+		}
+	}
+	return
+}
+
+func removeDialer(ds []Dialer, d Dialer) (ret []Dialer) {
+	for _, _d := range ds {
+		if _d != d {
+			ret = append(ret, _d)
+		}
+	}
+	return
+}
 
+func removeListener(ls []Listener, l Listener) (ret []Listener) {
+	for _, _l := range ls {
+		if _l != l {
+			ret = append(ret, _l)
+		}
+	}
 	return
 }
 
@@ -420,6 +477,9 @@ func (cl *Client) Close() {
 	for i := range cl.onClose {
 		cl.onClose[len(cl.onClose)-1-i]()
 	}
+	for s := range cl.eventSubscriptions {
+		cl.closeEventSubscription(s)
+	}
 	cl.event.Broadcast()
 }
 
@@ -482,6 +542,7 @@ func (cl *Client) acceptConnections(l Listener) {
 		if conn != nil {
 			reject = cl.rejectAccepted(conn)
 		}
+		removed := !cl.haveListener(l)
 		cl.rUnlock()
 		if closed {
 			if conn != nil {
@@ -490,6 +551,10 @@ func (cl *Client) acceptConnections(l Listener) {
 			return
 		}
 		if err != nil {
+			if removed {
+				// The listener was closed and replaced, such as by a listen port change.
+				return
+			}
 			log.Fmsg("error accepting connection: %s", err).SetLevel(log.Debug).Log(cl.logger)
 			continue
 		}
@@ -575,7 +640,10 @@ func (cl *Client) dopplegangerAddr(addr string) bool {
 
 // Returns a connection over UTP or TCP, whichever is first to connect.
 func (cl *Client) dialFirst(ctx context.Context, addr string) (res DialResult) {
-	return DialFirst(ctx, addr, cl.dialers)
+	cl.rLock()
+	dialers := cl.dialers
+	cl.rUnlock()
+	return DialFirst(ctx, addr, dialers)
 }
 
 // Returns a connection over UTP or TCP, whichever is first to connect.
@@ -924,6 +992,7 @@ func (cl *Client) runHandshookConn(c *PeerConn, t *Torrent) error {
 	if err := t.addPeerConn(c); err != nil {
 		return fmt.Errorf("adding connection: %w", err)
 	}
+	cl.publishEvent(PeerConnectedEvent{t, c})
 	defer t.dropConnection(c)
 	c.startWriter()
 	cl.sendInitialMessages(c, t)
@@ -997,6 +1066,25 @@ func (cl *Client) dhtPort() (ret uint16) {
 	return
 }
 
+func (cl *Client) haveListener(l Listener) bool {
+	for _, _l := range cl.listeners {
+		if _l == l {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the DHT server is still in use by the Client.
+func (cl *Client) hasDhtServer(s DhtServer) bool {
+	for _, _s := range cl.dhtServers {
+		if _s == s {
+			return true
+		}
+	}
+	return false
+}
+
 func (cl *Client) haveDhtServer() (ret bool) {
 	cl.eachDhtServer(func(_ DhtServer) {
 		ret = true
@@ -1143,6 +1231,7 @@ func (cl *Client) AddTorrentInfoHashWithStorage(infoHash metainfo.Hash, specStor
 		}
 	})
 	cl.torrents[infoHash] = t
+	cl.publishEvent(TorrentAddedEvent{t})
 	cl.clearAcceptLimits()
 	t.updateWantPeersEvent()
 	// Tickle Client.waitAccept, new torrent may want conns.
@@ -1169,7 +1258,7 @@ func (stringAddr) Network() string   { return "" }
 func (me stringAddr) String() string { return string(me) }
 
 // The trackers will be merged with the existing ones. If the Info isn't yet known, it will be set.
-// spec.DisallowDataDownload/Upload will be read and applied
+// spec.DisallowDataDownload/Upload and spec.Sequential will be read and applied
 // The display name is replaced if the new spec provides one. Note that any `Storage` is ignored.
 func (t *Torrent) MergeSpec(spec *TorrentSpec) error {
 	if spec.DisplayName != "" {
@@ -1180,6 +1269,11 @@ func (t *Torrent) MergeSpec(spec *TorrentSpec) error {
 		if err != nil {
 			return err
 		}
+		// Storage that can't be allocated fails the add, rather than the download.
+		err = t.waitStorageAllocation()
+		if err != nil {
+			return err
+		}
 	}
 	cl := t.cl
 	cl.AddDhtNodes(spec.DhtNodes)
@@ -1202,7 +1296,9 @@ func (t *Torrent) MergeSpec(spec *TorrentSpec) error {
 	t.addTrackers(spec.Trackers)
 	t.maybeNewConns()
 	t.dataDownloadDisallowed = spec.DisallowDataDownload
+	t.updateRequesting()
 	t.dataUploadDisallowed = spec.DisallowDataUpload
+	t.sequential = spec.Sequential
 	return nil
 }
 
@@ -1259,7 +1355,11 @@ func (cl *Client) dropTorrent(infoHash metainfo.Hash) (err error) {
 	if err != nil {
 		panic(err)
 	}
+	if cl.readCache != nil {
+		cl.readCache.removeTorrent(t)
+	}
 	delete(cl.torrents, infoHash)
+	cl.publishEvent(TorrentRemovedEvent{t})
 	return
 }
 
@@ -1383,8 +1483,9 @@ func (cl *Client) newConnection(nc net.Conn, outgoing bool, remoteAddr PeerRemot
 	c.logger = cl.logger.WithDefaultLevel(log.Warning).WithContextValue(c)
 	c.setRW(connStatsReadWriter{nc, c})
 	c.r = &rateLimitedReader{
-		l: cl.config.DownloadRateLimiter,
-		r: c.r,
+		l:  cl.config.DownloadRateLimiter,
+		lv: &cl.downloadRateLimiter,
+		r:  c.r,
 	}
 	c.logger.WithDefaultLevel(log.Debug).Printf("initialized with remote %v over network %v (outgoing=%t)", remoteAddr, network, outgoing)
 	for _, f := range cl.config.Callbacks.NewPeer {
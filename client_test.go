@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -16,6 +17,7 @@ import (
 	"github.com/frankban/quicktest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
 
 	"github.com/anacrolix/dht/v2"
 	"github.com/anacrolix/missinggo/v2"
@@ -777,3 +779,146 @@ func TestClientDisabledImplicitNetworksButDhtEnabled(t *testing.T) {
 	assert.Empty(t, cl.listeners)
 	assert.NotEmpty(t, cl.DhtServers())
 }
+
+func TestClientUpdateConfigListenPort(t *testing.T) {
+	cfg := TestingConfig(t)
+	cfg.NoDHT = false
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	oldPort := cl.LocalPort()
+	// Find a port that's probably free on all the networks we listen on.
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	newPort := missinggo.AddrPort(l.Addr())
+	l.Close()
+	require.NoError(t, cl.UpdateConfig(func(cfg *ClientConfig) {
+		cfg.ListenPort = newPort
+	}))
+	assert.EqualValues(t, newPort, cl.LocalPort())
+	assert.NotEmpty(t, cl.ListenAddrs())
+	for _, a := range cl.ListenAddrs() {
+		assert.EqualValues(t, newPort, missinggo.AddrPort(a))
+	}
+	assert.NotEmpty(t, cl.DhtServers())
+	for _, s := range cl.DhtServers() {
+		assert.EqualValues(t, newPort, missinggo.AddrPort(s.Addr()))
+	}
+	// The old port should be free again.
+	l, err = net.Listen("tcp", fmt.Sprintf("localhost:%d", oldPort))
+	require.NoError(t, err)
+	l.Close()
+}
+
+func TestClientUpdateConfigListenPortInUse(t *testing.T) {
+	cl, err := NewClient(TestingConfig(t))
+	require.NoError(t, err)
+	defer cl.Close()
+	oldPort := cl.LocalPort()
+	s, err := NewUtpSocket("udp", ":0", nil)
+	require.NoError(t, err)
+	defer s.Close()
+	inUse := missinggo.AddrPort(s.Addr())
+	require.Error(t, cl.UpdateConfig(func(cfg *ClientConfig) {
+		cfg.ListenPort = inUse
+		cfg.Seed = true
+	}))
+	assert.EqualValues(t, oldPort, cl.LocalPort())
+	assert.False(t, cl.config.Seed)
+}
+
+func TestClientUpdateConfigBlocklist(t *testing.T) {
+	cfg := TestingConfig(t)
+	cfg.NoDHT = false
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	ipl := iplist.New([]iplist.Range{{First: net.ParseIP("1.2.3.0"), Last: net.ParseIP("1.2.3.255")}})
+	require.NoError(t, cl.UpdateConfig(func(cfg *ClientConfig) {
+		cfg.IPBlocklist = ipl
+	}))
+	assert.True(t, cl.ipIsBlocked(net.ParseIP("1.2.3.4")))
+	cl.eachDhtServer(func(s DhtServer) {
+		assert.Equal(t, ipl, s.(AnacrolixDhtServerWrapper).Server.IPBlocklist())
+	})
+}
+
+func TestClientUpdateConfigDownloadRateLimiter(t *testing.T) {
+	cl, err := NewClient(TestingConfig(t))
+	require.NoError(t, err)
+	defer cl.Close()
+	r := &rateLimitedReader{l: cl.config.DownloadRateLimiter, lv: &cl.downloadRateLimiter}
+	l := rate.NewLimiter(1000, 1000)
+	require.NoError(t, cl.UpdateConfig(func(cfg *ClientConfig) {
+		cfg.DownloadRateLimiter = l
+	}))
+	assert.Equal(t, l, cl.Config().DownloadRateLimiter)
+	assert.Equal(t, l, r.limiter())
+	// A nil limiter removes the limit.
+	require.NoError(t, cl.UpdateConfig(func(cfg *ClientConfig) {
+		cfg.DownloadRateLimiter = nil
+	}))
+	require.NotNil(t, r.limiter())
+	assert.EqualValues(t, rate.Inf, r.limiter().Limit())
+	assert.EqualValues(t, rate.Inf, cl.Config().DownloadRateLimiter.Limit())
+}
+
+func TestClientUpdateConfigSeedNoUpload(t *testing.T) {
+	cfg := TestingConfig(t)
+	cfg.Seed = false
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	dir, mi := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(dir)
+	tt, _, err := cl.AddTorrentSpec(TorrentSpecFromMetaInfo(mi))
+	require.NoError(t, err)
+	seeding := func() bool {
+		cl.lock()
+		defer cl.unlock()
+		return tt.seeding()
+	}
+	assert.False(t, seeding())
+	require.NoError(t, cl.UpdateConfig(func(cfg *ClientConfig) {
+		cfg.Seed = true
+	}))
+	assert.True(t, seeding())
+	require.NoError(t, cl.UpdateConfig(func(cfg *ClientConfig) {
+		cfg.NoUpload = true
+	}))
+	assert.False(t, seeding())
+	assert.True(t, cl.Config().Seed)
+}
+
+func TestClientUpdateConfigOnlyChangedFields(t *testing.T) {
+	cfg := TestingConfig(t)
+	cfg.Seed = false
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	require.NoError(t, cl.UpdateConfig(func(cfg *ClientConfig) {
+		cfg.Seed = true
+		// f runs without the Client lock, so it can use the Client, and concurrent updates to
+		// other fields aren't reverted.
+		require.NoError(t, cl.UpdateConfig(func(cfg *ClientConfig) {
+			cfg.NoUpload = true
+		}))
+		assert.Empty(t, cl.Torrents())
+	}))
+	assert.True(t, cl.Config().Seed)
+	assert.True(t, cl.Config().NoUpload)
+}
+
+func TestClientUpdateConfigUnsupportedField(t *testing.T) {
+	cfg := TestingConfig(t)
+	cfg.Seed = false
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	require.Error(t, cl.UpdateConfig(func(cfg *ClientConfig) {
+		cfg.Seed = true
+		cfg.ScrubInterval = time.Hour
+	}))
+	assert.False(t, cl.Config().Seed)
+	assert.Zero(t, cl.Config().ScrubInterval)
+}
@@ -92,47 +92,51 @@ func resolveTestPeers(addrs []string) (ret []torrent.PeerInfo) {
 	return
 }
 
+// Adds a torrent from a magnet link, metainfo URL, "infohash:" prefixed infohash, or metainfo file
+// path.
+func addTorrentArg(client *torrent.Client, arg string) (*torrent.Torrent, error) {
+	if strings.HasPrefix(arg, "magnet:") {
+		t, err := client.AddMagnet(arg)
+		if err != nil {
+			return nil, xerrors.Errorf("error adding magnet: %w", err)
+		}
+		return t, nil
+	} else if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
+		response, err := http.Get(arg)
+		if err != nil {
+			return nil, xerrors.Errorf("Error downloading torrent file: %s", err)
+		}
+
+		metaInfo, err := metainfo.Load(response.Body)
+		defer response.Body.Close()
+		if err != nil {
+			return nil, xerrors.Errorf("error loading torrent file %q: %s\n", arg, err)
+		}
+		t, err := client.AddTorrent(metaInfo)
+		if err != nil {
+			return nil, xerrors.Errorf("adding torrent: %w", err)
+		}
+		return t, nil
+	} else if strings.HasPrefix(arg, "infohash:") {
+		t, _ := client.AddTorrentInfoHash(metainfo.NewHashFromHex(strings.TrimPrefix(arg, "infohash:")))
+		return t, nil
+	} else {
+		metaInfo, err := metainfo.LoadFromFile(arg)
+		if err != nil {
+			return nil, xerrors.Errorf("error loading torrent file %q: %s\n", arg, err)
+		}
+		t, err := client.AddTorrent(metaInfo)
+		if err != nil {
+			return nil, xerrors.Errorf("adding torrent: %w", err)
+		}
+		return t, nil
+	}
+}
+
 func addTorrents(client *torrent.Client) error {
 	testPeers := resolveTestPeers(flags.TestPeer)
 	for _, arg := range flags.Torrent {
-		t, err := func() (*torrent.Torrent, error) {
-			if strings.HasPrefix(arg, "magnet:") {
-				t, err := client.AddMagnet(arg)
-				if err != nil {
-					return nil, xerrors.Errorf("error adding magnet: %w", err)
-				}
-				return t, nil
-			} else if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
-				response, err := http.Get(arg)
-				if err != nil {
-					return nil, xerrors.Errorf("Error downloading torrent file: %s", err)
-				}
-
-				metaInfo, err := metainfo.Load(response.Body)
-				defer response.Body.Close()
-				if err != nil {
-					return nil, xerrors.Errorf("error loading torrent file %q: %s\n", arg, err)
-				}
-				t, err := client.AddTorrent(metaInfo)
-				if err != nil {
-					return nil, xerrors.Errorf("adding torrent: %w", err)
-				}
-				return t, nil
-			} else if strings.HasPrefix(arg, "infohash:") {
-				t, _ := client.AddTorrentInfoHash(metainfo.NewHashFromHex(strings.TrimPrefix(arg, "infohash:")))
-				return t, nil
-			} else {
-				metaInfo, err := metainfo.LoadFromFile(arg)
-				if err != nil {
-					return nil, xerrors.Errorf("error loading torrent file %q: %s\n", arg, err)
-				}
-				t, err := client.AddTorrent(metaInfo)
-				if err != nil {
-					return nil, xerrors.Errorf("adding torrent: %w", err)
-				}
-				return t, nil
-			}
-		}()
+		t, err := addTorrentArg(client, arg)
 		if err != nil {
 			return xerrors.Errorf("adding torrent for %q: %w", arg, err)
 		}
@@ -166,6 +170,7 @@ var flags struct {
 	*SpewBencodingCmd `arg:"subcommand:spew-bencoding"`
 	*AnnounceCmd      `arg:"subcommand:announce"`
 	*VersionCmd       `arg:"subcommand:version"`
+	*ServeCmd         `arg:"subcommand:serve"`
 }
 
 type VersionCmd struct{}
@@ -245,6 +250,8 @@ func mainErr() error {
 	//	return announceErr(flags.Args, parser)
 	case flags.DownloadCmd != nil:
 		return downloadErr()
+	case flags.ServeCmd != nil:
+		return serveErr()
 	case flags.ListFilesCmd != nil:
 		mi, err := metainfo.LoadFromFile(flags.ListFilesCmd.TorrentPath)
 		if err != nil {
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/anacrolix/log"
+	"github.com/anacrolix/missinggo/v2"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/torrenthttp"
+)
+
+type ServeCmd struct {
+	HttpAddr string   `default:"localhost:8080" help:"address to serve torrent files over HTTP"`
+	Args     []string `arity:"+" help:"torrent file path or magnet uri" arg:"positional"`
+}
+
+func serveErr() error {
+	cmd := flags.ServeCmd
+	clientConfig := torrent.NewDefaultClientConfig()
+	clientConfig.Debug = flags.Debug
+	client, err := torrent.NewClient(clientConfig)
+	if err != nil {
+		return fmt.Errorf("creating client: %w", err)
+	}
+	defer client.Close()
+	l, err := net.Listen("tcp", cmd.HttpAddr)
+	if err != nil {
+		return fmt.Errorf("listening for HTTP: %w", err)
+	}
+	defer l.Close()
+	for _, arg := range cmd.Args {
+		t, err := addTorrentArg(client, arg)
+		if err != nil {
+			return fmt.Errorf("adding torrent for %q: %w", arg, err)
+		}
+		go func() {
+			<-t.GotInfo()
+			base := fmt.Sprintf("http://%s/%s", l.Addr(), t.InfoHash().HexString())
+			if len(t.Files()) > 1 {
+				log.Printf("serving %q, playlist at %s.m3u", t.Name(), base)
+			} else {
+				log.Printf("serving %q at %s/%s", t.Name(), base, t.Files()[0].DisplayPath())
+			}
+		}()
+	}
+	var stop missinggo.SynchronizedEvent
+	go exitSignalHandlers(&stop)
+	go func() {
+		<-stop.C()
+		client.Close()
+		l.Close()
+	}()
+	err = http.Serve(l, torrenthttp.NewHandler(client, torrenthttp.NewHandlerOpts{}))
+	select {
+	case <-client.Closed():
+		return nil
+	default:
+		return err
+	}
+}
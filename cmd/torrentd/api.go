@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+const maxMetainfoSize = 10 << 20
+
+// Serves the JSON API:
+//
+//	GET    /status                               Client status
+//	GET    /torrents                             List torrents
+//	POST   /torrents                             Add a torrent. The body is a .torrent file
+//	                                             (application/x-bittorrent), a multipart form with
+//	                                             a "torrent" file, or JSON with "magnet" or "url".
+//	                                             ?paused=true adds it paused.
+//	GET    /torrents/<infohash>                  Torrent detail and files
+//	DELETE /torrents/<infohash>[?deleteData=true] Remove a torrent
+//	POST   /torrents/<infohash>/pause            Stop transferring data
+//	POST   /torrents/<infohash>/resume           Resume transferring data
+//	PUT    /torrents/<infohash>/files/<index>    Set a file's priority: {"priority": "high"}
+//	GET    /events                               Server-sent event stream
+//
+// All requests must carry "Authorization: Bearer <token>".
+type apiHandler struct {
+	d     *daemon
+	token string
+	// Closed when the server is shutting down, to end event streams.
+	stopping <-chan struct{}
+}
+
+func (h apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="torrentd"`)
+		writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "status":
+		h.allow(w, r, "GET", func() { writeJSON(w, http.StatusOK, h.d.cl.Status()) })
+	case len(parts) == 1 && parts[0] == "events":
+		h.allow(w, r, "GET", func() { h.serveEvents(w, r) })
+	case len(parts) == 1 && parts[0] == "torrents":
+		switch r.Method {
+		case "GET":
+			h.listTorrents(w)
+		case "POST":
+			h.addTorrent(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+	case len(parts) >= 2 && parts[0] == "torrents":
+		var ih metainfo.Hash
+		if err := ih.FromHexString(parts[1]); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("parsing infohash: %w", err))
+			return
+		}
+		h.serveTorrent(w, r, ih, parts[2:])
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (h apiHandler) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, prefix)), []byte(h.token)) == 1
+}
+
+func (h apiHandler) allow(w http.ResponseWriter, r *http.Request, method string, f func()) {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	f()
+}
+
+func (h apiHandler) serveTorrent(w http.ResponseWriter, r *http.Request, ih metainfo.Hash, rest []string) {
+	switch {
+	case len(rest) == 0:
+		switch r.Method {
+		case "GET":
+			t, ts, err := h.d.torrent(ih)
+			if err != nil {
+				writeDaemonError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, newTorrentDetail(t, ts))
+		case "DELETE":
+			deleteData, _ := strconv.ParseBool(r.URL.Query().Get("deleteData"))
+			err := h.d.remove(ih, deleteData)
+			if err != nil {
+				writeDaemonError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+	case len(rest) == 1 && (rest[0] == "pause" || rest[0] == "resume"):
+		h.allow(w, r, "POST", func() {
+			err := h.d.setPaused(ih, rest[0] == "pause")
+			if err != nil {
+				writeDaemonError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	case len(rest) == 2 && rest[0] == "files":
+		h.allow(w, r, "PUT", func() {
+			index, err := strconv.Atoi(rest[1])
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("parsing file index: %w", err))
+				return
+			}
+			var body struct {
+				Priority string `json:"priority"`
+			}
+			err = json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("decoding body: %w", err))
+				return
+			}
+			err = h.d.setFilePriority(ih, index, body.Priority)
+			if err != nil {
+				writeDaemonError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (h apiHandler) listTorrents(w http.ResponseWriter) {
+	ret := []torrentSummary{}
+	for _, t := range h.d.torrentsList() {
+		_, ts, err := h.d.torrent(t.InfoHash())
+		if err != nil {
+			// Removed concurrently.
+			continue
+		}
+		ret = append(ret, newTorrentSummary(t, ts))
+	}
+	writeJSON(w, http.StatusOK, ret)
+}
+
+func (h apiHandler) addTorrent(w http.ResponseWriter, r *http.Request) {
+	paused, _ := strconv.ParseBool(r.URL.Query().Get("paused"))
+	t, err := func() (*torrent.Torrent, error) {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "application/x-bittorrent":
+			return h.addMetainfoReader(r.Body, paused)
+		case "multipart/form-data":
+			f, _, err := r.FormFile("torrent")
+			if err != nil {
+				return nil, requestError{fmt.Errorf("getting torrent file from form: %w", err)}
+			}
+			defer f.Close()
+			return h.addMetainfoReader(f, paused)
+		case "application/json":
+			var body struct {
+				Magnet string `json:"magnet"`
+				URL    string `json:"url"`
+			}
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil {
+				return nil, requestError{fmt.Errorf("decoding body: %w", err)}
+			}
+			switch {
+			case body.Magnet != "":
+				return h.d.addMagnet(body.Magnet, paused)
+			case body.URL != "":
+				return h.addURL(body.URL, paused)
+			default:
+				return nil, requestError{errors.New(`expected "magnet" or "url"`)}
+			}
+		default:
+			return nil, requestError{fmt.Errorf("unsupported content type %q", mediaType)}
+		}
+	}()
+	if err != nil {
+		writeDaemonError(w, err)
+		return
+	}
+	_, ts, err := h.d.torrent(t.InfoHash())
+	if err != nil {
+		writeDaemonError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newTorrentSummary(t, ts))
+}
+
+func (h apiHandler) addMetainfoReader(r io.Reader, paused bool) (*torrent.Torrent, error) {
+	mi, err := metainfo.Load(io.LimitReader(r, maxMetainfoSize))
+	if err != nil {
+		return nil, requestError{fmt.Errorf("loading metainfo: %w", err)}
+	}
+	return h.d.addMetainfo(mi, paused)
+}
+
+var metainfoHttpClient = &http.Client{Timeout: time.Minute}
+
+func (h apiHandler) addURL(url string, paused bool) (*torrent.Torrent, error) {
+	if strings.HasPrefix(url, "magnet:") {
+		return h.d.addMagnet(url, paused)
+	}
+	resp, err := metainfoHttpClient.Get(url)
+	if err != nil {
+		return nil, requestError{fmt.Errorf("fetching torrent file: %w", err)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, requestError{fmt.Errorf("fetching torrent file: unexpected status %q", resp.Status)}
+	}
+	return h.addMetainfoReader(resp.Body, paused)
+}
+
+// Streams events as server-sent events until the request is cancelled.
+func (h apiHandler) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+	sub := h.d.cl.SubscribeEvents(256)
+	defer sub.Close()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	var lastDropped int64
+	for {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			je, ok := eventToJSON(e)
+			if !ok {
+				continue
+			}
+			b, err := json.Marshal(je)
+			if err != nil {
+				panic(err)
+			}
+			if dropped := sub.Dropped(); dropped != lastDropped {
+				// Let the client know it has missed events, and should resync if it cares.
+				fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", dropped-lastDropped)
+				lastDropped = dropped
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", je.Type, b)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-h.stopping:
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+// Writes the error with a status for its cause: missing torrents and bad requests are the client's
+// fault, anything else is the server's.
+func writeDaemonError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errTorrentNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	var re requestError
+	if errors.As(err, &re) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
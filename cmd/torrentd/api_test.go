@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/log"
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/internal/testutil"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+const testToken = "secret"
+
+func newTestDaemon(c *qt.C) *daemon {
+	td := c.TempDir()
+	stateDirPath := filepath.Join(td, "state")
+	c.Assert(os.Mkdir(stateDirPath, 0700), qt.IsNil)
+	d := &daemon{
+		state:      stateDir{stateDirPath},
+		dataDir:    td,
+		completion: storage.NewMapPieceCompletion(),
+		torrents:   make(map[metainfo.Hash]*torrentState),
+		logger:     log.Default,
+	}
+	cfg := torrent.TestingConfig(c)
+	cfg.DefaultStorage = d.newStorage()
+	cl, err := torrent.NewClient(cfg)
+	c.Assert(err, qt.IsNil)
+	d.cl = cl
+	c.Cleanup(d.close)
+	return d
+}
+
+func newTestServer(c *qt.C, d *daemon) *httptest.Server {
+	stopping := make(chan struct{})
+	s := httptest.NewServer(apiHandler{d: d, token: testToken, stopping: stopping})
+	c.Cleanup(func() {
+		close(stopping)
+		s.Close()
+	})
+	return s
+}
+
+func greetingMetainfoBytes(c *qt.C) []byte {
+	var buf bytes.Buffer
+	c.Assert(testutil.GreetingMetaInfo().Write(&buf), qt.IsNil)
+	return buf.Bytes()
+}
+
+func TestApiUnauthorized(t *testing.T) {
+	c := qt.New(t)
+	s := newTestServer(c, newTestDaemon(c))
+	for _, auth := range []string{"", "Bearer wrong", testToken, "Basic " + testToken} {
+		req, err := http.NewRequest("GET", s.URL+"/torrents", nil)
+		c.Assert(err, qt.IsNil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, qt.IsNil)
+		resp.Body.Close()
+		c.Check(resp.StatusCode, qt.Equals, http.StatusUnauthorized, qt.Commentf("%q", auth))
+		c.Check(resp.Header.Get("WWW-Authenticate"), qt.Not(qt.Equals), "")
+	}
+}
+
+func addTorrentRequest(c *qt.C, url string, body []byte) *http.Request {
+	req, err := http.NewRequest("POST", url+"/torrents", bytes.NewReader(body))
+	c.Assert(err, qt.IsNil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	req.Header.Set("Content-Type", "application/x-bittorrent")
+	return req
+}
+
+func TestApiAddTorrent(t *testing.T) {
+	c := qt.New(t)
+	d := newTestDaemon(c)
+	s := newTestServer(c, d)
+	resp, err := http.DefaultClient.Do(addTorrentRequest(c, s.URL, greetingMetainfoBytes(c)))
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, qt.Equals, http.StatusCreated)
+	c.Check(d.torrentsList(), qt.HasLen, 1)
+	resp, err = http.DefaultClient.Do(addTorrentRequest(c, s.URL, []byte("not a torrent")))
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, qt.Equals, http.StatusBadRequest)
+}
+
+// Failing to persist a torrent is the server's fault, not the request's.
+func TestApiAddTorrentStateSaveError(t *testing.T) {
+	c := qt.New(t)
+	d := newTestDaemon(c)
+	d.state.dir = filepath.Join(d.state.dir, "missing")
+	s := newTestServer(c, d)
+	resp, err := http.DefaultClient.Do(addTorrentRequest(c, s.URL, greetingMetainfoBytes(c)))
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, qt.Equals, http.StatusInternalServerError)
+	c.Check(d.torrentsList(), qt.HasLen, 0)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/anacrolix/torrent/types"
+)
+
+var priorityNames = map[string]types.PiecePriority{
+	"none":      torrent.PiecePriorityNone,
+	"normal":    torrent.PiecePriorityNormal,
+	"high":      torrent.PiecePriorityHigh,
+	"readahead": torrent.PiecePriorityReadahead,
+	"next":      torrent.PiecePriorityNext,
+	"now":       torrent.PiecePriorityNow,
+}
+
+func priorityName(prio types.PiecePriority) string {
+	for name, p := range priorityNames {
+		if p == prio {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d", prio)
+}
+
+var errTorrentNotFound = errors.New("torrent not found")
+
+// An error caused by the request, rather than by a failure of the daemon.
+type requestError struct {
+	error
+}
+
+func (me requestError) Unwrap() error {
+	return me.error
+}
+
+// Owns the Client and keeps the persisted state in step with changes made through the API.
+type daemon struct {
+	cl         *torrent.Client
+	logger     log.Logger
+	state      stateDir
+	dataDir    string
+	completion storage.PieceCompletion
+
+	mu       sync.Mutex
+	torrents map[metainfo.Hash]*torrentState
+	// The onGotInfo goroutines, which are waited for by close.
+	goroutines sync.WaitGroup
+}
+
+// Closes the Client, and waits for the goroutines that use it and the state directory to return.
+func (d *daemon) close() {
+	d.cl.Close()
+	d.goroutines.Wait()
+}
+
+// Torrent data is stored in a directory per infohash, so that it can be deleted without knowing
+// the torrent's file layout.
+func (d *daemon) torrentDataDir(ih metainfo.Hash) string {
+	return filepath.Join(d.dataDir, ih.HexString())
+}
+
+func (d *daemon) newStorage() storage.ClientImplCloser {
+	return storage.NewFileWithCustomPathMakerAndCompletion(
+		d.dataDir,
+		func(baseDir string, info *metainfo.Info, infoHash metainfo.Hash) string {
+			return d.torrentDataDir(infoHash)
+		},
+		d.completion,
+	)
+}
+
+// Adds the torrents from the state directory. Errors for individual torrents are logged, so that
+// one bad entry doesn't prevent the others from being restored.
+func (d *daemon) restore() error {
+	states, err := d.state.loadStates()
+	if err != nil {
+		return err
+	}
+	for _, ts := range states {
+		err := d.restoreTorrent(ts)
+		if err != nil {
+			d.logger.Printf("error restoring torrent %v: %v", ts.InfoHash, err)
+		}
+	}
+	return nil
+}
+
+func (d *daemon) restoreTorrent(ts torrentState) error {
+	mi, err := d.state.loadMetainfo(ts.InfoHash)
+	if err != nil {
+		return fmt.Errorf("loading metainfo: %w", err)
+	}
+	var spec *torrent.TorrentSpec
+	if mi != nil {
+		spec, err = torrent.TorrentSpecFromMetaInfoErr(mi)
+	} else if ts.Magnet != "" {
+		spec, err = torrent.TorrentSpecFromMagnetUri(ts.Magnet)
+	} else {
+		spec = &torrent.TorrentSpec{InfoHash: ts.InfoHash}
+	}
+	if err != nil {
+		return err
+	}
+	_, err = d.add(spec, ts)
+	return err
+}
+
+func (d *daemon) addMetainfo(mi *metainfo.MetaInfo, paused bool) (*torrent.Torrent, error) {
+	spec, err := torrent.TorrentSpecFromMetaInfoErr(mi)
+	if err != nil {
+		return nil, requestError{err}
+	}
+	return d.add(spec, torrentState{
+		InfoHash: spec.InfoHash,
+		Paused:   paused,
+	})
+}
+
+func (d *daemon) addMagnet(uri string, paused bool) (*torrent.Torrent, error) {
+	spec, err := torrent.TorrentSpecFromMagnetUri(uri)
+	if err != nil {
+		return nil, requestError{err}
+	}
+	return d.add(spec, torrentState{
+		InfoHash: spec.InfoHash,
+		Magnet:   uri,
+		Paused:   paused,
+	})
+}
+
+// Adds a torrent with the given state. If the torrent is already present, the spec is merged into
+// it, and the existing state is kept.
+func (d *daemon) add(spec *torrent.TorrentSpec, ts torrentState) (*torrent.Torrent, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	existing, ok := d.torrents[spec.InfoHash]
+	paused := ts.Paused
+	if ok {
+		paused = existing.Paused
+	}
+	// Merging a spec applies these, and torrents mustn't transfer data before they're paused.
+	spec.DisallowDataDownload = paused
+	spec.DisallowDataUpload = paused
+	t, _, err := d.cl.AddTorrentSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return t, nil
+	}
+	err = d.state.saveState(ts)
+	if err != nil {
+		t.Drop()
+		return nil, fmt.Errorf("saving state: %w", err)
+	}
+	d.torrents[ts.InfoHash] = &ts
+	d.goroutines.Add(1)
+	go func() {
+		defer d.goroutines.Done()
+		d.onGotInfo(t)
+	}()
+	return t, nil
+}
+
+// Stores the metainfo and starts downloading once the torrent's info is available.
+func (d *daemon) onGotInfo(t *torrent.Torrent) {
+	select {
+	case <-t.GotInfo():
+	case <-t.Closed():
+		return
+	}
+	ih := t.InfoHash()
+	err := d.state.saveMetainfo(ih, t.Metainfo())
+	if err != nil {
+		d.logger.Printf("error saving metainfo for %v: %v", ih, err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ts, ok := d.torrents[ih]
+	if !ok {
+		return
+	}
+	for i, f := range t.Files() {
+		if name, ok := ts.FilePriorities[i]; ok {
+			f.SetPriority(priorityNames[name])
+		} else {
+			f.Download()
+		}
+	}
+}
+
+// Returns the managed torrents, ordered by infohash.
+func (d *daemon) torrentsList() (ret []*torrent.Torrent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ih := range d.torrents {
+		if t, ok := d.cl.Torrent(ih); ok {
+			ret = append(ret, t)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].InfoHash().HexString() < ret[j].InfoHash().HexString()
+	})
+	return
+}
+
+func (d *daemon) torrent(ih metainfo.Hash) (*torrent.Torrent, torrentState, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ts, ok := d.torrents[ih]
+	if !ok {
+		return nil, torrentState{}, errTorrentNotFound
+	}
+	t, ok := d.cl.Torrent(ih)
+	if !ok {
+		return nil, torrentState{}, errTorrentNotFound
+	}
+	return t, *ts, nil
+}
+
+// Applies f to the torrent's state and persists it.
+func (d *daemon) updateState(ih metainfo.Hash, f func(*torrent.Torrent, *torrentState) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ts, ok := d.torrents[ih]
+	if !ok {
+		return errTorrentNotFound
+	}
+	t, ok := d.cl.Torrent(ih)
+	if !ok {
+		return errTorrentNotFound
+	}
+	new := *ts
+	err := f(t, &new)
+	if err != nil {
+		return err
+	}
+	err = d.state.saveState(new)
+	if err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	*ts = new
+	return nil
+}
+
+func (d *daemon) setPaused(ih metainfo.Hash, paused bool) error {
+	return d.updateState(ih, func(t *torrent.Torrent, ts *torrentState) error {
+		ts.Paused = paused
+		if paused {
+			t.DisallowDataDownload()
+			t.DisallowDataUpload()
+		} else {
+			t.AllowDataDownload()
+			t.AllowDataUpload()
+		}
+		return nil
+	})
+}
+
+func (d *daemon) setFilePriority(ih metainfo.Hash, index int, name string) error {
+	prio, ok := priorityNames[name]
+	if !ok {
+		return requestError{fmt.Errorf("unknown priority %q", name)}
+	}
+	return d.updateState(ih, func(t *torrent.Torrent, ts *torrentState) error {
+		if t.Info() == nil {
+			return requestError{errors.New("torrent info not yet available")}
+		}
+		files := t.Files()
+		if index < 0 || index >= len(files) {
+			return requestError{fmt.Errorf("file index %v out of range", index)}
+		}
+		priorities := make(map[int]string, len(ts.FilePriorities)+1)
+		for i, p := range ts.FilePriorities {
+			priorities[i] = p
+		}
+		priorities[index] = name
+		ts.FilePriorities = priorities
+		files[index].SetPriority(prio)
+		return nil
+	})
+}
+
+// Drops the torrent and forgets its state. If deleteData is set, the torrent's data and piece
+// completion is removed too.
+func (d *daemon) remove(ih metainfo.Hash, deleteData bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.torrents[ih]; !ok {
+		return errTorrentNotFound
+	}
+	t, ok := d.cl.Torrent(ih)
+	if !ok {
+		return errTorrentNotFound
+	}
+	info := t.Info()
+	t.Drop()
+	delete(d.torrents, ih)
+	err := d.state.remove(ih)
+	if err != nil {
+		return fmt.Errorf("removing state: %w", err)
+	}
+	if !deleteData {
+		return nil
+	}
+	if info != nil {
+		for i := 0; i < info.NumPieces(); i++ {
+			err := d.completion.Set(metainfo.PieceKey{InfoHash: ih, Index: i}, false)
+			if err != nil {
+				return fmt.Errorf("clearing piece completion: %w", err)
+			}
+		}
+	}
+	return os.RemoveAll(d.torrentDataDir(ih))
+}
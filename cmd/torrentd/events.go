@@ -0,0 +1,93 @@
+package main
+
+import (
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// The JSON form of a torrent.Event sent to API clients.
+type jsonEvent struct {
+	Type     string         `json:"type"`
+	InfoHash *metainfo.Hash `json:"infoHash,omitempty"`
+	Piece    *int           `json:"piece,omitempty"`
+	Passed   *bool          `json:"passed,omitempty"`
+	File     string         `json:"file,omitempty"`
+	Tracker  string         `json:"tracker,omitempty"`
+	NumPeers *int           `json:"numPeers,omitempty"`
+	Interval string         `json:"interval,omitempty"`
+	Peer     string         `json:"peer,omitempty"`
+	Deadline *time.Time     `json:"deadline,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Returns the JSON form of an event, and false for events that aren't exposed.
+func eventToJSON(e torrent.Event) (ret jsonEvent, ok bool) {
+	setTorrent := func(t *torrent.Torrent) {
+		ih := t.InfoHash()
+		ret.InfoHash = &ih
+	}
+	switch e := e.(type) {
+	case torrent.TorrentAddedEvent:
+		ret.Type = "torrentAdded"
+		setTorrent(e.Torrent)
+	case torrent.TorrentRemovedEvent:
+		ret.Type = "torrentRemoved"
+		setTorrent(e.Torrent)
+	case torrent.MetadataReceivedEvent:
+		ret.Type = "metadataReceived"
+		setTorrent(e.Torrent)
+	case torrent.PieceHashedEvent:
+		ret.Type = "pieceHashed"
+		setTorrent(e.Torrent)
+		ret.Piece = &e.Piece
+		ret.Passed = &e.Passed
+		ret.Error = errString(e.Err)
+	case torrent.FileCompletedEvent:
+		ret.Type = "fileCompleted"
+		setTorrent(e.File.Torrent())
+		ret.File = e.File.DisplayPath()
+	case torrent.TorrentCompletedEvent:
+		ret.Type = "torrentCompleted"
+		setTorrent(e.Torrent)
+	case torrent.TrackerAnnounceEvent:
+		ret.Type = "trackerAnnounce"
+		setTorrent(e.Torrent)
+		ret.Tracker = e.URL.String()
+		ret.NumPeers = &e.NumPeers
+		ret.Interval = e.Interval.String()
+		ret.Error = errString(e.Err)
+	case torrent.PeerConnectedEvent:
+		ret.Type = "peerConnected"
+		setTorrent(e.Torrent)
+		ret.Peer = e.PeerConn.RemoteAddr.String()
+	case torrent.PeerBannedEvent:
+		ret.Type = "peerBanned"
+		setTorrent(e.Torrent)
+		ret.Peer = e.IP.String()
+	case torrent.StorageErrorEvent:
+		ret.Type = "storageError"
+		setTorrent(e.Torrent)
+		if e.Piece >= 0 {
+			ret.Piece = &e.Piece
+		}
+		ret.Error = errString(e.Err)
+	case torrent.PieceDeadlineMissedEvent:
+		ret.Type = "pieceDeadlineMissed"
+		setTorrent(e.Torrent)
+		ret.Piece = &e.Piece
+		ret.Deadline = &e.Deadline
+	default:
+		return
+	}
+	ok = true
+	return
+}
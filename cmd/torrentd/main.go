@@ -0,0 +1,154 @@
+// Runs a long-lived torrent client that's controlled through an authenticated JSON HTTP API.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/alexflint/go-arg"
+	"github.com/anacrolix/envpprof"
+	"github.com/anacrolix/log"
+	"github.com/anacrolix/tagflag"
+	"golang.org/x/time/rate"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+var flags = struct {
+	ApiAddr      string         `help:"address to serve the HTTP API on"`
+	Token        string         `arg:"env:TORRENTD_TOKEN" help:"API bearer token. If unset, one is generated and stored in the state directory"`
+	DataDir      string         `help:"location to store torrent data"`
+	StateDir     string         `help:"location to store torrent state. Defaults to .torrentd in the data directory"`
+	ListenPort   int            `help:"port to listen for peers on"`
+	Seed         bool           `default:"true" help:"seed completed torrents"`
+	UploadRate   *tagflag.Bytes `help:"max piece bytes to send per second"`
+	DownloadRate *tagflag.Bytes `help:"max bytes per second down from peers"`
+	Dht          bool           `default:"true"`
+	Debug        bool
+}{
+	ApiAddr:    "localhost:9092",
+	DataDir:    ".",
+	ListenPort: 42069,
+}
+
+func main() {
+	defer envpprof.Stop()
+	if err := mainErr(); err != nil {
+		log.Printf("error in main: %v", err)
+		os.Exit(1)
+	}
+}
+
+// Returns the configured token, or the one in the state directory, generating it if necessary.
+func loadToken(stateDir string) (string, error) {
+	if flags.Token != "" {
+		return flags.Token, nil
+	}
+	name := filepath.Join(stateDir, "token")
+	b, err := ioutil.ReadFile(name)
+	if err == nil {
+		return strings.TrimSpace(string(b)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	var buf [16]byte
+	_, err = rand.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf[:])
+	err = ioutil.WriteFile(name, []byte(token+"\n"), 0600)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("generated API token in %q", name)
+	return token, nil
+}
+
+func mainErr() error {
+	arg.MustParse(&flags)
+	statePath := flags.StateDir
+	if statePath == "" {
+		statePath = filepath.Join(flags.DataDir, ".torrentd")
+	}
+	err := os.MkdirAll(statePath, 0700)
+	if err != nil {
+		return fmt.Errorf("creating state dir: %w", err)
+	}
+	token, err := loadToken(statePath)
+	if err != nil {
+		return fmt.Errorf("loading token: %w", err)
+	}
+	completion, err := storage.NewDefaultPieceCompletionForDir(statePath)
+	if err != nil {
+		return fmt.Errorf("opening piece completion: %w", err)
+	}
+	defer completion.Close()
+	d := &daemon{
+		state:      stateDir{statePath},
+		dataDir:    flags.DataDir,
+		completion: completion,
+		torrents:   make(map[metainfo.Hash]*torrentState),
+		logger:     log.Default,
+	}
+	cfg := torrent.NewDefaultClientConfig()
+	cfg.DataDir = flags.DataDir
+	cfg.DefaultStorage = d.newStorage()
+	cfg.ListenPort = flags.ListenPort
+	cfg.Seed = flags.Seed
+	cfg.NoDHT = !flags.Dht
+	cfg.Debug = flags.Debug
+	if flags.UploadRate != nil {
+		cfg.UploadRateLimiter = rate.NewLimiter(rate.Limit(*flags.UploadRate), 256<<10)
+	}
+	if flags.DownloadRate != nil {
+		cfg.DownloadRateLimiter = rate.NewLimiter(rate.Limit(*flags.DownloadRate), 1<<20)
+	}
+	cl, err := torrent.NewClient(cfg)
+	if err != nil {
+		return fmt.Errorf("creating client: %w", err)
+	}
+	d.cl = cl
+	defer d.close()
+	err = d.restore()
+	if err != nil {
+		return fmt.Errorf("restoring torrents: %w", err)
+	}
+	stopping := make(chan struct{})
+	server := &http.Server{
+		Addr:    flags.ApiAddr,
+		Handler: apiHandler{d: d, token: token, stopping: stopping},
+	}
+	server.RegisterOnShutdown(func() { close(stopping) })
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	log.Printf("serving API on %q", flags.ApiAddr)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("serving API: %w", err)
+	case sig := <-signals:
+		log.Printf("close signal received: %+v", sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	return nil
+}
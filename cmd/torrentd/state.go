@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// The persisted state of a torrent. The metainfo is stored separately once it's known, so that
+// torrents added by magnet don't need to fetch it again after a restart.
+type torrentState struct {
+	InfoHash metainfo.Hash `json:"infoHash"`
+	// Set for torrents added without metainfo.
+	Magnet string `json:"magnet,omitempty"`
+	Paused bool   `json:"paused,omitempty"`
+	// File priorities by file index, for files that were explicitly set.
+	FilePriorities map[int]string `json:"filePriorities,omitempty"`
+}
+
+// Stores torrent states and metainfos as files in a directory.
+type stateDir struct {
+	dir string
+}
+
+func (me stateDir) statePath(ih metainfo.Hash) string {
+	return filepath.Join(me.dir, ih.HexString()+".json")
+}
+
+func (me stateDir) metainfoPath(ih metainfo.Hash) string {
+	return filepath.Join(me.dir, ih.HexString()+".torrent")
+}
+
+// Writes to a temporary file and renames it into place, so a crash doesn't leave partial state.
+func writeFileAtomic(name string, write func(f *os.File) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (me stateDir) saveState(ts torrentState) error {
+	return writeFileAtomic(me.statePath(ts.InfoHash), func(f *os.File) error {
+		e := json.NewEncoder(f)
+		e.SetIndent("", "\t")
+		return e.Encode(ts)
+	})
+}
+
+func (me stateDir) saveMetainfo(ih metainfo.Hash, mi metainfo.MetaInfo) error {
+	return writeFileAtomic(me.metainfoPath(ih), func(f *os.File) error {
+		return mi.Write(f)
+	})
+}
+
+// Returns the stored metainfo, or nil if there isn't one.
+func (me stateDir) loadMetainfo(ih metainfo.Hash) (*metainfo.MetaInfo, error) {
+	mi, err := metainfo.LoadFromFile(me.metainfoPath(ih))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return mi, err
+}
+
+func (me stateDir) remove(ih metainfo.Hash) error {
+	for _, name := range []string{me.statePath(ih), me.metainfoPath(ih)} {
+		err := os.Remove(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (me stateDir) loadStates() (ret []torrentState, err error) {
+	names, err := filepath.Glob(filepath.Join(me.dir, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var ts torrentState
+		err = json.Unmarshal(b, &ts)
+		if err != nil {
+			return nil, fmt.Errorf("decoding %q: %w", name, err)
+		}
+		ret = append(ret, ts)
+	}
+	return
+}
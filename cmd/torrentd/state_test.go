@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/internal/testutil"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestStateDirRoundTrip(t *testing.T) {
+	c := qt.New(t)
+	sd := stateDir{c.TempDir()}
+	mi := testutil.GreetingMetaInfo()
+	ih := mi.HashInfoBytes()
+	ts := torrentState{
+		InfoHash:       ih,
+		Paused:         true,
+		FilePriorities: map[int]string{0: "high"},
+	}
+	c.Assert(sd.saveState(ts), qt.IsNil)
+	magnet := torrentState{
+		InfoHash: metainfo.HashBytes([]byte("magnet")),
+		Magnet:   "magnet:?xt=urn:btih:0000000000000000000000000000000000000000",
+	}
+	c.Assert(sd.saveState(magnet), qt.IsNil)
+	c.Assert(sd.saveMetainfo(ih, *mi), qt.IsNil)
+
+	states, err := sd.loadStates()
+	c.Assert(err, qt.IsNil)
+	c.Check(states, qt.HasLen, 2)
+	for _, s := range states {
+		switch s.InfoHash {
+		case ts.InfoHash:
+			c.Check(s, qt.DeepEquals, ts)
+		case magnet.InfoHash:
+			c.Check(s, qt.DeepEquals, magnet)
+		default:
+			c.Errorf("unexpected state %v", s)
+		}
+	}
+	loaded, err := sd.loadMetainfo(ih)
+	c.Assert(err, qt.IsNil)
+	c.Check(loaded.HashInfoBytes(), qt.Equals, ih)
+	loaded, err = sd.loadMetainfo(magnet.InfoHash)
+	c.Assert(err, qt.IsNil)
+	c.Check(loaded, qt.IsNil)
+
+	c.Assert(sd.remove(ih), qt.IsNil)
+	states, err = sd.loadStates()
+	c.Assert(err, qt.IsNil)
+	c.Check(states, qt.DeepEquals, []torrentState{magnet})
+	loaded, err = sd.loadMetainfo(ih)
+	c.Assert(err, qt.IsNil)
+	c.Check(loaded, qt.IsNil)
+}
+
+// Restarting the daemon restores torrents with their persisted state.
+func TestDaemonRestore(t *testing.T) {
+	c := qt.New(t)
+	d := newTestDaemon(c)
+	mi := testutil.GreetingMetaInfo()
+	tt, err := d.addMetainfo(mi, true)
+	c.Assert(err, qt.IsNil)
+	<-tt.GotInfo()
+	c.Assert(d.setFilePriority(tt.InfoHash(), 0, "high"), qt.IsNil)
+
+	restarted := newTestDaemon(c)
+	restarted.state = d.state
+	c.Assert(restarted.restore(), qt.IsNil)
+	_, ts, err := restarted.torrent(tt.InfoHash())
+	c.Assert(err, qt.IsNil)
+	c.Check(ts.Paused, qt.IsTrue)
+	c.Check(ts.FilePriorities, qt.DeepEquals, map[int]string{0: "high"})
+}
+
+// Adding a paused torrent again, such as from the same magnet, doesn't resume it.
+func TestDaemonAddPausedAgain(t *testing.T) {
+	c := qt.New(t)
+	d := newTestDaemon(c)
+	mi := testutil.GreetingMetaInfo()
+	tt, err := d.addMetainfo(mi, true)
+	c.Assert(err, qt.IsNil)
+	<-tt.GotInfo()
+	_, err = d.addMetainfo(mi, false)
+	c.Assert(err, qt.IsNil)
+	_, ts, err := d.torrent(tt.InfoHash())
+	c.Assert(err, qt.IsNil)
+	c.Check(ts.Paused, qt.IsTrue)
+	// Reads fail straight away, rather than waiting for the data to be downloaded.
+	r := tt.NewReader()
+	defer r.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = r.ReadContext(ctx, make([]byte, 1))
+	c.Check(err, qt.ErrorMatches, "downloading disabled.*")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+type torrentSummary struct {
+	InfoHash       metainfo.Hash `json:"infoHash"`
+	Name           string        `json:"name"`
+	HaveInfo       bool          `json:"haveInfo"`
+	Length         int64         `json:"length,omitempty"`
+	BytesCompleted int64         `json:"bytesCompleted"`
+	Paused         bool          `json:"paused"`
+	Seeding        bool          `json:"seeding"`
+	ActivePeers    int           `json:"activePeers"`
+	TotalPeers     int           `json:"totalPeers"`
+	BytesRead      int64         `json:"bytesRead"`
+	BytesWritten   int64         `json:"bytesWritten"`
+}
+
+type fileDetail struct {
+	Index          int    `json:"index"`
+	Path           string `json:"path"`
+	Length         int64  `json:"length"`
+	BytesCompleted int64  `json:"bytesCompleted"`
+	Priority       string `json:"priority"`
+}
+
+type torrentDetail struct {
+	torrentSummary
+	Files  []fileDetail          `json:"files"`
+	Status torrent.TorrentStatus `json:"status"`
+}
+
+func newTorrentSummary(t *torrent.Torrent, ts torrentState) torrentSummary {
+	stats := t.Stats()
+	ret := torrentSummary{
+		InfoHash:       t.InfoHash(),
+		Name:           t.Name(),
+		HaveInfo:       t.Info() != nil,
+		BytesCompleted: t.BytesCompleted(),
+		Paused:         ts.Paused,
+		Seeding:        t.Seeding(),
+		ActivePeers:    stats.ActivePeers,
+		TotalPeers:     stats.TotalPeers,
+		BytesRead:      stats.BytesReadData.Int64(),
+		BytesWritten:   stats.BytesWrittenData.Int64(),
+	}
+	if ret.HaveInfo {
+		ret.Length = t.Length()
+	}
+	return ret
+}
+
+func newTorrentDetail(t *torrent.Torrent, ts torrentState) torrentDetail {
+	ret := torrentDetail{
+		torrentSummary: newTorrentSummary(t, ts),
+		Files:          []fileDetail{},
+		Status:         t.Status(),
+	}
+	if t.Info() != nil {
+		for i, f := range t.Files() {
+			ret.Files = append(ret.Files, fileDetail{
+				Index:          i,
+				Path:           f.DisplayPath(),
+				Length:         f.Length(),
+				BytesCompleted: f.BytesCompleted(),
+				Priority:       priorityName(f.Priority()),
+			})
+		}
+	}
+	return ret
+}
@@ -0,0 +1,238 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/anacrolix/log"
+	"golang.org/x/time/rate"
+
+	"github.com/anacrolix/torrent/iplist"
+)
+
+// Returns a copy of the Client's current config. See UpdateConfig to change it.
+func (cl *Client) Config() ClientConfig {
+	cl.rLock()
+	defer cl.rUnlock()
+	return *cl.config
+}
+
+// UpdateConfig calls f with a copy of the Client's config, and applies the changes it makes under
+// the Client lock. f is called without the Client lock held, so it may use the Client, but fields
+// changed concurrently by another UpdateConfig call are overwritten only if f changes them too. A
+// nil rate limiter means no limit. Only the rate limiters, connection limits, Seed, NoUpload, the
+// IP blocklist and the listen port can be changed, and they take effect immediately: a new listen
+// port rebinds the Client's own listeners and DHT servers, and torrents reannounce. Listeners and
+// DHT servers added with AddListener and AddDhtServer are left alone. Changes to other fields
+// return an error. If an error is returned, the config is unchanged.
+func (cl *Client) UpdateConfig(f func(*ClientConfig)) error {
+	base := cl.Config()
+	new := base
+	f(&new)
+	if new.UploadRateLimiter == nil {
+		new.UploadRateLimiter = rate.NewLimiter(rate.Inf, 0)
+	}
+	if new.DownloadRateLimiter == nil {
+		new.DownloadRateLimiter = rate.NewLimiter(rate.Inf, 0)
+	}
+	// Everything else in the config may be read without the Client lock, or only when it's first
+	// used, so changing it here would race or have no effect.
+	others := new
+	setUpdatableConfigFields(&others, &base)
+	if changed := changedConfigFields(&base, &others); len(changed) != 0 {
+		return fmt.Errorf("config fields can't be changed on a running client: %v", changed)
+	}
+	cl.lock()
+	defer cl.unlock()
+	if cl.closed.IsSet() {
+		return errors.New("client closed")
+	}
+	old := *cl.config
+	// Only the fields f changed are taken from it, so that concurrent updates to other fields
+	// aren't reverted.
+	applied := old
+	mergeUpdatableConfigFields(&applied, &base, &new)
+	setUpdatableConfigFields(cl.config, &applied)
+	if cl.config.ListenPort != old.ListenPort {
+		// Rebind first, so that the Client is left in working order if the new port can't be
+		// used.
+		err := cl.rebindSockets()
+		if err != nil {
+			setUpdatableConfigFields(cl.config, &old)
+			return fmt.Errorf("listening on port %v: %w", new.ListenPort, err)
+		}
+	}
+	if cl.config.DownloadRateLimiter != old.DownloadRateLimiter {
+		cl.downloadRateLimiter.Store(cl.config.DownloadRateLimiter)
+	}
+	if cl.config.IPBlocklist != old.IPBlocklist {
+		cl.setIPBlocklist(cl.config.IPBlocklist)
+	}
+	for _, t := range cl.torrents {
+		if cl.config.EstablishedConnsPerTorrent != old.EstablishedConnsPerTorrent &&
+			t.maxEstablishedConns == old.EstablishedConnsPerTorrent {
+			// Only torrents that haven't had their limit set explicitly follow the config.
+			t.setMaxEstablishedConns(cl.config.EstablishedConnsPerTorrent)
+		}
+		t.updateWantPeersEvent()
+		for c := range t.conns {
+			// Seeding and upload changes are applied when the writer next runs.
+			c.tickleWriter()
+		}
+		t.openNewConns()
+	}
+	cl.event.Broadcast()
+	return nil
+}
+
+// Copies the fields that UpdateConfig can change from src to dst. They're all read with the Client
+// lock held, except for DownloadRateLimiter which readers get from Client.downloadRateLimiter.
+func setUpdatableConfigFields(dst, src *ClientConfig) {
+	dst.ListenPort = src.ListenPort
+	dst.UploadRateLimiter = src.UploadRateLimiter
+	dst.DownloadRateLimiter = src.DownloadRateLimiter
+	dst.EstablishedConnsPerTorrent = src.EstablishedConnsPerTorrent
+	dst.HalfOpenConnsPerTorrent = src.HalfOpenConnsPerTorrent
+	dst.TotalHalfOpenConns = src.TotalHalfOpenConns
+	dst.Seed = src.Seed
+	dst.NoUpload = src.NoUpload
+	dst.IPBlocklist = src.IPBlocklist
+}
+
+// Sets the fields that UpdateConfig can change in dst to their values in new, where they differ
+// from base.
+func mergeUpdatableConfigFields(dst, base, new *ClientConfig) {
+	if new.ListenPort != base.ListenPort {
+		dst.ListenPort = new.ListenPort
+	}
+	if new.UploadRateLimiter != base.UploadRateLimiter {
+		dst.UploadRateLimiter = new.UploadRateLimiter
+	}
+	if new.DownloadRateLimiter != base.DownloadRateLimiter {
+		dst.DownloadRateLimiter = new.DownloadRateLimiter
+	}
+	if new.EstablishedConnsPerTorrent != base.EstablishedConnsPerTorrent {
+		dst.EstablishedConnsPerTorrent = new.EstablishedConnsPerTorrent
+	}
+	if new.HalfOpenConnsPerTorrent != base.HalfOpenConnsPerTorrent {
+		dst.HalfOpenConnsPerTorrent = new.HalfOpenConnsPerTorrent
+	}
+	if new.TotalHalfOpenConns != base.TotalHalfOpenConns {
+		dst.TotalHalfOpenConns = new.TotalHalfOpenConns
+	}
+	if new.Seed != base.Seed {
+		dst.Seed = new.Seed
+	}
+	if new.NoUpload != base.NoUpload {
+		dst.NoUpload = new.NoUpload
+	}
+	if new.IPBlocklist != base.IPBlocklist {
+		dst.IPBlocklist = new.IPBlocklist
+	}
+}
+
+// Returns the names of the ClientConfig fields that differ between a and b.
+func changedConfigFields(a, b *ClientConfig) (ret []string) {
+	av := reflect.ValueOf(a).Elem()
+	bv := reflect.ValueOf(b).Elem()
+	for i := 0; i < av.NumField(); i++ {
+		if !configValuesEqual(av.Field(i), bv.Field(i)) {
+			ret = append(ret, av.Type().Field(i).Name)
+		}
+	}
+	return
+}
+
+// Compares config values by identity where they refer to something, since funcs aren't comparable,
+// and values such as rate limiters are shared rather than copied.
+func configValuesEqual(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Func, reflect.Map, reflect.Chan, reflect.Ptr, reflect.UnsafePointer:
+		return a.Pointer() == b.Pointer()
+	case reflect.Slice:
+		return a.Pointer() == b.Pointer() && a.Len() == b.Len()
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return a.Elem().Type() == b.Elem().Type() && configValuesEqual(a.Elem(), b.Elem())
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !configValuesEqual(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Array:
+		for i := 0; i < a.Len(); i++ {
+			if !configValuesEqual(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() == b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() == b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() == b.Float()
+	case reflect.Complex64, reflect.Complex128:
+		return a.Complex() == b.Complex()
+	case reflect.String:
+		return a.String() == b.String()
+	default:
+		// Anything else can't be compared, so it's reported as changed rather than accepted.
+		return false
+	}
+}
+
+// Replaces the sockets opened from the config with ones on the configured listen port, and prompts
+// torrents to announce the new port. The existing sockets are only closed if the new ones could be
+// opened.
+func (cl *Client) rebindSockets() error {
+	oldSockets := cl.sockets
+	oldDhtServers := cl.socketDhtServers
+	cl.sockets = nil
+	cl.socketDhtServers = nil
+	err := cl.listenSockets(cl.config.ListenPort)
+	newSockets := cl.sockets
+	newDhtServers := cl.socketDhtServers
+	cl.sockets = oldSockets
+	cl.socketDhtServers = oldDhtServers
+	if err != nil {
+		return err
+	}
+	cl.dropSockets()
+	cl.sockets = newSockets
+	cl.socketDhtServers = newDhtServers
+	cl.logger.WithDefaultLevel(log.Info).Printf("now listening on port %v", cl.LocalPort())
+	if cl.config.PeriodicallyAnnounceTorrentsToDht {
+		for _, t := range cl.torrents {
+			for _, ds := range newDhtServers {
+				go t.dhtAnnouncer(AnacrolixDhtServerWrapper{ds})
+			}
+		}
+	}
+	cl.reannounce.Broadcast()
+	go cl.forwardPort()
+	return nil
+}
+
+// Sets the blocklist used for peers and DHT servers, and drops connections to peers that are now
+// blocked.
+func (cl *Client) setIPBlocklist(list iplist.Ranger) {
+	cl.ipBlockList = list
+	for _, ds := range cl.socketDhtServers {
+		ds.SetIPBlockList(list)
+	}
+	for _, t := range cl.torrents {
+		for c := range t.conns {
+			if ip := c.remoteIp(); ip != nil && cl.ipIsBlocked(ip) {
+				t.dropConnection(c)
+			}
+		}
+	}
+}
@@ -16,10 +16,12 @@ import (
 
 	"github.com/anacrolix/torrent/iplist"
 	"github.com/anacrolix/torrent/mse"
+	request_strategy "github.com/anacrolix/torrent/request-strategy"
 	"github.com/anacrolix/torrent/storage"
 )
 
-// Probably not safe to modify this after it's given to a Client.
+// Probably not safe to modify this after it's given to a Client. Use Client.UpdateConfig to make
+// changes to a running Client.
 type ClientConfig struct {
 	// Store torrent file data in this directory unless .DefaultStorage is
 	// specified.
@@ -60,8 +62,29 @@ type ClientConfig struct {
 	// (~4096), and the requested chunk size (~16KiB, see
 	// TorrentSpec.ChunkSize).
 	DownloadRateLimiter *rate.Limiter
+	// Bytes of whole pieces kept in memory to serve peer requests, so that pieces wanted by several
+	// peers aren't read from storage for each of them. The rest of a piece is read ahead on the
+	// first request for it. Not used if zero.
+	ReadCacheCapacity int64
+	// How the read cache chooses pieces to evict. Defaults to ReadCacheARC.
+	ReadCachePolicy ReadCachePolicy
+	// How often the data of each complete piece is hashed again, to detect corruption in storage.
+	// Pieces that fail are marked not complete, so they're downloaded again, and each pass of the
+	// scrubber is reported with a ScrubFinishedEvent. Verification times are persisted if the
+	// storage's piece completion implements storage.PieceVerifiedTimes. Pieces without one are
+	// scrubbed over the interval following when their torrent's info was set. Not used if zero.
+	ScrubInterval time.Duration
+	// Limits the rate that the scrubber reads piece data. Each limiter token represents one byte.
+	// The burst must be positive unless the limit is infinite. Defaults to 16 MiB/s if nil.
+	ScrubRateLimiter *rate.Limiter
 	// Maximum unverified bytes across all torrents. Not used if zero.
 	MaxUnverifiedBytes int64
+	// Don't request the last chunks of a torrent from several peers at once. Endgame wastes some
+	// bandwidth on duplicate chunks, but stops slow peers from holding up completion.
+	DisableEndgame bool
+	// Determines the requests made to peers. Torrents can override this with
+	// Torrent.SetRequestStrategy. Defaults to request_strategy.ClientPieceOrder if nil.
+	RequestStrategy request_strategy.Strategy
 
 	// User-provided Client peer ID. If not present, one is generated automatically.
 	PeerID string
@@ -121,6 +144,10 @@ type ClientConfig struct {
 	// How long between writes before sending a keep alive message on a peer connection that we want
 	// to maintain.
 	KeepAliveTimeout time.Duration
+	// How long a peer can go without delivering requested chunks before it's considered snubbed.
+	// Snubbed peers have their requests given to other peers, and are only sent one request until
+	// they deliver again. Not used if zero.
+	PeerSnubTimeout time.Duration
 
 	// The IP addresses as our peers should see them. May differ from the
 	// local interfaces due to NAT or other network configurations.
@@ -174,6 +201,7 @@ func NewDefaultClientConfig() *ClientConfig {
 		TorrentPeersLowWater:           50,
 		HandshakesTimeout:              4 * time.Second,
 		KeepAliveTimeout:               time.Minute,
+		PeerSnubTimeout:                30 * time.Second,
 		DhtStartingNodes: func(network string) dht.StartingNodesGetter {
 			return func() ([]dht.Addr, error) { return dht.GlobalBootstrapAddrs(network) }
 		},
@@ -30,6 +30,9 @@ type ConnStats struct {
 	ChunksRead       Count
 	ChunksReadUseful Count
 	ChunksReadWasted Count
+	// The wasted chunks that another peer sent first, after they were requested from several peers
+	// at once.
+	ChunksReadDuplicate Count
 
 	MetadataChunksRead Count
 
@@ -67,7 +70,11 @@ func (me *Count) String() string {
 }
 
 func (me *Count) MarshalJSON() ([]byte, error) {
-	return json.Marshal(me.n)
+	return json.Marshal(me.Int64())
+}
+
+func (me *Count) UnmarshalJSON(b []byte) error {
+	return json.Unmarshal(b, &me.n)
 }
 
 func (cs *ConnStats) wroteMsg(msg *pp.Message) {
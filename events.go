@@ -0,0 +1,167 @@
+package torrent
+
+import (
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// Event is implemented by the types delivered to subscribers from Client.SubscribeEvents. Use a
+// type switch to handle the events of interest.
+type Event interface {
+	isEvent()
+}
+
+// A Torrent was added to the Client.
+type TorrentAddedEvent struct {
+	Torrent *Torrent
+}
+
+// A Torrent was dropped from the Client.
+type TorrentRemovedEvent struct {
+	Torrent *Torrent
+}
+
+// The info for a Torrent was obtained, from the metainfo or from peers.
+type MetadataReceivedEvent struct {
+	Torrent *Torrent
+}
+
+// A piece finished hashing. Passed is false if the piece data didn't match the piece hash. Err is
+// set if there was an error reading the piece from storage.
+type PieceHashedEvent struct {
+	Torrent *Torrent
+	Piece   int
+	Passed  bool
+	Err     error
+}
+
+// All the pieces containing a File's data are complete.
+type FileCompletedEvent struct {
+	File *File
+}
+
+// All the pieces of a Torrent are complete.
+type TorrentCompletedEvent struct {
+	Torrent *Torrent
+}
+
+// The result of announcing a Torrent to a tracker.
+type TrackerAnnounceEvent struct {
+	Torrent  *Torrent
+	URL      url.URL
+	NumPeers int
+	Interval time.Duration
+	Err      error
+}
+
+// A peer connection completed handshaking and was added to a Torrent.
+type PeerConnectedEvent struct {
+	Torrent  *Torrent
+	PeerConn *PeerConn
+}
+
+// A peer IP was banned, such as for contributing to a piece that failed to hash.
+type PeerBannedEvent struct {
+	Torrent *Torrent
+	IP      net.IP
+}
+
+// An operation on a Torrent's storage failed. Piece is -1 if the error isn't specific to a piece.
+type StorageErrorEvent struct {
+	Torrent *Torrent
+	Piece   int
+	Err     error
+}
+
+// A piece wasn't complete by its deadline, from Torrent.SetPieceDeadline or a Reader's bitrate.
+type PieceDeadlineMissedEvent struct {
+	Torrent  *Torrent
+	Piece    int
+	Deadline time.Time
+}
+
+// A pass of the scrubber finished, see ClientConfig.ScrubInterval.
+type ScrubFinishedEvent struct {
+	Report ScrubReport
+}
+
+func (TorrentAddedEvent) isEvent()        {}
+func (TorrentRemovedEvent) isEvent()      {}
+func (MetadataReceivedEvent) isEvent()    {}
+func (PieceHashedEvent) isEvent()         {}
+func (FileCompletedEvent) isEvent()       {}
+func (TorrentCompletedEvent) isEvent()    {}
+func (TrackerAnnounceEvent) isEvent()     {}
+func (PeerConnectedEvent) isEvent()       {}
+func (PeerBannedEvent) isEvent()          {}
+func (StorageErrorEvent) isEvent()        {}
+func (PieceDeadlineMissedEvent) isEvent() {}
+func (ScrubFinishedEvent) isEvent()       {}
+
+// A subscription to Client events. Events are delivered without blocking the Client: if the
+// buffer is full, the event is dropped and counted.
+type EventSubscription struct {
+	// First in struct to ensure 64-bit alignment. See #262.
+	dropped int64
+	cl      *Client
+	c       chan Event
+}
+
+// Receives events until the subscription or the Client is closed.
+func (me *EventSubscription) Events() <-chan Event {
+	return me.c
+}
+
+// The number of events that were dropped because the buffer was full.
+func (me *EventSubscription) Dropped() int64 {
+	return atomic.LoadInt64(&me.dropped)
+}
+
+// Stops delivery of events and closes the events channel.
+func (me *EventSubscription) Close() {
+	cl := me.cl
+	cl.lock()
+	defer cl.unlock()
+	cl.closeEventSubscription(me)
+}
+
+// Returns a subscription that receives Client and Torrent lifecycle events. bufferSize bounds the
+// number of events waiting to be received before events are dropped.
+func (cl *Client) SubscribeEvents(bufferSize int) *EventSubscription {
+	s := &EventSubscription{
+		cl: cl,
+		c:  make(chan Event, bufferSize),
+	}
+	cl.lock()
+	defer cl.unlock()
+	if cl.closed.IsSet() {
+		close(s.c)
+		return s
+	}
+	if cl.eventSubscriptions == nil {
+		cl.eventSubscriptions = make(map[*EventSubscription]struct{})
+	}
+	cl.eventSubscriptions[s] = struct{}{}
+	return s
+}
+
+func (cl *Client) closeEventSubscription(s *EventSubscription) {
+	if _, ok := cl.eventSubscriptions[s]; !ok {
+		return
+	}
+	delete(cl.eventSubscriptions, s)
+	close(s.c)
+}
+
+// Delivers an event to all subscriptions. The Client lock must be held.
+func (cl *Client) publishEvent(e Event) {
+	for s := range cl.eventSubscriptions {
+		select {
+		case s.c <- e:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+}
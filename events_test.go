@@ -0,0 +1,294 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/internal/testutil"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+func TestClientEventsSeededTorrent(t *testing.T) {
+	c := qt.New(t)
+	greetingDataDir, greetingMetainfo := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDataDir)
+	cfg := TestingConfig(t)
+	cfg.DataDir = greetingDataDir
+	cl, err := NewClient(cfg)
+	c.Assert(err, qt.IsNil)
+	defer cl.Close()
+	sub := cl.SubscribeEvents(100)
+	defer sub.Close()
+	tt, err := cl.AddTorrent(greetingMetainfo)
+	c.Assert(err, qt.IsNil)
+	var (
+		added, gotMetadata, fileCompleted bool
+		hashed                            int
+	)
+	timeout := time.After(10 * time.Second)
+	for done := false; !done; {
+		select {
+		case e := <-sub.Events():
+			switch e := e.(type) {
+			case TorrentAddedEvent:
+				c.Check(e.Torrent, qt.Equals, tt)
+				added = true
+			case MetadataReceivedEvent:
+				c.Check(e.Torrent, qt.Equals, tt)
+				gotMetadata = true
+			case PieceHashedEvent:
+				c.Check(e.Passed, qt.IsTrue)
+				c.Check(e.Err, qt.IsNil)
+				hashed++
+			case FileCompletedEvent:
+				c.Check(e.File.Torrent(), qt.Equals, tt)
+				fileCompleted = true
+			case TorrentCompletedEvent:
+				c.Check(e.Torrent, qt.Equals, tt)
+				done = true
+			}
+		case <-timeout:
+			c.Fatal("timed out waiting for torrent completed event")
+		}
+	}
+	c.Check(added, qt.IsTrue)
+	c.Check(gotMetadata, qt.IsTrue)
+	c.Check(fileCompleted, qt.IsTrue)
+	c.Check(hashed, qt.Equals, tt.NumPieces())
+	tt.Drop()
+	c.Check(<-sub.Events(), qt.Equals, Event(TorrentRemovedEvent{tt}))
+	c.Check(sub.Dropped(), qt.Equals, int64(0))
+}
+
+// Wraps storage so pieces report being complete without certainty until they're verified.
+type unsureStorage struct {
+	storage.ClientImpl
+	marked sync.Map
+}
+
+func (me *unsureStorage) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	ti, err := me.ClientImpl.OpenTorrent(info, infoHash)
+	if err != nil {
+		return ti, err
+	}
+	piece := ti.Piece
+	ti.Piece = func(p metainfo.Piece) storage.PieceImpl {
+		return unsurePiece{piece(p), me, p.Index()}
+	}
+	return ti, nil
+}
+
+type unsurePiece struct {
+	storage.PieceImpl
+	s     *unsureStorage
+	index int
+}
+
+func (me unsurePiece) MarkComplete() error {
+	me.s.marked.Store(me.index, true)
+	return me.PieceImpl.MarkComplete()
+}
+
+func (me unsurePiece) Completion() storage.Completion {
+	c := me.PieceImpl.Completion()
+	if _, ok := me.s.marked.Load(me.index); !ok {
+		c.Ok = false
+	}
+	return c
+}
+
+// Pieces that were already complete, and pass verification, don't complete the torrent again.
+func TestClientEventsNotRepeatedOnVerify(t *testing.T) {
+	c := qt.New(t)
+	greetingDataDir, greetingMetainfo := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDataDir)
+	info, err := greetingMetainfo.UnmarshalInfo()
+	c.Assert(err, qt.IsNil)
+	pc := storage.NewMapPieceCompletion()
+	for i := 0; i < info.NumPieces(); i++ {
+		pc.Set(metainfo.PieceKey{InfoHash: greetingMetainfo.HashInfoBytes(), Index: i}, true)
+	}
+	cfg := TestingConfig(t)
+	cfg.DefaultStorage = &unsureStorage{ClientImpl: storage.NewFileOpts(storage.FileOpts{
+		BaseDir:         greetingDataDir,
+		PieceCompletion: pc,
+	})}
+	cl, err := NewClient(cfg)
+	c.Assert(err, qt.IsNil)
+	defer cl.Close()
+	sub := cl.SubscribeEvents(100)
+	defer sub.Close()
+	tt, err := cl.AddTorrent(greetingMetainfo)
+	c.Assert(err, qt.IsNil)
+	tt.VerifyData()
+	// Wait for the last piece to finish being marked, which is when events are published.
+	for {
+		cl.lock()
+		marking := tt.piece(tt.NumPieces() - 1).marking
+		cl.unlock()
+		if !marking {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	completed := 0
+	for {
+		select {
+		case e := <-sub.Events():
+			if _, ok := e.(TorrentCompletedEvent); ok {
+				completed++
+			}
+			continue
+		default:
+		}
+		break
+	}
+	c.Check(completed, qt.Equals, 1)
+}
+
+func TestClientEventsDroppedWhenBufferFull(t *testing.T) {
+	c := qt.New(t)
+	cl, err := NewClient(TestingConfig(t))
+	c.Assert(err, qt.IsNil)
+	defer cl.Close()
+	sub := cl.SubscribeEvents(1)
+	mi := testutil.GreetingMetaInfo()
+	t1, _ := cl.AddTorrentInfoHash(mi.HashInfoBytes())
+	t1.Drop()
+	c.Check(<-sub.Events(), qt.Equals, Event(TorrentAddedEvent{t1}))
+	c.Check(sub.Dropped(), qt.Equals, int64(1))
+	sub.Close()
+	_, ok := <-sub.Events()
+	c.Check(ok, qt.IsFalse)
+	// Closing again is harmless.
+	sub.Close()
+}
+
+func TestClientEventsClosedWithClient(t *testing.T) {
+	c := qt.New(t)
+	cl, err := NewClient(TestingConfig(t))
+	c.Assert(err, qt.IsNil)
+	sub := cl.SubscribeEvents(0)
+	cl.Close()
+	_, ok := <-sub.Events()
+	c.Check(ok, qt.IsFalse)
+	sub.Close()
+}
+
+func TestStorageOpenErrorEvent(t *testing.T) {
+	c := qt.New(t)
+	td := t.TempDir()
+	mi := testutil.GreetingMetaInfo()
+	info, err := mi.UnmarshalInfo()
+	c.Assert(err, qt.IsNil)
+	// A directory in the way of the torrent's file fails preallocation.
+	c.Assert(os.MkdirAll(filepath.Join(td, info.Name), 0777), qt.IsNil)
+	cfg := TestingConfig(t)
+	cfg.DefaultStorage = storage.NewFileOpts(storage.FileOpts{
+		BaseDir:         td,
+		PieceCompletion: storage.NewMapPieceCompletion(),
+		Preallocate:     storage.PreallocateFull,
+	})
+	cl, err := NewClient(cfg)
+	c.Assert(err, qt.IsNil)
+	defer cl.Close()
+	sub := cl.SubscribeEvents(100)
+	defer sub.Close()
+	// Allocation happens in the background, but adding a torrent with its info waits for it.
+	_, err = cl.AddTorrent(mi)
+	c.Assert(err, qt.ErrorMatches, "allocating torrent storage: .*")
+	timeout := time.After(10 * time.Second)
+	func() {
+		for {
+			select {
+			case e := <-sub.Events():
+				// Hashing pieces fails too, but the torrent-wide event is for the allocation.
+				if e, ok := e.(StorageErrorEvent); ok && e.Piece == -1 {
+					c.Check(e.Err, qt.Not(qt.IsNil))
+					return
+				}
+			case <-timeout:
+				c.Fatal("no storage error event")
+			}
+		}
+	}()
+	// When the info arrives later, GotInfo waits for the allocation, and downloading doesn't
+	// start.
+	tt, _ := cl.AddTorrentInfoHash(mi.HashInfoBytes())
+	c.Assert(tt.SetInfoBytes(mi.InfoBytes), qt.IsNil)
+	select {
+	case <-tt.GotInfo():
+	case <-timeout:
+		c.Fatal("no info")
+	}
+	cl.lock()
+	defer cl.unlock()
+	c.Check(tt.dataDownloadDisallowed, qt.IsTrue)
+	c.Check(tt.storageAllocationErr, qt.Not(qt.IsNil))
+	_, requesting := cl.requestingTorrents[tt]
+	c.Check(requesting, qt.IsFalse)
+}
+
+// Completes the torrent's pieces during its background setup.
+type setupCompletingStorage struct {
+	storage.ClientImpl
+	pc storage.PieceCompletion
+}
+
+func (me *setupCompletingStorage) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	ti, err := me.ClientImpl.OpenTorrent(info, infoHash)
+	ti.Allocated = func() error {
+		for i := 0; i < info.NumPieces(); i++ {
+			me.pc.Set(metainfo.PieceKey{InfoHash: infoHash, Index: i}, true)
+		}
+		return nil
+	}
+	return ti, err
+}
+
+// Pieces that storage finds complete while it's being set up are seen by the client.
+func TestStorageSetupCompletesPieces(t *testing.T) {
+	c := qt.New(t)
+	greetingDataDir, greetingMetainfo := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDataDir)
+	info, err := greetingMetainfo.UnmarshalInfo()
+	c.Assert(err, qt.IsNil)
+	pc := storage.NewMapPieceCompletion()
+	// The pieces are known to be incomplete, so they aren't hashed.
+	for i := 0; i < info.NumPieces(); i++ {
+		pc.Set(metainfo.PieceKey{InfoHash: greetingMetainfo.HashInfoBytes(), Index: i}, false)
+	}
+	cfg := TestingConfig(t)
+	cfg.DefaultStorage = &setupCompletingStorage{
+		ClientImpl: storage.NewFileOpts(storage.FileOpts{
+			BaseDir:         greetingDataDir,
+			PieceCompletion: pc,
+		}),
+		pc: pc,
+	}
+	cl, err := NewClient(cfg)
+	c.Assert(err, qt.IsNil)
+	defer cl.Close()
+	sub := cl.SubscribeEvents(100)
+	defer sub.Close()
+	tt, err := cl.AddTorrent(greetingMetainfo)
+	c.Assert(err, qt.IsNil)
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e := <-sub.Events():
+			if _, ok := e.(TorrentCompletedEvent); ok {
+				c.Check(tt.BytesMissing(), qt.Equals, int64(0))
+				return
+			}
+		case <-timeout:
+			c.Fatal("torrent wasn't completed")
+		}
+	}
+}
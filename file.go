@@ -16,6 +16,11 @@ type File struct {
 	fi          metainfo.FileInfo
 	displayPath string
 	prio        piecePriority
+	// The index of the file in the info's upverted files.
+	index int
+	// Whether the storage was last told the file isn't wanted. Storage assumes files are wanted
+	// until told otherwise. Protected by Torrent.fileWantedMu.
+	storageUnwanted bool
 }
 
 func (f *File) Torrent() *Torrent {
@@ -151,15 +156,19 @@ func (f *File) NewReader() Reader {
 	return &tr
 }
 
-// Sets the minimum priority for pieces in the File.
+// Sets the minimum priority for pieces in the File. Setting PiecePriorityNone deselects the file,
+// which storage that supports it uses to avoid creating the file. Raising the priority again
+// selects it, which may mean the storage moves the file's data, before this returns. Failures to
+// do so are published as a StorageErrorEvent. File storage doesn't move the data of files that
+// already exist when they're deselected.
 func (f *File) SetPriority(prio piecePriority) {
 	f.t.cl.lock()
-	defer f.t.cl.unlock()
-	if prio == f.prio {
-		return
+	if prio != f.prio {
+		f.prio = prio
+		f.t.updatePiecePriorities(f.firstPieceIndex(), f.endPieceIndex())
 	}
-	f.prio = prio
-	f.t.updatePiecePriorities(f.firstPieceIndex(), f.endPieceIndex())
+	f.t.cl.unlock()
+	f.t.setFileWanted(f)
 }
 
 // Returns the priority per File.SetPriority.
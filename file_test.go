@@ -1,10 +1,16 @@
 package torrent
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/RoaringBitmap/roaring"
+	qt "github.com/frankban/quicktest"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/anacrolix/torrent/internal/testutil"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
 )
 
 func TestFileExclusivePieces(t *testing.T) {
@@ -115,3 +121,81 @@ func TestFileBytesLeft(t *testing.T) {
 		name: "ThreePiecesCompletedAll",
 	}.Run(t)
 }
+
+type fileWantedStorage struct {
+	storage.ClientImpl
+	wanted map[int]bool
+	// Optional result of telling the storage about a file.
+	onWanted func() error
+}
+
+func (me *fileWantedStorage) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	t, err := me.ClientImpl.OpenTorrent(info, infoHash)
+	t.SetFileWanted = func(fileIndex int, wanted bool) error {
+		me.wanted[fileIndex] = wanted
+		if me.onWanted != nil {
+			return me.onWanted()
+		}
+		return nil
+	}
+	return t, err
+}
+
+func TestFileSetPriorityTellsStorage(t *testing.T) {
+	c := qt.New(t)
+	cfg := TestingConfig(t)
+	s := &fileWantedStorage{
+		ClientImpl: storage.NewFileWithCompletion(t.TempDir(), storage.NewMapPieceCompletion()),
+		wanted:     make(map[int]bool),
+	}
+	cfg.DefaultStorage = s
+	cl, err := NewClient(cfg)
+	c.Assert(err, qt.IsNil)
+	defer cl.Close()
+	tt, err := cl.AddTorrent(testutil.GreetingMetaInfo())
+	c.Assert(err, qt.IsNil)
+	f := tt.Files()[0]
+	// Files have no priority initially, but deselecting them is still passed on.
+	f.SetPriority(PiecePriorityNone)
+	c.Check(s.wanted, qt.DeepEquals, map[int]bool{0: false})
+	f.SetPriority(PiecePriorityNormal)
+	c.Check(s.wanted, qt.DeepEquals, map[int]bool{0: true})
+	// The storage isn't told again if the file stays wanted.
+	delete(s.wanted, 0)
+	f.SetPriority(PiecePriorityHigh)
+	c.Check(s.wanted, qt.HasLen, 0)
+}
+
+// Storage is told about wanted files without the Client lock, as it may take a while, and its
+// errors are published.
+func TestFileSetPriorityStorageError(t *testing.T) {
+	c := qt.New(t)
+	cfg := TestingConfig(t)
+	var cl *Client
+	s := &fileWantedStorage{
+		ClientImpl: storage.NewFileWithCompletion(t.TempDir(), storage.NewMapPieceCompletion()),
+		wanted:     make(map[int]bool),
+		onWanted: func() error {
+			cl.lock()
+			cl.unlock()
+			return errors.New("no space")
+		},
+	}
+	cfg.DefaultStorage = s
+	cl, err := NewClient(cfg)
+	c.Assert(err, qt.IsNil)
+	defer cl.Close()
+	sub := cl.SubscribeEvents(100)
+	defer sub.Close()
+	tt, err := cl.AddTorrent(testutil.GreetingMetaInfo())
+	c.Assert(err, qt.IsNil)
+	tt.Files()[0].SetPriority(PiecePriorityNone)
+	for {
+		e := <-sub.Events()
+		if e, ok := e.(StorageErrorEvent); ok {
+			c.Check(e.Torrent, qt.Equals, tt)
+			c.Check(e.Err, qt.ErrorMatches, ".*no space")
+			break
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Package metrics provides a minimal model for labelled metrics, and writes them in the
+// OpenMetrics text format so they can be scraped without depending on an external monitoring
+// library.
+package metrics
+
+// The OpenMetrics type of a metric family.
+type Type string
+
+const (
+	Counter Type = "counter"
+	Gauge   Type = "gauge"
+	Summary Type = "summary"
+)
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// A single value in a metric family.
+type Sample struct {
+	// Appended to the family name, such as "_total" for counters, or "_sum" and "_count" for
+	// summaries.
+	Suffix string
+	Labels []Label
+	Value  float64
+}
+
+// A metric family. Samples with the same family name from different Collectors are merged.
+type Family struct {
+	Name    string
+	Help    string
+	Type    Type
+	Unit    string
+	Samples []Sample
+}
+
+// Collectors produce metric families when metrics are gathered.
+type Collector interface {
+	Collect(emit func(Family))
+}
+
+// Adapts a function to the Collector interface.
+type CollectorFunc func(emit func(Family))
+
+func (me CollectorFunc) Collect(emit func(Family)) {
+	me(emit)
+}
+
+// Returns a counter Family with a single sample.
+func NewCounter(name, help string, value float64, labels ...Label) Family {
+	return Family{
+		Name:    name,
+		Help:    help,
+		Type:    Counter,
+		Samples: []Sample{{Suffix: "_total", Labels: labels, Value: value}},
+	}
+}
+
+// Returns a gauge Family with a single sample.
+func NewGauge(name, help string, value float64, labels ...Label) Family {
+	return Family{
+		Name:    name,
+		Help:    help,
+		Type:    Gauge,
+		Samples: []Sample{{Labels: labels, Value: value}},
+	}
+}
+
+// Returns a summary Family with _count and _sum samples.
+func NewSummary(name, help, unit string, count, sum float64, labels ...Label) Family {
+	return Family{
+		Name: name,
+		Help: help,
+		Type: Summary,
+		Unit: unit,
+		Samples: []Sample{
+			{Suffix: "_count", Labels: labels, Value: count},
+			{Suffix: "_sum", Labels: labels, Value: sum},
+		},
+	}
+}
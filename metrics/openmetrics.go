@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// Gathers families from the Collectors, merging families with the same name in the order they're
+// first seen.
+func Gather(cs ...Collector) (ret []Family) {
+	index := make(map[string]int)
+	for _, c := range cs {
+		c.Collect(func(f Family) {
+			i, ok := index[f.Name]
+			if !ok {
+				index[f.Name] = len(ret)
+				ret = append(ret, f)
+				return
+			}
+			ret[i].Samples = append(ret[i].Samples, f.Samples...)
+		})
+	}
+	return
+}
+
+// Writes the metrics from the Collectors in the OpenMetrics text format.
+func WriteOpenMetrics(w io.Writer, cs ...Collector) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range Gather(cs...) {
+		writeFamily(bw, f)
+	}
+	bw.WriteString("# EOF\n")
+	return bw.Flush()
+}
+
+func writeFamily(w *bufio.Writer, f Family) {
+	w.WriteString("# TYPE " + f.Name + " " + string(f.Type) + "\n")
+	if f.Unit != "" {
+		w.WriteString("# UNIT " + f.Name + " " + f.Unit + "\n")
+	}
+	if f.Help != "" {
+		w.WriteString("# HELP " + f.Name + " " + escape(f.Help) + "\n")
+	}
+	for _, s := range f.Samples {
+		w.WriteString(f.Name + s.Suffix)
+		if len(s.Labels) != 0 {
+			w.WriteByte('{')
+			for i, l := range s.Labels {
+				if i != 0 {
+					w.WriteByte(',')
+				}
+				w.WriteString(l.Name + `="` + escape(l.Value) + `"`)
+			}
+			w.WriteByte('}')
+		}
+		w.WriteString(" " + formatValue(s.Value) + "\n")
+	}
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Returns a http.Handler that serves the metrics from the Collectors in the OpenMetrics text
+// format.
+func Handler(cs ...Collector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		WriteOpenMetrics(w, cs...)
+	})
+}
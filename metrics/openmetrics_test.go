@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestWriteOpenMetricsMergesFamilies(t *testing.T) {
+	c := qt.New(t)
+	collector := func(client string, bytes float64) Collector {
+		return CollectorFunc(func(emit func(Family)) {
+			emit(NewCounter("bytes_read", "Bytes read.", bytes, Label{"client", client}))
+			emit(NewSummary("op_duration_seconds", "Op \"latency\".", "seconds", 2, 0.5, Label{"client", client}))
+		})
+	}
+	var buf bytes.Buffer
+	c.Assert(WriteOpenMetrics(&buf, collector("a", 1), collector("b\n", 1e9)), qt.IsNil)
+	c.Check(buf.String(), qt.Equals, `# TYPE bytes_read counter
+# HELP bytes_read Bytes read.
+bytes_read_total{client="a"} 1
+bytes_read_total{client="b\n"} 1e+09
+# TYPE op_duration_seconds summary
+# UNIT op_duration_seconds seconds
+# HELP op_duration_seconds Op \"latency\".
+op_duration_seconds_count{client="a"} 2
+op_duration_seconds_sum{client="a"} 0.5
+op_duration_seconds_count{client="b\n"} 2
+op_duration_seconds_sum{client="b\n"} 0.5
+# EOF
+`)
+}
+
+func TestHandler(t *testing.T) {
+	c := qt.New(t)
+	rec := httptest.NewRecorder()
+	Handler(CollectorFunc(func(emit func(Family)) {
+		emit(NewGauge("peers", "", 3))
+	})).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	c.Check(rec.Header().Get("Content-Type"), qt.Equals, ContentType)
+	c.Check(rec.Body.String(), qt.Equals, "# TYPE peers gauge\npeers 3\n# EOF\n")
+}
@@ -6,9 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"net"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -86,6 +86,15 @@ type Peer struct {
 	actualRequestState   requestState
 	lastBecameInterested time.Time
 	priorInterest        time.Duration
+	// When outstanding requests were sent, to measure chunk latency.
+	requestTimes map[Request]time.Time
+	// The lowest recent chunk latency, as an estimate of the round trip time.
+	minRtt         time.Duration
+	minRttObserved time.Time
+	// The last time a requested chunk was received.
+	lastChunkReceived time.Time
+	// The peer stopped delivering requested chunks.
+	snubbed bool
 
 	lastStartedExpectingToReceiveChunks time.Time
 	cumulativeExpectedToReceiveChunks   time.Duration
@@ -98,6 +107,9 @@ type Peer struct {
 	// latency, buffering, and implementation differences, we may receive
 	// chunks that are no longer in the set of requests actually want.
 	validReceiveChunks map[Request]int
+	// Chunks in validReceiveChunks that another peer sent first, because they were requested from
+	// several peers at once, such as in endgame.
+	duplicateReceiveChunks map[Request]struct{}
 	// Indexed by metadata piece, set to true if posted and pending a
 	// response.
 	metadataRequests []bool
@@ -254,14 +266,6 @@ func (cn *Peer) bestPeerNumPieces() pieceIndex {
 	return cn.peerMinPieces
 }
 
-func (cn *Peer) completedString() string {
-	have := pieceIndex(cn._peerPieces.Len())
-	if cn.peerSentHaveAll {
-		have = cn.bestPeerNumPieces()
-	}
-	return fmt.Sprintf("%d/%d", have, cn.bestPeerNumPieces())
-}
-
 func (cn *PeerConn) onGotInfo(info *metainfo.Info) {
 	cn.setNumPieces(info.NumPieces())
 }
@@ -311,6 +315,9 @@ func (cn *Peer) statusFlags() (ret string) {
 	if cn.choking {
 		c('c')
 	}
+	if cn.snubbed {
+		c('s')
+	}
 	c('-')
 	ret += cn.connectionFlags()
 	c('-')
@@ -339,58 +346,6 @@ func (cn *Peer) numRequestsByPiece() (ret map[pieceIndex]int) {
 	return
 }
 
-func (cn *Peer) writeStatus(w io.Writer, t *Torrent) {
-	// \t isn't preserved in <pre> blocks?
-	if cn.closed.IsSet() {
-		fmt.Fprint(w, "CLOSED: ")
-	}
-	fmt.Fprintln(w, cn.connStatusString())
-	prio, err := cn.peerPriority()
-	prioStr := fmt.Sprintf("%08x", prio)
-	if err != nil {
-		prioStr += ": " + err.Error()
-	}
-	fmt.Fprintf(w, "    bep40-prio: %v\n", prioStr)
-	fmt.Fprintf(w, "    last msg: %s, connected: %s, last helpful: %s, itime: %s, etime: %s\n",
-		eventAgeString(cn.lastMessageReceived),
-		eventAgeString(cn.completedHandshake),
-		eventAgeString(cn.lastHelpful()),
-		cn.cumInterest(),
-		cn.totalExpectingTime(),
-	)
-	fmt.Fprintf(w,
-		"    %s completed, %d pieces touched, good chunks: %v/%v-%v reqq: %d/(%d/%d)-%d/%d, flags: %s, dr: %.1f KiB/s\n",
-		cn.completedString(),
-		len(cn.peerTouchedPieces),
-		&cn._stats.ChunksReadUseful,
-		&cn._stats.ChunksRead,
-		&cn._stats.ChunksWritten,
-		cn.numLocalRequests(),
-		cn.nominalMaxRequests(),
-		cn.PeerMaxRequests,
-		len(cn.peerRequests),
-		localClientReqq,
-		cn.statusFlags(),
-		cn.downloadRate()/(1<<10),
-	)
-	fmt.Fprintf(w, "    requested pieces:")
-	type pieceNumRequestsType struct {
-		piece       pieceIndex
-		numRequests int
-	}
-	var pieceNumRequests []pieceNumRequestsType
-	for piece, count := range cn.numRequestsByPiece() {
-		pieceNumRequests = append(pieceNumRequests, pieceNumRequestsType{piece, count})
-	}
-	sort.Slice(pieceNumRequests, func(i, j int) bool {
-		return pieceNumRequests[i].piece < pieceNumRequests[j].piece
-	})
-	for _, elem := range pieceNumRequests {
-		fmt.Fprintf(w, " %v(%v)", elem.piece, elem.numRequests)
-	}
-	fmt.Fprintf(w, "\n")
-}
-
 func (p *Peer) close() {
 	if !p.closed.Set() {
 		return
@@ -461,9 +416,54 @@ func (cn *PeerConn) requestedMetadataPiece(index int) bool {
 	return index < len(cn.metadataRequests) && cn.metadataRequests[index]
 }
 
-// The actual value to use as the maximum outbound requests.
+// The number of requests to keep outstanding with the peer. This covers the bandwidth-delay product
+// from the peer's download rate and chunk latency, with headroom for the rate to grow. Until those
+// are known, it grows with the chunks received between request updates. It's capped by the peer's
+// reqq.
 func (cn *Peer) nominalMaxRequests() (ret maxRequests) {
-	return int(clamp(1, 2*int64(cn.maxPiecesReceivedBetweenRequestUpdates), int64(cn.PeerMaxRequests)))
+	if cn.snubbed {
+		return 1
+	}
+	ret = 2 * cn.maxPiecesReceivedBetweenRequestUpdates
+	if bdp := cn.bdpRequests(); bdp > ret {
+		ret = bdp
+	}
+	return int(clamp(1, int64(ret), int64(cn.PeerMaxRequests)))
+}
+
+// Returns twice the number of chunks in the bandwidth-delay product, or zero if it isn't known.
+func (cn *Peer) bdpRequests() maxRequests {
+	rate := cn.downloadRate()
+	if rate == 0 || cn.minRtt == 0 {
+		return 0
+	}
+	return maxRequests(math.Ceil(2 * rate * cn.minRtt.Seconds() / float64(cn.t.chunkSize)))
+}
+
+// The window over which the minimum chunk latency is taken, so that it can recover if the route
+// or load on the peer changes.
+const minRttWindow = 10 * time.Second
+
+func (cn *Peer) onChunkLatency(d time.Duration, now time.Time) {
+	if cn.minRtt == 0 || d < cn.minRtt || now.Sub(cn.minRttObserved) > minRttWindow {
+		cn.minRtt = d
+		cn.minRttObserved = now
+	}
+}
+
+// Marks the peer snubbed if it's gone the timeout without delivering a chunk while we expected
+// some.
+func (cn *Peer) updateSnubbed(now time.Time, timeout time.Duration) {
+	if cn.snubbed || timeout <= 0 || !cn.expectingChunks() {
+		return
+	}
+	since := cn.lastChunkReceived
+	if cn.lastStartedExpectingToReceiveChunks.After(since) {
+		since = cn.lastStartedExpectingToReceiveChunks
+	}
+	if now.Sub(since) >= timeout {
+		cn.snubbed = true
+	}
 }
 
 func (cn *Peer) totalExpectingTime() (ret time.Duration) {
@@ -567,13 +567,20 @@ func (cn *Peer) shouldRequest(r Request) error {
 }
 
 func (cn *Peer) request(r Request) (more bool, err error) {
+	// The chunk may have arrived from another peer since the request state was determined, such as
+	// in endgame.
+	if cn.t.haveChunk(r) {
+		return true, nil
+	}
 	if err := cn.shouldRequest(r); err != nil {
 		panic(err)
 	}
 	if _, ok := cn.actualRequestState.Requests[r]; ok {
 		return true, nil
 	}
-	if cn.numLocalRequests() >= cn.nominalMaxRequests() {
+	// The request strategy allots requests up to nominalMaxRequests as it was when the strategy
+	// ran, and that can since have fallen with the download rate and latency estimates.
+	if n := cn.numLocalRequests(); n >= cn.nominalMaxRequests() && n >= len(cn.nextRequestState.Requests) {
 		return true, errors.New("too many outstanding requests")
 	}
 	if cn.actualRequestState.Requests == nil {
@@ -584,6 +591,10 @@ func (cn *Peer) request(r Request) (more bool, err error) {
 		cn.validReceiveChunks = make(map[Request]int)
 	}
 	cn.validReceiveChunks[r]++
+	if cn.requestTimes == nil {
+		cn.requestTimes = make(map[Request]time.Time)
+	}
+	cn.requestTimes[r] = time.Now()
 	cn.t.pendingRequests[r]++
 	cn.updateExpectingChunks()
 	for _, f := range cn.callbacks.SentRequest {
@@ -991,6 +1002,9 @@ func (c *PeerConn) peerRequestDataReadFailed(err error, r Request) {
 }
 
 func readPeerRequestData(r Request, c *PeerConn) ([]byte, error) {
+	if rc := c.t.cl.readCache; rc != nil && c.t.info.Piece(int(r.Index)).Length() <= rc.capacity {
+		return c.t.readCachedPeerRequestData(rc, r)
+	}
 	b := make([]byte, r.Length)
 	p := c.t.info.Piece(int(r.Index))
 	n, err := c.t.readAt(b, p.Offset()+int64(r.Begin))
@@ -1149,6 +1163,7 @@ func (c *Peer) decExpectedChunkReceive(r Request) {
 	count := c.validReceiveChunks[r]
 	if count == 1 {
 		delete(c.validReceiveChunks, r)
+		delete(c.duplicateReceiveChunks, r)
 	} else if count > 1 {
 		c.validReceiveChunks[r] = count - 1
 	} else {
@@ -1254,7 +1269,14 @@ func (c *Peer) receiveChunk(msg *pp.Message) error {
 		chunksReceived.Add("unexpected", 1)
 		return errors.New("received unexpected chunk")
 	}
+	_, duplicate := c.duplicateReceiveChunks[req]
 	c.decExpectedChunkReceive(req)
+	now := time.Now()
+	c.lastChunkReceived = now
+	c.snubbed = false
+	if sent, ok := c.requestTimes[req]; ok {
+		c.onChunkLatency(now.Sub(sent), now)
+	}
 
 	if c.peerChoking && c.peerAllowedFast.Get(bitmap.BitIndex(req.Index)) {
 		chunksReceived.Add("due to allowed fast", 1)
@@ -1287,6 +1309,10 @@ func (c *Peer) receiveChunk(msg *pp.Message) error {
 	// Do we actually want this chunk?
 	if t.haveChunk(req) {
 		chunksReceived.Add("wasted", 1)
+		if duplicate {
+			chunksReceived.Add("duplicate", 1)
+			c.allStats(add(1, func(cs *ConnStats) *Count { return &cs.ChunksReadDuplicate }))
+		}
 		c.allStats(add(1, func(cs *ConnStats) *Count { return &cs.ChunksReadWasted }))
 		return nil
 	}
@@ -1318,6 +1344,12 @@ func (c *Peer) receiveChunk(msg *pp.Message) error {
 			return
 		}
 		p.cancel(req)
+		if p.validReceiveChunks[req] > 0 {
+			if p.duplicateReceiveChunks == nil {
+				p.duplicateReceiveChunks = make(map[Request]struct{})
+			}
+			p.duplicateReceiveChunks[req] = struct{}{}
+		}
 	})
 
 	err := func() error {
@@ -1460,6 +1492,7 @@ func (c *Peer) deleteRequest(r Request) bool {
 		return false
 	}
 	delete(c.actualRequestState.Requests, r)
+	delete(c.requestTimes, r)
 	for _, f := range c.callbacks.DeletedRequest {
 		f(PeerRequestEvent{c, r})
 	}
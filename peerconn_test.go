@@ -1,16 +1,19 @@
 package torrent
 
 import (
+	"bytes"
 	"io"
 	"net"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/anacrolix/missinggo/pubsub"
 	"github.com/bradfitz/iter"
 	"github.com/frankban/quicktest"
 	"github.com/stretchr/testify/require"
 
+	"github.com/anacrolix/torrent/internal/testutil"
 	"github.com/anacrolix/torrent/metainfo"
 	pp "github.com/anacrolix/torrent/peer_protocol"
 	"github.com/anacrolix/torrent/storage"
@@ -207,3 +210,88 @@ func TestConnPexEvent(t *testing.T) {
 		require.EqualValues(t, tc.e, e, i)
 	}
 }
+
+func TestNominalMaxRequestsFromBandwidthDelayProduct(t *testing.T) {
+	c := quicktest.New(t)
+	p := Peer{
+		t:               &Torrent{chunkSize: defaultChunkSize},
+		PeerMaxRequests: 250,
+	}
+	c.Check(p.nominalMaxRequests(), quicktest.Equals, 1)
+	p.maxPiecesReceivedBetweenRequestUpdates = 3
+	c.Check(p.nominalMaxRequests(), quicktest.Equals, 6)
+	// 1 MiB/s with 500ms latency has 32 chunks in flight.
+	p._stats.BytesReadUsefulData.Add(1 << 20)
+	p.cumulativeExpectedToReceiveChunks = time.Second
+	now := time.Now()
+	p.onChunkLatency(time.Second, now)
+	p.onChunkLatency(500*time.Millisecond, now)
+	p.onChunkLatency(time.Second, now)
+	c.Check(p.minRtt, quicktest.Equals, 500*time.Millisecond)
+	c.Check(p.nominalMaxRequests(), quicktest.Equals, 64)
+	// The minimum expires.
+	p.onChunkLatency(2*time.Second, now.Add(minRttWindow+time.Second))
+	c.Check(p.nominalMaxRequests(), quicktest.Equals, 250)
+	p.PeerMaxRequests = 100
+	c.Check(p.nominalMaxRequests(), quicktest.Equals, 100)
+}
+
+func TestPeerSnubbed(t *testing.T) {
+	c := quicktest.New(t)
+	now := time.Now()
+	p := Peer{
+		t:               &Torrent{chunkSize: defaultChunkSize},
+		PeerMaxRequests: 250,
+		actualRequestState: requestState{
+			Interested: true,
+			Requests:   map[Request]struct{}{{}: {}},
+		},
+		lastStartedExpectingToReceiveChunks:    now.Add(-time.Minute),
+		lastChunkReceived:                      now.Add(-10 * time.Second),
+		maxPiecesReceivedBetweenRequestUpdates: 10,
+	}
+	p.updateSnubbed(now, 30*time.Second)
+	c.Check(p.snubbed, quicktest.IsFalse)
+	p.updateSnubbed(now.Add(20*time.Second), 30*time.Second)
+	c.Check(p.snubbed, quicktest.IsTrue)
+	c.Check(p.nominalMaxRequests(), quicktest.Equals, 1)
+}
+
+// A chunk requested from two peers is a duplicate, not wasted, when it arrives from the second.
+func TestReceiveDuplicateChunk(t *testing.T) {
+	c := quicktest.New(t)
+	cfg := TestingConfig(t)
+	cfg.DataDir = t.TempDir()
+	cl, err := NewClient(cfg)
+	c.Assert(err, quicktest.IsNil)
+	defer cl.Close()
+	tt, err := cl.AddTorrent(testutil.GreetingMetaInfo())
+	c.Assert(err, quicktest.IsNil)
+	cl.lock()
+	defer cl.unlock()
+	msg := pp.Message{
+		Type:  pp.Piece,
+		Index: 0,
+		Begin: 0,
+		Piece: []byte(testutil.GreetingFileContents[:5]),
+	}
+	req := newRequestFromMessage(&msg)
+	var conns []*PeerConn
+	for range iter.N(2) {
+		cn := cl.newConnection(nil, false, nil, "io.Pipe", "")
+		// Messages such as cancels are buffered, and never written.
+		cn.messageWriter.writeBuffer = new(bytes.Buffer)
+		cn.setTorrent(tt)
+		tt.conns[cn] = struct{}{}
+		cn.actualRequestState.Requests = map[Request]struct{}{req: {}}
+		cn.validReceiveChunks = map[Request]int{req: 1}
+		tt.pendingRequests[req]++
+		conns = append(conns, cn)
+	}
+	c.Assert(conns[0].receiveChunk(&msg), quicktest.IsNil)
+	c.Check(conns[0]._stats.ChunksReadUseful.Int64(), quicktest.Equals, int64(1))
+	c.Assert(conns[1].receiveChunk(&msg), quicktest.IsNil)
+	c.Check(conns[1]._stats.ChunksReadWasted.Int64(), quicktest.Equals, int64(1))
+	c.Check(conns[1]._stats.ChunksReadDuplicate.Int64(), quicktest.Equals, int64(1))
+	c.Check(conns[1].duplicateReceiveChunks, quicktest.HasLen, 0)
+}
@@ -0,0 +1,95 @@
+package torrent
+
+import (
+	"time"
+)
+
+// Sets the time by which the piece is needed, such as for media playback. Pieces with deadlines
+// are requested before all others, earliest deadline first, and pieces close to their deadline are
+// requested from more than one peer. A piece with a deadline is wanted, even if it would otherwise
+// have no priority. A PieceDeadlineMissedEvent is published if the deadline passes before the
+// piece is complete. The deadline is cleared when the piece completes, or by passing the zero
+// time. It does nothing if the torrent's info isn't available yet, or the piece is out of range.
+func (t *Torrent) SetPieceDeadline(piece pieceIndex, deadline time.Time) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	if !t.haveInfo() || piece < 0 || piece >= t.numPieces() {
+		return
+	}
+	if deadline.IsZero() || t.pieceComplete(piece) {
+		delete(t.pieceDeadlines, piece)
+	} else {
+		if t.pieceDeadlines == nil {
+			t.pieceDeadlines = make(map[pieceIndex]time.Time)
+		}
+		t.pieceDeadlines[piece] = deadline
+	}
+	t.updatePiecePriority(piece)
+	t.cl.tickleRequester()
+}
+
+// Returns the earliest deadline for the piece from SetPieceDeadline and readers with a bitrate, or
+// the zero time if there is none.
+func (t *Torrent) pieceDeadline(piece pieceIndex) (ret time.Time) {
+	ret = t.pieceDeadlines[piece]
+	for r := range t.readers {
+		d, ok := r.pieceDeadline(piece)
+		if ok && (ret.IsZero() || d.Before(ret)) {
+			ret = d
+		}
+	}
+	return
+}
+
+// Publishes a PieceDeadlineMissedEvent if the deadline has passed with the piece incomplete, once
+// per piece and deadline.
+func (t *Torrent) checkPieceDeadline(piece pieceIndex, deadline, now time.Time) {
+	if deadline.IsZero() || !deadline.Before(now) || t.pieceComplete(piece) {
+		return
+	}
+	if missed, ok := t.missedPieceDeadlines[piece]; ok && missed.Equal(deadline) {
+		return
+	}
+	if t.missedPieceDeadlines == nil {
+		t.missedPieceDeadlines = make(map[pieceIndex]time.Time)
+	}
+	t.missedPieceDeadlines[piece] = deadline
+	t.cl.publishEvent(PieceDeadlineMissedEvent{
+		Torrent:  t,
+		Piece:    piece,
+		Deadline: deadline,
+	})
+}
+
+// Checks for missed deadlines from SetPieceDeadline and readers with a bitrate.
+func (t *Torrent) checkPieceDeadlines(now time.Time) {
+	for piece := range t.pieceDeadlines {
+		t.checkPieceDeadline(piece, t.pieceDeadline(piece), now)
+	}
+	for r := range t.readers {
+		if r.bitrate <= 0 {
+			continue
+		}
+		for piece := r.pieces.begin; piece < r.pieces.end; piece++ {
+			t.checkPieceDeadline(piece, t.pieceDeadline(piece), now)
+		}
+	}
+}
+
+func (t *Torrent) clearPieceDeadline(piece pieceIndex) {
+	delete(t.pieceDeadlines, piece)
+	delete(t.missedPieceDeadlines, piece)
+}
+
+// Returns when the reader will reach the piece at its bitrate, if the piece is in its readahead
+// window.
+func (r *reader) pieceDeadline(piece pieceIndex) (time.Time, bool) {
+	if r.bitrate <= 0 || piece < r.pieces.begin || piece >= r.pieces.end {
+		return time.Time{}, false
+	}
+	ahead := int64(piece)*r.t.info.PieceLength - r.torrentOffset(r.deadlinePos)
+	if ahead < 0 {
+		ahead = 0
+	}
+	return r.deadlineTime.Add(time.Duration(float64(ahead) / float64(r.bitrate) * float64(time.Second))), true
+}
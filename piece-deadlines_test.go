@@ -0,0 +1,102 @@
+package torrent
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/internal/testutil"
+)
+
+func TestPieceDeadlineMissed(t *testing.T) {
+	c := qt.New(t)
+	cl, err := NewClient(TestingConfig(t))
+	c.Assert(err, qt.IsNil)
+	defer cl.Close()
+	sub := cl.SubscribeEvents(100)
+	defer sub.Close()
+	// There's no data for the torrent, so the piece can't complete.
+	tt, err := cl.AddTorrent(testutil.GreetingMetaInfo())
+	c.Assert(err, qt.IsNil)
+	// Ignores the state of the piece's initial hashing.
+	purePriority := func() piecePriority {
+		cl.lock()
+		defer cl.unlock()
+		return tt.piece(0).purePriority()
+	}
+	c.Assert(purePriority(), qt.Equals, PiecePriorityNone)
+	deadline := time.Now().Add(-time.Second)
+	tt.SetPieceDeadline(0, deadline)
+	c.Check(purePriority(), qt.Equals, PiecePriorityNormal)
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e := <-sub.Events():
+			if e, ok := e.(PieceDeadlineMissedEvent); ok {
+				c.Check(e.Torrent, qt.Equals, tt)
+				c.Check(e.Piece, qt.Equals, 0)
+				c.Check(e.Deadline.Equal(deadline), qt.IsTrue)
+				tt.SetPieceDeadline(0, time.Time{})
+				c.Check(purePriority(), qt.Equals, PiecePriorityNone)
+				return
+			}
+		case <-timeout:
+			c.Fatal("timed out waiting for missed deadline event")
+		}
+	}
+}
+
+func TestReaderBitratePieceDeadlines(t *testing.T) {
+	c := qt.New(t)
+	cl, err := NewClient(TestingConfig(t))
+	c.Assert(err, qt.IsNil)
+	defer cl.Close()
+	tt, err := cl.AddTorrent(testutil.GreetingMetaInfo())
+	c.Assert(err, qt.IsNil)
+	r := tt.NewReader()
+	defer r.Close()
+	cl.lock()
+	c.Check(tt.pieceDeadline(0).IsZero(), qt.IsTrue)
+	cl.unlock()
+	r.(BitrateSetter).SetBitrate(1)
+	// Pieces are 5 bytes, and due when the bitrate gets the reader to them.
+	check := func(piece pieceIndex, expected time.Duration) {
+		cl.lock()
+		defer cl.unlock()
+		c.Check(tt.pieceDeadline(piece).Sub(r.(*reader).deadlineTime), qt.Equals, expected)
+	}
+	check(0, 0)
+	check(1, 5*time.Second)
+	check(2, 10*time.Second)
+	_, err = r.Seek(7, io.SeekStart)
+	c.Assert(err, qt.IsNil)
+	check(1, 0)
+	check(2, 3*time.Second)
+	cl.lock()
+	c.Check(tt.pieceDeadline(0).IsZero(), qt.IsTrue)
+	cl.unlock()
+	// Explicit deadlines apply when they're earlier.
+	tt.SetPieceDeadline(2, time.Now().Add(-time.Minute))
+	cl.lock()
+	c.Check(time.Since(tt.pieceDeadline(2)) >= time.Minute, qt.IsTrue)
+	cl.unlock()
+}
+
+func TestSetPieceDeadlineIgnoresInvalidPieces(t *testing.T) {
+	c := qt.New(t)
+	cl, err := NewClient(TestingConfig(t))
+	c.Assert(err, qt.IsNil)
+	defer cl.Close()
+	mi := testutil.GreetingMetaInfo()
+	tt, _ := cl.AddTorrentInfoHash(mi.HashInfoBytes())
+	// There's no info yet.
+	tt.SetPieceDeadline(0, time.Now())
+	c.Assert(tt.SetInfoBytes(mi.InfoBytes), qt.IsNil)
+	tt.SetPieceDeadline(-1, time.Now())
+	tt.SetPieceDeadline(tt.NumPieces(), time.Now())
+	cl.lock()
+	c.Check(tt.pieceDeadlines, qt.HasLen, 0)
+	cl.unlock()
+}
@@ -0,0 +1,120 @@
+package torrent
+
+import (
+	"github.com/anacrolix/multiless"
+	"github.com/google/btree"
+)
+
+// The state of a pending piece that determines its place in the request order. Pieces are stored
+// with the state at insertion, and are reinserted as it changes.
+type pieceRequestOrderItem struct {
+	index        pieceIndex
+	priority     piecePriority
+	partial      bool
+	availability int64
+}
+
+// Orders pieces by priority, then partial pieces first, and then rarest first, as the default
+// request strategy does for pieces without deadlines.
+func (me pieceRequestOrderItem) Less(than btree.Item) bool {
+	other := than.(pieceRequestOrderItem)
+	return multiless.New().Int(
+		int(other.priority), int(me.priority),
+	).Bool(
+		other.partial, me.partial,
+	).Int64(
+		me.availability, other.availability,
+	).Int(
+		me.index, other.index,
+	).Less()
+}
+
+func (t *Torrent) pieceRequestOrderItem(i pieceIndex) pieceRequestOrderItem {
+	p := &t.pieces[i]
+	return pieceRequestOrderItem{
+		index:        i,
+		priority:     p.purePriority(),
+		partial:      t.piecePartiallyDownloaded(i),
+		availability: p.availability,
+	}
+}
+
+// Updates the piece's place in the request order, after anything it's ordered by may have changed.
+// Only pending pieces are included.
+func (t *Torrent) updatePieceRequestOrder(i pieceIndex) {
+	p := &t.pieces[i]
+	if !t._pendingPieces.Contains(i) {
+		if p.inRequestOrder {
+			t.requestOrder.Delete(p.requestOrderItem)
+			p.inRequestOrder = false
+		}
+		return
+	}
+	item := t.pieceRequestOrderItem(i)
+	if p.inRequestOrder {
+		if item == p.requestOrderItem {
+			return
+		}
+		t.requestOrder.Delete(p.requestOrderItem)
+	}
+	if t.requestOrder == nil {
+		t.requestOrder = btree.New(32)
+	}
+	t.requestOrder.ReplaceOrInsert(item)
+	p.requestOrderItem = item
+	p.inRequestOrder = true
+}
+
+// Calls f with the pending pieces in request order.
+func (t *Torrent) iterPiecesInRequestOrder(f func(pieceIndex) bool) {
+	if t.requestOrder == nil {
+		return
+	}
+	t.requestOrder.Ascend(func(i btree.Item) bool {
+		return f(i.(pieceRequestOrderItem).index)
+	})
+}
+
+// Adds or removes the Torrent from the Client's set of Torrents that the request strategy runs
+// over, after anything skipRequests depends on may have changed, and returns whether it's in the
+// set. Torrents whose storage is still allocating are left out. Otherwise Torrents with storage
+// capacity are always included, as their pieces all count against the capacity, and so are
+// Torrents with piece deadlines, so missed deadlines are reported. Peers of Torrents that are
+// removed have their requests cleared.
+func (t *Torrent) updateRequesting() bool {
+	cl := t.cl
+	_, ok := cl.requestingTorrents[t]
+	want := !t.closed.IsSet() && !t.storageAllocating &&
+		(t.hasCapacity() || t.hasPieceDeadlines() || !t.skipRequests())
+	if want == ok {
+		return ok
+	}
+	if !want {
+		delete(cl.requestingTorrents, t)
+		t.clearPeerRequestStates()
+		return false
+	}
+	if cl.requestingTorrents == nil {
+		cl.requestingTorrents = make(map[*Torrent]struct{})
+	}
+	cl.requestingTorrents[t] = struct{}{}
+	cl.tickleRequester()
+	return true
+}
+
+func (t *Torrent) hasCapacity() bool {
+	return t.storage != nil && t.storage.Capacity != nil
+}
+
+// Whether there are deadlines from SetPieceDeadline or readers with a bitrate.
+func (t *Torrent) hasPieceDeadlines() bool {
+	if len(t.pieceDeadlines) != 0 {
+		return true
+	}
+	for r := range t.readers {
+		if r.bitrate > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -3,6 +3,7 @@ package torrent
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/anacrolix/missinggo/v2/bitmap"
 
@@ -25,16 +26,27 @@ type Piece struct {
 	hashing             bool
 	marking             bool
 	storageCompletionOk bool
+	// When the piece's data last matched its hash. Zero if it isn't known, such as if the storage
+	// doesn't persist it and it hasn't been hashed since the info was set.
+	lastVerified time.Time
+	// When the piece's newest entry in the Client's scrub queue is due. Zero if it has none.
+	scrubDue time.Time
 
 	publicPieceState PieceState
 	priority         piecePriority
 	availability     int64
+	// The piece's entry in the Torrent's request order, if it's pending.
+	requestOrderItem pieceRequestOrderItem
+	inRequestOrder   bool
 
 	// This can be locked when the Client lock is taken, but probably not vice versa.
 	pendingWritesMutex sync.Mutex
 	pendingWrites      int
 	noPendingWrites    sync.Cond
 
+	// Passed to the request strategy. Cached to avoid allocating for every piece on every run.
+	iterPendingChunks func(func(ChunkSpec))
+
 	// Connections that have written data to this piece since its last check.
 	// This can include connections that have closed.
 	dirtiers map[*Peer]struct{}
@@ -70,11 +82,13 @@ func (p *Piece) numDirtyChunks() pp.Integer {
 
 func (p *Piece) unpendChunkIndex(i int) {
 	p._dirtyChunks.Add(bitmap.BitIndex(i))
+	p.t.updatePieceRequestOrder(p.index)
 	p.t.tickleReaders()
 }
 
 func (p *Piece) pendChunkIndex(i int) {
 	p._dirtyChunks.Remove(bitmap.BitIndex(i))
+	p.t.updatePieceRequestOrder(p.index)
 }
 
 func (p *Piece) numChunks() pp.Integer {
@@ -201,6 +215,9 @@ func (p *Piece) purePriority() (ret piecePriority) {
 	if p.t.readerReadaheadPieces().Contains(bitmap.BitIndex(p.index)) {
 		ret.Raise(PiecePriorityReadahead)
 	}
+	if _, ok := p.t.pieceDeadlines[p.index]; ok {
+		ret.Raise(PiecePriorityNormal)
+	}
 	ret.Raise(p.priority)
 	return
 }
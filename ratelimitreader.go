@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -11,38 +12,51 @@ import (
 
 type rateLimitedReader struct {
 	l *rate.Limiter
-	r io.Reader
+	// If set and holding a value, the *rate.Limiter to use instead of l. It's loaded on every Read
+	// so the limiter can be replaced while the reader is in use.
+	lv *atomic.Value
+	r  io.Reader
 
 	// This is the time of the last Read's reservation.
 	lastRead time.Time
 }
 
+func (me *rateLimitedReader) limiter() *rate.Limiter {
+	if me.lv != nil {
+		if l, ok := me.lv.Load().(*rate.Limiter); ok {
+			return l
+		}
+	}
+	return me.l
+}
+
 func (me *rateLimitedReader) Read(b []byte) (n int, err error) {
+	l := me.limiter()
 	const oldStyle = false // Retained for future reference.
 	if oldStyle {
 		// Wait until we can read at all.
-		if err := me.l.WaitN(context.Background(), 1); err != nil {
+		if err := l.WaitN(context.Background(), 1); err != nil {
 			panic(err)
 		}
 		// Limit the read to within the burst.
-		if me.l.Limit() != rate.Inf && len(b) > me.l.Burst() {
-			b = b[:me.l.Burst()]
+		if l.Limit() != rate.Inf && len(b) > l.Burst() {
+			b = b[:l.Burst()]
 		}
 		n, err = me.r.Read(b)
 		// Pay the piper.
 		now := time.Now()
 		me.lastRead = now
-		if !me.l.ReserveN(now, n-1).OK() {
+		if !l.ReserveN(now, n-1).OK() {
 			panic(fmt.Sprintf("burst exceeded?: %d", n-1))
 		}
 	} else {
 		// Limit the read to within the burst.
-		if me.l.Limit() != rate.Inf && len(b) > me.l.Burst() {
-			b = b[:me.l.Burst()]
+		if l.Limit() != rate.Inf && len(b) > l.Burst() {
+			b = b[:l.Burst()]
 		}
 		n, err = me.r.Read(b)
 		now := time.Now()
-		r := me.l.ReserveN(now, n)
+		r := l.ReserveN(now, n)
 		if !r.OK() {
 			panic(n)
 		}
@@ -0,0 +1,261 @@
+package torrent
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// Determines which pieces the read cache evicts to make room.
+type ReadCachePolicy int
+
+const (
+	// Adaptive replacement cache. Balances recently and frequently requested pieces, so that a
+	// sweep through a torrent by one peer doesn't evict the pieces that many peers want.
+	ReadCacheARC ReadCachePolicy = iota
+	// Evicts the least recently requested pieces.
+	ReadCacheLRU
+)
+
+func (me ReadCachePolicy) String() string {
+	switch me {
+	case ReadCacheARC:
+		return "arc"
+	case ReadCacheLRU:
+		return "lru"
+	default:
+		return fmt.Sprintf("ReadCachePolicy(%d)", int(me))
+	}
+}
+
+type readCacheKey struct {
+	t     *Torrent
+	piece pieceIndex
+}
+
+type readCacheEntry struct {
+	key readCacheKey
+	// Nil for entries in the ghost lists, which only remember that the piece was cached.
+	data []byte
+	size int64
+	l    *readCacheList
+	elem *list.Element
+}
+
+// Most recently used at the front.
+type readCacheList struct {
+	list.List
+	bytes int64
+}
+
+// Caches whole pieces for serving peer requests. Sizes are in bytes, so the ARC adaptation works
+// with pieces of differing lengths. With LRU only t1 is used. Safe for concurrent use.
+type readCache struct {
+	capacity int64
+	policy   ReadCachePolicy
+
+	mu      sync.Mutex
+	entries map[readCacheKey]*readCacheEntry
+	// Pieces requested once, and pieces requested more than once since being cached.
+	t1, t2 readCacheList
+	// Pieces recently evicted from t1 and t2.
+	b1, b2 readCacheList
+	// The target size of t1.
+	p int64
+	// Incremented when pieces are invalidated, so that reads that raced with invalidation aren't
+	// cached.
+	generation uint64
+
+	hits   int64
+	misses int64
+}
+
+func newReadCache(capacity int64, policy ReadCachePolicy) *readCache {
+	return &readCache{
+		capacity: capacity,
+		policy:   policy,
+		entries:  make(map[readCacheKey]*readCacheEntry),
+	}
+}
+
+// Returns the cached piece data, or the generation to pass to add after reading the piece.
+func (c *readCache) get(key readCacheKey) (data []byte, generation uint64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[key]
+	if e == nil || e.data == nil {
+		c.misses++
+		return nil, c.generation, false
+	}
+	c.hits++
+	if c.policy == ReadCacheARC {
+		c.move(e, &c.t2)
+	} else {
+		c.move(e, &c.t1)
+	}
+	return e.data, 0, true
+}
+
+// Caches piece data read after a miss. The data must not be modified afterwards.
+func (c *readCache) add(key readCacheKey, data []byte, generation uint64) {
+	size := int64(len(data))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation || size > c.capacity {
+		return
+	}
+	e := c.entries[key]
+	if e != nil && e.data != nil {
+		// Another request read the piece at the same time.
+		return
+	}
+	if c.policy == ReadCacheLRU {
+		for c.t1.bytes+size > c.capacity {
+			c.remove(c.back(&c.t1))
+		}
+		c.insert(key, data, &c.t1)
+		return
+	}
+	switch {
+	case e != nil && e.l == &c.b1:
+		// Evicted from t1 too early: favour recent pieces.
+		c.p += size * max(1, c.b2.bytes/c.b1.bytes)
+		if c.p > c.capacity {
+			c.p = c.capacity
+		}
+		c.remove(e)
+		c.replace(size, false)
+		c.insert(key, data, &c.t2)
+	case e != nil && e.l == &c.b2:
+		// Evicted from t2 too early: favour frequent pieces.
+		c.p -= size * max(1, c.b1.bytes/c.b2.bytes)
+		if c.p < 0 {
+			c.p = 0
+		}
+		c.remove(e)
+		c.replace(size, true)
+		c.insert(key, data, &c.t2)
+	default:
+		for c.t1.bytes+c.b1.bytes+size > c.capacity && c.b1.Len() != 0 {
+			c.remove(c.back(&c.b1))
+		}
+		for c.t1.bytes+size > c.capacity {
+			c.remove(c.back(&c.t1))
+		}
+		for c.t1.bytes+c.t2.bytes+c.b1.bytes+c.b2.bytes+size > 2*c.capacity && c.b2.Len() != 0 {
+			c.remove(c.back(&c.b2))
+		}
+		c.replace(size, false)
+		c.insert(key, data, &c.t1)
+	}
+}
+
+// Evicts pieces from t1 or t2 into their ghost lists until size bytes fit.
+func (c *readCache) replace(size int64, inB2 bool) {
+	for c.t1.bytes+c.t2.bytes+size > c.capacity {
+		if c.t1.Len() != 0 && (c.t1.bytes > c.p || (inB2 && c.t1.bytes == c.p) || c.t2.Len() == 0) {
+			c.demote(c.back(&c.t1), &c.b1)
+		} else {
+			c.demote(c.back(&c.t2), &c.b2)
+		}
+	}
+}
+
+func (c *readCache) back(l *readCacheList) *readCacheEntry {
+	return l.Back().Value.(*readCacheEntry)
+}
+
+func (c *readCache) insert(key readCacheKey, data []byte, l *readCacheList) {
+	e := &readCacheEntry{key: key, data: data, size: int64(len(data))}
+	c.entries[key] = e
+	c.pushFront(e, l)
+}
+
+func (c *readCache) pushFront(e *readCacheEntry, l *readCacheList) {
+	e.l = l
+	e.elem = l.PushFront(e)
+	l.bytes += e.size
+}
+
+func (c *readCache) unlink(e *readCacheEntry) {
+	e.l.Remove(e.elem)
+	e.l.bytes -= e.size
+	e.l = nil
+	e.elem = nil
+}
+
+func (c *readCache) move(e *readCacheEntry, l *readCacheList) {
+	c.unlink(e)
+	c.pushFront(e, l)
+}
+
+// Drops the piece data, remembering the piece in a ghost list.
+func (c *readCache) demote(e *readCacheEntry, ghosts *readCacheList) {
+	e.data = nil
+	c.move(e, ghosts)
+}
+
+func (c *readCache) remove(e *readCacheEntry) {
+	c.unlink(e)
+	delete(c.entries, e.key)
+}
+
+// Drops a piece whose data may have changed.
+func (c *readCache) invalidatePiece(key readCacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if e := c.entries[key]; e != nil {
+		c.remove(e)
+	}
+}
+
+func (c *readCache) removeTorrent(t *Torrent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for key, e := range c.entries {
+		if key.t == t {
+			c.remove(e)
+		}
+	}
+}
+
+type readCacheStats struct {
+	hits   int64
+	misses int64
+	// Bytes of piece data held.
+	bytes int64
+}
+
+func (c *readCache) stats() readCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return readCacheStats{
+		hits:   c.hits,
+		misses: c.misses,
+		bytes:  c.t1.bytes + c.t2.bytes,
+	}
+}
+
+// Reads the requested data through the read cache. On a miss the whole piece is read, so that
+// subsequent requests for the piece are served from memory. The piece must fit in the cache.
+func (t *Torrent) readCachedPeerRequestData(c *readCache, r Request) ([]byte, error) {
+	key := readCacheKey{t, pieceIndex(r.Index)}
+	data, generation, ok := c.get(key)
+	if !ok {
+		p := t.info.Piece(int(r.Index))
+		data = make([]byte, p.Length())
+		n, err := t.readAt(data, p.Offset())
+		if n != len(data) {
+			if err == nil {
+				panic("expected error")
+			}
+			return nil, err
+		}
+		c.add(key, data, generation)
+	}
+	end := r.Begin + r.Length
+	// Limit the capacity so the cached data can't be appended to.
+	return data[r.Begin:end:end], nil
+}
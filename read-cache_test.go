@@ -0,0 +1,142 @@
+package torrent
+
+import (
+	"os"
+	"testing"
+
+	"github.com/bradfitz/iter"
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/internal/testutil"
+	pp "github.com/anacrolix/torrent/peer_protocol"
+)
+
+func readCacheTestPiece(c *readCache, piece pieceIndex, size int) bool {
+	key := readCacheKey{piece: piece}
+	_, generation, ok := c.get(key)
+	if !ok {
+		c.add(key, make([]byte, size), generation)
+	}
+	return ok
+}
+
+func TestReadCacheLRU(t *testing.T) {
+	c := qt.New(t)
+	rc := newReadCache(3, ReadCacheLRU)
+	for i := range iter.N(3) {
+		c.Check(readCacheTestPiece(rc, i, 1), qt.IsFalse)
+	}
+	c.Check(readCacheTestPiece(rc, 0, 1), qt.IsTrue)
+	// Piece 1 is the least recently used.
+	c.Check(readCacheTestPiece(rc, 3, 1), qt.IsFalse)
+	c.Check(readCacheTestPiece(rc, 0, 1), qt.IsTrue)
+	c.Check(readCacheTestPiece(rc, 2, 1), qt.IsTrue)
+	c.Check(readCacheTestPiece(rc, 1, 1), qt.IsFalse)
+	c.Check(rc.stats(), qt.Equals, readCacheStats{hits: 3, misses: 5, bytes: 3})
+}
+
+func TestReadCacheARCScanResistant(t *testing.T) {
+	c := qt.New(t)
+	rc := newReadCache(4, ReadCacheARC)
+	// Pieces 0 and 1 are popular.
+	for range iter.N(2) {
+		readCacheTestPiece(rc, 0, 1)
+		readCacheTestPiece(rc, 1, 1)
+	}
+	// A single pass over many other pieces.
+	for i := range iter.N(20) {
+		c.Check(readCacheTestPiece(rc, 10+i, 1), qt.IsFalse)
+	}
+	c.Check(readCacheTestPiece(rc, 0, 1), qt.IsTrue)
+	c.Check(readCacheTestPiece(rc, 1, 1), qt.IsTrue)
+	c.Check(rc.stats().bytes <= 4, qt.IsTrue)
+}
+
+func TestReadCacheARCAdapts(t *testing.T) {
+	c := qt.New(t)
+	rc := newReadCache(4, ReadCacheARC)
+	for range iter.N(2) {
+		readCacheTestPiece(rc, 0, 1)
+		readCacheTestPiece(rc, 1, 1)
+	}
+	for i := range iter.N(4) {
+		readCacheTestPiece(rc, 2+i, 1)
+	}
+	c.Check(rc.p, qt.Equals, int64(0))
+	// Piece 2 was evicted from t1 and is remembered in b1. Requesting it again grows the target
+	// size of t1, and caches it as a frequently requested piece.
+	c.Check(rc.entries[readCacheKey{piece: 2}].l, qt.Equals, &rc.b1)
+	c.Check(readCacheTestPiece(rc, 2, 1), qt.IsFalse)
+	c.Check(rc.p, qt.Equals, int64(1))
+	c.Check(rc.entries[readCacheKey{piece: 2}].l, qt.Equals, &rc.t2)
+	c.Check(readCacheTestPiece(rc, 2, 1), qt.IsTrue)
+	c.Check(rc.stats().bytes, qt.Equals, int64(4))
+	c.Check(rc.t1.bytes+rc.t2.bytes+rc.b1.bytes+rc.b2.bytes <= 8, qt.IsTrue)
+}
+
+func TestReadCacheInvalidate(t *testing.T) {
+	c := qt.New(t)
+	rc := newReadCache(4, ReadCacheARC)
+	key := readCacheKey{piece: 0}
+	readCacheTestPiece(rc, 0, 1)
+	rc.invalidatePiece(key)
+	_, generation, ok := rc.get(key)
+	c.Assert(ok, qt.IsFalse)
+	// A read that started before the piece was invalidated isn't cached.
+	rc.invalidatePiece(key)
+	rc.add(key, []byte{1}, generation)
+	_, _, ok = rc.get(key)
+	c.Check(ok, qt.IsFalse)
+	// Pieces that don't fit aren't cached.
+	_, generation, _ = rc.get(key)
+	rc.add(key, make([]byte, 5), generation)
+	c.Check(rc.stats().bytes, qt.Equals, int64(0))
+}
+
+func TestReadCacheServesPeerRequests(t *testing.T) {
+	c := qt.New(t)
+	greetingDataDir, greetingMetainfo := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDataDir)
+	cfg := TestingConfig(t)
+	cfg.DataDir = greetingDataDir
+	cfg.ReadCacheCapacity = 1 << 20
+	cl, err := NewClient(cfg)
+	c.Assert(err, qt.IsNil)
+	defer cl.Close()
+	sub := cl.SubscribeEvents(100)
+	defer sub.Close()
+	tt, err := cl.AddTorrent(greetingMetainfo)
+	c.Assert(err, qt.IsNil)
+	for e := range sub.Events() {
+		if _, ok := e.(TorrentCompletedEvent); ok {
+			break
+		}
+	}
+	pc := cl.newConnection(nil, false, nil, "io.Pipe", "")
+	pc.t = tt
+	pieceLength := tt.info.Piece(0).Length()
+	var got []byte
+	// The first request reads the whole piece, and the rest are served from memory.
+	for begin := int64(0); begin < pieceLength; begin++ {
+		b, err := readPeerRequestData(Request{Index: 0, ChunkSpec: ChunkSpec{pp.Integer(begin), 1}}, pc)
+		c.Assert(err, qt.IsNil)
+		got = append(got, b...)
+	}
+	c.Check(got, qt.DeepEquals, []byte(testutil.GreetingFileContents[:pieceLength]))
+	c.Check(cl.readCache.stats(), qt.Equals, readCacheStats{
+		hits:   pieceLength - 1,
+		misses: 1,
+		bytes:  pieceLength,
+	})
+	// Appending to the returned data mustn't modify the cache.
+	b, err := readPeerRequestData(Request{Index: 0, ChunkSpec: ChunkSpec{0, 1}}, pc)
+	c.Assert(err, qt.IsNil)
+	_ = append(b, 'x')
+	b, err = readPeerRequestData(Request{Index: 0, ChunkSpec: ChunkSpec{1, 1}}, pc)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, []byte(testutil.GreetingFileContents[1:2]))
+	cl.lock()
+	cl.dropTorrent(tt.InfoHash())
+	cl.unlock()
+	c.Check(cl.readCache.stats().bytes, qt.Equals, int64(0))
+}
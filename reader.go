@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/anacrolix/log"
 	"github.com/anacrolix/missinggo/v2"
@@ -26,6 +27,14 @@ type Reader interface {
 	SetResponsive()
 }
 
+// Implemented by the Readers returned by Torrent.NewReader and File.NewReader.
+type BitrateSetter interface {
+	// Sets the rate in bytes per second that data is consumed from the Reader, such as for media
+	// playback. Pieces in the readahead window are given deadlines for when reading at that rate
+	// from the last position change would reach them. Zero disables deadlines.
+	SetBitrate(bytesPerSecond int64)
+}
+
 // Piece range by piece index, [begin, end).
 type pieceRange struct {
 	begin, end pieceIndex
@@ -43,13 +52,23 @@ type reader struct {
 	mu        sync.Locker
 	pos       int64
 	readahead int64
+	// When pos last changed.
+	posTime time.Time
+	// The bitrate, and pos and posTime as of the last call to posChanged, from which piece
+	// deadlines are determined. Only accessed with the Client lock held.
+	bitrate      int64
+	deadlinePos  int64
+	deadlineTime time.Time
 	// The cached piece range this reader wants downloaded. The zero value corresponds to nothing.
 	// We cache this so that changes can be detected, and bubbled up to the Torrent only as
 	// required.
 	pieces pieceRange
 }
 
-var _ io.ReadCloser = (*reader)(nil)
+var (
+	_ io.ReadCloser = (*reader)(nil)
+	_ BitrateSetter = (*reader)(nil)
+)
 
 func (r *reader) SetResponsive() {
 	r.responsive = true
@@ -71,6 +90,18 @@ func (r *reader) SetReadahead(readahead int64) {
 	r.posChanged()
 }
 
+func (r *reader) SetBitrate(bytesPerSecond int64) {
+	r.mu.Lock()
+	r.posTime = time.Now()
+	r.mu.Unlock()
+	r.t.cl.lock()
+	defer r.t.cl.unlock()
+	r.bitrate = bytesPerSecond
+	r.posChanged()
+	r.t.updateRequesting()
+	r.t.cl.tickleRequester()
+}
+
 // How many bytes are available to read. Max is the most we could require.
 func (r *reader) available(off, max int64) (ret int64) {
 	off += r.offset
@@ -153,6 +184,7 @@ func (r *reader) ReadContext(ctx context.Context, b []byte) (n int, err error) {
 
 	r.mu.Lock()
 	r.pos += int64(n)
+	r.posTime = time.Now()
 	r.posChanged()
 	r.mu.Unlock()
 	if r.pos >= r.length {
@@ -247,7 +279,10 @@ func (r *reader) Close() error {
 	return nil
 }
 
+// Must be called with the Client lock held.
 func (r *reader) posChanged() {
+	r.deadlinePos = r.pos
+	r.deadlineTime = r.posTime
 	to := r.piecesUncached()
 	from := r.pieces
 	if to == from {
@@ -275,6 +310,7 @@ func (r *reader) Seek(off int64, whence int) (ret int64, err error) {
 		err = errors.New("bad whence")
 	}
 	ret = r.pos
+	r.posTime = time.Now()
 
 	r.posChanged()
 	return
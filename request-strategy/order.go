@@ -1,8 +1,11 @@
 package request_strategy
 
 import (
+	"container/heap"
 	"fmt"
+	"math"
 	"sort"
+	"time"
 
 	"github.com/anacrolix/multiless"
 
@@ -18,31 +21,114 @@ type (
 	ChunkSpec = types.ChunkSpec
 )
 
-type ClientPieceOrder struct{}
-
 type filterTorrent struct {
 	*Torrent
 	unverifiedBytes int64
 	// Potentially shared with other torrents.
 	storageLeft *int64
+	// The torrent's pieces in request order, and the index of the next to be merged with other
+	// torrents' pieces.
+	pieces []filterPiece
+	next   int
+	// Storage capacity taken by the torrent's pieces, and how much it can take before it has to
+	// wait for other torrents to take their shares.
+	storageUsed  int64
+	storageShare int64
+	// How many unverified bytes the torrent can have before it has to wait for other torrents to
+	// take their shares of MaxUnverifiedBytes.
+	unverifiedShare int64
+}
+
+// A heap of torrents ordered by their next pieces, for merging the pieces of all torrents into one
+// request order. Pieces with deadlines and higher priorities come first, and then partial and
+// rarest pieces, regardless of torrent.
+type torrentQueue struct {
+	ts  []*filterTorrent
+	key pieceOrderKey
+}
+
+func (q *torrentQueue) Len() int { return len(q.ts) }
+
+func (q *torrentQueue) Less(i, j int) bool {
+	ti, tj := q.ts[i], q.ts[j]
+	l := &ti.pieces[ti.next]
+	r := &tj.pieces[tj.next]
+	return byUrgency(l, r).Bool(
+		r.Partial, l.Partial,
+	).Int64(
+		q.key(ti.Torrent, l.index, l.Piece), q.key(tj.Torrent, r.index, r.Piece),
+	).Int(
+		l.index, r.index,
+	).Uintptr(
+		ti.StableId, tj.StableId,
+	).Less()
+}
+
+func (q *torrentQueue) Swap(i, j int) { q.ts[i], q.ts[j] = q.ts[j], q.ts[i] }
+
+func (q *torrentQueue) Push(x interface{}) { q.ts = append(q.ts, x.(*filterTorrent)) }
+
+func (q *torrentQueue) Pop() interface{} {
+	old := q.ts
+	t := old[len(old)-1]
+	q.ts = old[:len(old)-1]
+	return t
 }
 
-func sortFilterPieces(pieces []filterPiece) {
-	sort.Slice(pieces, func(_i, _j int) bool {
+// Pieces with deadlines closer than this are requested from more than one peer.
+const nearDeadline = 2 * time.Second
+
+// The number of peers each chunk is requested from in endgame.
+const endgameRequestsPerChunk = 3
+
+// Orders pieces that are otherwise equal by deadline, priority and partial completion. Lower
+// values are requested first.
+type pieceOrderKey func(t *Torrent, index pieceIndex, p *Piece) int64
+
+// Requests the rarest pieces first.
+func rarestFirst(_ *Torrent, _ pieceIndex, p *Piece) int64 {
+	return p.Availability
+}
+
+// Orders pieces with deadlines first, earliest first, and then by priority.
+func byUrgency(i, j *filterPiece) multiless.Computation {
+	return multiless.New().Bool(
+		i.Deadline.IsZero(), j.Deadline.IsZero(),
+	).Int64(
+		deadlineKey(i.Deadline), deadlineKey(j.Deadline),
+	).Int(
+		int(j.Priority), int(i.Priority),
+	)
+}
+
+// Sorts the pieces of a torrent into request order. Pieces are often given in order already, such
+// as by a client that keeps them ordered as they change, and then aren't sorted again.
+func sortFilterPieces(pieces []filterPiece, key pieceOrderKey) {
+	less := func(_i, _j int) bool {
 		i := &pieces[_i]
 		j := &pieces[_j]
-		return multiless.New().Int(
-			int(j.Priority), int(i.Priority),
+		return byUrgency(i, j).Int(
+			i.sequentialWindow(), j.sequentialWindow(),
 		).Bool(
 			j.Partial, i.Partial,
 		).Int64(
-			i.Availability, j.Availability,
+			key(i.t.Torrent, i.index, i.Piece), key(j.t.Torrent, j.index, j.Piece),
 		).Int(
 			i.index, j.index,
 		).Uintptr(
 			i.t.StableId, j.t.StableId,
 		).MustLess()
-	})
+	}
+	if !sort.SliceIsSorted(pieces, less) {
+		sort.Slice(pieces, less)
+	}
+}
+
+func deadlineKey(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
 }
 
 type requestsPeer struct {
@@ -74,96 +160,334 @@ func (me *peersForPieceRequests) addNextRequest(r Request) {
 }
 
 type requestablePiece struct {
-	index             pieceIndex
-	t                 *Torrent
-	alwaysReallocate  bool
-	NumPendingChunks  int
-	IterPendingChunks ChunksIter
+	index            pieceIndex
+	t                *Torrent
+	alwaysReallocate bool
+	// The number of peers to request each chunk from. Above 1, chunks are also requested from the
+	// fastest peers that don't already have the request, to reduce the chance of missing a
+	// deadline, or so slow peers don't hold up the end of a download.
+	requestsPerChunk int
+	// Only duplicate requests to peers with a known download rate.
+	duplicateKnownRateOnly bool
+	NumPendingChunks       int
+	IterPendingChunks      ChunksIter
 }
 
 type filterPiece struct {
 	t     *filterTorrent
 	index pieceIndex
 	*Piece
+	// The piece has been considered, and has taken its storage capacity if any.
+	done bool
+}
+
+func (p *filterPiece) requestable() bool {
+	return p.Request && p.NumPendingChunks != 0
 }
 
-func getRequestablePieces(input Input) (ret []requestablePiece) {
+// Whether two pieces are given the same urgency by byUrgency, so that torrents share limits by
+// weight amongst them.
+func sameUrgency(i, j *filterPiece) bool {
+	if i.Deadline.IsZero() != j.Deadline.IsZero() {
+		return false
+	}
+	return !i.Deadline.IsZero() || i.Priority == j.Priority
+}
+
+// The number of pieces in a sequential torrent that are ordered amongst themselves by the usual
+// criteria, such as availability. This keeps rarest-first behaviour in the small, so sequential
+// downloaders still help out the swarm.
+const sequentialWindowLen = 8
+
+// Returns the window that orders the piece in a sequential torrent, or 0 for all other pieces.
+func (p *filterPiece) sequentialWindow() int {
+	if !p.t.Sequential {
+		return 0
+	}
+	return p.index / sequentialWindowLen
+}
+
+// Each torrent's pieces are sorted separately, and then merged, so that pieces are rarest first
+// across torrents, but sequential torrents keep their order. Storage capacity and
+// MaxUnverifiedBytes are shared by torrents in proportion to their weights, amongst pieces of the
+// same urgency, so that a torrent with many rare pieces can't take all of the limits. What a torrent
+// doesn't use of its share goes to the others.
+func getRequestablePieces(input Input, key pieceOrderKey) (ret []requestablePiece) {
+	now := input.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	budget := input.Budget
+	if budget == nil {
+		budget = new(Budget)
+	}
+	if budget.storageLeft == nil {
+		budget.storageLeft = make(map[*func() *int64]*int64)
+	}
+	storageLeft := budget.storageLeft
+	queue := torrentQueue{
+		ts:  make([]*filterTorrent, 0, len(input.Torrents)),
+		key: key,
+	}
 	maxPieces := 0
-	for i := range input.Torrents {
-		maxPieces += len(input.Torrents[i].Pieces)
-	}
-	pieces := make([]filterPiece, 0, maxPieces)
-	ret = make([]requestablePiece, 0, maxPieces)
-	// Storage capacity left for this run, keyed by the storage capacity pointer on the storage
-	// TorrentImpl.
-	storageLeft := make(map[*func() *int64]*int64)
 	for _t := range input.Torrents {
 		// TODO: We could do metainfo requests here.
 		t := &filterTorrent{
 			Torrent:         &input.Torrents[_t],
 			unverifiedBytes: 0,
 		}
-		key := t.Capacity
-		if key != nil {
-			if _, ok := storageLeft[key]; !ok {
-				storageLeft[key] = (*key)()
+		capKey := t.Capacity
+		if capKey != nil {
+			if _, ok := storageLeft[capKey]; !ok {
+				storageLeft[capKey] = (*capKey)()
 			}
-			t.storageLeft = storageLeft[key]
+			t.storageLeft = storageLeft[capKey]
+		}
+		if len(t.Pieces) == 0 {
+			continue
 		}
+		t.pieces = make([]filterPiece, 0, len(t.Pieces))
 		for i := range t.Pieces {
-			pieces = append(pieces, filterPiece{
+			t.pieces = append(t.pieces, filterPiece{
 				t:     t,
-				index: i,
+				index: t.pieceIndex(i),
 				Piece: &t.Pieces[i],
 			})
 		}
+		sortFilterPieces(t.pieces, key)
+		queue.ts = append(queue.ts, t)
+		maxPieces += len(t.pieces)
 	}
-	sortFilterPieces(pieces)
-	var allTorrentsUnverifiedBytes int64
-	for _, piece := range pieces {
-		if left := piece.t.storageLeft; left != nil {
-			if *left < int64(piece.Length) {
-				continue
+	pieces := make([]*filterPiece, 0, maxPieces)
+	heap.Init(&queue)
+	for queue.Len() != 0 {
+		t := queue.ts[0]
+		pieces = append(pieces, &t.pieces[t.next])
+		t.next++
+		if t.next == len(t.pieces) {
+			heap.Pop(&queue)
+		} else {
+			heap.Fix(&queue, 0)
+		}
+	}
+	ret = make([]requestablePiece, 0, len(pieces))
+	// Considers the piece for requesting. If withinShare, the piece isn't taken if that would put
+	// its torrent over its share of a limit, and it's left to be considered again.
+	consider := func(piece *filterPiece, withinShare bool) {
+		t := piece.t
+		if left := t.storageLeft; left != nil {
+			if *left < piece.Length {
+				piece.done = true
+				return
+			}
+			if withinShare && t.storageUsed+piece.Length > t.storageShare {
+				return
 			}
-			*left -= int64(piece.Length)
 		}
-		if !piece.Request || piece.NumPendingChunks == 0 {
+		requestable := piece.requestable()
+		if requestable && withinShare && t.unverifiedBytes+piece.Length > t.unverifiedShare {
+			return
+		}
+		piece.done = true
+		if left := t.storageLeft; left != nil {
+			*left -= piece.Length
+			t.storageUsed += piece.Length
+		}
+		if !requestable {
 			// TODO: Clarify exactly what is verified. Stuff that's being hashed should be
 			// considered unverified and hold up further requests.
-			continue
+			return
 		}
-		if piece.t.MaxUnverifiedBytes != 0 && piece.t.unverifiedBytes+piece.Length > piece.t.MaxUnverifiedBytes {
-			continue
+		if t.MaxUnverifiedBytes != 0 && t.unverifiedBytes+piece.Length > t.MaxUnverifiedBytes {
+			return
 		}
-		if input.MaxUnverifiedBytes != 0 && allTorrentsUnverifiedBytes+piece.Length > input.MaxUnverifiedBytes {
-			continue
+		if input.MaxUnverifiedBytes != 0 && budget.unverifiedBytes+piece.Length > input.MaxUnverifiedBytes {
+			return
 		}
-		piece.t.unverifiedBytes += piece.Length
-		allTorrentsUnverifiedBytes += piece.Length
-		ret = append(ret, requestablePiece{
+		t.unverifiedBytes += piece.Length
+		budget.unverifiedBytes += piece.Length
+		urgent := !piece.Deadline.IsZero() && piece.Deadline.Sub(now) < nearDeadline
+		rp := requestablePiece{
 			index:             piece.index,
-			t:                 piece.t.Torrent,
+			t:                 t.Torrent,
 			NumPendingChunks:  piece.NumPendingChunks,
 			IterPendingChunks: piece.iterPendingChunksWrapper,
-			alwaysReallocate:  piece.Priority >= types.PiecePriorityNext,
-		})
+			alwaysReallocate:  piece.Priority >= types.PiecePriorityNext || urgent,
+			requestsPerChunk:  1,
+		}
+		if urgent {
+			rp.requestsPerChunk = 2
+			rp.duplicateKnownRateOnly = true
+		}
+		ret = append(ret, rp)
+	}
+	for len(pieces) != 0 {
+		n := 1
+		for n < len(pieces) && sameUrgency(pieces[0], pieces[n]) {
+			n++
+		}
+		group := pieces[:n]
+		pieces = pieces[n:]
+		setShares(group, input.MaxUnverifiedBytes-budget.unverifiedBytes, input.MaxUnverifiedBytes != 0)
+		for _, p := range group {
+			consider(p, true)
+		}
+		// Pieces are considered again in order, for whatever the torrents that have taken their
+		// shares left behind.
+		for _, p := range group {
+			if !p.done {
+				consider(p, false)
+			}
+		}
 	}
 	return
 }
 
+// Sets the shares of storage capacity and unverified bytes of the torrents with pieces in group.
+func setShares(group []*filterPiece, unverifiedLeft int64, limitUnverified bool) {
+	type demand struct {
+		storage    int64
+		unverified int64
+	}
+	demands := make(map[*filterTorrent]*demand)
+	var ts []*filterTorrent
+	for _, p := range group {
+		d, ok := demands[p.t]
+		if !ok {
+			d = new(demand)
+			demands[p.t] = d
+			ts = append(ts, p.t)
+		}
+		d.storage += p.Length
+		if p.requestable() {
+			d.unverified += p.Length
+		}
+	}
+	// Torrents with the same storage share its capacity.
+	byStorage := make(map[*int64][]*filterTorrent)
+	var storages []*int64
+	for _, t := range ts {
+		if t.storageLeft == nil {
+			continue
+		}
+		if _, ok := byStorage[t.storageLeft]; !ok {
+			storages = append(storages, t.storageLeft)
+		}
+		byStorage[t.storageLeft] = append(byStorage[t.storageLeft], t)
+	}
+	for _, left := range storages {
+		sharers := byStorage[left]
+		shares := fairShares(*left, sharers, func(t *filterTorrent) int64 { return demands[t].storage })
+		for i, t := range sharers {
+			t.storageShare = t.storageUsed + shares[i]
+		}
+	}
+	if !limitUnverified {
+		for _, t := range ts {
+			t.unverifiedShare = math.MaxInt64
+		}
+		return
+	}
+	shares := fairShares(unverifiedLeft, ts, func(t *filterTorrent) int64 {
+		d := demands[t].unverified
+		if t.MaxUnverifiedBytes != 0 && d > t.MaxUnverifiedBytes-t.unverifiedBytes {
+			d = t.MaxUnverifiedBytes - t.unverifiedBytes
+		}
+		return d
+	})
+	for i, t := range ts {
+		t.unverifiedShare = t.unverifiedBytes + shares[i]
+	}
+}
+
+// Divides limit amongst torrents in proportion to their weights, without giving any more than they
+// demand, so that what one torrent can't use goes to the others.
+func fairShares(limit int64, ts []*filterTorrent, demand func(*filterTorrent) int64) []int64 {
+	shares := make([]int64, len(ts))
+	wanting := make([]int, 0, len(ts))
+	for i, t := range ts {
+		if demand(t) > 0 {
+			wanting = append(wanting, i)
+		}
+	}
+	for limit > 0 && len(wanting) != 0 {
+		var totalWeight float64
+		for _, i := range wanting {
+			totalWeight += ts[i].weight()
+		}
+		left := limit
+		stillWanting := wanting[:0:0]
+		for _, i := range wanting {
+			fair := int64(float64(limit) * ts[i].weight() / totalWeight)
+			want := demand(ts[i]) - shares[i]
+			if want <= fair {
+				shares[i] += want
+				left -= want
+			} else {
+				shares[i] += fair
+				left -= fair
+				stillWanting = append(stillWanting, i)
+			}
+		}
+		if len(stillWanting) == len(wanting) {
+			// Everyone got their fair share, and what's left is rounding.
+			break
+		}
+		limit = left
+		wanting = stillWanting
+	}
+	return shares
+}
+
 type Input struct {
 	Torrents           []Torrent
 	MaxUnverifiedBytes int64
+	// The time that piece deadlines are compared against. Defaults to time.Now().
+	Now time.Time
+	// Request the remaining chunks of torrents that are in endgame from several peers.
+	Endgame bool
+	// Shares storage capacity and MaxUnverifiedBytes with other runs using the same Budget. If
+	// nil, the run has them to itself.
+	Budget *Budget
+	// The highest weight of the torrents downloading in other runs, so that peers' request limits
+	// are scaled by weight across runs. See Torrent.Weight.
+	MaxWeight int
+}
+
+// The storage capacity and MaxUnverifiedBytes used by runs over different torrents, such as when
+// some torrents have their own Strategy. The zero value is ready to use, and should be used for a
+// single round of runs.
+type Budget struct {
+	unverifiedBytes int64
+	// Storage capacity left, keyed by the storage capacity pointer on the storage TorrentImpl.
+	storageLeft map[*func() *int64]*int64
 }
 
-// TODO: We could do metainfo requests here.
+// Runs the default Strategy. TODO: We could do metainfo requests here.
 func Run(input Input) map[PeerId]PeerNextRequestState {
-	requestPieces := getRequestablePieces(input)
+	return run(input, rarestFirst)
+}
+
+func run(input Input, key pieceOrderKey) map[PeerId]PeerNextRequestState {
+	requestPieces := getRequestablePieces(input, key)
 	torrents := input.Torrents
+	maxWeight := float64(input.MaxWeight)
+	downloading := make(map[uintptr]struct{}, len(torrents))
+	for _, p := range requestPieces {
+		downloading[p.t.StableId] = struct{}{}
+	}
+	for i := range torrents {
+		t := &torrents[i]
+		if _, ok := downloading[t.StableId]; ok && t.weight() > maxWeight {
+			maxWeight = t.weight()
+		}
+	}
 	allPeers := make(map[uintptr][]*requestsPeer, len(torrents))
-	for _, t := range torrents {
+	for i := range torrents {
+		t := &torrents[i]
 		peers := make([]*requestsPeer, 0, len(t.Peers))
 		for _, p := range t.Peers {
+			p.MaxRequests = weightedMaxRequests(p.MaxRequests, t.weight(), maxWeight)
 			peers = append(peers, &requestsPeer{
 				Peer: p,
 				nextState: PeerNextRequestState{
@@ -180,6 +504,17 @@ func Run(input Input) map[PeerId]PeerNextRequestState {
 			}
 		}
 	}
+	for _, t := range torrents {
+		if input.Endgame && inEndgame(t, allPeers[t.StableId]) {
+			for i := range requestPieces {
+				rp := &requestPieces[i]
+				if rp.t.StableId == t.StableId && rp.requestsPerChunk < endgameRequestsPerChunk {
+					rp.requestsPerChunk = endgameRequestsPerChunk
+					rp.duplicateKnownRateOnly = false
+				}
+			}
+		}
+	}
 	for _, piece := range requestPieces {
 		allocatePendingChunks(piece, allPeers[piece.t.StableId])
 	}
@@ -198,6 +533,70 @@ func Run(input Input) map[PeerId]PeerNextRequestState {
 	return ret
 }
 
+// Scales a peer's request limit by its torrent's weight relative to the highest weight of the
+// torrents downloading. Torrents then share the bandwidth they compete for roughly in proportion to
+// their weights, even without limits on the pieces requested. Peers keep at least one request, so
+// no torrent is starved.
+func weightedMaxRequests(maxRequests int, weight, maxWeight float64) int {
+	if maxRequests <= 1 || weight >= maxWeight {
+		return maxRequests
+	}
+	n := int(float64(maxRequests) * weight / maxWeight)
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// A torrent is in endgame when all its remaining chunks are already requested, and they fit in the
+// request capacity of the peers that can provide them, so requests would otherwise sit waiting on
+// whichever peers got them, however slow. Requiring the chunks to be requested first keeps small
+// torrents from starting out in endgame.
+func inEndgame(t Torrent, peers []*requestsPeer) bool {
+	pendingChunks := 0
+	for _, p := range t.Pieces {
+		if p.Request {
+			pendingChunks += p.NumPendingChunks
+		}
+	}
+	if pendingChunks == 0 {
+		return false
+	}
+	capacity := 0
+	for _, p := range peers {
+		if p.requestablePiecesRemaining != 0 {
+			capacity += p.MaxRequests
+		}
+	}
+	if pendingChunks >= capacity {
+		return false
+	}
+	for i := range t.Pieces {
+		p := &t.Pieces[i]
+		if !p.Request || p.NumPendingChunks == 0 {
+			continue
+		}
+		index := t.pieceIndex(i)
+		allRequested := true
+		p.IterPendingChunks(func(cs ChunkSpec) {
+			if !allRequested {
+				return
+			}
+			r := Request{Index: pp.Integer(index), ChunkSpec: cs}
+			for _, peer := range peers {
+				if peer.HasExistingRequest != nil && peer.HasExistingRequest(r) {
+					return
+				}
+			}
+			allRequested = false
+		})
+		if !allRequested {
+			return false
+		}
+	}
+	return true
+}
+
 // Checks that a sorted peersForPiece slice makes sense.
 func ensureValidSortedPeersForPieceRequests(peers []*peersForPieceRequests, sortLess func(_, _ int) bool) {
 	if !sort.SliceIsSorted(peers, sortLess) {
@@ -213,12 +612,24 @@ func ensureValidSortedPeersForPieceRequests(peers []*peersForPieceRequests, sort
 }
 
 func allocatePendingChunks(p requestablePiece, peers []*requestsPeer) {
+	if !anyCanFitRequest(peers) {
+		// Peers only keep or get requests they have room for, so there's nothing to do. This is
+		// common once the torrent's peers are full, and there are many more pieces.
+		for _, peer := range peers {
+			if peer.canRequestPiece(p.index) {
+				peer.requestablePiecesRemaining--
+			}
+		}
+		return
+	}
+	peersForPieceStorage := make([]peersForPieceRequests, len(peers))
 	peersForPiece := make([]*peersForPieceRequests, 0, len(peers))
-	for _, peer := range peers {
-		peersForPiece = append(peersForPiece, &peersForPieceRequests{
+	for i, peer := range peers {
+		peersForPieceStorage[i] = peersForPieceRequests{
 			requestsInPiece: 0,
 			requestsPeer:    peer,
-		})
+		}
+		peersForPiece = append(peersForPiece, &peersForPieceStorage[i])
 	}
 	defer func() {
 		for _, peer := range peersForPiece {
@@ -238,7 +649,8 @@ func allocatePendingChunks(p requestablePiece, peers []*requestsPeer) {
 				}
 				return ml
 			}()
-			ml := multiless.New()
+			ml := multiless.New().Bool(
+				peersForPiece[i].Snubbed, peersForPiece[j].Snubbed)
 			// We always "reallocate", that is force even striping amongst peers that are either on
 			// the last piece they can contribute too, or for pieces marked for this behaviour.
 			// Striping prevents starving peers of requests, and will always re-balance to the
@@ -278,7 +690,7 @@ func allocatePendingChunks(p requestablePiece, peers []*requestsPeer) {
 	// with "next" request state before another request strategy run occurs.
 	preallocated := make(map[ChunkSpec][]*peersForPieceRequests, p.NumPendingChunks)
 	p.IterPendingChunks(func(spec ChunkSpec) {
-		req := Request{pp.Integer(p.index), spec}
+		req := Request{Index: pp.Integer(p.index), ChunkSpec: spec}
 		for _, peer := range peersForPiece {
 			if h := peer.HasExistingRequest; h == nil || !h(req) {
 				continue
@@ -298,7 +710,7 @@ func allocatePendingChunks(p requestablePiece, peers []*requestsPeer) {
 		if _, ok := preallocated[chunk]; ok {
 			return
 		}
-		req := Request{pp.Integer(p.index), chunk}
+		req := Request{Index: pp.Integer(p.index), ChunkSpec: chunk}
 		defer func() { pendingChunksRemaining-- }()
 		sortPeersForPiece(nil)
 		for _, peer := range peersForPiece {
@@ -319,10 +731,15 @@ func allocatePendingChunks(p requestablePiece, peers []*requestsPeer) {
 			break
 		}
 	})
-chunk:
-	for chunk, prePeers := range preallocated {
+	// Preallocated chunks are reallocated in the piece's chunk order, so that the result doesn't
+	// depend on map iteration order.
+	p.IterPendingChunks(func(chunk ChunkSpec) {
+		prePeers, ok := preallocated[chunk]
+		if !ok {
+			return
+		}
 		pendingChunksRemaining--
-		req := Request{pp.Integer(p.index), chunk}
+		req := Request{Index: pp.Integer(p.index), ChunkSpec: chunk}
 		for _, pp := range prePeers {
 			pp.requestsInPiece--
 		}
@@ -345,10 +762,58 @@ chunk:
 				}
 			}
 			peer.addNextRequest(req)
-			continue chunk
+			return
 		}
-	}
+	})
 	if pendingChunksRemaining != 0 {
 		panic(pendingChunksRemaining)
 	}
+	if p.requestsPerChunk > 1 {
+		addDuplicateRequests(p, peersForPiece)
+	}
+}
+
+func anyCanFitRequest(peers []*requestsPeer) bool {
+	for _, peer := range peers {
+		if peer.canFitRequest() {
+			return true
+		}
+	}
+	return false
+}
+
+// Requests each pending chunk of the piece from the fastest peers that aren't already going to
+// request it, until it's requested by p.requestsPerChunk peers.
+func addDuplicateRequests(p requestablePiece, peers []*peersForPieceRequests) {
+	byRate := append([]*peersForPieceRequests(nil), peers...)
+	sort.SliceStable(byRate, func(i, j int) bool {
+		return byRate[i].DownloadRate > byRate[j].DownloadRate
+	})
+	p.IterPendingChunks(func(chunk ChunkSpec) {
+		req := Request{Index: pp.Integer(p.index), ChunkSpec: chunk}
+		requests := 0
+		for _, peer := range peers {
+			if _, ok := peer.nextState.Requests[req]; ok {
+				requests++
+			}
+		}
+		for _, peer := range byRate {
+			if requests >= p.requestsPerChunk {
+				return
+			}
+			// Peers without a known download rate may well be slower than the peer that has the
+			// chunk already.
+			if p.duplicateKnownRateOnly && peer.DownloadRate <= 0 {
+				return
+			}
+			if _, ok := peer.nextState.Requests[req]; ok {
+				continue
+			}
+			if !peer.canFitRequest() || !peer.canRequestPiece(p.index) {
+				continue
+			}
+			peer.addNextRequest(req)
+			requests++
+		}
+	})
 }
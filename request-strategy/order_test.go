@@ -3,11 +3,13 @@ package request_strategy
 import (
 	"math"
 	"testing"
+	"time"
 
 	"github.com/bradfitz/iter"
 	qt "github.com/frankban/quicktest"
 
 	pp "github.com/anacrolix/torrent/peer_protocol"
+	"github.com/anacrolix/torrent/types"
 )
 
 func r(i pieceIndex, begin int) Request {
@@ -295,3 +297,383 @@ func TestDuplicatePreallocations(t *testing.T) {
 	c := qt.New(t)
 	c.Assert(2, qt.Equals, len(results[intPeerId(1)].Requests)+len(results[intPeerId(2)].Requests))
 }
+
+func TestDeadlinePiecesFirst(t *testing.T) {
+	c := qt.New(t)
+	now := time.Unix(1000, 0)
+	peer := Peer{
+		HasPiece: func(i pieceIndex) bool {
+			return true
+		},
+		MaxRequests: 1,
+		Id:          intPeerId(1),
+	}
+	results := Run(Input{
+		Now: now,
+		Torrents: []Torrent{{
+			Pieces: []Piece{{
+				Request:           true,
+				Priority:          types.PiecePriorityNow,
+				NumPendingChunks:  1,
+				IterPendingChunks: chunkIterRange(1),
+			}, {
+				Request:           true,
+				Priority:          types.PiecePriorityNormal,
+				NumPendingChunks:  1,
+				IterPendingChunks: chunkIterRange(1),
+				Deadline:          now.Add(time.Minute),
+			}, {
+				Request:           true,
+				Priority:          types.PiecePriorityNormal,
+				NumPendingChunks:  1,
+				IterPendingChunks: chunkIterRange(1),
+				Deadline:          now.Add(time.Second),
+			}},
+			Peers: []Peer{peer},
+		}},
+	})
+	c.Check(results[peer.Id].Requests, qt.DeepEquals, requestSetFromSlice(r(2, 0)))
+}
+
+func TestNearDeadlineDuplicateRequests(t *testing.T) {
+	c := qt.New(t)
+	now := time.Unix(1000, 0)
+	peer := func(id int, downloadRate float64) Peer {
+		return Peer{
+			HasPiece: func(i pieceIndex) bool {
+				return true
+			},
+			MaxRequests:  math.MaxInt16,
+			Id:           intPeerId(id),
+			DownloadRate: downloadRate,
+		}
+	}
+	run := func(deadline time.Time) map[PeerId]PeerNextRequestState {
+		return Run(Input{
+			Now: now,
+			Torrents: []Torrent{{
+				Pieces: []Piece{{
+					Request:           true,
+					NumPendingChunks:  2,
+					IterPendingChunks: chunkIterRange(2),
+					Deadline:          deadline,
+				}},
+				Peers: []Peer{peer(1, 3), peer(2, 2), peer(3, 0)},
+			}},
+		})
+	}
+	results := run(now.Add(time.Second))
+	c.Check(results[intPeerId(1)].Requests, qt.DeepEquals, requestSetFromSlice(r(0, 0), r(0, 1)))
+	c.Check(results[intPeerId(2)].Requests, qt.DeepEquals, requestSetFromSlice(r(0, 0), r(0, 1)))
+	c.Check(results[intPeerId(3)].Requests, qt.HasLen, 0)
+	// Deadlines that aren't near don't warrant duplicates.
+	results = run(now.Add(time.Minute))
+	c.Check(
+		len(results[intPeerId(1)].Requests)+len(results[intPeerId(2)].Requests)+len(results[intPeerId(3)].Requests),
+		qt.Equals, 2)
+}
+
+func TestSequentialPieceOrder(t *testing.T) {
+	c := qt.New(t)
+	order := func(sequential bool) (ret []pieceIndex) {
+		var pieces []Piece
+		for i := range iter.N(20) {
+			pieces = append(pieces, Piece{
+				Request: true,
+				// Later pieces are rarer.
+				Availability:      int64(20 - i),
+				NumPendingChunks:  1,
+				IterPendingChunks: chunkIterRange(1),
+			})
+		}
+		for _, p := range getRequestablePieces(Input{Torrents: []Torrent{{
+			Pieces:     pieces,
+			Sequential: sequential,
+		}}}, rarestFirst) {
+			ret = append(ret, p.index)
+		}
+		return
+	}
+	c.Check(order(false), qt.DeepEquals, []pieceIndex{
+		19, 18, 17, 16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0})
+	// Rarest first within each window.
+	c.Check(order(true), qt.DeepEquals, []pieceIndex{
+		7, 6, 5, 4, 3, 2, 1, 0, 15, 14, 13, 12, 11, 10, 9, 8, 19, 18, 17, 16})
+}
+
+func TestEndgame(t *testing.T) {
+	c := qt.New(t)
+	peer := func(id int, maxRequests int) Peer {
+		return Peer{
+			HasPiece: func(i pieceIndex) bool {
+				return true
+			},
+			MaxRequests:  maxRequests,
+			Id:           intPeerId(id),
+			DownloadRate: float64(id),
+		}
+	}
+	// The first peer has requests for the chunks from earlier runs if requested is set.
+	run := func(endgame bool, maxRequests int, requested bool) (numRequests int) {
+		first := peer(1, maxRequests)
+		if requested {
+			first.HasExistingRequest = func(r Request) bool {
+				return true
+			}
+		}
+		results := Run(Input{
+			Endgame: endgame,
+			Torrents: []Torrent{{
+				Pieces: []Piece{{
+					Request:           true,
+					NumPendingChunks:  2,
+					IterPendingChunks: chunkIterRange(2),
+				}},
+				Peers: []Peer{first, peer(2, maxRequests), peer(3, maxRequests), peer(4, maxRequests)},
+			}},
+		})
+		for _, s := range results {
+			numRequests += len(s.Requests)
+		}
+		return
+	}
+	c.Check(run(false, 2, true), qt.Equals, 2)
+	c.Check(run(true, 2, true), qt.Equals, 2*endgameRequestsPerChunk)
+	// The chunks haven't all been requested yet, such as when a small torrent is just starting.
+	c.Check(run(true, 2, false), qt.Equals, 2)
+	// The chunks don't fit in the capacity of the other peers, so it's not endgame.
+	c.Check(run(true, 0, true), qt.Equals, 0)
+}
+
+func TestSnubbedPeerRequestsReassigned(t *testing.T) {
+	c := qt.New(t)
+	snubbed := Peer{
+		HasPiece: func(i pieceIndex) bool {
+			return true
+		},
+		MaxRequests:  1,
+		DownloadRate: 10,
+		Snubbed:      true,
+		Id:           intPeerId(1),
+	}
+	other := Peer{
+		HasPiece: func(i pieceIndex) bool {
+			return true
+		},
+		MaxRequests: math.MaxInt16,
+		Id:          intPeerId(2),
+	}
+	results := Run(Input{Torrents: []Torrent{{
+		Pieces: []Piece{{
+			Request:           true,
+			NumPendingChunks:  3,
+			IterPendingChunks: chunkIterRange(3),
+		}},
+		Peers: []Peer{snubbed, other},
+	}}})
+	c.Check(results[snubbed.Id].Requests, qt.HasLen, 0)
+	c.Check(results[other.Id].Requests, qt.HasLen, 3)
+}
+
+// Returns a torrent with pieces of length 1.
+func weightTestTorrent(stableId uintptr, weight, numPieces int, availability int64, priority piecePriority) Torrent {
+	t := Torrent{
+		StableId: stableId,
+		Weight:   weight,
+	}
+	for range iter.N(numPieces) {
+		t.Pieces = append(t.Pieces, Piece{
+			Request:           true,
+			Priority:          priority,
+			Availability:      availability,
+			Length:            1,
+			NumPendingChunks:  1,
+			IterPendingChunks: chunkIterRange(1),
+		})
+	}
+	return t
+}
+
+// Returns the number of pieces taken for requesting by torrent StableId.
+func requestablePiecesByTorrent(input Input) map[uintptr]int {
+	ret := make(map[uintptr]int)
+	for _, p := range getRequestablePieces(input, rarestFirst) {
+		ret[p.t.StableId]++
+	}
+	return ret
+}
+
+func TestLargeTorrentWithRarePiecesDoesntStarveOthers(t *testing.T) {
+	c := qt.New(t)
+	c.Check(requestablePiecesByTorrent(Input{
+		MaxUnverifiedBytes: 10,
+		Torrents: []Torrent{
+			weightTestTorrent(1, 0, 1000, 1, types.PiecePriorityNormal),
+			weightTestTorrent(2, 0, 10, 100, types.PiecePriorityNormal),
+		},
+	}), qt.DeepEquals, map[uintptr]int{1: 5, 2: 5})
+}
+
+func TestWeightedShares(t *testing.T) {
+	c := qt.New(t)
+	c.Check(requestablePiecesByTorrent(Input{
+		MaxUnverifiedBytes: 40,
+		Torrents: []Torrent{
+			weightTestTorrent(1, 3, 100, 1, types.PiecePriorityNormal),
+			weightTestTorrent(2, 1, 100, 1, types.PiecePriorityNormal),
+		},
+	}), qt.DeepEquals, map[uintptr]int{1: 30, 2: 10})
+	// Even a very low relative weight gets a turn once its share comes up.
+	c.Check(requestablePiecesByTorrent(Input{
+		MaxUnverifiedBytes: 101,
+		Torrents: []Torrent{
+			weightTestTorrent(1, 100, 1000, 1, types.PiecePriorityNormal),
+			weightTestTorrent(2, 1, 1000, 1, types.PiecePriorityNormal),
+		},
+	})[2], qt.Equals, 1)
+	// Torrents that can't use their share leave it to the others.
+	c.Check(requestablePiecesByTorrent(Input{
+		MaxUnverifiedBytes: 40,
+		Torrents: []Torrent{
+			weightTestTorrent(1, 1, 100, 1, types.PiecePriorityNormal),
+			weightTestTorrent(2, 100, 5, 1, types.PiecePriorityNormal),
+		},
+	}), qt.DeepEquals, map[uintptr]int{1: 35, 2: 5})
+}
+
+func TestPriorityBeforeWeight(t *testing.T) {
+	c := qt.New(t)
+	c.Check(requestablePiecesByTorrent(Input{
+		MaxUnverifiedBytes: 10,
+		Torrents: []Torrent{
+			weightTestTorrent(1, 100, 100, 1, types.PiecePriorityNormal),
+			weightTestTorrent(2, 1, 10, 1, types.PiecePriorityHigh),
+		},
+	}), qt.DeepEquals, map[uintptr]int{2: 10})
+}
+
+// Runs sharing a Budget take MaxUnverifiedBytes and storage capacity from what earlier runs left.
+func TestBudgetSharedBetweenRuns(t *testing.T) {
+	c := qt.New(t)
+	var budget Budget
+	capacity := func() *int64 {
+		c := int64(15)
+		return &c
+	}
+	withCapacity := func(t Torrent) Torrent {
+		t.Capacity = &capacity
+		return t
+	}
+	c.Check(requestablePiecesByTorrent(Input{
+		MaxUnverifiedBytes: 10,
+		Torrents:           []Torrent{weightTestTorrent(1, 0, 6, 1, types.PiecePriorityNormal)},
+		Budget:             &budget,
+	}), qt.DeepEquals, map[uintptr]int{1: 6})
+	c.Check(requestablePiecesByTorrent(Input{
+		MaxUnverifiedBytes: 10,
+		Torrents:           []Torrent{weightTestTorrent(2, 0, 6, 1, types.PiecePriorityNormal)},
+		Budget:             &budget,
+	}), qt.DeepEquals, map[uintptr]int{2: 4})
+	// Capacity is shared by torrents with the same storage, even when run separately.
+	budget = Budget{}
+	c.Check(requestablePiecesByTorrent(Input{
+		Torrents: []Torrent{withCapacity(weightTestTorrent(1, 0, 10, 1, types.PiecePriorityNormal))},
+		Budget:   &budget,
+	}), qt.DeepEquals, map[uintptr]int{1: 10})
+	c.Check(requestablePiecesByTorrent(Input{
+		Torrents: []Torrent{withCapacity(weightTestTorrent(2, 0, 10, 1, types.PiecePriorityNormal))},
+		Budget:   &budget,
+	}), qt.DeepEquals, map[uintptr]int{2: 5})
+}
+
+// The rarest pieces go first across torrents, but rarity doesn't let a torrent take more than its
+// share.
+func TestRarestFirstWithinShares(t *testing.T) {
+	c := qt.New(t)
+	common := weightTestTorrent(1, 0, 10, 10, types.PiecePriorityNormal)
+	rare := weightTestTorrent(2, 0, 10, 10, types.PiecePriorityNormal)
+	for i := range iter.N(3) {
+		rare.Pieces[i].Availability = 1
+	}
+	input := Input{
+		MaxUnverifiedBytes: 1,
+		Torrents:           []Torrent{common, rare},
+	}
+	c.Check(requestablePiecesByTorrent(input), qt.DeepEquals, map[uintptr]int{2: 1})
+	input.MaxUnverifiedBytes = 4
+	c.Check(requestablePiecesByTorrent(input), qt.DeepEquals, map[uintptr]int{1: 2, 2: 2})
+}
+
+func TestRarestFirstAcrossTorrents(t *testing.T) {
+	c := qt.New(t)
+	common := weightTestTorrent(1, 0, 3, 10, types.PiecePriorityNormal)
+	rare := weightTestTorrent(2, 0, 3, 1, types.PiecePriorityNormal)
+	var order []uintptr
+	for _, p := range getRequestablePieces(Input{Torrents: []Torrent{common, rare}}, rarestFirst) {
+		order = append(order, p.t.StableId)
+	}
+	c.Check(order, qt.DeepEquals, []uintptr{2, 2, 2, 1, 1, 1})
+}
+
+// Adds a peer that has every piece to each torrent, and returns the number of requests each
+// torrent's peer is given.
+func requestsByTorrent(input Input) map[uintptr]int {
+	for i := range input.Torrents {
+		input.Torrents[i].Peers = []Peer{{
+			HasPiece:    func(pieceIndex) bool { return true },
+			MaxRequests: 8,
+			Id:          intPeerId(input.Torrents[i].StableId),
+		}}
+	}
+	ret := make(map[uintptr]int)
+	for id, state := range Run(input) {
+		ret[id.Uintptr()] = len(state.Requests)
+	}
+	return ret
+}
+
+// Without limits on the pieces requested, torrents share requests by weight.
+func TestWeightedRequestsWithoutLimits(t *testing.T) {
+	c := qt.New(t)
+	c.Check(requestsByTorrent(Input{
+		Torrents: []Torrent{
+			weightTestTorrent(1, 0, 100, 1, types.PiecePriorityNormal),
+			weightTestTorrent(2, 0, 100, 1, types.PiecePriorityNormal),
+		},
+	}), qt.DeepEquals, map[uintptr]int{1: 8, 2: 8})
+	c.Check(requestsByTorrent(Input{
+		Torrents: []Torrent{
+			weightTestTorrent(1, 4, 100, 1, types.PiecePriorityNormal),
+			weightTestTorrent(2, 1, 100, 1, types.PiecePriorityNormal),
+		},
+	}), qt.DeepEquals, map[uintptr]int{1: 8, 2: 2})
+	// Torrents with nothing to download don't reduce the others' requests.
+	c.Check(requestsByTorrent(Input{
+		Torrents: []Torrent{
+			weightTestTorrent(1, 4, 0, 1, types.PiecePriorityNormal),
+			weightTestTorrent(2, 1, 100, 1, types.PiecePriorityNormal),
+		},
+	}), qt.DeepEquals, map[uintptr]int{1: 0, 2: 8})
+	// Weights of torrents in other runs count too.
+	c.Check(requestsByTorrent(Input{
+		Torrents:  []Torrent{weightTestTorrent(1, 1, 100, 1, types.PiecePriorityNormal)},
+		MaxWeight: 2,
+	}), qt.DeepEquals, map[uintptr]int{1: 4})
+}
+
+func TestLowWeightNotStarvedWithoutLimits(t *testing.T) {
+	c := qt.New(t)
+	c.Check(requestsByTorrent(Input{
+		Torrents: []Torrent{
+			weightTestTorrent(1, 1000, 10000, 1, types.PiecePriorityNormal),
+			weightTestTorrent(2, 1, 10, 100, types.PiecePriorityNormal),
+		},
+	}), qt.DeepEquals, map[uintptr]int{1: 8, 2: 1})
+	// A large torrent with rare pieces doesn't take requests from others of the same weight.
+	c.Check(requestsByTorrent(Input{
+		Torrents: []Torrent{
+			weightTestTorrent(1, 0, 10000, 1, types.PiecePriorityNormal),
+			weightTestTorrent(2, 0, 10, 100, types.PiecePriorityNormal),
+		},
+	}), qt.DeepEquals, map[uintptr]int{1: 8, 2: 8})
+}
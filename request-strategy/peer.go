@@ -21,6 +21,8 @@ type Peer struct {
 	PieceAllowedFast   func(pieceIndex) bool
 	DownloadRate       float64
 	Age                time.Duration
+	// The peer has stopped delivering requests. It's the last choice for new requests.
+	Snubbed bool
 	// This is passed back out at the end, so must support equality. Could be a type-param later.
 	Id PeerId
 }
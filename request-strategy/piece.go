@@ -1,6 +1,8 @@
 package request_strategy
 
 import (
+	"time"
+
 	"github.com/anacrolix/torrent/types"
 )
 
@@ -14,6 +16,10 @@ type Piece struct {
 	Length            int64
 	NumPendingChunks  int
 	IterPendingChunks ChunksIter
+
+	// When the piece is needed by, or the zero value if it has no deadline. Pieces with deadlines
+	// are requested before all others, earliest first.
+	Deadline time.Time
 }
 
 func (p Piece) iterPendingChunksWrapper(f func(ChunkSpec)) {
@@ -0,0 +1,78 @@
+package simulator
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+type Result struct {
+	Torrents []TorrentResult
+	// When the last torrent completed, or the timeout if any didn't.
+	Duration time.Duration
+	// Bytes received for chunks that we already had, across all torrents.
+	DuplicateBytes int64
+	// Jain's fairness index of the bytes the torrents received per unit of weight, up to when the
+	// first torrent completed. 1 is perfectly fair, and 1/n is as unfair as it gets for n torrents.
+	Fairness float64
+}
+
+type TorrentResult struct {
+	Complete       bool
+	CompletionTime time.Duration
+	BytesReceived  int64
+	DuplicateBytes int64
+	// How the availability of the pieces we don't have changes over time.
+	Availability []AvailabilitySample
+}
+
+// The availability of the pieces that aren't complete at a point in time.
+type AvailabilitySample struct {
+	Time time.Duration
+	Min  int
+	Mean float64
+	// The number of pieces that no connected peer has.
+	Unavailable int
+}
+
+func (sim *simulation) result() (ret Result) {
+	var sum, sumSquares float64
+	for _, t := range sim.torrents {
+		tr := TorrentResult{
+			Complete:       t.isComplete(),
+			CompletionTime: t.completedAt,
+			BytesReceived:  t.bytesReceived,
+			DuplicateBytes: t.duplicateBytes,
+			Availability:   t.availability,
+		}
+		ret.Torrents = append(ret.Torrents, tr)
+		ret.DuplicateBytes += t.duplicateBytes
+		weight := float64(t.Weight)
+		if weight <= 0 {
+			weight = 1
+		}
+		x := float64(t.fairnessSnapshot) / weight
+		sum += x
+		sumSquares += x * x
+	}
+	ret.Duration = sim.now
+	ret.Fairness = 1
+	if sumSquares != 0 {
+		ret.Fairness = sum * sum / (float64(len(sim.torrents)) * sumSquares)
+	}
+	return
+}
+
+// Writes a human readable summary of the result.
+func (r Result) WriteReport(w io.Writer) {
+	fmt.Fprintf(w, "duration: %v\n", r.Duration)
+	fmt.Fprintf(w, "duplicate bytes: %v\n", r.DuplicateBytes)
+	fmt.Fprintf(w, "fairness: %.3f\n", r.Fairness)
+	for i, t := range r.Torrents {
+		fmt.Fprintf(w, "torrent %v: complete: %v, completion time: %v, bytes received: %v, duplicate bytes: %v\n",
+			i, t.Complete, t.CompletionTime, t.BytesReceived, t.DuplicateBytes)
+		for _, s := range t.Availability {
+			fmt.Fprintf(w, "\t%v: min availability %v, mean %.2f, %v unavailable\n", s.Time, s.Min, s.Mean, s.Unavailable)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package simulator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// A time.Duration that's written as a string in scenario files, such as "150ms".
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	*d = Duration(v)
+	return err
+}
+
+// Describes a swarm to simulate, and what's expected of the request strategy in it.
+type Scenario struct {
+	// Seeds the random number generator that decides peer bitfields, churn and choking.
+	Seed int64
+	// The interval between request strategy runs. Defaults to 100ms.
+	Tick Duration
+	// The simulation stops here if the torrents haven't completed. Defaults to an hour.
+	Timeout Duration
+	// The interval between samples of piece availability. Defaults to a second.
+	SampleInterval Duration
+	// Passed through to request_strategy.Input.
+	MaxUnverifiedBytes int64
+	Endgame            bool
+	Torrents           []TorrentScenario
+	Expect             Expectations
+}
+
+type TorrentScenario struct {
+	NumPieces   int
+	PieceLength int64
+	// Defaults to 16 KiB.
+	ChunkSize  int64
+	Weight     int
+	Sequential bool
+	Peers      []PeerScenario
+}
+
+type PeerScenario struct {
+	// The number of peers with these settings. Defaults to 1.
+	Count int
+	// The fraction of pieces the peer has when it arrives. 1 is a seed.
+	Have float64
+	// The pieces per second the peer gets from the rest of the swarm.
+	PieceRate float64
+	// The bytes per second the peer uploads to us.
+	Rate int64
+	// The round trip time of a request.
+	Latency     Duration
+	MaxRequests int
+	// When the peer connects, and disconnects. A zero Leave means the peer stays.
+	Arrive Duration
+	Leave  Duration
+	// The chance that the peer chokes us each ChokeInterval, which defaults to 10s, the usual
+	// unchoke interval.
+	Choked        float64
+	ChokeInterval Duration
+}
+
+// Limits on a Result for a scenario to pass. Zero values aren't checked.
+type Expectations struct {
+	MaxDuration       Duration
+	MaxDuplicateBytes int64
+	MinFairness       float64
+}
+
+func (e Expectations) Check(r Result) error {
+	for i, t := range r.Torrents {
+		if !t.Complete {
+			return fmt.Errorf("torrent %v didn't complete", i)
+		}
+	}
+	if e.MaxDuration != 0 && r.Duration > time.Duration(e.MaxDuration) {
+		return fmt.Errorf("took %v, expected at most %v", r.Duration, time.Duration(e.MaxDuration))
+	}
+	if e.MaxDuplicateBytes != 0 && r.DuplicateBytes > e.MaxDuplicateBytes {
+		return fmt.Errorf("%v duplicate bytes, expected at most %v", r.DuplicateBytes, e.MaxDuplicateBytes)
+	}
+	if r.Fairness < e.MinFairness {
+		return fmt.Errorf("fairness %.3f, expected at least %.3f", r.Fairness, e.MinFairness)
+	}
+	return nil
+}
+
+func LoadScenario(filename string) (s Scenario, err error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &s)
+	return
+}
+
+func (s *Scenario) setDefaults() {
+	if s.Tick == 0 {
+		s.Tick = Duration(100 * time.Millisecond)
+	}
+	if s.Timeout == 0 {
+		s.Timeout = Duration(time.Hour)
+	}
+	if s.SampleInterval == 0 {
+		s.SampleInterval = Duration(time.Second)
+	}
+	for i := range s.Torrents {
+		t := &s.Torrents[i]
+		if t.ChunkSize == 0 {
+			t.ChunkSize = 16 << 10
+		}
+		for j := range t.Peers {
+			p := &t.Peers[j]
+			if p.Count == 0 {
+				p.Count = 1
+			}
+			if p.ChokeInterval == 0 {
+				p.ChokeInterval = Duration(10 * time.Second)
+			}
+		}
+	}
+}
+
+func (s *Scenario) validate() error {
+	if len(s.Torrents) == 0 {
+		return errors.New("no torrents")
+	}
+	for i, t := range s.Torrents {
+		if t.NumPieces <= 0 || t.PieceLength <= 0 {
+			return fmt.Errorf("torrent %v has no data", i)
+		}
+		for j, p := range t.Peers {
+			if p.Rate <= 0 || p.MaxRequests <= 0 {
+				return fmt.Errorf("torrent %v peer %v needs a rate and max requests", i, j)
+			}
+		}
+	}
+	return nil
+}
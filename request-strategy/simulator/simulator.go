@@ -0,0 +1,423 @@
+// Package simulator runs request strategies against simulated swarms. Peers have bitfields, upload
+// rates, latency, churn and choking, and time is simulated, so runs are deterministic and much
+// faster than real time. This allows changes to piece and peer selection to be judged by their
+// effect on downloads.
+package simulator
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/bradfitz/iter"
+
+	pp "github.com/anacrolix/torrent/peer_protocol"
+	request_strategy "github.com/anacrolix/torrent/request-strategy"
+	"github.com/anacrolix/torrent/types"
+)
+
+// The wall clock time that simulated time starts at, for request_strategy.Input.Now.
+var epoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type peerId int
+
+func (me peerId) Uintptr() uintptr {
+	return uintptr(me)
+}
+
+type request struct {
+	types.Request
+	sent time.Duration
+}
+
+type peer struct {
+	PeerScenario
+	id  peerId
+	t   *torrent
+	has []bool
+	// Whether the peer is currently connected.
+	present bool
+	choking bool
+	// Outstanding requests, in the order the peer serves them.
+	requests   []request
+	requestSet map[types.Request]struct{}
+	// Upload allowance carried between ticks.
+	budget    float64
+	pieceGain float64
+	nextChoke time.Duration
+	received  int64
+}
+
+func (p *peer) downloadRate(now time.Duration) float64 {
+	d := now - time.Duration(p.Arrive)
+	if d <= 0 {
+		return 0
+	}
+	return float64(p.received) / d.Seconds()
+}
+
+func (p *peer) dropRequests() {
+	p.requests = nil
+	p.requestSet = make(map[types.Request]struct{})
+}
+
+type torrent struct {
+	TorrentScenario
+	index int
+	peers []*peer
+	// Received chunks by piece.
+	chunks           [][]bool
+	complete         []bool
+	numComplete      int
+	completedAt      time.Duration
+	bytesReceived    int64
+	duplicateBytes   int64
+	availability     []AvailabilitySample
+	fairnessSnapshot int64
+}
+
+func (t *torrent) isComplete() bool {
+	return t.numComplete == t.NumPieces
+}
+
+func (t *torrent) chunkSpec(chunk int) types.ChunkSpec {
+	begin := int64(chunk) * t.ChunkSize
+	length := t.ChunkSize
+	if begin+length > t.PieceLength {
+		length = t.PieceLength - begin
+	}
+	return types.ChunkSpec{Begin: pp.Integer(begin), Length: pp.Integer(length)}
+}
+
+func (t *torrent) availabilityOf(piece int) (ret int64) {
+	for _, p := range t.peers {
+		if p.present && p.has[piece] {
+			ret++
+		}
+	}
+	return
+}
+
+func (t *torrent) receiveChunk(p *peer, r types.Request) {
+	p.received += int64(r.Length)
+	piece := int(r.Index)
+	chunk := int(int64(r.Begin) / t.ChunkSize)
+	if t.complete[piece] || t.chunks[piece][chunk] {
+		t.duplicateBytes += int64(r.Length)
+		return
+	}
+	t.chunks[piece][chunk] = true
+	t.bytesReceived += int64(r.Length)
+	for _, have := range t.chunks[piece] {
+		if !have {
+			return
+		}
+	}
+	t.complete[piece] = true
+	t.numComplete++
+}
+
+func (t *torrent) requestStrategyTorrent(now time.Duration) request_strategy.Torrent {
+	ret := request_strategy.Torrent{
+		StableId:           uintptr(t.index + 1),
+		Weight:             t.Weight,
+		Sequential:         t.Sequential,
+		NumCompletedPieces: t.numComplete,
+	}
+	for i := range iter.N(t.NumPieces) {
+		chunks := t.chunks[i]
+		pending := 0
+		for _, have := range chunks {
+			if !have {
+				pending++
+			}
+		}
+		ret.Pieces = append(ret.Pieces, request_strategy.Piece{
+			Request:          !t.complete[i],
+			Priority:         types.PiecePriorityNormal,
+			Partial:          !t.complete[i] && pending != len(chunks),
+			Availability:     t.availabilityOf(i),
+			Length:           t.PieceLength,
+			NumPendingChunks: pending,
+			IterPendingChunks: func(f func(types.ChunkSpec)) {
+				for c, have := range chunks {
+					if !have {
+						f(t.chunkSpec(c))
+					}
+				}
+			},
+		})
+	}
+	for _, p := range t.peers {
+		if !p.present {
+			continue
+		}
+		p := p
+		ret.Peers = append(ret.Peers, request_strategy.Peer{
+			HasPiece: func(i int) bool {
+				return p.has[i]
+			},
+			MaxRequests: p.MaxRequests,
+			HasExistingRequest: func(r types.Request) bool {
+				_, ok := p.requestSet[r]
+				return ok
+			},
+			Choking:      p.choking,
+			DownloadRate: p.downloadRate(now),
+			Age:          now - time.Duration(p.Arrive),
+			Id:           p.id,
+		})
+	}
+	return ret
+}
+
+type simulation struct {
+	Scenario
+	strategy request_strategy.Strategy
+	rand     *rand.Rand
+	now      time.Duration
+	torrents []*torrent
+}
+
+// Runs the scenario with the strategy, or request_strategy.ClientPieceOrder if it's nil, until
+// all the torrents complete or the scenario times out.
+func Run(s Scenario, strategy request_strategy.Strategy) (ret Result, err error) {
+	s.setDefaults()
+	if err = s.validate(); err != nil {
+		return
+	}
+	if strategy == nil {
+		strategy = request_strategy.ClientPieceOrder{}
+	}
+	sim := simulation{
+		Scenario: s,
+		strategy: strategy,
+		rand:     rand.New(rand.NewSource(s.Seed)),
+	}
+	sim.init()
+	sim.run()
+	return sim.result(), nil
+}
+
+func (sim *simulation) init() {
+	nextPeerId := peerId(1)
+	for i, ts := range sim.Torrents {
+		t := &torrent{
+			TorrentScenario: ts,
+			index:           i,
+			chunks:          make([][]bool, ts.NumPieces),
+			complete:        make([]bool, ts.NumPieces),
+		}
+		numChunks := int((ts.PieceLength + ts.ChunkSize - 1) / ts.ChunkSize)
+		for j := range t.chunks {
+			t.chunks[j] = make([]bool, numChunks)
+		}
+		for _, ps := range ts.Peers {
+			for range iter.N(ps.Count) {
+				p := &peer{
+					PeerScenario: ps,
+					id:           nextPeerId,
+					t:            t,
+					has:          make([]bool, ts.NumPieces),
+					nextChoke:    time.Duration(ps.Arrive),
+				}
+				nextPeerId++
+				for j := range p.has {
+					p.has[j] = ps.Have >= 1 || sim.rand.Float64() < ps.Have
+				}
+				p.dropRequests()
+				t.peers = append(t.peers, p)
+			}
+		}
+		sim.torrents = append(sim.torrents, t)
+	}
+}
+
+func (sim *simulation) allComplete() bool {
+	for _, t := range sim.torrents {
+		if !t.isComplete() {
+			return false
+		}
+	}
+	return true
+}
+
+func (sim *simulation) run() {
+	tick := time.Duration(sim.Tick)
+	var nextSample time.Duration
+	fairnessTaken := false
+	for !sim.allComplete() && sim.now < time.Duration(sim.Timeout) {
+		if sim.now >= nextSample {
+			sim.sampleAvailability()
+			nextSample += time.Duration(sim.SampleInterval)
+		}
+		sim.updatePeers()
+		sim.runStrategy()
+		end := sim.now + tick
+		for _, t := range sim.torrents {
+			for _, p := range t.peers {
+				sim.serve(p, end)
+			}
+		}
+		sim.now = end
+		for _, t := range sim.torrents {
+			if t.isComplete() && t.completedAt == 0 {
+				t.completedAt = sim.now
+				if !fairnessTaken {
+					// Fairness is measured while all the torrents are still competing.
+					for _, t := range sim.torrents {
+						t.fairnessSnapshot = t.bytesReceived
+					}
+					fairnessTaken = true
+				}
+			}
+		}
+	}
+	if !fairnessTaken {
+		for _, t := range sim.torrents {
+			t.fairnessSnapshot = t.bytesReceived
+		}
+	}
+	sim.sampleAvailability()
+}
+
+// Applies churn, choking and pieces the peers get from the rest of the swarm.
+func (sim *simulation) updatePeers() {
+	for _, t := range sim.torrents {
+		for _, p := range t.peers {
+			present := sim.now >= time.Duration(p.Arrive) && (p.Leave == 0 || sim.now < time.Duration(p.Leave))
+			if !present && p.present {
+				p.dropRequests()
+			}
+			p.present = present
+			if !present {
+				continue
+			}
+			if p.Choked > 0 && sim.now >= p.nextChoke {
+				p.choking = sim.rand.Float64() < p.Choked
+				if p.choking {
+					p.dropRequests()
+				}
+				p.nextChoke += time.Duration(p.ChokeInterval)
+			}
+			p.pieceGain += p.PieceRate * time.Duration(sim.Tick).Seconds()
+			for ; p.pieceGain >= 1; p.pieceGain-- {
+				sim.gainPiece(p)
+			}
+		}
+	}
+}
+
+func (sim *simulation) gainPiece(p *peer) {
+	var missing []int
+	for i, has := range p.has {
+		if !has {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	p.has[missing[sim.rand.Intn(len(missing))]] = true
+}
+
+func (sim *simulation) runStrategy() {
+	input := request_strategy.Input{
+		MaxUnverifiedBytes: sim.MaxUnverifiedBytes,
+		Now:                epoch.Add(sim.now),
+		Endgame:            sim.Endgame,
+	}
+	for _, t := range sim.torrents {
+		if t.isComplete() {
+			continue
+		}
+		input.Torrents = append(input.Torrents, t.requestStrategyTorrent(sim.now))
+	}
+	next := sim.strategy.Run(input)
+	for _, t := range sim.torrents {
+		for _, p := range t.peers {
+			if !p.present {
+				continue
+			}
+			p.applyNextRequestState(next[p.id], sim.now)
+		}
+	}
+}
+
+// Cancels requests that aren't in the next state, and sends the new ones, in a fixed order.
+func (p *peer) applyNextRequestState(next request_strategy.PeerNextRequestState, now time.Duration) {
+	kept := p.requests[:0]
+	for _, r := range p.requests {
+		if _, ok := next.Requests[r.Request]; ok {
+			kept = append(kept, r)
+		} else {
+			delete(p.requestSet, r.Request)
+		}
+	}
+	p.requests = kept
+	var added []types.Request
+	for r := range next.Requests {
+		if _, ok := p.requestSet[r]; !ok {
+			added = append(added, r)
+		}
+	}
+	sort.Slice(added, func(i, j int) bool {
+		l, r := added[i], added[j]
+		if l.Index != r.Index {
+			return l.Index < r.Index
+		}
+		return l.Begin < r.Begin
+	})
+	for _, r := range added {
+		p.requests = append(p.requests, request{r, now})
+		p.requestSet[r] = struct{}{}
+	}
+}
+
+// Delivers the peer's requests that have made the round trip, as its rate allows, up to the end of
+// the tick.
+func (sim *simulation) serve(p *peer, end time.Duration) {
+	if !p.present || p.choking || len(p.requests) == 0 || p.requests[0].sent+time.Duration(p.Latency) > end {
+		// An idle peer doesn't save up its upload rate.
+		p.budget = 0
+		return
+	}
+	p.budget += float64(p.Rate) * time.Duration(sim.Tick).Seconds()
+	served := 0
+	for _, r := range p.requests {
+		if r.sent+time.Duration(p.Latency) > end || p.budget < float64(r.Length) {
+			break
+		}
+		p.budget -= float64(r.Length)
+		delete(p.requestSet, r.Request)
+		p.t.receiveChunk(p, r.Request)
+		served++
+	}
+	p.requests = p.requests[served:]
+}
+
+func (sim *simulation) sampleAvailability() {
+	for _, t := range sim.torrents {
+		s := AvailabilitySample{Time: sim.now}
+		var total int64
+		var n int
+		for i := range iter.N(t.NumPieces) {
+			if t.complete[i] {
+				continue
+			}
+			a := t.availabilityOf(i)
+			if n == 0 || int(a) < s.Min {
+				s.Min = int(a)
+			}
+			if a == 0 {
+				s.Unavailable++
+			}
+			total += a
+			n++
+		}
+		if n != 0 {
+			s.Mean = float64(total) / float64(n)
+		}
+		t.availability = append(t.availability, s)
+	}
+}
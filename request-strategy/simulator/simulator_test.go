@@ -0,0 +1,101 @@
+package simulator
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func scenarioFiles(tb testing.TB) []string {
+	names, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return names
+}
+
+func scenarioName(filename string) string {
+	return strings.TrimSuffix(filepath.Base(filename), ".json")
+}
+
+// The checked in scenarios are regression tests for the default request strategy.
+func TestScenarios(t *testing.T) {
+	for _, name := range scenarioFiles(t) {
+		name := name
+		t.Run(scenarioName(name), func(t *testing.T) {
+			c := qt.New(t)
+			s, err := LoadScenario(name)
+			c.Assert(err, qt.IsNil)
+			r, err := Run(s, nil)
+			c.Assert(err, qt.IsNil)
+			var buf bytes.Buffer
+			r.WriteReport(&buf)
+			t.Log(buf.String())
+			c.Check(s.Expect.Check(r), qt.IsNil)
+			// Runs are deterministic.
+			again, err := Run(s, nil)
+			c.Assert(err, qt.IsNil)
+			c.Check(again, qt.DeepEquals, r)
+		})
+	}
+}
+
+func TestPeerLatencyAndRate(t *testing.T) {
+	c := qt.New(t)
+	r, err := Run(Scenario{
+		Tick: Duration(10 * time.Millisecond),
+		Torrents: []TorrentScenario{{
+			NumPieces:   4,
+			PieceLength: 1 << 16,
+			Peers: []PeerScenario{{
+				Have:        1,
+				Rate:        1 << 16,
+				Latency:     Duration(500 * time.Millisecond),
+				MaxRequests: 100,
+			}},
+		}},
+	}, nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(r.Torrents, qt.HasLen, 1)
+	c.Check(r.Torrents[0].Complete, qt.IsTrue)
+	c.Check(r.Torrents[0].BytesReceived, qt.Equals, int64(4<<16))
+	// All the requests go out at once, so the download takes the round trip, plus the time to
+	// upload 4 pieces at a piece a second.
+	c.Check(r.Duration > 4400*time.Millisecond && r.Duration <= 4500*time.Millisecond, qt.IsTrue, qt.Commentf("%v", r.Duration))
+	c.Check(r.DuplicateBytes, qt.Equals, int64(0))
+	c.Check(r.Fairness, qt.Equals, 1.0)
+}
+
+func TestInvalidScenario(t *testing.T) {
+	c := qt.New(t)
+	_, err := Run(Scenario{}, nil)
+	c.Check(err, qt.Not(qt.IsNil))
+}
+
+// Reports simulated download time and duplicate bytes for each scenario, so strategy changes can
+// be compared with benchstat.
+func BenchmarkScenarios(b *testing.B) {
+	for _, name := range scenarioFiles(b) {
+		name := name
+		b.Run(scenarioName(name), func(b *testing.B) {
+			s, err := LoadScenario(name)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var r Result
+			for i := 0; i < b.N; i++ {
+				r, err = Run(s, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(r.Duration.Seconds(), "sim-s")
+			b.ReportMetric(float64(r.DuplicateBytes), "dup-bytes")
+			b.ReportMetric(r.Fairness, "fairness")
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package request_strategy
+
+// Determines the requests that peers should have outstanding, for the torrents in an Input. The
+// returned map should have an entry for every peer in the Input.
+type Strategy interface {
+	Run(Input) map[PeerId]PeerNextRequestState
+}
+
+// Adapts a function to a Strategy.
+type StrategyFunc func(Input) map[PeerId]PeerNextRequestState
+
+func (f StrategyFunc) Run(input Input) map[PeerId]PeerNextRequestState {
+	return f(input)
+}
+
+// The default Strategy. Pieces with deadlines come first, then pieces are ordered by priority,
+// partial pieces first, and then rarest first.
+type ClientPieceOrder struct{}
+
+func (ClientPieceOrder) Run(input Input) map[PeerId]PeerNextRequestState {
+	return Run(input)
+}
+
+// Orders the pieces of all torrents by index within each priority, as though Torrent.Sequential
+// were set for all of them.
+type Sequential struct{}
+
+func (Sequential) Run(input Input) map[PeerId]PeerNextRequestState {
+	torrents := make([]Torrent, 0, len(input.Torrents))
+	for _, t := range input.Torrents {
+		t.Sequential = true
+		torrents = append(torrents, t)
+	}
+	input.Torrents = torrents
+	return Run(input)
+}
+
+// Requests pieces in a random order, rather than rarest first, for torrents with fewer than
+// NumPieces completed pieces. Common pieces tend to download faster, so this gets a new torrent
+// some pieces to share sooner. The random order is fixed per torrent, so requests don't churn
+// between runs.
+type RandomFirstPieces struct {
+	NumPieces int
+}
+
+func (me RandomFirstPieces) Run(input Input) map[PeerId]PeerNextRequestState {
+	return run(input, func(t *Torrent, index pieceIndex, p *Piece) int64 {
+		if t.NumCompletedPieces >= me.NumPieces {
+			return p.Availability
+		}
+		return randomPieceOrder(t.StableId, index)
+	})
+}
+
+// Returns a non-negative pseudo-random value that's fixed for a given torrent and piece. This is
+// the SplitMix64 finalizer.
+func randomPieceOrder(stableId uintptr, index pieceIndex) int64 {
+	x := uint64(stableId)*31 + uint64(index) + 0x9e3779b97f4a7c15
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return int64(x >> 1)
+}
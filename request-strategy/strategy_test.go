@@ -0,0 +1,61 @@
+package request_strategy
+
+import (
+	"testing"
+
+	"github.com/bradfitz/iter"
+	qt "github.com/frankban/quicktest"
+)
+
+// A torrent where later pieces are rarer, with a single peer that can make one request.
+func strategyTestInput(numCompletedPieces int) Input {
+	var pieces []Piece
+	for i := range iter.N(20) {
+		pieces = append(pieces, Piece{
+			Request:           true,
+			Availability:      int64(20 - i),
+			NumPendingChunks:  1,
+			IterPendingChunks: chunkIterRange(1),
+		})
+	}
+	return Input{Torrents: []Torrent{{
+		Pieces:             pieces,
+		NumCompletedPieces: numCompletedPieces,
+		StableId:           1,
+		Peers: []Peer{{
+			HasPiece: func(i pieceIndex) bool {
+				return true
+			},
+			MaxRequests: 1,
+			Id:          intPeerId(1),
+		}},
+	}}}
+}
+
+func TestStrategies(t *testing.T) {
+	c := qt.New(t)
+	c.Check(
+		ClientPieceOrder{}.Run(strategyTestInput(0))[intPeerId(1)].Requests,
+		qt.DeepEquals, requestSetFromSlice(r(19, 0)))
+	c.Check(
+		Sequential{}.Run(strategyTestInput(0))[intPeerId(1)].Requests,
+		qt.DeepEquals, requestSetFromSlice(r(7, 0)))
+	var s Strategy = StrategyFunc(Run)
+	c.Check(
+		s.Run(strategyTestInput(0))[intPeerId(1)].Requests,
+		qt.DeepEquals, requestSetFromSlice(r(19, 0)))
+}
+
+func TestRandomFirstPieces(t *testing.T) {
+	c := qt.New(t)
+	s := RandomFirstPieces{NumPieces: 4}
+	first := s.Run(strategyTestInput(0))[intPeerId(1)].Requests
+	c.Assert(first, qt.HasLen, 1)
+	c.Check(first, qt.Not(qt.DeepEquals), requestSetFromSlice(r(19, 0)))
+	// The order is stable between runs.
+	c.Check(s.Run(strategyTestInput(3))[intPeerId(1)].Requests, qt.DeepEquals, first)
+	// Rarest first once enough pieces are complete.
+	c.Check(
+		s.Run(strategyTestInput(4))[intPeerId(1)].Requests,
+		qt.DeepEquals, requestSetFromSlice(r(19, 0)))
+}
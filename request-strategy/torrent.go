@@ -1,11 +1,38 @@
 package request_strategy
 
 type Torrent struct {
-	Pieces   []Piece
-	Capacity *func() *int64
-	Peers    []Peer // not closed.
+	Pieces []Piece
+	// The torrent piece index of each element of Pieces. If nil, Pieces contains every piece of
+	// the torrent, in order.
+	PieceIndexes []pieceIndex
+	Capacity     *func() *int64
+	Peers        []Peer // not closed.
 	// Some value that's unique and stable between runs. Could even use the infohash?
 	StableId uintptr
 
 	MaxUnverifiedBytes int64
+	// The torrent's share of downloading, relative to other torrents. Zero is treated as 1. Peers'
+	// request limits are scaled by the torrent's weight relative to the highest weight of the
+	// torrents downloading, and storage capacity and MaxUnverifiedBytes are shared in proportion to
+	// weights, amongst pieces of the same priority.
+	Weight int
+	// Used by strategies that treat new torrents differently.
+	NumCompletedPieces int
+	// Order pieces by index within each priority, allowing for a small window of pieces ordered
+	// by the usual criteria.
+	Sequential bool
+}
+
+func (t *Torrent) weight() float64 {
+	if t.Weight <= 0 {
+		return 1
+	}
+	return float64(t.Weight)
+}
+
+func (t *Torrent) pieceIndex(i int) pieceIndex {
+	if t.PieceIndexes == nil {
+		return i
+	}
+	return t.PieceIndexes[i]
 }
@@ -38,31 +38,53 @@ func (cl *Client) tickleRequester() {
 }
 
 func (cl *Client) doRequests() {
+	now := time.Now()
 	ts := make([]request_strategy.Torrent, 0, len(cl.torrents))
-	for _, t := range cl.torrents {
+	// Torrents with their own strategy, which are run after the others.
+	var own []request_strategy.Strategy
+	var ownInputs []request_strategy.Torrent
+	// The highest weight of the torrents downloading, so that weights apply across runs.
+	maxWeight := 0
+	for t := range cl.requestingTorrents {
+		// Torrents are added to the set as they change, but removals are only noticed here for
+		// some changes.
+		if !t.updateRequesting() {
+			continue
+		}
+		t.checkPieceDeadlines(now)
 		rst := request_strategy.Torrent{
-			StableId: uintptr(unsafe.Pointer(t)),
+			StableId:           uintptr(unsafe.Pointer(t)),
+			Sequential:         t.sequential,
+			NumCompletedPieces: int(t.numPiecesCompleted()),
+			Weight:             t.downloadWeight,
 		}
 		if t.storage != nil {
 			rst.Capacity = t.storage.Capacity
 		}
-		for i := range t.pieces {
-			p := &t.pieces[i]
-			rst.Pieces = append(rst.Pieces, request_strategy.Piece{
-				Request:          !t.ignorePieceForRequests(i),
-				Priority:         p.purePriority(),
-				Partial:          t.piecePartiallyDownloaded(i),
-				Availability:     p.availability,
-				Length:           int64(p.length()),
-				NumPendingChunks: int(t.pieceNumPendingChunks(i)),
-				IterPendingChunks: func(f func(types.ChunkSpec)) {
-					p.iterUndirtiedChunks(func(cs ChunkSpec) bool {
-						f(cs)
-						return true
-					})
-				},
+		if rst.Capacity != nil {
+			// Every piece counts against the storage capacity, so they're all included.
+			rst.Pieces = make([]request_strategy.Piece, 0, len(t.pieces))
+			for i := range t.pieces {
+				rst.Pieces = append(rst.Pieces, t.requestStrategyPiece(i))
+			}
+		} else if t.skipRequests() {
+			t.clearPeerRequestStates()
+			continue
+		} else {
+			// Only pending pieces can be requested. They're kept in request order as they change,
+			// so this doesn't walk every piece, and the strategy needn't sort them again.
+			n := t._pendingPieces.Len()
+			rst.Pieces = make([]request_strategy.Piece, 0, n)
+			rst.PieceIndexes = make([]pieceIndex, 0, n)
+			t.iterPiecesInRequestOrder(func(i pieceIndex) bool {
+				rst.Pieces = append(rst.Pieces, t.requestStrategyPiece(i))
+				rst.PieceIndexes = append(rst.PieceIndexes, i)
+				return true
 			})
 		}
+		if (rst.Capacity == nil || !t.skipRequests()) && t.downloadWeight > maxWeight {
+			maxWeight = t.downloadWeight
+		}
 		t.iterPeers(func(p *Peer) {
 			if p.closed.IsSet() {
 				return
@@ -71,33 +93,109 @@ func (cl *Client) doRequests() {
 				p.maxPiecesReceivedBetweenRequestUpdates = p.piecesReceivedSinceLastRequestUpdate
 			}
 			p.piecesReceivedSinceLastRequestUpdate = 0
+			p.updateSnubbed(now, cl.config.PeerSnubTimeout)
+			// Snubbed peers' requests are given to other peers.
+			hasExistingRequest := func(r request_strategy.Request) bool {
+				_, ok := p.actualRequestState.Requests[r]
+				return ok
+			}
+			if p.snubbed {
+				hasExistingRequest = nil
+			}
 			rst.Peers = append(rst.Peers, request_strategy.Peer{
-				HasPiece:    p.peerHasPiece,
-				MaxRequests: p.nominalMaxRequests(),
-				HasExistingRequest: func(r request_strategy.Request) bool {
-					_, ok := p.actualRequestState.Requests[r]
-					return ok
-				},
-				Choking: p.peerChoking,
+				HasPiece:           p.peerHasPiece,
+				MaxRequests:        p.nominalMaxRequests(),
+				HasExistingRequest: hasExistingRequest,
+				Choking:            p.peerChoking,
 				PieceAllowedFast: func(i pieceIndex) bool {
 					return p.peerAllowedFast.Contains(bitmap.BitIndex(i))
 				},
 				DownloadRate: p.downloadRate(),
 				Age:          time.Since(p.completedHandshake),
+				Snubbed:      p.snubbed,
 				Id:           (*peerId)(p),
 			})
 		})
-		ts = append(ts, rst)
+		if t.requestStrategy != nil {
+			own = append(own, t.requestStrategy)
+			ownInputs = append(ownInputs, rst)
+		} else {
+			ts = append(ts, rst)
+		}
+	}
+	strategy := cl.config.RequestStrategy
+	if strategy == nil {
+		strategy = request_strategy.ClientPieceOrder{}
 	}
-	nextPeerStates := request_strategy.Run(request_strategy.Input{
+	// Torrents run separately still share MaxUnverifiedBytes and storage capacity with the rest.
+	var budget request_strategy.Budget
+	cl.runRequestStrategy(strategy, ts, now, &budget, maxWeight)
+	for i, s := range own {
+		cl.runRequestStrategy(s, ownInputs[i:i+1], now, &budget, maxWeight)
+	}
+}
+
+func (cl *Client) runRequestStrategy(
+	s request_strategy.Strategy, ts []request_strategy.Torrent, now time.Time, budget *request_strategy.Budget,
+	maxWeight int,
+) {
+	nextPeerStates := s.Run(request_strategy.Input{
 		Torrents:           ts,
 		MaxUnverifiedBytes: cl.config.MaxUnverifiedBytes,
+		Now:                now,
+		Endgame:            !cl.config.DisableEndgame,
+		Budget:             budget,
+		MaxWeight:          maxWeight,
 	})
 	for p, state := range nextPeerStates {
 		setPeerNextRequestState(p, state)
 	}
 }
 
+func (t *Torrent) requestStrategyPiece(i pieceIndex) request_strategy.Piece {
+	p := &t.pieces[i]
+	if p.iterPendingChunks == nil {
+		p.iterPendingChunks = func(f func(types.ChunkSpec)) {
+			p.iterUndirtiedChunks(func(cs ChunkSpec) bool {
+				f(cs)
+				return true
+			})
+		}
+	}
+	return request_strategy.Piece{
+		Request:           !t.ignorePieceForRequests(i),
+		Priority:          p.purePriority(),
+		Partial:           t.piecePartiallyDownloaded(i),
+		Availability:      p.availability,
+		Length:            int64(p.length()),
+		NumPendingChunks:  int(t.pieceNumPendingChunks(i)),
+		IterPendingChunks: p.iterPendingChunks,
+		Deadline:          t.pieceDeadline(i),
+	}
+}
+
+// Whether the Torrent can't make any requests, such as when it's seeding or paused, so the request
+// strategy can skip it.
+func (t *Torrent) skipRequests() bool {
+	return !t.haveInfo() || t.dataDownloadDisallowed || t._pendingPieces.IsEmpty() || len(t.conns) == 0 && len(t.webSeeds) == 0
+}
+
+// Clears the next request state of peers of a Torrent that's skipped by the request strategy.
+// Peers that are already clear are left alone, so idle torrents don't wake their writers.
+func (t *Torrent) clearPeerRequestStates() {
+	t.iterPeers(func(p *Peer) {
+		if p.closed.IsSet() {
+			return
+		}
+		if !p.nextRequestState.Interested && len(p.nextRequestState.Requests) == 0 {
+			return
+		}
+		setPeerNextRequestState((*peerId)(p), request_strategy.PeerNextRequestState{
+			Requests: make(map[Request]struct{}),
+		})
+	})
+}
+
 type peerId Peer
 
 func (p *peerId) Uintptr() uintptr {
@@ -0,0 +1,116 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/bradfitz/iter"
+	qt "github.com/frankban/quicktest"
+	"github.com/stretchr/testify/require"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// A client seeding many torrents, with only a few downloading. The seeding torrents shouldn't
+// contribute to the cost of updating requests.
+func BenchmarkDoRequests(b *testing.B) {
+	const (
+		numTorrents     = 10000
+		numDownloading  = 10
+		numPieces       = 256
+		pieceLength     = 256 << 10
+		peersPerTorrent = 2
+	)
+	cl := &Client{config: TestingConfig(b)}
+	cl.initLogger()
+	cl.torrents = make(map[metainfo.Hash]*Torrent, numTorrents)
+	for i := range iter.N(numTorrents) {
+		var ih metainfo.Hash
+		binary.BigEndian.PutUint32(ih[:], uint32(i))
+		t := cl.newTorrent(ih, nil)
+		require.NoError(b, t.setInfo(&metainfo.Info{
+			Pieces:      make([]byte, metainfo.HashSize*numPieces),
+			PieceLength: pieceLength,
+			Length:      pieceLength * numPieces,
+		}))
+		for range iter.N(peersPerTorrent) {
+			cn := cl.newConnection(nil, false, nil, "io.Pipe", "")
+			cn.setTorrent(t)
+			cn.peerSentHaveAll = true
+			cn.peerChoking = false
+			t.conns[cn] = struct{}{}
+		}
+		if i < numDownloading {
+			t.DownloadPieces(0, numPieces)
+		} else {
+			t._completedPieces.AddRange(0, uint64(numPieces))
+		}
+		cl.torrents[ih] = t
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range iter.N(b.N) {
+		cl.lock()
+		cl.doRequests()
+		cl.unlock()
+	}
+}
+
+// Returns a torrent of a bare Client, with a peer that has all pieces.
+func newRequestingTestTorrent(t testing.TB, cl *Client, numPieces int) *Torrent {
+	tt := cl.newTorrent(metainfo.Hash{}, nil)
+	require.NoError(t, tt.setInfo(&metainfo.Info{
+		Pieces:      make([]byte, metainfo.HashSize*numPieces),
+		PieceLength: 1 << 15,
+		Length:      1 << 15 * int64(numPieces),
+	}))
+	cn := cl.newConnection(nil, false, nil, "io.Pipe", "")
+	cn.setTorrent(tt)
+	cn.peerSentHaveAll = true
+	cn.peerChoking = false
+	tt.conns[cn] = struct{}{}
+	return tt
+}
+
+func TestPieceRequestOrderKeptUpdated(t *testing.T) {
+	c := qt.New(t)
+	cl := &Client{config: TestingConfig(t)}
+	cl.initLogger()
+	tt := newRequestingTestTorrent(t, cl, 4)
+	order := func() (ret []pieceIndex) {
+		tt.iterPiecesInRequestOrder(func(i pieceIndex) bool {
+			ret = append(ret, i)
+			return true
+		})
+		return
+	}
+	c.Check(order(), qt.HasLen, 0)
+	tt.DownloadPieces(0, 4)
+	c.Check(order(), qt.DeepEquals, []pieceIndex{0, 1, 2, 3})
+	tt.incPieceAvailability(0)
+	tt.incPieceAvailability(1)
+	c.Check(order(), qt.DeepEquals, []pieceIndex{2, 3, 0, 1})
+	tt.pieces[3].priority = PiecePriorityHigh
+	tt.updatePiecePriority(3)
+	c.Check(order(), qt.DeepEquals, []pieceIndex{3, 2, 0, 1})
+	// Partial pieces come first within a priority.
+	tt.pieces[1].unpendChunkIndex(0)
+	c.Check(order(), qt.DeepEquals, []pieceIndex{3, 1, 2, 0})
+	tt._completedPieces.Add(2)
+	tt.updatePiecePriority(2)
+	c.Check(order(), qt.DeepEquals, []pieceIndex{3, 1, 0})
+}
+
+func TestRequestingTorrents(t *testing.T) {
+	c := qt.New(t)
+	cl := &Client{config: TestingConfig(t)}
+	cl.initLogger()
+	tt := newRequestingTestTorrent(t, cl, 4)
+	c.Check(cl.requestingTorrents, qt.Not(qt.Contains), tt)
+	tt.DownloadPieces(0, 4)
+	_, ok := cl.requestingTorrents[tt]
+	c.Check(ok, qt.IsTrue)
+	tt.disallowDataDownloadLocked()
+	_, ok = cl.requestingTorrents[tt]
+	c.Check(ok, qt.IsFalse)
+}
@@ -0,0 +1,302 @@
+package torrent
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/anacrolix/log"
+	"golang.org/x/time/rate"
+)
+
+// The scrubber's read rate in bytes per second, if ClientConfig.ScrubRateLimiter is nil.
+const defaultScrubRate = 16 << 20
+
+// The longest the scrubber waits before looking at its queue again.
+const scrubPollInterval = time.Minute
+
+// The result of a pass of the scrubber over the pieces that were due, see
+// ClientConfig.ScrubInterval.
+type ScrubReport struct {
+	Started  time.Time
+	Finished time.Time
+	// The pieces hashed, and the bytes of data read for them.
+	Pieces int
+	Bytes  int64
+	// Pieces whose data didn't match their hash. They've been marked not complete.
+	Failed []ScrubFailure
+}
+
+type ScrubFailure struct {
+	Torrent *Torrent
+	Piece   int
+	// Set if the piece couldn't be read from storage.
+	Err error
+}
+
+type scrubCandidate struct {
+	t   *Torrent
+	i   pieceIndex
+	due time.Time
+}
+
+// Complete pieces ordered by when they're due for scrubbing. Entries are added when pieces are
+// completed or verified, and entries that no longer apply are dropped when they reach the front,
+// so the scrubber never has to look at pieces that aren't due.
+type scrubQueue []scrubCandidate
+
+func (me scrubQueue) Len() int           { return len(me) }
+func (me scrubQueue) Less(i, j int) bool { return me[i].due.Before(me[j].due) }
+func (me scrubQueue) Swap(i, j int)      { me[i], me[j] = me[j], me[i] }
+
+func (me *scrubQueue) Push(x interface{}) {
+	*me = append(*me, x.(scrubCandidate))
+}
+
+func (me *scrubQueue) Pop() interface{} {
+	old := *me
+	ret := old[len(old)-1]
+	old[len(old)-1] = scrubCandidate{}
+	*me = old[:len(old)-1]
+	return ret
+}
+
+// Queues the piece to be scrubbed when it's next due, if it's complete. The Client lock must be
+// held.
+func (t *Torrent) queueScrub(i pieceIndex) {
+	if t.cl.config.ScrubInterval == 0 || !t.pieceComplete(i) {
+		return
+	}
+	p := t.piece(i)
+	due := t.pieceScrubDue(i)
+	if due.Equal(p.scrubDue) {
+		return
+	}
+	p.scrubDue = due
+	heap.Push(&t.cl.scrubQueue, scrubCandidate{t, i, due})
+	t.cl.scrubQueued.Broadcast()
+}
+
+// Removes the entry at the front of the queue.
+func (cl *Client) popScrubQueue() scrubCandidate {
+	c := heap.Pop(&cl.scrubQueue).(scrubCandidate)
+	if p := c.t.piece(c.i); p.scrubDue.Equal(c.due) {
+		p.scrubDue = time.Time{}
+	}
+	return c
+}
+
+// Whether the piece is complete, and not being hashed for another reason.
+func (t *Torrent) pieceScrubbable(i pieceIndex) bool {
+	if t.closed.IsSet() || !t.haveInfo() || t.storage == nil {
+		return false
+	}
+	p := t.piece(i)
+	return t.pieceComplete(i) && !p.hashing && !p.queuedForHash()
+}
+
+// Whether the queued piece should still be scrubbed when it's due. Entries are out of date if the
+// piece has been queued again since, such as after it was verified.
+func (c scrubCandidate) current() bool {
+	return c.t.pieceScrubbable(c.i) && c.t.piece(c.i).scrubDue.Equal(c.due)
+}
+
+// Writes are split to fit the limiter's burst, so there must be room for some bytes.
+func checkScrubRateLimiter(lim *rate.Limiter) error {
+	if lim != nil && lim.Limit() != rate.Inf && lim.Burst() <= 0 {
+		return errors.New("scrub rate limiter has no burst")
+	}
+	return nil
+}
+
+// Hashes complete pieces again as they come due, until the Client is closed.
+func (cl *Client) scrubber() {
+	lim := cl.config.ScrubRateLimiter
+	if lim == nil {
+		lim = rate.NewLimiter(defaultScrubRate, 1<<20)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-cl.closed.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		cl.lock()
+		due, next := cl.piecesDueForScrub(time.Now())
+		queued := cl.scrubQueued.Signaled()
+		cl.unlock()
+		if len(due) != 0 {
+			cl.scrubPass(ctx, lim, due)
+			continue
+		}
+		wait := scrubPollInterval
+		if !next.IsZero() && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+		select {
+		case <-cl.closed.Done():
+			return
+		case <-queued:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Removes the pieces that are due for scrubbing from the queue, the longest overdue first, and
+// returns when the next piece that isn't due yet will be. The Client lock must be held.
+func (cl *Client) piecesDueForScrub(now time.Time) (due []scrubCandidate, next time.Time) {
+	for cl.scrubQueue.Len() != 0 {
+		c := cl.scrubQueue[0]
+		if !c.current() {
+			cl.popScrubQueue()
+			continue
+		}
+		if c.due.After(now) {
+			next = c.due
+			return
+		}
+		due = append(due, cl.popScrubQueue())
+	}
+	return
+}
+
+// Returns when the piece should next be hashed by the scrubber.
+func (t *Torrent) pieceScrubDue(i pieceIndex) time.Time {
+	interval := t.cl.config.ScrubInterval
+	p := t.piece(i)
+	if !p.lastVerified.IsZero() {
+		return p.lastVerified.Add(interval)
+	}
+	// Spread the pieces over the interval, so they aren't all due at once.
+	return t.scrubEpoch.Add(interval / time.Duration(t.numPieces()) * time.Duration(i))
+}
+
+// Scrubs the pieces, and reports the result.
+func (cl *Client) scrubPass(ctx context.Context, lim *rate.Limiter, pieces []scrubCandidate) {
+	report := ScrubReport{Started: time.Now()}
+	for _, c := range pieces {
+		if ctx.Err() != nil {
+			return
+		}
+		cl.scrubPiece(ctx, lim, c, &report)
+	}
+	report.Finished = time.Now()
+	if report.Pieces == 0 {
+		return
+	}
+	cl.lock()
+	defer cl.unlock()
+	cl.logger.Printf(
+		"scrubbed %d pieces (%d bytes) in %v: %d failed",
+		report.Pieces, report.Bytes, report.Finished.Sub(report.Started), len(report.Failed))
+	cl.publishEvent(ScrubFinishedEvent{report})
+}
+
+// Hashes the complete piece, marking it not complete if it fails, and adds the result to the
+// report. Pieces that are no longer complete, or have been verified or are being hashed for
+// another reason, are skipped.
+func (cl *Client) scrubPiece(ctx context.Context, lim *rate.Limiter, c scrubCandidate, report *ScrubReport) {
+	t, i := c.t, c.i
+	cl.lock()
+	p := t.piece(i)
+	// The piece may have been verified since it was taken from the queue.
+	if !t.pieceScrubbable(i) || !t.pieceScrubDue(i).Equal(c.due) {
+		cl.unlock()
+		return
+	}
+	p.hashing = true
+	t.publishPieceChange(i)
+	t.updatePiecePriority(i)
+	t.storageLock.RLock()
+	cl.unlock()
+	sum, err := t.hashPieceThrough(i, func(w io.Writer) io.Writer {
+		return scrubWriter{t, rateLimitedWriter{ctx, lim, w}}
+	})
+	verified := time.Now()
+	passed := err == nil || err == io.EOF
+	passed = passed && sum == *p.hash
+	if passed {
+		t.persistPieceVerified(i, verified)
+	}
+	t.storageLock.RUnlock()
+	cl.lock()
+	defer cl.unlock()
+	p.hashing = false
+	t.updatePiecePriority(i)
+	t.publishPieceChange(i)
+	if ctx.Err() != nil || t.closed.IsSet() {
+		return
+	}
+	report.Pieces++
+	report.Bytes += p.Info().Length()
+	if err == io.EOF {
+		err = nil
+	}
+	if passed {
+		p.lastVerified = verified
+		t.queueScrub(i)
+		cl.numPiecesScrubbedGood++
+		return
+	}
+	cl.numPiecesScrubbedBad++
+	if err != nil {
+		t.logger.WithDefaultLevel(log.Warning).Printf("error reading piece %d to scrub: %v", i, err)
+	} else {
+		t.logger.WithDefaultLevel(log.Warning).Printf("piece %d failed scrub", i)
+	}
+	report.Failed = append(report.Failed, ScrubFailure{t, i, err})
+	t.pieceHashed(i, false, err)
+}
+
+// Hashes data for the scrubber without holding the Torrent's storage lock while waiting on the
+// rate limiter, so that closing the storage isn't held up for the whole piece. The lock is held
+// again while the storage is read.
+type scrubWriter struct {
+	t *Torrent
+	w io.Writer
+}
+
+func (me scrubWriter) Write(b []byte) (n int, err error) {
+	me.t.storageLock.RUnlock()
+	n, err = me.w.Write(b)
+	me.t.storageLock.RLock()
+	if err == nil && me.t.closed.IsSet() {
+		// The storage may have been closed while the lock wasn't held.
+		err = errors.New("torrent closed")
+	}
+	return
+}
+
+// Waits on the limiter for the bytes written, splitting writes that are larger than its burst.
+type rateLimitedWriter struct {
+	ctx context.Context
+	l   *rate.Limiter
+	w   io.Writer
+}
+
+func (me rateLimitedWriter) Write(b []byte) (n int, err error) {
+	for len(b) != 0 {
+		chunk := b
+		if me.l.Limit() != rate.Inf && len(chunk) > me.l.Burst() {
+			chunk = chunk[:me.l.Burst()]
+		}
+		err = me.l.WaitN(me.ctx, len(chunk))
+		if err != nil {
+			return
+		}
+		var n1 int
+		n1, err = me.w.Write(chunk)
+		n += n1
+		b = b[n1:]
+		if err != nil {
+			return
+		}
+	}
+	return
+}
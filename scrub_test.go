@@ -0,0 +1,160 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"golang.org/x/time/rate"
+
+	"github.com/anacrolix/torrent/internal/testutil"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+func TestScrubberMarksCorruptPieceNotComplete(t *testing.T) {
+	c := qt.New(t)
+	greetingDataDir, greetingMetainfo := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDataDir)
+	cfg := TestingConfig(t)
+	cfg.DataDir = greetingDataDir
+	cfg.ScrubInterval = 100 * time.Millisecond
+	cl, err := NewClient(cfg)
+	c.Assert(err, qt.IsNil)
+	defer cl.Close()
+	sub := cl.SubscribeEvents(100)
+	defer sub.Close()
+	tt, err := cl.AddTorrent(greetingMetainfo)
+	c.Assert(err, qt.IsNil)
+	timeout := time.After(10 * time.Second)
+	// Returns the next scrub report.
+	nextReport := func() ScrubReport {
+		for {
+			select {
+			case e := <-sub.Events():
+				if e, ok := e.(ScrubFinishedEvent); ok {
+					return e.Report
+				}
+			case <-timeout:
+				c.Fatal("timed out waiting for scrub")
+			}
+		}
+	}
+	// Every piece is scrubbed without failing.
+	scrubbed := 0
+	for scrubbed < tt.NumPieces() {
+		r := nextReport()
+		c.Assert(r.Failed, qt.HasLen, 0)
+		c.Check(r.Bytes, qt.Not(qt.Equals), int64(0))
+		scrubbed += r.Pieces
+	}
+	c.Check(tt.BytesMissing(), qt.Equals, int64(0))
+
+	f, err := os.OpenFile(filepath.Join(greetingDataDir, testutil.GreetingFileName), os.O_WRONLY, 0)
+	c.Assert(err, qt.IsNil)
+	_, err = f.WriteAt([]byte("j"), 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+	for {
+		r := nextReport()
+		if len(r.Failed) == 0 {
+			continue
+		}
+		c.Assert(r.Failed, qt.HasLen, 1)
+		c.Check(r.Failed[0], qt.Equals, ScrubFailure{Torrent: tt, Piece: 0})
+		break
+	}
+	c.Check(tt.PieceState(0).Complete, qt.IsFalse)
+	c.Check(tt.BytesMissing(), qt.Equals, tt.Info().Piece(0).Length())
+}
+
+// Verification times are persisted in the piece completion, so pieces aren't all scrubbed again
+// after a restart.
+func TestScrubVerifiedTimesPersisted(t *testing.T) {
+	c := qt.New(t)
+	greetingDataDir, greetingMetainfo := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDataDir)
+	pc := storage.NewMapPieceCompletion()
+	newClient := func() *Client {
+		cfg := TestingConfig(t)
+		cfg.DefaultStorage = storage.NewFileWithCompletion(greetingDataDir, pc)
+		cfg.ScrubInterval = time.Hour
+		cl, err := NewClient(cfg)
+		c.Assert(err, qt.IsNil)
+		return cl
+	}
+	cl := newClient()
+	tt, err := cl.AddTorrent(greetingMetainfo)
+	c.Assert(err, qt.IsNil)
+	// The pieces' completion isn't known, so they're hashed when the torrent is added.
+	for tt.BytesMissing() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cl.Close()
+	verified, ok, err := pc.(storage.PieceVerifiedTimes).GetVerifiedTime(metainfo.PieceKey{
+		InfoHash: greetingMetainfo.HashInfoBytes(),
+		Index:    tt.NumPieces() - 1,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+
+	cl = newClient()
+	defer cl.Close()
+	tt, err = cl.AddTorrent(greetingMetainfo)
+	c.Assert(err, qt.IsNil)
+	cl.lock()
+	defer cl.unlock()
+	i := tt.NumPieces() - 1
+	c.Check(tt.piece(i).lastVerified.Equal(verified), qt.IsTrue)
+	c.Check(tt.pieceScrubDue(i).Equal(verified.Add(time.Hour)), qt.IsTrue)
+}
+
+// Pieces queued more than once are only due once, from when they were last verified.
+func TestScrubQueueDropsOutOfDateEntries(t *testing.T) {
+	c := qt.New(t)
+	greetingDataDir, greetingMetainfo := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDataDir)
+	cfg := TestingConfig(t)
+	cfg.DataDir = greetingDataDir
+	cfg.ScrubInterval = time.Hour
+	cl, err := NewClient(cfg)
+	c.Assert(err, qt.IsNil)
+	defer cl.Close()
+	tt, err := cl.AddTorrent(greetingMetainfo)
+	c.Assert(err, qt.IsNil)
+	tt.VerifyData()
+	cl.lock()
+	defer cl.unlock()
+	c.Assert(tt.haveAllPieces(), qt.IsTrue)
+	tt.queueScrub(0)
+	tt.queueScrub(0)
+	verified := tt.piece(1).lastVerified
+	due, next := cl.piecesDueForScrub(verified.Add(cfg.ScrubInterval - time.Second))
+	c.Check(due, qt.HasLen, 0)
+	c.Check(next.IsZero(), qt.IsFalse)
+	due, _ = cl.piecesDueForScrub(time.Now().Add(2 * cfg.ScrubInterval))
+	c.Assert(due, qt.HasLen, tt.NumPieces())
+	seen := make(map[pieceIndex]bool)
+	for _, d := range due {
+		c.Check(seen[d.i], qt.IsFalse)
+		seen[d.i] = true
+		c.Check(d.due, qt.Equals, tt.piece(d.i).lastVerified.Add(cfg.ScrubInterval))
+	}
+	c.Check(cl.scrubQueue.Len(), qt.Equals, 0)
+}
+
+// The scrubber can't make progress with a limiter that has no burst.
+func TestScrubRateLimiterWithoutBurst(t *testing.T) {
+	c := qt.New(t)
+	cfg := TestingConfig(t)
+	cfg.ScrubInterval = time.Hour
+	cfg.ScrubRateLimiter = rate.NewLimiter(1<<20, 0)
+	_, err := NewClient(cfg)
+	c.Check(err, qt.ErrorMatches, "scrub rate limiter has no burst")
+	cfg.ScrubRateLimiter = rate.NewLimiter(rate.Inf, 0)
+	cl, err := NewClient(cfg)
+	c.Assert(err, qt.IsNil)
+	cl.Close()
+}
@@ -29,6 +29,9 @@ type TorrentSpec struct {
 	// Whether to allow data download or upload
 	DisallowDataUpload   bool
 	DisallowDataDownload bool
+
+	// Request pieces in index order. See Torrent.SetSequential.
+	Sequential bool
 }
 
 func TorrentSpecFromMagnetUri(uri string) (spec *TorrentSpec, err error) {
@@ -0,0 +1,512 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/anacrolix/missinggo/slices"
+	"github.com/anacrolix/missinggo/v2"
+	"github.com/anacrolix/multiless"
+	"github.com/davecgh/go-spew/spew"
+	"github.com/dustin/go-humanize"
+)
+
+// A snapshot of the state of a Client, as rendered by Client.WriteStatus. Suitable for encoding as
+// JSON.
+type ClientStatus struct {
+	ListenPort int `json:"listenPort"`
+	// Hex encoded.
+	PeerID        string            `json:"peerId"`
+	ExtensionBits string            `json:"extensionBits"`
+	AnnounceKey   int32             `json:"announceKey"`
+	BannedIPs     int               `json:"bannedIps"`
+	Listeners     []ListenerStatus  `json:"listeners"`
+	DhtServers    []DhtServerStatus `json:"dhtServers"`
+	Stats         ConnStatsStatus   `json:"stats"`
+	Torrents      []TorrentStatus   `json:"torrents"`
+}
+
+// The values of ConnStats.
+type ConnStatsStatus struct {
+	BytesWritten                int64 `json:"bytesWritten"`
+	BytesWrittenData            int64 `json:"bytesWrittenData"`
+	BytesRead                   int64 `json:"bytesRead"`
+	BytesReadData               int64 `json:"bytesReadData"`
+	BytesReadUsefulData         int64 `json:"bytesReadUsefulData"`
+	BytesReadUsefulIntendedData int64 `json:"bytesReadUsefulIntendedData"`
+	ChunksWritten               int64 `json:"chunksWritten"`
+	ChunksRead                  int64 `json:"chunksRead"`
+	ChunksReadUseful            int64 `json:"chunksReadUseful"`
+	ChunksReadWasted            int64 `json:"chunksReadWasted"`
+	ChunksReadDuplicate         int64 `json:"chunksReadDuplicate"`
+	MetadataChunksRead          int64 `json:"metadataChunksRead"`
+	PiecesDirtiedGood           int64 `json:"piecesDirtiedGood"`
+	PiecesDirtiedBad            int64 `json:"piecesDirtiedBad"`
+}
+
+func connStatsStatus(cs *ConnStats) ConnStatsStatus {
+	return ConnStatsStatus{
+		BytesWritten:                cs.BytesWritten.Int64(),
+		BytesWrittenData:            cs.BytesWrittenData.Int64(),
+		BytesRead:                   cs.BytesRead.Int64(),
+		BytesReadData:               cs.BytesReadData.Int64(),
+		BytesReadUsefulData:         cs.BytesReadUsefulData.Int64(),
+		BytesReadUsefulIntendedData: cs.BytesReadUsefulIntendedData.Int64(),
+		ChunksWritten:               cs.ChunksWritten.Int64(),
+		ChunksRead:                  cs.ChunksRead.Int64(),
+		ChunksReadUseful:            cs.ChunksReadUseful.Int64(),
+		ChunksReadWasted:            cs.ChunksReadWasted.Int64(),
+		ChunksReadDuplicate:         cs.ChunksReadDuplicate.Int64(),
+		MetadataChunksRead:          cs.MetadataChunksRead.Int64(),
+		PiecesDirtiedGood:           cs.PiecesDirtiedGood.Int64(),
+		PiecesDirtiedBad:            cs.PiecesDirtiedBad.Int64(),
+	}
+}
+
+// The values of TorrentStats.
+type TorrentStatsStatus struct {
+	ConnStatsStatus
+	TotalPeers       int `json:"totalPeers"`
+	PendingPeers     int `json:"pendingPeers"`
+	ActivePeers      int `json:"activePeers"`
+	ConnectedSeeders int `json:"connectedSeeders"`
+	HalfOpenPeers    int `json:"halfOpenPeers"`
+}
+
+func torrentStatsStatus(ts *TorrentStats) TorrentStatsStatus {
+	return TorrentStatsStatus{
+		ConnStatsStatus:  connStatsStatus(&ts.ConnStats),
+		TotalPeers:       ts.TotalPeers,
+		PendingPeers:     ts.PendingPeers,
+		ActivePeers:      ts.ActivePeers,
+		ConnectedSeeders: ts.ConnectedSeeders,
+		HalfOpenPeers:    ts.HalfOpenPeers,
+	}
+}
+
+type ListenerStatus struct {
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+}
+
+type DhtServerStatus struct {
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+	// Hex encoded.
+	ID string `json:"id"`
+	// The value returned by DhtServer.Stats.
+	Stats interface{} `json:"stats"`
+}
+
+type TorrentStatus struct {
+	// Hex encoded.
+	InfoHash string `json:"infoHash"`
+	// Empty if not known.
+	Name     string `json:"name"`
+	HaveInfo bool   `json:"haveInfo"`
+	// The following are only set if HaveInfo.
+	Length             int64 `json:"length,omitempty"`
+	BytesMissing       int64 `json:"bytesMissing,omitempty"`
+	PieceLength        int64 `json:"pieceLength,omitempty"`
+	NumPieces          int   `json:"numPieces,omitempty"`
+	NumPiecesCompleted int   `json:"numPiecesCompleted,omitempty"`
+	// Runs of pieces with the same state.
+	PieceStateRuns PieceStateRuns `json:"pieceStateRuns,omitempty"`
+	// Runs of pieces with the same availability among connected peers.
+	PieceAvailabilityRuns []PieceAvailabilityRun `json:"pieceAvailabilityRuns,omitempty"`
+
+	MetadataLength int `json:"metadataLength"`
+	// Which metadata pieces have been obtained. Only set if the info isn't available yet.
+	MetadataHave []bool `json:"metadataHave,omitempty"`
+	ChunkSize    int    `json:"chunkSize"`
+	// Piece ranges that Readers are interested in.
+	ReaderPieces []PieceRange       `json:"readerPieces"`
+	Trackers     []TrackerStatus    `json:"trackers"`
+	DhtAnnounces int                `json:"dhtAnnounces"`
+	Stats        TorrentStatsStatus `json:"stats"`
+	Peers        []PeerStatus       `json:"peers"`
+}
+
+type PieceAvailabilityRun struct {
+	Length       int   `json:"length"`
+	Availability int64 `json:"availability"`
+}
+
+func (me PieceAvailabilityRun) String() string {
+	return fmt.Sprintf("%v(%v)", me.Length, me.Availability)
+}
+
+// A half-open range of piece indices.
+type PieceRange struct {
+	Begin int `json:"begin"`
+	End   int `json:"end"`
+}
+
+type TrackerStatus struct {
+	URL string `json:"url"`
+	// A human readable summary of the announce state.
+	Status string `json:"status"`
+	// Only set for trackers we announce to directly, and after an announce completes.
+	LastAnnounce *TrackerAnnounceStatus `json:"lastAnnounce,omitempty"`
+}
+
+type TrackerAnnounceStatus struct {
+	Completed time.Time     `json:"completed"`
+	Err       string        `json:"err,omitempty"`
+	NumPeers  int           `json:"numPeers"`
+	Interval  time.Duration `json:"interval"`
+}
+
+type PeerStatus struct {
+	// A human readable identification of the peer and its connection.
+	Description string `json:"description"`
+	Closed      bool   `json:"closed"`
+	RemoteAddr  string `json:"remoteAddr"`
+	Network     string `json:"network"`
+	Source      string `json:"source"`
+	// Hex encoded. Empty for peers that aren't BitTorrent protocol connections.
+	PeerID string `json:"peerId,omitempty"`
+	// The client name reported in the extended handshake.
+	ClientName string `json:"clientName,omitempty"`
+	// Local and remote interest and choking, and connection flags. See Peer.statusFlags.
+	Flags         string `json:"flags"`
+	Bep40Priority string `json:"bep40Priority"`
+
+	LastMessage          time.Time     `json:"lastMessage"`
+	Connected            time.Time     `json:"connected"`
+	LastHelpful          time.Time     `json:"lastHelpful"`
+	CumulativeInterest   time.Duration `json:"cumulativeInterest"`
+	TotalExpectingTime   time.Duration `json:"totalExpectingTime"`
+	PiecesHave           int           `json:"piecesHave"`
+	PiecesTotal          int           `json:"piecesTotal"`
+	PiecesTouched        int           `json:"piecesTouched"`
+	ChunksReadUseful     int64         `json:"chunksReadUseful"`
+	ChunksReadWasted     int64         `json:"chunksReadWasted"`
+	ChunksReadDuplicate  int64         `json:"chunksReadDuplicate"`
+	ChunksRead           int64         `json:"chunksRead"`
+	ChunksWritten        int64         `json:"chunksWritten"`
+	LocalRequests        int           `json:"localRequests"`
+	NominalMaxRequests   int           `json:"nominalMaxRequests"`
+	PeerMaxRequests      int           `json:"peerMaxRequests"`
+	PeerRequests         int           `json:"peerRequests"`
+	LocalMaxPeerRequests int           `json:"localMaxPeerRequests"`
+	// Useful bytes received per second while expecting chunks.
+	DownloadRate    float64              `json:"downloadRate"`
+	RequestedPieces []PieceRequestsCount `json:"requestedPieces"`
+}
+
+// The number of outstanding requests to a peer for a piece.
+type PieceRequestsCount struct {
+	Piece    int `json:"piece"`
+	Requests int `json:"requests"`
+}
+
+// Returns a snapshot of the state of the Client and its torrents.
+func (cl *Client) Status() ClientStatus {
+	cl.rLock()
+	defer cl.rUnlock()
+	return cl.statusLocked()
+}
+
+func (cl *Client) statusLocked() (ret ClientStatus) {
+	ret.ListenPort = cl.LocalPort()
+	ret.PeerID = hex.EncodeToString(cl.peerID[:])
+	ret.ExtensionBits = cl.config.Extensions.String()
+	ret.AnnounceKey = cl.announceKey()
+	ret.BannedIPs = len(cl.badPeerIPsLocked())
+	cl.eachListener(func(l Listener) bool {
+		ret.Listeners = append(ret.Listeners, ListenerStatus{
+			Network: l.Addr().Network(),
+			Addr:    l.Addr().String(),
+		})
+		return true
+	})
+	cl.eachDhtServer(func(s DhtServer) {
+		id := s.ID()
+		ret.DhtServers = append(ret.DhtServers, DhtServerStatus{
+			Network: s.Addr().Network(),
+			Addr:    s.Addr().String(),
+			ID:      hex.EncodeToString(id[:]),
+			Stats:   s.Stats(),
+		})
+	})
+	ret.Stats = connStatsStatus(&cl.stats)
+	for _, t := range slices.Sort(cl.torrentsAsSlice(), func(l, r *Torrent) bool {
+		return l.InfoHash().AsString() < r.InfoHash().AsString()
+	}).([]*Torrent) {
+		ret.Torrents = append(ret.Torrents, t.statusLocked())
+	}
+	return
+}
+
+// Returns a snapshot of the state of the Torrent.
+func (t *Torrent) Status() TorrentStatus {
+	t.cl.rLock()
+	defer t.cl.rUnlock()
+	return t.statusLocked()
+}
+
+func (t *Torrent) statusLocked() (ret TorrentStatus) {
+	ret.InfoHash = t.infoHash.HexString()
+	ret.Name = t.name()
+	ret.HaveInfo = t.haveInfo()
+	ret.MetadataLength = t.metadataSize()
+	ret.ChunkSize = int(t.chunkSize)
+	if t.haveInfo() {
+		ret.Length = *t.length
+		ret.BytesMissing = t.bytesMissingLocked()
+		ret.PieceLength = int64(t.usualPieceSize())
+		ret.NumPieces = t.numPieces()
+		ret.NumPiecesCompleted = t.numPiecesCompleted()
+		ret.PieceStateRuns = t.pieceStateRuns()
+		ret.PieceAvailabilityRuns = t.pieceAvailabilityRuns()
+	} else {
+		ret.MetadataHave = append([]bool(nil), t.metadataCompletedChunks...)
+	}
+	t.forReaderOffsetPieces(func(begin, end pieceIndex) (again bool) {
+		ret.ReaderPieces = append(ret.ReaderPieces, PieceRange{begin, end})
+		return true
+	})
+	for _, ta := range slices.Sort(slices.FromMapElems(t.trackerAnnouncers), func(l, r torrentTrackerAnnouncer) bool {
+		lu := l.URL()
+		ru := r.URL()
+		var luns, runs url.URL = *lu, *ru
+		luns.Scheme = ""
+		runs.Scheme = ""
+		var ml missinggo.MultiLess
+		ml.StrictNext(luns.String() == runs.String(), luns.String() < runs.String())
+		ml.StrictNext(lu.String() == ru.String(), lu.String() < ru.String())
+		return ml.Less()
+	}).([]torrentTrackerAnnouncer) {
+		ret.Trackers = append(ret.Trackers, trackerStatus(ta))
+	}
+	ret.DhtAnnounces = t.numDHTAnnounces
+	stats := t.statsLocked()
+	ret.Stats = torrentStatsStatus(&stats)
+	peers := t.peersAsSlice()
+	sort.Slice(peers, func(_i, _j int) bool {
+		i := peers[_i]
+		j := peers[_j]
+		if less, ok := multiless.New().EagerSameLess(
+			i.downloadRate() == j.downloadRate(), i.downloadRate() < j.downloadRate(),
+		).LessOk(); ok {
+			return less
+		}
+		return worseConn(i, j)
+	})
+	for _, p := range peers {
+		ret.Peers = append(ret.Peers, p.status())
+	}
+	return
+}
+
+func trackerStatus(ta torrentTrackerAnnouncer) (ret TrackerStatus) {
+	ret.URL = ta.URL().String()
+	ret.Status = ta.statusLine()
+	if ts, ok := ta.(*trackerScraper); ok && !ts.lastAnnounce.Completed.IsZero() {
+		la := ts.lastAnnounce
+		ret.LastAnnounce = &TrackerAnnounceStatus{
+			Completed: la.Completed,
+			NumPeers:  la.NumPeers,
+			Interval:  la.Interval,
+		}
+		if la.Err != nil {
+			ret.LastAnnounce.Err = la.Err.Error()
+		}
+	}
+	return
+}
+
+func (cn *Peer) status() (ret PeerStatus) {
+	ret.Description = cn.connStatusString()
+	ret.Closed = cn.closed.IsSet()
+	if cn.RemoteAddr != nil {
+		ret.RemoteAddr = cn.RemoteAddr.String()
+	}
+	ret.Network = cn.Network
+	ret.Source = string(cn.Discovery)
+	if pc, ok := cn.TryAsPeerConn(); ok {
+		ret.PeerID = hex.EncodeToString(pc.PeerID[:])
+	}
+	ret.ClientName = cn.PeerClientName
+	ret.Flags = cn.statusFlags()
+	prio, err := cn.peerPriority()
+	ret.Bep40Priority = fmt.Sprintf("%08x", prio)
+	if err != nil {
+		ret.Bep40Priority += ": " + err.Error()
+	}
+	ret.LastMessage = cn.lastMessageReceived
+	ret.Connected = cn.completedHandshake
+	ret.LastHelpful = cn.lastHelpful()
+	ret.CumulativeInterest = cn.cumInterest()
+	ret.TotalExpectingTime = cn.totalExpectingTime()
+	ret.PiecesHave = pieceIndex(cn._peerPieces.Len())
+	if cn.peerSentHaveAll {
+		ret.PiecesHave = cn.bestPeerNumPieces()
+	}
+	ret.PiecesTotal = cn.bestPeerNumPieces()
+	ret.PiecesTouched = len(cn.peerTouchedPieces)
+	ret.ChunksReadUseful = cn._stats.ChunksReadUseful.Int64()
+	ret.ChunksReadWasted = cn._stats.ChunksReadWasted.Int64()
+	ret.ChunksReadDuplicate = cn._stats.ChunksReadDuplicate.Int64()
+	ret.ChunksRead = cn._stats.ChunksRead.Int64()
+	ret.ChunksWritten = cn._stats.ChunksWritten.Int64()
+	ret.LocalRequests = cn.numLocalRequests()
+	ret.NominalMaxRequests = cn.nominalMaxRequests()
+	ret.PeerMaxRequests = cn.PeerMaxRequests
+	ret.PeerRequests = len(cn.peerRequests)
+	ret.LocalMaxPeerRequests = localClientReqq
+	ret.DownloadRate = cn.downloadRate()
+	for piece, count := range cn.numRequestsByPiece() {
+		ret.RequestedPieces = append(ret.RequestedPieces, PieceRequestsCount{piece, count})
+	}
+	sort.Slice(ret.RequestedPieces, func(i, j int) bool {
+		return ret.RequestedPieces[i].Piece < ret.RequestedPieces[j].Piece
+	})
+	return
+}
+
+func writeClientStatus(w io.Writer, s ClientStatus) {
+	fmt.Fprintf(w, "Listen port: %d\n", s.ListenPort)
+	var peerId PeerID
+	hex.Decode(peerId[:], []byte(s.PeerID))
+	fmt.Fprintf(w, "Peer ID: %+q\n", peerId)
+	fmt.Fprintf(w, "Extension bits: %v\n", s.ExtensionBits)
+	fmt.Fprintf(w, "Announce key: %x\n", s.AnnounceKey)
+	fmt.Fprintf(w, "Banned IPs: %d\n", s.BannedIPs)
+	for _, ds := range s.DhtServers {
+		fmt.Fprintf(w, "%s DHT server at %s:\n", ds.Network, ds.Addr)
+		fmt.Fprintf(w, " ID: %s\n", ds.ID)
+		spew.Fdump(w, ds.Stats)
+	}
+	spew.Fdump(w, &s.Stats)
+	fmt.Fprintf(w, "# Torrents: %d\n", len(s.Torrents))
+	fmt.Fprintln(w)
+	for _, t := range s.Torrents {
+		if t.Name == "" {
+			fmt.Fprint(w, "<unknown name>")
+		} else {
+			fmt.Fprint(w, t.Name)
+		}
+		fmt.Fprint(w, "\n")
+		if t.HaveInfo {
+			fmt.Fprintf(
+				w,
+				"%f%% of %d bytes (%s)",
+				100*(1-float64(t.BytesMissing)/float64(t.Length)),
+				t.Length,
+				humanize.Bytes(uint64(t.Length)))
+		} else {
+			fmt.Fprint(w, "<missing metainfo>")
+		}
+		fmt.Fprint(w, "\n")
+		writeTorrentStatus(w, t)
+		fmt.Fprintln(w)
+	}
+}
+
+func writeTorrentStatus(w io.Writer, t TorrentStatus) {
+	fmt.Fprintf(w, "Infohash: %s\n", t.InfoHash)
+	fmt.Fprintf(w, "Metadata length: %d\n", t.MetadataLength)
+	if !t.HaveInfo {
+		fmt.Fprintf(w, "Metadata have: ")
+		for _, h := range t.MetadataHave {
+			fmt.Fprintf(w, "%c", func() rune {
+				if h {
+					return 'H'
+				} else {
+					return '.'
+				}
+			}())
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "Piece length: %s\n",
+		func() string {
+			if t.HaveInfo {
+				return fmt.Sprintf("%v (%v chunks)",
+					t.PieceLength,
+					float64(t.PieceLength)/float64(t.ChunkSize))
+			} else {
+				return "no info"
+			}
+		}(),
+	)
+	if t.HaveInfo {
+		fmt.Fprintf(w, "Num Pieces: %d (%d completed)\n", t.NumPieces, t.NumPiecesCompleted)
+		fmt.Fprintf(w, "Piece States: %s\n", t.PieceStateRuns)
+		fmt.Fprintf(w, "Piece availability: %v\n", strings.Join(func() (ret []string) {
+			for _, run := range t.PieceAvailabilityRuns {
+				ret = append(ret, run.String())
+			}
+			return
+		}(), " "))
+	}
+	fmt.Fprintf(w, "Reader Pieces:")
+	for _, r := range t.ReaderPieces {
+		fmt.Fprintf(w, " %d:%d", r.Begin, r.End)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "Enabled trackers:\n")
+	func() {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "    URL\tExtra\n")
+		for _, ts := range t.Trackers {
+			fmt.Fprintf(tw, "    %q\t%v\n", ts.URL, ts.Status)
+		}
+		tw.Flush()
+	}()
+
+	fmt.Fprintf(w, "DHT Announces: %d\n", t.DhtAnnounces)
+
+	spew.Fdump(w, t.Stats)
+
+	for i, p := range t.Peers {
+		fmt.Fprintf(w, "%2d. ", i+1)
+		writePeerStatus(w, p)
+	}
+}
+
+func writePeerStatus(w io.Writer, p PeerStatus) {
+	// \t isn't preserved in <pre> blocks?
+	if p.Closed {
+		fmt.Fprint(w, "CLOSED: ")
+	}
+	fmt.Fprintln(w, p.Description)
+	fmt.Fprintf(w, "    bep40-prio: %v\n", p.Bep40Priority)
+	fmt.Fprintf(w, "    last msg: %s, connected: %s, last helpful: %s, itime: %s, etime: %s\n",
+		eventAgeString(p.LastMessage),
+		eventAgeString(p.Connected),
+		eventAgeString(p.LastHelpful),
+		p.CumulativeInterest,
+		p.TotalExpectingTime,
+	)
+	fmt.Fprintf(w,
+		"    %d/%d completed, %d pieces touched, good chunks: %v/%v-%v reqq: %d/(%d/%d)-%d/%d, flags: %s, dr: %.1f KiB/s\n",
+		p.PiecesHave,
+		p.PiecesTotal,
+		p.PiecesTouched,
+		p.ChunksReadUseful,
+		p.ChunksRead,
+		p.ChunksWritten,
+		p.LocalRequests,
+		p.NominalMaxRequests,
+		p.PeerMaxRequests,
+		p.PeerRequests,
+		p.LocalMaxPeerRequests,
+		p.Flags,
+		p.DownloadRate/(1<<10),
+	)
+	fmt.Fprintf(w, "    requested pieces:")
+	for _, elem := range p.RequestedPieces {
+		fmt.Fprintf(w, " %v(%v)", elem.Piece, elem.Requests)
+	}
+	fmt.Fprintf(w, "\n")
+}
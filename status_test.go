@@ -0,0 +1,75 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/internal/testutil"
+)
+
+func TestClientStatusSeededTorrent(t *testing.T) {
+	c := qt.New(t)
+	greetingDataDir, greetingMetainfo := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDataDir)
+	cfg := TestingConfig(t)
+	cfg.DataDir = greetingDataDir
+	cl, err := NewClient(cfg)
+	c.Assert(err, qt.IsNil)
+	defer cl.Close()
+	tt, err := cl.AddTorrent(greetingMetainfo)
+	c.Assert(err, qt.IsNil)
+	tt.VerifyData()
+	status := cl.Status()
+	c.Check(status.ListenPort, qt.Equals, cl.LocalPort())
+	c.Assert(status.Torrents, qt.HasLen, 1)
+	ts := status.Torrents[0]
+	c.Check(ts.InfoHash, qt.Equals, tt.InfoHash().HexString())
+	c.Check(ts.HaveInfo, qt.IsTrue)
+	c.Check(ts.NumPieces, qt.Equals, tt.NumPieces())
+	c.Check(ts.NumPiecesCompleted, qt.Equals, tt.NumPieces())
+	c.Check(ts.BytesMissing, qt.Equals, int64(0))
+	b, err := json.Marshal(status)
+	c.Assert(err, qt.IsNil)
+	var decoded ClientStatus
+	c.Assert(json.Unmarshal(b, &decoded), qt.IsNil)
+	c.Check(decoded.Torrents[0].InfoHash, qt.Equals, ts.InfoHash)
+	c.Check(decoded.Torrents[0].Length, qt.Equals, ts.Length)
+	var buf bytes.Buffer
+	cl.WriteStatus(&buf)
+	c.Check(buf.String(), qt.Contains, "Listen port:")
+	c.Check(buf.String(), qt.Contains, tt.InfoHash().HexString())
+}
+
+// Counters are marshalled as numbers from the Status values, which are what callers are given.
+func TestClientStatusJSONCounts(t *testing.T) {
+	c := qt.New(t)
+	cl, err := NewClient(TestingConfig(t))
+	c.Assert(err, qt.IsNil)
+	defer cl.Close()
+	tt, err := cl.AddTorrent(testutil.GreetingMetaInfo())
+	c.Assert(err, qt.IsNil)
+	cl.lock()
+	cl.stats.BytesRead.Add(3)
+	tt.stats.ChunksRead.Add(2)
+	cl.unlock()
+	b, err := json.Marshal(cl.Status())
+	c.Assert(err, qt.IsNil)
+	var decoded struct {
+		Stats struct {
+			BytesRead int64 `json:"bytesRead"`
+		} `json:"stats"`
+		Torrents []struct {
+			Stats struct {
+				ChunksRead int64 `json:"chunksRead"`
+			} `json:"stats"`
+		} `json:"torrents"`
+	}
+	c.Assert(json.Unmarshal(b, &decoded), qt.IsNil)
+	c.Check(decoded.Stats.BytesRead, qt.Equals, int64(3))
+	c.Assert(decoded.Torrents, qt.HasLen, 1)
+	c.Check(decoded.Torrents[0].Stats.ChunksRead, qt.Equals, int64(2))
+}
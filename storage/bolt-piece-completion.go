@@ -21,13 +21,21 @@ const (
 
 var (
 	completionBucketKey = []byte("completion")
+	// Hold the last access and verified times of pieces, as Unix nanoseconds, in a bucket per
+	// infohash.
+	accessBucketKey   = []byte("access")
+	verifiedBucketKey = []byte("verified")
 )
 
 type boltPieceCompletion struct {
 	db *bbolt.DB
 }
 
-var _ PieceCompletion = (*boltPieceCompletion)(nil)
+var _ interface {
+	PieceCompletion
+	PieceAccessTimes
+	PieceVerifiedTimes
+} = (*boltPieceCompletion)(nil)
 
 func NewBoltPieceCompletion(dir string) (ret PieceCompletion, err error) {
 	os.MkdirAll(dir, 0770)
@@ -94,6 +102,64 @@ func (me boltPieceCompletion) Set(pk metainfo.PieceKey, b bool) error {
 	})
 }
 
+func (me boltPieceCompletion) GetAccessTime(pk metainfo.PieceKey) (time.Time, bool, error) {
+	return me.getTime(accessBucketKey, pk)
+}
+
+func (me boltPieceCompletion) SetAccessTime(pk metainfo.PieceKey, t time.Time) error {
+	return me.setTime(accessBucketKey, pk, t)
+}
+
+func (me boltPieceCompletion) GetVerifiedTime(pk metainfo.PieceKey) (time.Time, bool, error) {
+	return me.getTime(verifiedBucketKey, pk)
+}
+
+func (me boltPieceCompletion) SetVerifiedTime(pk metainfo.PieceKey, t time.Time) error {
+	return me.setTime(verifiedBucketKey, pk, t)
+}
+
+// Gets a piece's time from the bucket of per-infohash buckets.
+func (me boltPieceCompletion) getTime(bucketKey []byte, pk metainfo.PieceKey) (t time.Time, ok bool, err error) {
+	err = me.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketKey)
+		if b == nil {
+			return nil
+		}
+		ih := b.Bucket(pk.InfoHash[:])
+		if ih == nil {
+			return nil
+		}
+		var key [4]byte
+		binary.BigEndian.PutUint32(key[:], uint32(pk.Index))
+		v := ih.Get(key[:])
+		if len(v) != 8 {
+			return nil
+		}
+		t = time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+		ok = true
+		return nil
+	})
+	return
+}
+
+func (me boltPieceCompletion) setTime(bucketKey []byte, pk metainfo.PieceKey, t time.Time) error {
+	return me.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketKey)
+		if err != nil {
+			return err
+		}
+		ih, err := b.CreateBucketIfNotExists(pk.InfoHash[:])
+		if err != nil {
+			return err
+		}
+		var key [4]byte
+		binary.BigEndian.PutUint32(key[:], uint32(pk.Index))
+		var value [8]byte
+		binary.BigEndian.PutUint64(value[:], uint64(t.UnixNano()))
+		return ih.Put(key[:], value[:])
+	})
+}
+
 func (me *boltPieceCompletion) Close() error {
 	return me.db.Close()
 }
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -38,3 +39,32 @@ func TestBoltPieceCompletion(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, Completion{Complete: true, Ok: true}, b)
 }
+
+func TestBoltPieceCompletionTimes(t *testing.T) {
+	pc, err := NewBoltPieceCompletion(t.TempDir())
+	require.NoError(t, err)
+	defer pc.Close()
+	pk := metainfo.PieceKey{Index: 1}
+	times := pc.(interface {
+		PieceAccessTimes
+		PieceVerifiedTimes
+	})
+
+	_, ok, err := times.GetVerifiedTime(pk)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	accessed := time.Unix(1, 0)
+	verified := time.Unix(2, 0)
+	require.NoError(t, times.SetAccessTime(pk, accessed))
+	require.NoError(t, times.SetVerifiedTime(pk, verified))
+
+	at, ok, err := times.GetAccessTime(pk)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, at.Equal(accessed))
+	vt, ok, err := times.GetVerifiedTime(pk)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, vt.Equal(verified))
+}
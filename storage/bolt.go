@@ -22,6 +22,8 @@ const (
 
 type boltClient struct {
 	db *bbolt.DB
+	// Nil if there's no capacity.
+	lru *lruCapacity
 }
 
 type boltTorrent struct {
@@ -30,12 +32,31 @@ type boltTorrent struct {
 }
 
 func NewBoltDB(filePath string) ClientImplCloser {
-	db, err := bbolt.Open(filepath.Join(filePath, "bolt.db"), 0600, &bbolt.Options{
+	ret, err := NewBoltDBOpts(BoltDBOpts{Dir: filePath})
+	expect.Nil(err)
+	return ret
+}
+
+type BoltDBOpts struct {
+	// The directory containing the database.
+	Dir string
+	// The most bytes of complete piece data kept for all the torrents opened with the client. The
+	// least recently used complete pieces are deleted to make room, and are marked not complete.
+	// Zero means no limit.
+	Capacity int64
+}
+
+func NewBoltDBOpts(opts BoltDBOpts) (ClientImplCloser, error) {
+	db, err := bbolt.Open(filepath.Join(opts.Dir, "bolt.db"), 0600, &bbolt.Options{
 		Timeout: time.Second,
 	})
-	expect.Nil(err)
+	if err != nil {
+		return nil, err
+	}
 	db.NoSync = true
-	return &boltClient{db}
+	ret := &boltClient{db: db}
+	ret.lru = newLRUCapacity(opts.Capacity, boltPieceCompletion{db}, ret.evictPiece)
+	return ret, nil
 }
 
 func (me *boltClient) Close() error {
@@ -44,10 +65,46 @@ func (me *boltClient) Close() error {
 
 func (me *boltClient) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (TorrentImpl, error) {
 	t := &boltTorrent{me, infoHash}
-	return TorrentImpl{
+	ret := TorrentImpl{
 		Piece: t.Piece,
 		Close: t.Close,
-	}, nil
+	}
+	if me.lru != nil {
+		err := me.lru.addTorrent(info, infoHash)
+		if err != nil {
+			return TorrentImpl{}, err
+		}
+		ret.Capacity = &me.lru.capFunc
+		ret.OnPieceEvicted = func(f func(int)) {
+			me.lru.setOnEvicted(infoHash, f)
+		}
+	}
+	return ret, nil
+}
+
+// Deletes the piece's chunks and marks it not complete.
+func (me *boltClient) evictPiece(pk metainfo.PieceKey, length int64) error {
+	err := me.db.Update(func(tx *bbolt.Tx) error {
+		db := tx.Bucket(dataBucketKey)
+		if db == nil {
+			return nil
+		}
+		p := boltPiece{ih: pk.InfoHash}
+		copy(p.key[:], pk.InfoHash[:])
+		binary.BigEndian.PutUint32(p.key[20:], uint32(pk.Index))
+		for ci := 0; int64(ci)*chunkSize < length; ci++ {
+			ck := p.chunkKey(ci)
+			err := db.Delete(ck[:])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return boltPieceCompletion{me.db}.Set(pk, false)
 }
 
 func (me *boltTorrent) Piece(p metainfo.Piece) PieceImpl {
@@ -58,6 +115,9 @@ func (me *boltTorrent) Piece(p metainfo.Piece) PieceImpl {
 	}
 	copy(ret.key[:], me.ih[:])
 	binary.BigEndian.PutUint32(ret.key[20:], uint32(p.Index()))
+	if me.cl.lru != nil {
+		return lruPieceImpl{ret, me.cl.lru, p, ret.pk()}
+	}
 	return ret
 }
 
@@ -0,0 +1,326 @@
+package storage
+
+import (
+	"container/list"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Access times of pieces that are read are persisted at most this often, so that reads don't each
+// write to the piece completion.
+const lruAccessPersistInterval = time.Minute
+
+var errPieceEvicted = errors.New("piece evicted from storage")
+
+// Bounds the complete piece data of all the torrents opened with a storage client, evicting the
+// least recently used complete pieces to make room for newly completed ones. Pieces count against
+// the capacity from when their torrent is first opened with the client.
+type lruCapacity struct {
+	capacity int64
+	// Shared by all the client's torrents, so their pieces count against the same capacity.
+	capFunc     func() *int64
+	completion  PieceCompletionGetSetter
+	accessTimes PieceAccessTimes
+	// Removes the piece's data, and marks it not complete.
+	evict func(_ metainfo.PieceKey, length int64) error
+
+	// Held for reading while piece data is read or written, and for writing while it's evicted,
+	// so that reads never return data that's being removed. Pieces share them by their key, so
+	// evicting a piece only holds up the few pieces that share its lock. Acquired before mu.
+	dataMus [64]sync.RWMutex
+
+	mu   sync.Mutex
+	used int64
+	// Complete pieces, most recently used first.
+	lru    list.List
+	pieces map[metainfo.PieceKey]*lruPiece
+	// Pieces that have been evicted, and not written since.
+	evicted map[metainfo.PieceKey]struct{}
+	// Called with the index of each piece of the torrent that's evicted, see
+	// TorrentImpl.OnPieceEvicted.
+	onEvicted map[metainfo.Hash]func(int)
+}
+
+type lruPiece struct {
+	key    metainfo.PieceKey
+	length int64
+	// When the piece was last used, and when that was last persisted.
+	accessed, persisted time.Time
+	elem                *list.Element
+}
+
+// Returns nil if capacity is zero, which means no limit.
+func newLRUCapacity(
+	capacity int64,
+	completion PieceCompletionGetSetter,
+	evict func(_ metainfo.PieceKey, length int64) error,
+) *lruCapacity {
+	if capacity == 0 {
+		return nil
+	}
+	l := &lruCapacity{
+		capacity:   capacity,
+		completion: completion,
+		evict:      evict,
+		pieces:     make(map[metainfo.PieceKey]*lruPiece),
+		evicted:    make(map[metainfo.PieceKey]struct{}),
+		onEvicted:  make(map[metainfo.Hash]func(int)),
+	}
+	l.accessTimes, _ = completion.(PieceAccessTimes)
+	l.capFunc = func() *int64 {
+		c := capacity
+		return &c
+	}
+	return l
+}
+
+// Adds the torrent's complete pieces, ordered by their persisted access times, and evicts pieces
+// if they don't fit.
+func (l *lruCapacity) addTorrent(info *metainfo.Info, infoHash metainfo.Hash) error {
+	var added []*lruPiece
+	for i := 0; i < info.NumPieces(); i++ {
+		pk := metainfo.PieceKey{InfoHash: infoHash, Index: i}
+		c, err := l.completion.Get(pk)
+		if err != nil {
+			return err
+		}
+		if !c.Complete {
+			continue
+		}
+		p := &lruPiece{key: pk, length: info.Piece(i).Length()}
+		if l.accessTimes != nil {
+			p.accessed, _, err = l.accessTimes.GetAccessTime(pk)
+			if err != nil {
+				return err
+			}
+			p.persisted = p.accessed
+		}
+		added = append(added, p)
+	}
+	l.mu.Lock()
+	all := make([]*lruPiece, 0, l.lru.Len()+len(added))
+	for e := l.lru.Front(); e != nil; e = e.Next() {
+		all = append(all, e.Value.(*lruPiece))
+	}
+	for _, p := range added {
+		if _, ok := l.pieces[p.key]; ok {
+			continue
+		}
+		l.pieces[p.key] = p
+		l.used += p.length
+		all = append(all, p)
+	}
+	// Pieces without a persisted access time are treated as the least recently used.
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].accessed.After(all[j].accessed)
+	})
+	l.lru.Init()
+	for _, p := range all {
+		p.elem = l.lru.PushBack(p)
+	}
+	victims := l.takeVictims(nil)
+	l.mu.Unlock()
+	l.evictVictims(victims)
+	return nil
+}
+
+// Removes least recently used pieces other than keep from the LRU until the rest fit, and returns
+// them. They read as evicted from now on.
+func (l *lruCapacity) takeVictims(keep *lruPiece) (victims []*lruPiece) {
+	for e := l.lru.Back(); e != nil && l.used > l.capacity; {
+		p := e.Value.(*lruPiece)
+		e = e.Prev()
+		if p == keep {
+			continue
+		}
+		l.remove(p)
+		l.evicted[p.key] = struct{}{}
+		victims = append(victims, p)
+	}
+	return
+}
+
+func (l *lruCapacity) dataMu(pk metainfo.PieceKey) *sync.RWMutex {
+	return &l.dataMus[(int(pk.InfoHash[0])+pk.Index)%len(l.dataMus)]
+}
+
+// Evicts the pieces that haven't been written since they were taken, each after waiting for reads
+// and writes of it in progress, and tells their torrents.
+func (l *lruCapacity) evictVictims(victims []*lruPiece) {
+	for _, p := range victims {
+		if !l.evictVictim(p) {
+			continue
+		}
+		l.mu.Lock()
+		f := l.onEvicted[p.key.InfoHash]
+		l.mu.Unlock()
+		if f != nil {
+			f(p.key.Index)
+		}
+	}
+}
+
+// Returns whether the piece was evicted.
+func (l *lruCapacity) evictVictim(p *lruPiece) bool {
+	mu := l.dataMu(p.key)
+	mu.Lock()
+	defer mu.Unlock()
+	l.mu.Lock()
+	_, ok := l.evicted[p.key]
+	l.mu.Unlock()
+	if !ok {
+		return false
+	}
+	err := l.evict(p.key, p.length)
+	if err != nil {
+		log.Printf("error evicting piece %v of %v: %v", p.key.Index, p.key.InfoHash, err)
+	}
+	return true
+}
+
+// Sets the function called when pieces of the torrent are evicted. Nil removes it.
+func (l *lruCapacity) setOnEvicted(infoHash metainfo.Hash, f func(int)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f == nil {
+		delete(l.onEvicted, infoHash)
+	} else {
+		l.onEvicted[infoHash] = f
+	}
+}
+
+func (l *lruCapacity) remove(p *lruPiece) {
+	l.lru.Remove(p.elem)
+	delete(l.pieces, p.key)
+	l.used -= p.length
+}
+
+// Records a use of the piece, persisting it if the last persisted use is old enough.
+func (l *lruCapacity) touch(p *lruPiece, now time.Time, persist bool) {
+	l.lru.MoveToFront(p.elem)
+	p.accessed = now
+	if l.accessTimes == nil || !persist && now.Sub(p.persisted) < lruAccessPersistInterval {
+		return
+	}
+	err := l.accessTimes.SetAccessTime(p.key, now)
+	if err != nil {
+		log.Printf("error persisting access time of piece %v of %v: %v", p.key.Index, p.key.InfoHash, err)
+		return
+	}
+	p.persisted = now
+}
+
+// Calls f if the torrent's pieces in [begin, end) have all been evicted, and not written since.
+// Writes to the pieces wait for f to return, so they aren't lost to what it does.
+func (l *lruCapacity) ifAllEvicted(infoHash metainfo.Hash, begin, end int, f func() error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := begin; i < end; i++ {
+		if _, ok := l.evicted[metainfo.PieceKey{InfoHash: infoHash, Index: i}]; !ok {
+			return nil
+		}
+	}
+	return f()
+}
+
+// Starts a read of the piece's data. The returned function must be called when the read is done.
+func (l *lruCapacity) startRead(pk metainfo.PieceKey) (done func(), err error) {
+	dataMu := l.dataMu(pk)
+	dataMu.RLock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.evicted[pk]; ok {
+		dataMu.RUnlock()
+		return nil, errPieceEvicted
+	}
+	if p, ok := l.pieces[pk]; ok {
+		l.touch(p, time.Now(), false)
+	}
+	return dataMu.RUnlock, nil
+}
+
+// Starts a write to the piece's data. The returned function must be called when the write is done.
+func (l *lruCapacity) startWrite(pk metainfo.PieceKey) (done func()) {
+	dataMu := l.dataMu(pk)
+	dataMu.RLock()
+	l.mu.Lock()
+	delete(l.evicted, pk)
+	l.mu.Unlock()
+	return dataMu.RUnlock
+}
+
+// Adds a newly completed piece as the most recently used, and evicts other pieces if it doesn't
+// fit.
+func (l *lruCapacity) completed(pk metainfo.PieceKey, length int64) {
+	l.mu.Lock()
+	p, ok := l.pieces[pk]
+	if !ok {
+		p = &lruPiece{key: pk, length: length}
+		p.elem = l.lru.PushFront(p)
+		l.pieces[pk] = p
+		l.used += length
+	}
+	delete(l.evicted, pk)
+	l.touch(p, time.Now(), true)
+	victims := l.takeVictims(p)
+	l.mu.Unlock()
+	l.evictVictims(victims)
+}
+
+// Stops counting a piece that's no longer complete.
+func (l *lruCapacity) notComplete(pk metainfo.PieceKey) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if p, ok := l.pieces[pk]; ok {
+		l.remove(p)
+	}
+}
+
+// Wraps pieces of storage with a capacity, to track their use and refuse reads of evicted data.
+type lruPieceImpl struct {
+	PieceImpl
+	l  *lruCapacity
+	mp metainfo.Piece
+	pk metainfo.PieceKey
+}
+
+func (p lruPieceImpl) ReadAt(b []byte, off int64) (int, error) {
+	done, err := p.l.startRead(p.pk)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	return p.PieceImpl.ReadAt(b, off)
+}
+
+func (p lruPieceImpl) WriteAt(b []byte, off int64) (int, error) {
+	defer p.l.startWrite(p.pk)()
+	return p.PieceImpl.WriteAt(b, off)
+}
+
+func (p lruPieceImpl) MarkComplete() error {
+	err := p.PieceImpl.MarkComplete()
+	if err != nil {
+		return err
+	}
+	p.l.completed(p.pk, p.mp.Length())
+	return nil
+}
+
+func (p lruPieceImpl) MarkNotComplete() error {
+	p.l.notComplete(p.pk)
+	return p.PieceImpl.MarkNotComplete()
+}
+
+func (p lruPieceImpl) Completion() Completion {
+	c := p.PieceImpl.Completion()
+	if c.Ok && !c.Complete {
+		p.l.notComplete(p.pk)
+	}
+	return c
+}
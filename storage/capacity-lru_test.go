@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func testLRUCapacityEvictsAcrossTorrents(t *testing.T, newClient func(dir string, capacity int64) ClientImplCloser) {
+	c := qt.New(t)
+	// Room for two pieces.
+	ci := newClient(t.TempDir(), 8<<10)
+	defer ci.Close()
+	info := writeBackTestInfo(2)
+	t1, err := ci.OpenTorrent(info, metainfo.Hash{1})
+	c.Assert(err, qt.IsNil)
+	t2, err := ci.OpenTorrent(info, metainfo.Hash{2})
+	c.Assert(err, qt.IsNil)
+	c.Assert(t1.Capacity, qt.Not(qt.IsNil))
+	c.Check(t1.Capacity, qt.Equals, t2.Capacity)
+	c.Check(*(*t1.Capacity)(), qt.Equals, int64(8<<10))
+	c.Assert(t1.OnPieceEvicted, qt.Not(qt.IsNil))
+	var evicted []int
+	t1.OnPieceEvicted(func(i int) { evicted = append(evicted, i) })
+	p1 := func(i int) Piece { return Torrent{TorrentImpl: t1}.Piece(info.Piece(i)) }
+	for i := 0; i < 2; i++ {
+		writePieceChunks(c, p1(i), bytes.Repeat([]byte{byte('a' + i)}, 4<<10))
+		c.Assert(p1(i).MarkComplete(), qt.IsNil)
+	}
+	// Piece 0 is read, so piece 1 is evicted to make room for the other torrent's piece.
+	b := make([]byte, 2)
+	_, err = p1(0).ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(string(b), qt.Equals, "aa")
+	p2 := Torrent{TorrentImpl: t2}.Piece(info.Piece(0))
+	writePieceChunks(c, p2, bytes.Repeat([]byte{'c'}, 4<<10))
+	c.Assert(p2.MarkComplete(), qt.IsNil)
+	c.Check(p1(0).Completion().Complete, qt.IsTrue)
+	c.Check(p1(1).Completion().Complete, qt.IsFalse)
+	c.Check(evicted, qt.DeepEquals, []int{1})
+	_, err = p1(1).ReadAt(b, 0)
+	c.Check(err, qt.Not(qt.IsNil))
+	c.Check(p2.Completion().Complete, qt.IsTrue)
+	// The evicted piece can be downloaded again.
+	writePieceChunks(c, p1(1), bytes.Repeat([]byte{'d'}, 4<<10))
+	c.Assert(p1(1).MarkComplete(), qt.IsNil)
+	_, err = p1(1).ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(string(b), qt.Equals, "dd")
+	c.Check(p1(0).Completion().Complete, qt.IsFalse)
+	c.Check(evicted, qt.DeepEquals, []int{1, 0})
+}
+
+func TestFileCapacityEvictsAcrossTorrents(t *testing.T) {
+	testLRUCapacityEvictsAcrossTorrents(t, func(dir string, capacity int64) ClientImplCloser {
+		return NewFileOpts(FileOpts{
+			BaseDir:         dir,
+			PathMaker:       infoHashPathMaker,
+			PieceCompletion: NewMapPieceCompletion(),
+			Capacity:        capacity,
+		})
+	})
+}
+
+func TestBoltDBCapacityEvictsAcrossTorrents(t *testing.T) {
+	testLRUCapacityEvictsAcrossTorrents(t, func(dir string, capacity int64) ClientImplCloser {
+		ci, err := NewBoltDBOpts(BoltDBOpts{Dir: dir, Capacity: capacity})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ci
+	})
+}
+
+func TestFileCapacityUsesPersistedAccessTimes(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	pc, err := NewBoltPieceCompletion(dir)
+	c.Assert(err, qt.IsNil)
+	defer pc.Close()
+	newClient := func(capacity int64) ClientImplCloser {
+		return NewFileOpts(FileOpts{BaseDir: dir, PieceCompletion: pc, Capacity: capacity})
+	}
+	// Piece 0 is file "a", and pieces 1 and 2 are in file "b".
+	info := &metainfo.Info{
+		Name:        "t",
+		PieceLength: 4 << 10,
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 4 << 10},
+			{Path: []string{"b"}, Length: 8 << 10},
+		},
+		Pieces: make([]byte, 3*metainfo.HashSize),
+	}
+	ci := newClient(12 << 10)
+	ti, err := ci.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	for _, i := range []int{0, 2, 1} {
+		p := ti.Piece(info.Piece(i))
+		writePieceChunks(c, p, bytes.Repeat([]byte{byte('a' + i)}, 4<<10))
+		c.Assert(p.MarkComplete(), qt.IsNil)
+	}
+
+	// Reopening with less capacity evicts the piece that was completed first.
+	ci = newClient(8 << 10)
+	ti, err = ci.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	ts := Torrent{TorrentImpl: ti}
+	var complete []bool
+	for i := 0; i < info.NumPieces(); i++ {
+		complete = append(complete, ts.Piece(info.Piece(i)).Completion().Complete)
+	}
+	c.Check(complete, qt.DeepEquals, []bool{false, true, true})
+	// The evicted piece's file is removed, and the other data is kept.
+	_, err = os.Stat(filepath.Join(dir, "t", "a"))
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+	b := make([]byte, 2)
+	_, err = ts.Piece(info.Piece(1)).ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(string(b), qt.Equals, "bb")
+}
+
+// Where holes can't be punched, a file is removed once all its pieces are evicted.
+func TestFileCapacityWithoutHolePunching(t *testing.T) {
+	c := qt.New(t)
+	defer func(old bool) { canPunchHoles = old }(canPunchHoles)
+	canPunchHoles = false
+	dir := t.TempDir()
+	// Room for one piece.
+	ci := NewFileOpts(FileOpts{BaseDir: dir, PieceCompletion: NewMapPieceCompletion(), Capacity: 4 << 10})
+	defer ci.Close()
+	// Piece 0 is file "a", and pieces 1 and 2 are in file "b".
+	info := &metainfo.Info{
+		Name:        "t",
+		PieceLength: 4 << 10,
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 4 << 10},
+			{Path: []string{"b"}, Length: 8 << 10},
+		},
+		Pieces: make([]byte, 3*metainfo.HashSize),
+	}
+	ti, err := ci.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	complete := func(i int) {
+		p := ti.Piece(info.Piece(i))
+		writePieceChunks(c, p, bytes.Repeat([]byte{byte('a' + i)}, 4<<10))
+		c.Assert(p.MarkComplete(), qt.IsNil)
+	}
+	bPath := filepath.Join(dir, "t", "b")
+	complete(1)
+	// Piece 1 is evicted, but "b" still has piece 2.
+	complete(2)
+	st, err := os.Stat(bPath)
+	c.Assert(err, qt.IsNil)
+	c.Check(st.Size(), qt.Equals, int64(8<<10))
+	// Once piece 2 is evicted too, "b" is removed.
+	complete(0)
+	_, err = os.Stat(bPath)
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+}
@@ -0,0 +1,492 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+type DedupFileOpts struct {
+	// Capacity isn't supported, as evicting data would leave holes in files shared with the store.
+	FileOpts
+	// Where completed files are stored by content, shared by all torrents. It must be on the same
+	// filesystem as the torrent data, so files can be reflinked or hardlinked.
+	StoreDir string
+}
+
+// File storage that deduplicates identical files across torrents. Completed files are added to a
+// content-addressed store, sharing data with the torrent's file through a reflink where the
+// filesystem supports them, and otherwise a hardlink. Pieces can be written again after they're
+// complete, such as when they fail a check, so hardlinked files are copied before they're written
+// to. Files changed other than through the storage change the store too. Nothing is stored where
+// data can't be shared, such as for hardlinks on systems other than Linux. When a torrent is
+// opened, stored files of the same length as its files are checked against the piece hashes in
+// the background, and matching data is shared with them and its pieces marked complete without
+// being downloaded. Data isn't read or written until that's done, and TorrentImpl.Allocated waits
+// for it.
+func NewDedupFile(opts DedupFileOpts) ClientImplCloser {
+	opts.Capacity = 0
+	return &dedupClientImpl{
+		fileClientImpl: NewFileOpts(opts.FileOpts).(*fileClientImpl),
+		storeDir:       opts.StoreDir,
+	}
+}
+
+type dedupClientImpl struct {
+	*fileClientImpl
+	storeDir string
+	// Files being added to the store.
+	ingesting sync.WaitGroup
+}
+
+// Waits for files to be added to the store before closing.
+func (me *dedupClientImpl) Close() error {
+	me.ingesting.Wait()
+	return me.fileClientImpl.Close()
+}
+
+func (me *dedupClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (TorrentImpl, error) {
+	fts, err := me.fileClientImpl.openTorrent(info, infoHash)
+	if err != nil {
+		return TorrentImpl{}, err
+	}
+	t := &dedupTorrentImpl{
+		c:         me,
+		fts:       fts,
+		info:      info,
+		ingesting: make(map[int]bool),
+		linked:    make([]bool, len(fts.files)),
+	}
+	// Stored copies replace the files, so they're used after preallocation, and data access waits
+	// for both.
+	preallocation := fts.allocation
+	fts.allocation = startAllocation(func() error {
+		err := preallocation.wait()
+		if err != nil {
+			return err
+		}
+		t.findLinkedFiles()
+		for i := range fts.files {
+			err := t.useStoredFile(i)
+			if err != nil {
+				log.Printf("dedup storage: error looking for stored copy of %q: %v", fts.files[i].path, err)
+			}
+		}
+		return nil
+	})
+	ret := TorrentImpl{
+		Piece:         t.Piece,
+		Close:         t.Close,
+		SetFileWanted: fts.setFileWanted,
+		Allocated:     fts.allocation.wait,
+	}
+	ret.VerifiedTimes, _ = me.pc.(PieceVerifiedTimes)
+	return ret, nil
+}
+
+// Stored files are named by the SHA-256 of their data, in a directory for their length.
+func (me *dedupClientImpl) storeLengthDir(length int64) string {
+	return filepath.Join(me.storeDir, strconv.FormatInt(length, 10))
+}
+
+type dedupTorrentImpl struct {
+	c    *dedupClientImpl
+	fts  *fileTorrentImpl
+	info *metainfo.Info
+
+	mu        sync.Mutex
+	ingesting map[int]bool
+
+	// Held for reading while writing data, and for writing while files are linked or unlinked, so
+	// that linked files are never written to. Acquired before the file storage lock.
+	linkMu sync.RWMutex
+	// Files that are hardlinked to others, such as in the store.
+	linked []bool
+}
+
+// Looks for files hardlinked in a previous session.
+func (t *dedupTorrentImpl) findLinkedFiles() {
+	t.linkMu.Lock()
+	defer t.linkMu.Unlock()
+	for i, f := range t.fts.files {
+		fi, err := os.Stat(f.path)
+		t.linked[i] = err == nil && fileLinked(fi)
+	}
+}
+
+// Replaces the file with a copy, so it can be written without changing the files it's linked to.
+func (t *dedupTorrentImpl) unlinkFile(i int) error {
+	t.linkMu.Lock()
+	defer t.linkMu.Unlock()
+	if !t.linked[i] {
+		return nil
+	}
+	err := copyFile(t.fts.files[i].path, t.fts.files[i].path)
+	if err != nil {
+		return fmt.Errorf("copying hardlinked file before writing: %w", err)
+	}
+	t.linked[i] = false
+	return nil
+}
+
+// Returns a linked file with data in the extent of the torrent, if there is one. linkMu must be
+// held.
+func (t *dedupTorrentImpl) linkedFileIn(off, length int64) (int, bool) {
+	for i, f := range t.fts.files {
+		if t.linked[i] && f.offset < off+length && off < f.offset+f.length {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Returns the range of pieces that lie entirely within the file.
+func (t *dedupTorrentImpl) containedPieces(f file) (begin, end int) {
+	pl := t.info.PieceLength
+	begin = int((f.offset + pl - 1) / pl)
+	fileEnd := f.offset + f.length
+	if fileEnd == t.info.TotalLength() {
+		end = t.info.NumPieces()
+	} else {
+		end = int(fileEnd / pl)
+	}
+	if end < begin {
+		end = begin
+	}
+	return
+}
+
+func (t *dedupTorrentImpl) pieceComplete(i int) bool {
+	c, err := t.fts.completion.Get(metainfo.PieceKey{InfoHash: t.fts.infoHash, Index: i})
+	return err == nil && c.Complete
+}
+
+// Shares the data of a stored file with the same data as the file, and marks the pieces it
+// contains complete.
+func (t *dedupTorrentImpl) useStoredFile(i int) error {
+	f := t.fts.files[i]
+	begin, end := t.containedPieces(f)
+	if begin == end || t.fts.parked[i] {
+		return nil
+	}
+	allComplete := true
+	for p := begin; p < end; p++ {
+		if !t.pieceComplete(p) {
+			allComplete = false
+			break
+		}
+	}
+	if allComplete {
+		return nil
+	}
+	// Don't replace data that's been written.
+	if fi, err := os.Stat(f.path); err == nil && fi.Size() != 0 && atomic.LoadInt32(&t.fts.untouched[i]) == 0 {
+		return nil
+	}
+	candidates, err := ioutil.ReadDir(t.c.storeLengthDir(f.length))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fi := range candidates {
+		if strings.HasSuffix(fi.Name(), cloneTempSuffix) {
+			continue
+		}
+		stored := filepath.Join(t.c.storeLengthDir(f.length), fi.Name())
+		ok, err := t.verifyStored(stored, f, begin, end)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		t.linkMu.Lock()
+		err = t.shareFile(stored, i, f.path)
+		t.linkMu.Unlock()
+		if errors.Is(err, errCantShare) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		atomic.StoreInt32(&t.fts.untouched[i], 0)
+		for p := begin; p < end; p++ {
+			err = t.fts.completion.Set(metainfo.PieceKey{InfoHash: t.fts.infoHash, Index: p}, true)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// Checks the stored data against the hashes of the pieces within the file.
+func (t *dedupTorrentImpl) verifyStored(stored string, f file, begin, end int) (bool, error) {
+	sf, err := os.Open(stored)
+	if err != nil {
+		return false, err
+	}
+	defer sf.Close()
+	for p := begin; p < end; p++ {
+		mp := t.info.Piece(p)
+		h := sha1.New()
+		_, err := io.Copy(h, io.NewSectionReader(sf, mp.Offset()-f.offset, mp.Length()))
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(h.Sum(nil), mp.Hash().Bytes()) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (t *dedupTorrentImpl) Piece(p metainfo.Piece) PieceImpl {
+	return dedupPieceImpl{t.fts.Piece(p), t, p}
+}
+
+func (t *dedupTorrentImpl) Close() error {
+	return t.fts.Close()
+}
+
+// Adds the files that the piece completes to the store in the background.
+func (t *dedupTorrentImpl) pieceCompleted(p metainfo.Piece) {
+	pl := t.info.PieceLength
+	for i, f := range t.fts.files {
+		if f.length == 0 || f.offset >= p.Offset()+p.Length() || f.offset+f.length <= p.Offset() {
+			continue
+		}
+		complete := true
+		for pi := int(f.offset / pl); pi < int((f.offset+f.length+pl-1)/pl); pi++ {
+			if !t.pieceComplete(pi) {
+				complete = false
+				break
+			}
+		}
+		if !complete {
+			continue
+		}
+		t.mu.Lock()
+		if t.ingesting[i] {
+			t.mu.Unlock()
+			continue
+		}
+		t.ingesting[i] = true
+		t.mu.Unlock()
+		t.c.ingesting.Add(1)
+		go func(i int) {
+			defer t.c.ingesting.Done()
+			err := t.ingestFile(i)
+			if err != nil {
+				log.Printf("dedup storage: error storing %q: %v", t.fts.files[i].path, err)
+			}
+			t.mu.Lock()
+			delete(t.ingesting, i)
+			t.mu.Unlock()
+		}(i)
+	}
+}
+
+// Adds a completed file to the store, or if the store already has its data, makes the file share
+// the stored data.
+func (t *dedupTorrentImpl) ingestFile(i int) error {
+	stored, fi, err := t.hashFile(i)
+	if err != nil || stored == "" {
+		return err
+	}
+	// Writers hold the read locks, so nothing can be written between checking the file is
+	// unchanged and sharing its data.
+	t.linkMu.Lock()
+	defer t.linkMu.Unlock()
+	t.fts.mu.Lock()
+	defer t.fts.mu.Unlock()
+	if ok, err := t.fileUnchanged(i, fi); !ok {
+		return err
+	}
+	_, err = os.Stat(stored)
+	if os.IsNotExist(err) {
+		err = t.shareFile(t.fts.files[i].path, i, stored)
+	} else if err == nil {
+		err = t.shareFile(stored, i, t.fts.files[i].path)
+	}
+	if errors.Is(err, errCantShare) {
+		return nil
+	}
+	return err
+}
+
+// Replaces dst with a file that shares the data of src, one of which is the torrent's file i.
+// linkMu must be held for writing.
+func (t *dedupTorrentImpl) shareFile(src string, i int, dst string) error {
+	linked, err := shareFile(src, dst)
+	if linked {
+		t.linked[i] = true
+	}
+	return err
+}
+
+// Whether the file is still as it was when it was hashed, and not parked. The file storage lock
+// must be held.
+func (t *dedupTorrentImpl) fileUnchanged(i int, hashed os.FileInfo) (bool, error) {
+	if t.fts.parked[i] {
+		return false, nil
+	}
+	fi, err := os.Stat(t.fts.files[i].path)
+	if err != nil {
+		return false, err
+	}
+	return fi.Size() == hashed.Size() && fi.ModTime().Equal(hashed.ModTime()), nil
+}
+
+// Returns the path in the store for the file's data, and the file's info from before it was
+// hashed. The path is empty if the file is parked.
+func (t *dedupTorrentImpl) hashFile(i int) (stored string, fi os.FileInfo, err error) {
+	t.fts.mu.RLock()
+	defer t.fts.mu.RUnlock()
+	if t.fts.parked[i] {
+		return
+	}
+	f := t.fts.files[i]
+	file, err := os.Open(f.path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	fi, err = file.Stat()
+	if err != nil {
+		return
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, file)
+	if err != nil {
+		return
+	}
+	if n != f.length {
+		err = fmt.Errorf("file is %d bytes, expected %d", n, f.length)
+		return
+	}
+	stored = filepath.Join(t.c.storeLengthDir(f.length), hex.EncodeToString(h.Sum(nil)))
+	return
+}
+
+type dedupPieceImpl struct {
+	PieceImpl
+	t  *dedupTorrentImpl
+	mp metainfo.Piece
+}
+
+// Copies hardlinked files before they're written to.
+func (p dedupPieceImpl) WriteAt(b []byte, off int64) (int, error) {
+	err := p.t.fts.allocation.wait()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		p.t.linkMu.RLock()
+		i, ok := p.t.linkedFileIn(p.mp.Offset()+off, int64(len(b)))
+		if !ok {
+			defer p.t.linkMu.RUnlock()
+			return p.PieceImpl.WriteAt(b, off)
+		}
+		p.t.linkMu.RUnlock()
+		err := p.t.unlinkFile(i)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (p dedupPieceImpl) MarkComplete() error {
+	err := p.PieceImpl.MarkComplete()
+	if err != nil {
+		return err
+	}
+	p.t.pieceCompleted(p.mp)
+	return nil
+}
+
+const cloneTempSuffix = ".dedup-tmp"
+
+// Returned where files can't share data.
+var errCantShare = errors.New("files can't share data")
+
+// Creates a file in the directory of dst for replacing it, with a name that's unique so that
+// concurrent replacements don't interfere.
+func createCloneTemp(dst string) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(dst), 0777)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".*"+cloneTempSuffix)
+}
+
+// Replaces dst with a reflink of src where supported, and otherwise a hardlink, which it returns
+// whether it used. dst is replaced atomically.
+func shareFile(src, dst string) (linked bool, err error) {
+	tmp, err := createCloneTemp(dst)
+	if err != nil {
+		return
+	}
+	err = reflinkFile(src, tmp)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Hardlinks need the name to be free.
+		os.Remove(tmp.Name())
+		err = linkFile(src, tmp.Name())
+		if err != nil {
+			return
+		}
+		linked = true
+	}
+	err = os.Rename(tmp.Name(), dst)
+	if err != nil {
+		os.Remove(tmp.Name())
+		linked = false
+	}
+	return
+}
+
+// Replaces dst with a copy of src. dst is replaced atomically.
+func copyFile(src, dst string) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	d, err := createCloneTemp(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(d, s)
+	closeErr := d.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(d.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(d.Name())
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// The FICLONE ioctl, from linux/fs.h.
+const ficlone = 0x40049409
+
+// Makes the empty file dst a reflink of src.
+func reflinkFile(src string, dst *os.File) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, s.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func linkFile(src, dst string) error {
+	return os.Link(src, dst)
+}
+
+// Whether the file has other hardlinks.
+func fileLinked(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Nlink > 1
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+import "os"
+
+func reflinkFile(src string, dst *os.File) error {
+	return errCantShare
+}
+
+// Hardlinks aren't used, as they can't be found to copy the files before they're written to.
+func linkFile(src, dst string) error {
+	return errCantShare
+}
+
+func fileLinked(fi os.FileInfo) bool {
+	return false
+}
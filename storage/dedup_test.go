@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+const dedupTestPieceLength = 4 << 10
+
+// Returns an info for the files, with piece hashes for their data.
+func dedupTestInfo(name string, files ...[]byte) *metainfo.Info {
+	info := &metainfo.Info{Name: name, PieceLength: dedupTestPieceLength}
+	var all []byte
+	for i, f := range files {
+		info.Files = append(info.Files, metainfo.FileInfo{
+			Path:   []string{string(rune('a' + i))},
+			Length: int64(len(f)),
+		})
+		all = append(all, f...)
+	}
+	for off := 0; off < len(all); off += dedupTestPieceLength {
+		end := off + dedupTestPieceLength
+		if end > len(all) {
+			end = len(all)
+		}
+		h := sha1.Sum(all[off:end])
+		info.Pieces = append(info.Pieces, h[:]...)
+	}
+	return info
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// Writes all the torrent's data and marks its pieces complete.
+func downloadDedupTestTorrent(c *qt.C, ti TorrentImpl, info *metainfo.Info, files ...[]byte) {
+	all := bytes.Join(files, nil)
+	for i := 0; i < info.NumPieces(); i++ {
+		mp := info.Piece(i)
+		p := ti.Piece(mp)
+		_, err := p.WriteAt(all[mp.Offset():mp.Offset()+mp.Length()], 0)
+		c.Assert(err, qt.IsNil)
+		c.Assert(p.MarkComplete(), qt.IsNil)
+	}
+}
+
+func newDedupTestClient(c *qt.C, storeDir string) ClientImplCloser {
+	return newDedupTestClientDir(c, c.TempDir(), storeDir)
+}
+
+func newDedupTestClientDir(c *qt.C, baseDir, storeDir string) ClientImplCloser {
+	return NewDedupFile(DedupFileOpts{
+		FileOpts: FileOpts{
+			BaseDir:         baseDir,
+			PathMaker:       infoHashPathMaker,
+			PieceCompletion: NewMapPieceCompletion(),
+		},
+		StoreDir: storeDir,
+	})
+}
+
+func TestDedupFileAcrossTorrents(t *testing.T) {
+	c := qt.New(t)
+	storeDir := t.TempDir()
+	installer := randomBytes(3 * dedupTestPieceLength)
+	other := randomBytes(dedupTestPieceLength + 100)
+
+	ci := newDedupTestClient(c, storeDir)
+	info1 := dedupTestInfo("bundle1", installer, other)
+	ti, err := ci.OpenTorrent(info1, metainfo.Hash{1})
+	c.Assert(err, qt.IsNil)
+	downloadDedupTestTorrent(c, ti, info1, installer, other)
+	// Closing waits for the completed files to be stored.
+	c.Assert(ci.Close(), qt.IsNil)
+	stored, err := ioutil.ReadDir(filepath.Join(storeDir, "12288"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(stored, qt.HasLen, 1)
+
+	// The installer is aligned to pieces in another bundle, so it's cloned in complete, once it's
+	// been checked in the background.
+	ci = newDedupTestClient(c, storeDir)
+	defer ci.Close()
+	prefix := randomBytes(dedupTestPieceLength)
+	info2 := dedupTestInfo("bundle2", prefix, installer)
+	ti, err = ci.OpenTorrent(info2, metainfo.Hash{2})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ti.Allocated(), qt.IsNil)
+	ts := Torrent{ti}
+	c.Check(ts.Piece(info2.Piece(0)).Completion().Complete, qt.IsFalse)
+	for i := 1; i < 4; i++ {
+		c.Check(ts.Piece(info2.Piece(i)).Completion(), qt.Equals, Completion{Complete: true, Ok: true})
+	}
+	b := make([]byte, dedupTestPieceLength)
+	_, err = ts.Piece(info2.Piece(2)).ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, installer[dedupTestPieceLength:2*dedupTestPieceLength])
+
+	// Files that aren't aligned to pieces only have their contained pieces completed. Pieces at
+	// their edges are written later, without changing the stored file.
+	info3 := dedupTestInfo("bundle3", prefix[:100], installer)
+	ti, err = ci.OpenTorrent(info3, metainfo.Hash{3})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ti.Allocated(), qt.IsNil)
+	ts = Torrent{ti}
+	var complete []bool
+	for i := 0; i < info3.NumPieces(); i++ {
+		complete = append(complete, ts.Piece(info3.Piece(i)).Completion().Complete)
+	}
+	c.Check(complete, qt.DeepEquals, []bool{false, true, true, true})
+	all := append(prefix[:100:100], installer...)
+	mp := info3.Piece(0)
+	_, err = ts.Piece(mp).WriteAt(bytes.Repeat([]byte{'x'}, int(mp.Length())), 0)
+	c.Assert(err, qt.IsNil)
+	storedPath := filepath.Join(storeDir, "12288", stored[0].Name())
+	storedFi, err := os.Stat(storedPath)
+	c.Assert(err, qt.IsNil)
+	fi, err := os.Stat(filepath.Join(ci.(*dedupClientImpl).baseDir, metainfo.Hash{3}.HexString(), "bundle3", "b"))
+	c.Assert(err, qt.IsNil)
+	c.Check(os.SameFile(fi, storedFi), qt.IsFalse)
+	b, err = ioutil.ReadFile(storedPath)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, installer)
+	b = make([]byte, info3.Piece(1).Length())
+	_, err = ts.Piece(info3.Piece(1)).ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, all[dedupTestPieceLength:2*dedupTestPieceLength])
+}
+
+func TestDedupFileMismatch(t *testing.T) {
+	c := qt.New(t)
+	storeDir := t.TempDir()
+	data := randomBytes(2 * dedupTestPieceLength)
+	ci := newDedupTestClient(c, storeDir)
+	info1 := dedupTestInfo("t1", data)
+	ti, err := ci.OpenTorrent(info1, metainfo.Hash{1})
+	c.Assert(err, qt.IsNil)
+	downloadDedupTestTorrent(c, ti, info1, data)
+	c.Assert(ci.Close(), qt.IsNil)
+
+	// A file with the same length but different data isn't used.
+	ci = newDedupTestClient(c, storeDir)
+	defer ci.Close()
+	info2 := dedupTestInfo("t2", randomBytes(len(data)))
+	ti, err = ci.OpenTorrent(info2, metainfo.Hash{2})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ti.Allocated(), qt.IsNil)
+	c.Check(ti.Piece(info2.Piece(0)).Completion().Complete, qt.IsFalse)
+	c.Check(ti.Piece(info2.Piece(1)).Completion().Complete, qt.IsFalse)
+}
+
+func TestDedupFileSharesCompletedDuplicates(t *testing.T) {
+	c := qt.New(t)
+	storeDir := t.TempDir()
+	baseDir := t.TempDir()
+	data := randomBytes(dedupTestPieceLength)
+	ci := newDedupTestClientDir(c, baseDir, storeDir)
+	// Both torrents are opened before either has data, and are downloaded separately.
+	var (
+		infos []*metainfo.Info
+		paths []string
+	)
+	for i, name := range []string{"t1", "t2"} {
+		info := dedupTestInfo(name, data)
+		ih := metainfo.Hash{byte(i)}
+		ti, err := ci.OpenTorrent(info, ih)
+		c.Assert(err, qt.IsNil)
+		downloadDedupTestTorrent(c, ti, info, data)
+		ci.(*dedupClientImpl).ingesting.Wait()
+		infos = append(infos, info)
+		paths = append(paths, filepath.Join(baseDir, ih.HexString(), name, "a"))
+	}
+	c.Assert(ci.Close(), qt.IsNil)
+	stored, err := ioutil.ReadDir(filepath.Join(storeDir, "4096"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(stored, qt.HasLen, 1)
+	storedPath := filepath.Join(storeDir, "4096", stored[0].Name())
+	b, err := ioutil.ReadFile(paths[1])
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, data)
+
+	// Writing to a file, such as when a piece is checked again and fails, doesn't change the store
+	// or the other torrent, even after the files are opened again.
+	ci = newDedupTestClientDir(c, baseDir, storeDir)
+	defer ci.Close()
+	ti, err := ci.OpenTorrent(infos[0], metainfo.Hash{0})
+	c.Assert(err, qt.IsNil)
+	_, err = ti.Piece(infos[0].Piece(0)).WriteAt([]byte("corrupt"), 0)
+	c.Assert(err, qt.IsNil)
+	b, err = ioutil.ReadFile(paths[0])
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, append([]byte("corrupt"), data[7:]...))
+	b, err = ioutil.ReadFile(paths[1])
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, data)
+	b, err = ioutil.ReadFile(storedPath)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, data)
+}
+
+// Torrents storing the same data at once don't interfere with each other's temporary files.
+func TestDedupFileConcurrentIngest(t *testing.T) {
+	c := qt.New(t)
+	storeDir := t.TempDir()
+	data := randomBytes(dedupTestPieceLength)
+	ci := newDedupTestClient(c, storeDir)
+	defer ci.Close()
+	var pieces []PieceImpl
+	for i := 0; i < 4; i++ {
+		info := dedupTestInfo("t", data)
+		ti, err := ci.OpenTorrent(info, metainfo.Hash{byte(i)})
+		c.Assert(err, qt.IsNil)
+		p := ti.Piece(info.Piece(0))
+		_, err = p.WriteAt(data, 0)
+		c.Assert(err, qt.IsNil)
+		pieces = append(pieces, p)
+	}
+	errs := make(chan error, len(pieces))
+	for _, p := range pieces {
+		go func(p PieceImpl) {
+			errs <- p.MarkComplete()
+		}(p)
+	}
+	for range pieces {
+		c.Assert(<-errs, qt.IsNil)
+	}
+	ci.(*dedupClientImpl).ingesting.Wait()
+	stored, err := ioutil.ReadDir(filepath.Join(storeDir, "4096"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(stored, qt.HasLen, 1)
+	b, err := ioutil.ReadFile(filepath.Join(storeDir, "4096", stored[0].Name()))
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, data)
+}
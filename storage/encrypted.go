@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+type EncryptedOpts struct {
+	// 32 bytes. Each torrent's data is encrypted with a key derived from this and its infohash.
+	MasterKey []byte
+	// Where the authentication tags of encrypted blocks are kept, in a file per torrent. They
+	// don't need to be kept secret.
+	TagDir string
+}
+
+// Piece data is encrypted in blocks of this size, aligned to the start of each piece.
+const encryptedBlockSize = 1 << 14
+
+// Each block's tag entry holds the random nonce it was last sealed with, followed by its AES-GCM
+// tag. An all-zero nonce means the block hasn't been written.
+const (
+	encryptedNonceSize    = 12
+	encryptedTagEntrySize = encryptedNonceSize + 16
+)
+
+// Wraps storage so that piece data is encrypted at rest with AES-256-GCM. Each block of a piece is
+// sealed separately with a fresh random nonce, so reads and writes stay random-access, and nonces
+// aren't reused even if the tag files are rolled back. The piece index and block index are
+// authenticated with each block, so blocks can't be moved around. Reads return plaintext, so
+// pieces are hashed as usual. Data that's been tampered with fails to read.
+func NewEncrypted(ci ClientImpl, opts EncryptedOpts) (ClientImplCloser, error) {
+	if len(opts.MasterKey) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(opts.MasterKey))
+	}
+	if opts.TagDir == "" {
+		return nil, errors.New("tag dir not set")
+	}
+	return &encryptedClientImpl{ci, opts}, nil
+}
+
+type encryptedClientImpl struct {
+	ci   ClientImpl
+	opts EncryptedOpts
+}
+
+func (me *encryptedClientImpl) Close() error {
+	if closer, ok := me.ci.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Derives the torrent's key from the master key, so that identical data in different torrents
+// encrypts differently.
+func (me *encryptedClientImpl) torrentKey(infoHash metainfo.Hash) []byte {
+	mac := hmac.New(sha256.New, me.opts.MasterKey)
+	mac.Write([]byte("torrent storage encryption\x00"))
+	mac.Write(infoHash[:])
+	return mac.Sum(nil)
+}
+
+func (me *encryptedClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (TorrentImpl, error) {
+	block, err := aes.NewCipher(me.torrentKey(infoHash))
+	if err != nil {
+		return TorrentImpl{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return TorrentImpl{}, err
+	}
+	os.MkdirAll(me.opts.TagDir, 0777)
+	tags, err := os.OpenFile(filepath.Join(me.opts.TagDir, infoHash.HexString()+".tags"), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return TorrentImpl{}, fmt.Errorf("opening tags: %w", err)
+	}
+	ti, err := me.ci.OpenTorrent(info, infoHash)
+	if err != nil {
+		tags.Close()
+		return ti, err
+	}
+	t := &encryptedTorrentImpl{
+		ti:             ti,
+		aead:           aead,
+		tags:           tags,
+		blocksPerPiece: int((info.PieceLength + encryptedBlockSize - 1) / encryptedBlockSize),
+		locks:          make([]sync.RWMutex, info.NumPieces()),
+	}
+	ret := ti
+	ret.Piece = t.Piece
+	ret.Close = t.Close
+	return ret, nil
+}
+
+type encryptedTorrentImpl struct {
+	ti             TorrentImpl
+	aead           cipher.AEAD
+	tags           *os.File
+	blocksPerPiece int
+	// Guards each piece's blocks and tag entries, so partial block writes aren't lost.
+	locks []sync.RWMutex
+}
+
+func (t *encryptedTorrentImpl) Piece(p metainfo.Piece) PieceImpl {
+	return encryptedPieceImpl{t, p, t.ti.Piece(p)}
+}
+
+func (t *encryptedTorrentImpl) Close() error {
+	err := t.tags.Close()
+	if t.ti.Close != nil {
+		if err1 := t.ti.Close(); err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+type encryptedPieceImpl struct {
+	t     *encryptedTorrentImpl
+	mp    metainfo.Piece
+	inner PieceImpl
+}
+
+// Returns the offset and length of the block within the piece.
+func (p encryptedPieceImpl) blockBounds(i int) (off, length int64) {
+	off = int64(i) * encryptedBlockSize
+	length = p.mp.Length() - off
+	if length > encryptedBlockSize {
+		length = encryptedBlockSize
+	}
+	return
+}
+
+func (p encryptedPieceImpl) tagEntryOffset(block int) int64 {
+	return (int64(p.mp.Index())*int64(p.t.blocksPerPiece) + int64(block)) * encryptedTagEntrySize
+}
+
+// Returns the block's nonce and tag. The nonce is nil if the block hasn't been written.
+func (p encryptedPieceImpl) readTagEntry(block int) (nonce, tag []byte, err error) {
+	var b [encryptedTagEntrySize]byte
+	n, err := p.t.tags.ReadAt(b[:], p.tagEntryOffset(block))
+	if err == io.EOF && n == 0 {
+		return nil, nil, nil
+	}
+	if err != nil && !(err == io.EOF && n == len(b)) {
+		return nil, nil, err
+	}
+	nonce = b[:encryptedNonceSize]
+	if bytes.Equal(nonce, make([]byte, encryptedNonceSize)) {
+		return nil, nil, nil
+	}
+	return nonce, b[encryptedNonceSize:], nil
+}
+
+// Binds the sealed block to its position, so it can't be swapped with another block.
+func (p encryptedPieceImpl) additionalData(block int) []byte {
+	var ad [8]byte
+	binary.BigEndian.PutUint32(ad[0:], uint32(p.mp.Index()))
+	binary.BigEndian.PutUint32(ad[4:], uint32(block))
+	return ad[:]
+}
+
+// Reads and decrypts the block. Blocks that haven't been written read as zeroes.
+func (p encryptedPieceImpl) readBlock(block int) ([]byte, error) {
+	off, length := p.blockBounds(block)
+	nonce, tag, err := p.readTagEntry(block)
+	if err != nil {
+		return nil, err
+	}
+	if nonce == nil {
+		return make([]byte, length), nil
+	}
+	sealed := make([]byte, length, length+int64(len(tag)))
+	n, err := p.inner.ReadAt(sealed, off)
+	if int64(n) < length {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	plain, err := p.t.aead.Open(sealed[:0], nonce, append(sealed, tag...), p.additionalData(block))
+	if err != nil {
+		return nil, fmt.Errorf("block %d of piece %d failed authentication", block, p.mp.Index())
+	}
+	return plain, nil
+}
+
+// Encrypts and writes the block with a new random nonce. If the data can't be written after the
+// tag entry, the block fails authentication until it's written again.
+func (p encryptedPieceImpl) writeBlock(block int, plain []byte) error {
+	off, _ := p.blockBounds(block)
+	var entry [encryptedTagEntrySize]byte
+	nonce := entry[:encryptedNonceSize]
+	for {
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		// The zero nonce marks unwritten blocks.
+		if !bytes.Equal(nonce, make([]byte, encryptedNonceSize)) {
+			break
+		}
+	}
+	sealed := p.t.aead.Seal(nil, nonce, plain, p.additionalData(block))
+	copy(entry[encryptedNonceSize:], sealed[len(plain):])
+	_, err := p.t.tags.WriteAt(entry[:], p.tagEntryOffset(block))
+	if err != nil {
+		return err
+	}
+	_, err = p.inner.WriteAt(sealed[:len(plain)], off)
+	return err
+}
+
+func (p encryptedPieceImpl) ReadAt(b []byte, off int64) (n int, err error) {
+	mu := &p.t.locks[p.mp.Index()]
+	mu.RLock()
+	defer mu.RUnlock()
+	for len(b) != 0 && off < p.mp.Length() {
+		block := int(off / encryptedBlockSize)
+		blockOff, _ := p.blockBounds(block)
+		var plain []byte
+		plain, err = p.readBlock(block)
+		if err != nil {
+			return
+		}
+		n1 := copy(b, plain[off-blockOff:])
+		n += n1
+		off += int64(n1)
+		b = b[n1:]
+	}
+	if len(b) != 0 {
+		err = io.EOF
+	}
+	return
+}
+
+func (p encryptedPieceImpl) WriteAt(b []byte, off int64) (n int, err error) {
+	mu := &p.t.locks[p.mp.Index()]
+	mu.Lock()
+	defer mu.Unlock()
+	for len(b) != 0 && off < p.mp.Length() {
+		block := int(off / encryptedBlockSize)
+		blockOff, blockLen := p.blockBounds(block)
+		var plain []byte
+		if off == blockOff && int64(len(b)) >= blockLen {
+			plain = b[:blockLen]
+		} else {
+			// Partial writes keep the rest of the block.
+			plain, err = p.readBlock(block)
+			if err != nil {
+				return
+			}
+			copy(plain[off-blockOff:], b)
+		}
+		err = p.writeBlock(block, plain)
+		if err != nil {
+			return
+		}
+		n1 := int(blockOff + blockLen - off)
+		if n1 > len(b) {
+			n1 = len(b)
+		}
+		n += n1
+		off += int64(n1)
+		b = b[n1:]
+	}
+	if len(b) != 0 {
+		err = io.ErrShortWrite
+	}
+	return
+}
+
+func (p encryptedPieceImpl) MarkComplete() error {
+	return p.inner.MarkComplete()
+}
+
+func (p encryptedPieceImpl) MarkNotComplete() error {
+	return p.inner.MarkNotComplete()
+}
+
+func (p encryptedPieceImpl) Completion() Completion {
+	return p.inner.Completion()
+}
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+var testMasterKey = bytes.Repeat([]byte{7}, 32)
+
+func newTestEncryptedFile(c *qt.C, dataDir, tagDir string) ClientImplCloser {
+	ci, err := NewEncrypted(
+		NewFileOpts(FileOpts{
+			BaseDir:         dataDir,
+			PathMaker:       infoHashPathMaker,
+			PieceCompletion: NewMapPieceCompletion(),
+		}),
+		EncryptedOpts{MasterKey: testMasterKey, TagDir: tagDir})
+	c.Assert(err, qt.IsNil)
+	return ci
+}
+
+func encryptedTestInfo() *metainfo.Info {
+	// Pieces of two and a half blocks, so the last block of each is short.
+	return &metainfo.Info{
+		Name:        "t",
+		PieceLength: 5 * encryptedBlockSize / 2,
+		Length:      5 * encryptedBlockSize,
+		Pieces:      make([]byte, 2*metainfo.HashSize),
+	}
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	c := qt.New(t)
+	dataDir, tagDir := t.TempDir(), t.TempDir()
+	ci := newTestEncryptedFile(c, dataDir, tagDir)
+	info := encryptedTestInfo()
+	ih := metainfo.Hash{1}
+	ti, err := ci.OpenTorrent(info, ih)
+	c.Assert(err, qt.IsNil)
+	p := Torrent{ti}.Piece(info.Piece(1))
+	data := bytes.Repeat([]byte("secret! "), int(info.PieceLength)/8)
+	// Chunks that don't line up with blocks.
+	for off := 0; off < len(data); off += 10000 {
+		end := off + 10000
+		if end > len(data) {
+			end = len(data)
+		}
+		n, err := p.WriteAt(data[off:end], int64(off))
+		c.Assert(err, qt.IsNil)
+		c.Assert(n, qt.Equals, end-off)
+	}
+	// Hashing reads plaintext.
+	h := sha1.New()
+	_, err = p.WriteTo(h)
+	c.Assert(err, qt.IsNil)
+	sum := sha1.Sum(data)
+	c.Check(h.Sum(nil), qt.DeepEquals, sum[:])
+	b := make([]byte, 100)
+	_, err = p.ReadAt(b, encryptedBlockSize-50)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, data[encryptedBlockSize-50:encryptedBlockSize+50])
+	// The data at rest doesn't contain the plaintext.
+	dataPath := filepath.Join(dataDir, ih.HexString(), "t")
+	raw, err := ioutil.ReadFile(dataPath)
+	c.Assert(err, qt.IsNil)
+	c.Check(bytes.Contains(raw, []byte("secret!")), qt.IsFalse)
+	c.Assert(ti.Close(), qt.IsNil)
+	c.Assert(ci.Close(), qt.IsNil)
+
+	// Data is readable after reopening.
+	ci = newTestEncryptedFile(c, dataDir, tagDir)
+	defer ci.Close()
+	ti, err = ci.OpenTorrent(info, ih)
+	c.Assert(err, qt.IsNil)
+	defer ti.Close()
+	p = Torrent{ti}.Piece(info.Piece(1))
+	b = make([]byte, len(data))
+	_, err = p.ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, data)
+
+	// Tampering is detected.
+	f, err := os.OpenFile(dataPath, os.O_WRONLY, 0)
+	c.Assert(err, qt.IsNil)
+	_, err = f.WriteAt([]byte{raw[info.PieceLength] ^ 1}, info.PieceLength)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+	_, err = p.ReadAt(b[:1], 0)
+	c.Check(err, qt.ErrorMatches, "block 0 of piece 1 failed authentication")
+	_, err = p.ReadAt(b[:1], encryptedBlockSize)
+	c.Check(err, qt.IsNil)
+}
+
+func TestEncryptedNoncesNotReused(t *testing.T) {
+	c := qt.New(t)
+	dataDir := t.TempDir()
+	ci := newTestEncryptedFile(c, dataDir, t.TempDir())
+	defer ci.Close()
+	info := encryptedTestInfo()
+	block := bytes.Repeat([]byte{'x'}, encryptedBlockSize)
+	ciphertext := func(ih metainfo.Hash) []byte {
+		b, err := ioutil.ReadFile(filepath.Join(dataDir, ih.HexString(), "t"))
+		c.Assert(err, qt.IsNil)
+		return b[:encryptedBlockSize]
+	}
+	var seen [][]byte
+	for _, ih := range []metainfo.Hash{{1}, {2}} {
+		ti, err := ci.OpenTorrent(info, ih)
+		c.Assert(err, qt.IsNil)
+		p := ti.Piece(info.Piece(0))
+		// The same plaintext written twice to the same block.
+		for range []int{0, 1} {
+			_, err = p.WriteAt(block, 0)
+			c.Assert(err, qt.IsNil)
+			seen = append(seen, ciphertext(ih))
+		}
+		c.Assert(ti.Close(), qt.IsNil)
+	}
+	for i := range seen {
+		for j := range seen[:i] {
+			c.Check(bytes.Equal(seen[i], seen[j]), qt.IsFalse, qt.Commentf("%v, %v", i, j))
+		}
+	}
+}
+
+// Nonces don't depend on anything stored on disk, so rolling back the tags doesn't cause reuse.
+func TestEncryptedTagRollbackDoesntReuseNonces(t *testing.T) {
+	c := qt.New(t)
+	dataDir, tagDir := t.TempDir(), t.TempDir()
+	ci := newTestEncryptedFile(c, dataDir, tagDir)
+	defer ci.Close()
+	info := encryptedTestInfo()
+	ih := metainfo.Hash{1}
+	ti, err := ci.OpenTorrent(info, ih)
+	c.Assert(err, qt.IsNil)
+	defer ti.Close()
+	p := ti.Piece(info.Piece(0)).(encryptedPieceImpl)
+	block := bytes.Repeat([]byte{'x'}, encryptedBlockSize)
+	_, err = p.WriteAt(block, 0)
+	c.Assert(err, qt.IsNil)
+	before, _, err := p.readTagEntry(0)
+	c.Assert(err, qt.IsNil)
+	before = append([]byte(nil), before...)
+	// Roll back the tags to before the block was written.
+	c.Assert(p.t.tags.Truncate(0), qt.IsNil)
+	_, err = p.WriteAt(block, 0)
+	c.Assert(err, qt.IsNil)
+	after, _, err := p.readTagEntry(0)
+	c.Assert(err, qt.IsNil)
+	c.Check(after, qt.Not(qt.DeepEquals), before)
+	b := make([]byte, len(block))
+	_, err = p.ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, block)
+}
+
+// A write that doesn't reach the data leaves the block failing authentication until it's written
+// again.
+func TestEncryptedFailedWrite(t *testing.T) {
+	c := qt.New(t)
+	var failWrites int32
+	inner := &countingClientImpl{
+		ClientImpl: NewFileOpts(FileOpts{BaseDir: t.TempDir(), PieceCompletion: NewMapPieceCompletion()}),
+		onWrite: func() error {
+			if atomic.LoadInt32(&failWrites) != 0 {
+				return errors.New("crashed")
+			}
+			return nil
+		},
+	}
+	ci, err := NewEncrypted(inner, EncryptedOpts{MasterKey: testMasterKey, TagDir: t.TempDir()})
+	c.Assert(err, qt.IsNil)
+	defer ci.Close()
+	info := encryptedTestInfo()
+	ti, err := ci.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	defer ti.Close()
+	p := ti.Piece(info.Piece(0))
+	block := bytes.Repeat([]byte{'x'}, encryptedBlockSize)
+	_, err = p.WriteAt(block, 0)
+	c.Assert(err, qt.IsNil)
+	atomic.StoreInt32(&failWrites, 1)
+	_, err = p.WriteAt(bytes.Repeat([]byte{'y'}, encryptedBlockSize), 0)
+	c.Assert(err, qt.ErrorMatches, "crashed")
+	_, err = p.ReadAt(make([]byte, 1), 0)
+	c.Check(err, qt.ErrorMatches, "block 0 of piece 0 failed authentication")
+	atomic.StoreInt32(&failWrites, 0)
+	_, err = p.WriteAt(block, 0)
+	c.Assert(err, qt.IsNil)
+	b := make([]byte, len(block))
+	_, err = p.ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, block)
+}
+
+func TestEncryptedOptsValidated(t *testing.T) {
+	c := qt.New(t)
+	_, err := NewEncrypted(NewMemory(0), EncryptedOpts{MasterKey: []byte("short"), TagDir: t.TempDir()})
+	c.Check(err, qt.ErrorMatches, "master key must be 32 bytes, got 5")
+	_, err = NewEncrypted(NewMemory(0), EncryptedOpts{MasterKey: testMasterKey})
+	c.Check(err, qt.ErrorMatches, "tag dir not set")
+}
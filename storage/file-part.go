@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Deselected files are "parked" in a part-file, rather than being created for the bytes of pieces
+// they share with wanted files. The part-file starts with a bitmap of the parked files, so that
+// parking survives restarts, followed by a sparse image of the torrent data. When a parked file is
+// selected again, its data is moved out of the part-file, and its range of the part-file is
+// deallocated. The part-file is removed when no files are parked. Files that already exist when
+// they're deselected aren't parked, and their data stays where it is.
+
+func (fts *fileTorrentImpl) partFileHeaderLen() int64 {
+	return int64(len(fts.files)+7) / 8
+}
+
+// Returns the path and offset in it that the file's data starts at.
+func (fts *fileTorrentImpl) fileData(i int) (name string, base int64) {
+	if fts.parked[i] {
+		return fts.partFilePath, fts.partFileHeaderLen() + fts.files[i].offset
+	}
+	return fts.files[i].path, 0
+}
+
+func (fts *fileTorrentImpl) loadParked() error {
+	fts.parked = make([]bool, len(fts.files))
+	f, err := os.Open(fts.partFilePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := make([]byte, fts.partFileHeaderLen())
+	_, err = io.ReadFull(f, header)
+	if err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+	for i := range fts.parked {
+		fts.parked[i] = header[i/8]&(1<<(i%8)) != 0
+	}
+	return nil
+}
+
+// Writes the bitmap of parked files, or removes the part-file if there are none.
+func (fts *fileTorrentImpl) writeParked() error {
+	header := make([]byte, fts.partFileHeaderLen())
+	anyParked := false
+	for i, parked := range fts.parked {
+		if parked {
+			header[i/8] |= 1 << (i % 8)
+			anyParked = true
+		}
+	}
+	if !anyParked {
+		err := os.Remove(fts.partFilePath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	err := os.MkdirAll(filepath.Dir(fts.partFilePath), 0777)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fts.partFilePath, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(header, 0)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (fts *fileTorrentImpl) setFileWanted(i int, wanted bool) error {
+	if i < 0 || i >= len(fts.files) {
+		return errors.New("file index out of range")
+	}
+	err := fts.allocation.wait()
+	if err != nil {
+		return err
+	}
+	fts.mu.Lock()
+	defer fts.mu.Unlock()
+	if wanted == !fts.parked[i] {
+		return nil
+	}
+	if wanted {
+		err := fts.unparkFile(i)
+		if err != nil {
+			return fmt.Errorf("moving data out of part-file: %w", err)
+		}
+		_, err = preallocateFile(fts.files[i].path, fts.files[i].length, fts.preallocate)
+		if err != nil {
+			return err
+		}
+	} else if atomic.LoadInt32(&fts.untouched[i]) != 0 {
+		// The file only exists because it was preallocated.
+		err := os.Remove(fts.files[i].path)
+		if err != nil {
+			return err
+		}
+		atomic.StoreInt32(&fts.untouched[i], 0)
+	} else {
+		// Files that already exist stay where they are. There's nothing to gain from moving their
+		// data into the part-file.
+		_, err := os.Stat(fts.files[i].path)
+		if err == nil {
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	fts.parked[i] = !wanted
+	return fts.writeParked()
+}
+
+// The size of the blocks copied from the part-file. Blocks of zeroes can be skipped, so that the
+// holes of the sparse part-file don't take up space in the file.
+const partFileCopyBlockSize = 1 << 16
+
+// Moves the file's data from the part-file into the file.
+func (fts *fileTorrentImpl) unparkFile(i int) error {
+	file := fts.files[i]
+	src, err := os.OpenFile(fts.partFilePath, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	base := fts.partFileHeaderLen() + file.offset
+	// The length of the file's data that made it into the part-file.
+	length := fi.Size() - base
+	if length > file.length {
+		length = file.length
+	}
+	if length <= 0 {
+		return nil
+	}
+	os.MkdirAll(filepath.Dir(file.path), 0777)
+	dst, err := os.OpenFile(file.path, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	// Full preallocation wants the holes filled too.
+	err = copyBlocks(dst, src, base, length, fts.preallocate != PreallocateFull)
+	if err == nil {
+		// Holes at the end of the data were skipped, but still count toward the file length.
+		var dstFi os.FileInfo
+		dstFi, err = dst.Stat()
+		if err == nil && dstFi.Size() < length {
+			err = dst.Truncate(length)
+		}
+	}
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// Other files may still be parked, so the part-file can't be removed, but the data that was
+	// moved no longer needs the space.
+	err = punchHole(src, base, length)
+	if err != nil {
+		log.Printf("error freeing unparked data of %q in part-file: %v", file.path, err)
+	}
+	return nil
+}
+
+func copyBlocks(dst io.WriterAt, src io.ReaderAt, srcOff, length int64, skipZeroes bool) error {
+	buf := make([]byte, partFileCopyBlockSize)
+	zeroes := make([]byte, partFileCopyBlockSize)
+	for off := int64(0); off < length; off += int64(len(buf)) {
+		if length-off < int64(len(buf)) {
+			buf = buf[:length-off]
+		}
+		n, err := src.ReadAt(buf, srcOff+off)
+		if err != nil && !(err == io.EOF && n == len(buf)) {
+			return err
+		}
+		if skipZeroes && bytes.Equal(buf, zeroes[:len(buf)]) {
+			continue
+		}
+		_, err = dst.WriteAt(buf, off)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
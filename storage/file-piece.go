@@ -30,13 +30,16 @@ func (fs *filePieceImpl) Completion() Completion {
 	}
 	if c.Complete {
 		// If it's allegedly complete, check that its constituent files have the necessary length.
+		fs.mu.RLock()
 		for _, fi := range extentCompleteRequiredLengths(fs.p.Info, fs.p.Offset(), fs.p.Length()) {
-			s, err := os.Stat(fs.files[fi.fileIndex].path)
-			if err != nil || s.Size() < fi.length {
+			name, base := fs.fileData(fi.fileIndex)
+			s, err := os.Stat(name)
+			if err != nil || s.Size() < base+fi.length {
 				c.Complete = false
 				break
 			}
 		}
+		fs.mu.RUnlock()
 	}
 	if !c.Complete {
 		// The completion was wrong, fix it.
@@ -5,6 +5,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 
 	"github.com/anacrolix/missinggo/v2"
 	"github.com/anacrolix/torrent/common"
@@ -16,9 +18,16 @@ import (
 // File-based storage for torrents, that isn't yet bound to a particular
 // torrent.
 type fileClientImpl struct {
-	baseDir   string
-	pathMaker func(baseDir string, info *metainfo.Info, infoHash metainfo.Hash) string
-	pc        PieceCompletion
+	baseDir     string
+	pathMaker   func(baseDir string, info *metainfo.Info, infoHash metainfo.Hash) string
+	pc          PieceCompletion
+	preallocate Preallocation
+	// Nil if there's no capacity.
+	lru *lruCapacity
+
+	mu sync.Mutex
+	// Torrents opened with the client, so their pieces can be evicted.
+	torrents map[metainfo.Hash]*fileTorrentImpl
 }
 
 // The Default path maker just returns the current path
@@ -63,14 +72,88 @@ func NewFileWithCustomPathMakerAndCompletion(baseDir string, pathMaker func(base
 	}
 }
 
+type FileOpts struct {
+	BaseDir string
+	// Returns the directory for a torrent's data. Defaults to BaseDir.
+	PathMaker func(baseDir string, info *metainfo.Info, infoHash metainfo.Hash) string
+	// Defaults to the piece completion for BaseDir.
+	PieceCompletion PieceCompletion
+	// Files are allocated in the background when the torrent is opened, and its data isn't read
+	// or written until that's done. Failures are returned by TorrentImpl.Allocated, so they can be
+	// seen before any data is downloaded.
+	Preallocate Preallocation
+	// The most bytes of complete piece data kept for all the torrents opened with the client. The
+	// least recently used complete pieces are evicted to make room, by punching holes in their files
+	// where supported, and are marked not complete. Where holes can't be punched, which is
+	// everywhere but Linux, a file's space is only freed once all its pieces are evicted. Last use
+	// is recorded in the PieceCompletion if it implements PieceAccessTimes. Zero means no limit.
+	Capacity int64
+}
+
+func NewFileOpts(opts FileOpts) ClientImplCloser {
+	if opts.PieceCompletion == nil {
+		opts.PieceCompletion = pieceCompletionForDir(opts.BaseDir)
+	}
+	ret := NewFileWithCustomPathMakerAndCompletion(opts.BaseDir, opts.PathMaker, opts.PieceCompletion)
+	ret.preallocate = opts.Preallocate
+	ret.lru = newLRUCapacity(opts.Capacity, opts.PieceCompletion, ret.evictPiece)
+	return ret
+}
+
 func (me *fileClientImpl) Close() error {
 	return me.pc.Close()
 }
 
-func (fs *fileClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (_ TorrentImpl, err error) {
+func (fs *fileClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (TorrentImpl, error) {
+	t, err := fs.openTorrent(info, infoHash)
+	if err != nil {
+		return TorrentImpl{}, err
+	}
+	ret := TorrentImpl{
+		Piece:         t.Piece,
+		Close:         t.Close,
+		Capacity:      fs.capacity(),
+		SetFileWanted: t.setFileWanted,
+	}
+	if fs.lru != nil {
+		ret.OnPieceEvicted = func(f func(int)) {
+			fs.lru.setOnEvicted(infoHash, f)
+		}
+	}
+	if t.allocation != nil {
+		ret.Allocated = t.allocation.wait
+	}
+	ret.VerifiedTimes, _ = fs.pc.(PieceVerifiedTimes)
+	return ret, nil
+}
+
+func (fs *fileClientImpl) capacity() *func() *int64 {
+	if fs.lru == nil {
+		return nil
+	}
+	return &fs.lru.capFunc
+}
+
+// Marks the piece not complete and deallocates its data.
+func (fs *fileClientImpl) evictPiece(pk metainfo.PieceKey, length int64) error {
+	err := fs.pc.Set(pk, false)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	t, ok := fs.torrents[pk.InfoHash]
+	fs.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return t.deallocate(int64(pk.Index)*t.info.PieceLength, length)
+}
+
+func (fs *fileClientImpl) openTorrent(info *metainfo.Info, infoHash metainfo.Hash) (t *fileTorrentImpl, err error) {
 	dir := fs.pathMaker(fs.baseDir, info, infoHash)
 	upvertedFiles := info.UpvertedFiles()
 	files := make([]file, 0, len(upvertedFiles))
+	var offset int64
 	for i, fileInfo := range upvertedFiles {
 		var s string
 		s, err = ToSafeFilePath(append([]string{info.Name}, fileInfo.Path...)...)
@@ -80,55 +163,165 @@ func (fs *fileClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Has
 		}
 		f := file{
 			path:   filepath.Join(dir, s),
+			offset: offset,
 			length: fileInfo.Length,
 		}
-		if f.length == 0 {
-			err = CreateNativeZeroLengthFile(f.path)
-			if err != nil {
-				err = fmt.Errorf("creating zero length file: %w", err)
-				return
-			}
-		}
+		offset += f.length
 		files = append(files, f)
 	}
-	t := &fileTorrentImpl{
-		files,
-		segments.NewIndex(common.LengthIterFromUpvertedFiles(upvertedFiles)),
-		infoHash,
-		fs.pc,
+	t = &fileTorrentImpl{
+		info:           info,
+		files:          files,
+		segmentLocater: segments.NewIndex(common.LengthIterFromUpvertedFiles(upvertedFiles)),
+		infoHash:       infoHash,
+		completion:     fs.pc,
+		partFilePath:   filepath.Join(dir, "."+infoHash.HexString()+".parts"),
+		preallocate:    fs.preallocate,
+		untouched:      make([]int32, len(files)),
+	}
+	err = t.loadParked()
+	if err != nil {
+		err = fmt.Errorf("loading part-file: %w", err)
+		return
+	}
+	for i, f := range files {
+		if t.parked[i] || f.length != 0 {
+			continue
+		}
+		err = CreateNativeZeroLengthFile(f.path)
+		if err != nil {
+			err = fmt.Errorf("creating zero length file: %w", err)
+			return
+		}
+	}
+	if t.preallocate != PreallocateSparse {
+		t.allocation = startAllocation(t.preallocateFiles)
+	}
+	if fs.lru != nil {
+		fs.mu.Lock()
+		if fs.torrents == nil {
+			fs.torrents = make(map[metainfo.Hash]*fileTorrentImpl)
+		}
+		fs.torrents[infoHash] = t
+		fs.mu.Unlock()
+		t.lru = fs.lru
+		err = fs.lru.addTorrent(info, infoHash)
 	}
-	return TorrentImpl{
-		Piece: t.Piece,
-		Close: t.Close,
-	}, nil
+	return
 }
 
 type file struct {
 	// The safe, OS-local file path.
-	path   string
+	path string
+	// The offset of the file's data in the torrent.
+	offset int64
 	length int64
 }
 
 type fileTorrentImpl struct {
+	info           *metainfo.Info
 	files          []file
 	segmentLocater segments.Index
 	infoHash       metainfo.Hash
 	completion     PieceCompletion
+	// Holds the data of deselected files, see file-part.go.
+	partFilePath string
+	// Protects parked, and moving data between the part-file and the files.
+	mu sync.RWMutex
+	// Whether each file's data is in the part-file.
+	parked      []bool
+	preallocate Preallocation
+	// Set atomically to 1 for files that were created by preallocation, and haven't been written
+	// to since. They can be removed if they're deselected.
+	untouched []int32
+	// Nil if the client has no capacity.
+	lru *lruCapacity
+	// Set if files are being preallocated.
+	allocation *allocation
+}
+
+// Preallocates the files that aren't parked.
+func (fts *fileTorrentImpl) preallocateFiles() error {
+	for i, f := range fts.files {
+		if fts.parked[i] || f.length == 0 {
+			continue
+		}
+		created, err := preallocateFile(f.path, f.length, fts.preallocate)
+		if err != nil {
+			return err
+		}
+		if created {
+			atomic.StoreInt32(&fts.untouched[i], 1)
+		}
+	}
+	return nil
 }
 
 func (fts *fileTorrentImpl) Piece(p metainfo.Piece) PieceImpl {
 	// Create a view onto the file-based torrent storage.
 	_io := fileTorrentImplIO{fts}
 	// Return the appropriate segments of this.
-	return &filePieceImpl{
+	var ret PieceImpl = &filePieceImpl{
 		fts,
 		p,
 		missinggo.NewSectionWriter(_io, p.Offset(), p.Length()),
 		io.NewSectionReader(_io, p.Offset(), p.Length()),
 	}
+	if fts.lru != nil {
+		ret = lruPieceImpl{ret, fts.lru, p, metainfo.PieceKey{InfoHash: fts.infoHash, Index: p.Index()}}
+	}
+	return ret
+}
+
+// Frees the disk space of the torrent's data in the extent. Files entirely within it are removed,
+// and holes are punched in the others where supported. Otherwise files are removed once all their
+// pieces are evicted.
+func (fts *fileTorrentImpl) deallocate(off, length int64) (err error) {
+	fts.mu.RLock()
+	defer fts.mu.RUnlock()
+	fts.segmentLocater.Locate(segments.Extent{Start: off, Length: length}, func(i int, e segments.Extent) bool {
+		name, base := fts.fileData(i)
+		whole := e.Start == 0 && e.Length == fts.files[i].length
+		removed := false
+		if !fts.parked[i] && whole {
+			err = os.Remove(name)
+			removed = true
+		} else if !fts.parked[i] && !canPunchHoles {
+			removed, err = fts.removeIfEvicted(i, name)
+		}
+		if !removed && err == nil {
+			var f *os.File
+			f, err = os.OpenFile(name, os.O_WRONLY, 0)
+			if err == nil {
+				err = punchHole(f, base+e.Start, e.Length)
+				f.Close()
+			}
+		}
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err == nil
+	})
+	return
+}
+
+// Removes the file if all the pieces with data in it have been evicted.
+func (fts *fileTorrentImpl) removeIfEvicted(i int, name string) (removed bool, err error) {
+	f := fts.files[i]
+	pl := fts.info.PieceLength
+	err = fts.lru.ifAllEvicted(fts.infoHash, int(f.offset/pl), int((f.offset+f.length+pl-1)/pl), func() error {
+		removed = true
+		return os.Remove(name)
+	})
+	return
 }
 
 func (fs *fileTorrentImpl) Close() error {
+	// Don't leave files being allocated after the torrent is closed.
+	fs.allocation.wait()
+	if fs.lru != nil {
+		fs.lru.setOnEvicted(fs.infoHash, nil)
+	}
 	return nil
 }
 
@@ -151,8 +344,10 @@ type fileTorrentImplIO struct {
 }
 
 // Returns EOF on short or missing file.
-func (fst *fileTorrentImplIO) readFileAt(file file, b []byte, off int64) (n int, err error) {
-	f, err := os.Open(file.path)
+func (fst *fileTorrentImplIO) readFileAt(i int, b []byte, off int64) (n int, err error) {
+	file := fst.fts.files[i]
+	name, base := fst.fts.fileData(i)
+	f, err := os.Open(name)
 	if os.IsNotExist(err) {
 		// File missing is treated the same as a short file.
 		err = io.EOF
@@ -167,7 +362,7 @@ func (fst *fileTorrentImplIO) readFileAt(file file, b []byte, off int64) (n int,
 		b = b[:file.length-off]
 	}
 	for off < file.length && len(b) != 0 {
-		n1, err1 := f.ReadAt(b, off)
+		n1, err1 := f.ReadAt(b, base+off)
 		b = b[n1:]
 		n += n1
 		off += int64(n1)
@@ -181,8 +376,14 @@ func (fst *fileTorrentImplIO) readFileAt(file file, b []byte, off int64) (n int,
 
 // Only returns EOF at the end of the torrent. Premature EOF is ErrUnexpectedEOF.
 func (fst fileTorrentImplIO) ReadAt(b []byte, off int64) (n int, err error) {
+	err = fst.fts.allocation.wait()
+	if err != nil {
+		return
+	}
+	fst.fts.mu.RLock()
+	defer fst.fts.mu.RUnlock()
 	fst.fts.segmentLocater.Locate(segments.Extent{off, int64(len(b))}, func(i int, e segments.Extent) bool {
-		n1, err1 := fst.readFileAt(fst.fts.files[i], b[:e.Length], e.Start)
+		n1, err1 := fst.readFileAt(i, b[:e.Length], e.Start)
 		n += n1
 		b = b[n1:]
 		err = err1
@@ -196,8 +397,15 @@ func (fst fileTorrentImplIO) ReadAt(b []byte, off int64) (n int, err error) {
 
 func (fst fileTorrentImplIO) WriteAt(p []byte, off int64) (n int, err error) {
 	//log.Printf("write at %v: %v bytes", off, len(p))
+	err = fst.fts.allocation.wait()
+	if err != nil {
+		return
+	}
+	fst.fts.mu.RLock()
+	defer fst.fts.mu.RUnlock()
 	fst.fts.segmentLocater.Locate(segments.Extent{off, int64(len(p))}, func(i int, e segments.Extent) bool {
-		name := fst.fts.files[i].path
+		name, base := fst.fts.fileData(i)
+		atomic.StoreInt32(&fst.fts.untouched[i], 0)
 		os.MkdirAll(filepath.Dir(name), 0777)
 		var f *os.File
 		f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0666)
@@ -205,7 +413,7 @@ func (fst fileTorrentImplIO) WriteAt(p []byte, off int64) (n int, err error) {
 			return false
 		}
 		var n1 int
-		n1, err = f.WriteAt(p[:e.Length], e.Start)
+		n1, err = f.WriteAt(p[:e.Length], base+e.Start)
 		//log.Printf("%v %v wrote %v: %v", i, e, n1, err)
 		closeErr := f.Close()
 		n += n1
@@ -6,9 +6,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
 
 	"github.com/anacrolix/missinggo/v2"
+	qt "github.com/frankban/quicktest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -42,3 +44,104 @@ func TestShortFile(t *testing.T) {
 		t.Errorf("expected nil or EOF error from truncated piece, got %v", err)
 	}
 }
+
+func TestDeselectedFileParkedInPartFile(t *testing.T) {
+	c := qt.New(t)
+	td := t.TempDir()
+	s := NewFileWithCompletion(td, NewMapPieceCompletion())
+	info := &metainfo.Info{
+		Name:        "t",
+		PieceLength: 4,
+		// The first piece straddles both files.
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 3},
+			{Path: []string{"b"}, Length: 5},
+		},
+	}
+	info.Pieces = make([]byte, 2*metainfo.HashSize)
+	data := []byte("abcdefgh")
+	ts, err := s.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ts.SetFileWanted(1, false), qt.IsNil)
+	for i := 0; i < info.NumPieces(); i++ {
+		p := info.Piece(i)
+		_, err := ts.Piece(p).WriteAt(data[p.Offset():p.Offset()+p.Length()], 0)
+		c.Assert(err, qt.IsNil)
+	}
+	fileName := func(name string) string {
+		return filepath.Join(td, "t", name)
+	}
+	partFileName := filepath.Join(td, "."+metainfo.Hash{}.HexString()+".parts")
+	_, err = os.Stat(fileName("b"))
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+	c.Check(partFileName, qt.Satisfies, func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	})
+	readAll := func(ts TorrentImpl) []byte {
+		var b []byte
+		for i := 0; i < info.NumPieces(); i++ {
+			p := info.Piece(i)
+			buf := make([]byte, p.Length())
+			_, err := ts.Piece(p).ReadAt(buf, 0)
+			c.Assert(err, qt.IsNil)
+			b = append(b, buf...)
+		}
+		return b
+	}
+	c.Check(readAll(ts), qt.DeepEquals, data)
+	// Parking survives reopening the storage.
+	ts, err = s.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	c.Check(readAll(ts), qt.DeepEquals, data)
+	c.Assert(ts.SetFileWanted(1, true), qt.IsNil)
+	b, err := ioutil.ReadFile(fileName("b"))
+	c.Assert(err, qt.IsNil)
+	c.Check(string(b), qt.Equals, "defgh")
+	_, err = os.Stat(partFileName)
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+	c.Check(readAll(ts), qt.DeepEquals, data)
+	// Files that exist aren't parked.
+	c.Assert(ts.SetFileWanted(0, false), qt.IsNil)
+	_, err = os.Stat(partFileName)
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+}
+
+// The data of an unparked file is deallocated in the part-file, while other files are still parked.
+func TestUnparkedFileFreedInPartFile(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("punching holes is only supported on linux")
+	}
+	c := qt.New(t)
+	td := t.TempDir()
+	s := NewFileWithCompletion(td, NewMapPieceCompletion())
+	info := &metainfo.Info{
+		Name:        "t",
+		PieceLength: 4,
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 1},
+			{Path: []string{"b"}, Length: 8 << 10},
+			{Path: []string{"c"}, Length: 8 << 10},
+		},
+	}
+	info.Pieces = make([]byte, (info.TotalLength()+3)/4*metainfo.HashSize)
+	ts, err := s.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ts.SetFileWanted(1, false), qt.IsNil)
+	c.Assert(ts.SetFileWanted(2, false), qt.IsNil)
+	data := bytes.Repeat([]byte("x"), int(info.TotalLength()))
+	for i := 0; i < info.NumPieces(); i++ {
+		p := info.Piece(i)
+		_, err := ts.Piece(p).WriteAt(data[p.Offset():p.Offset()+p.Length()], 0)
+		c.Assert(err, qt.IsNil)
+	}
+	c.Assert(ts.SetFileWanted(1, true), qt.IsNil)
+	b, err := ioutil.ReadFile(filepath.Join(td, "t", "b"))
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, data[1:1+8<<10])
+	part, err := ioutil.ReadFile(filepath.Join(td, "."+metainfo.Hash{}.HexString()+".parts"))
+	c.Assert(err, qt.IsNil)
+	// The header is a byte, and file b's data follows that of a.
+	c.Check(part[2:2+8<<10], qt.DeepEquals, make([]byte, 8<<10))
+	c.Check(part[2+8<<10:], qt.DeepEquals, data[1+8<<10:])
+}
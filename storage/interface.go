@@ -22,6 +22,23 @@ type TorrentImpl struct {
 	Close func() error
 	// Storages that share the same value, will provide a pointer to the same function.
 	Capacity *func() *int64
+	// Optional. Called with the index of a file in the info's upverted files when it's deselected
+	// or selected again, so the storage can avoid creating files that aren't wanted.
+	SetFileWanted func(fileIndex int, wanted bool) error
+	// Optional. Waits for setup the storage does in the background after being opened, such as
+	// allocating space, and returns the error if that failed. Data can't be read or written until
+	// then, and the Torrent doesn't request any. Failures are returned when the torrent is added
+	// with its info. Piece completion is checked again afterwards, as the setup can find complete
+	// pieces.
+	Allocated func() error
+	// Optional. Persists when pieces' data last matched their hashes, so it isn't all hashed again
+	// after a restart.
+	VerifiedTimes PieceVerifiedTimes
+	// Optional. Called by the user of the storage with a function for the storage to call with the
+	// index of each piece it marks not complete on its own, such as when it removes data to stay
+	// within its capacity, or fails to write out data. The function may be called from any
+	// goroutine, including during calls to the storage.
+	OnPieceEvicted func(func(piece int))
 }
 
 // Interacts with torrent piece data. Optional interfaces to implement include:
@@ -2,15 +2,22 @@ package storage
 
 import (
 	"sync"
+	"time"
 
 	"github.com/anacrolix/torrent/metainfo"
 )
 
 type mapPieceCompletion struct {
 	m sync.Map
+	// Access and verified times of pieces, by PieceKey.
+	accessed, verified sync.Map
 }
 
-var _ PieceCompletion = (*mapPieceCompletion)(nil)
+var _ interface {
+	PieceCompletion
+	PieceAccessTimes
+	PieceVerifiedTimes
+} = (*mapPieceCompletion)(nil)
 
 func NewMapPieceCompletion() PieceCompletion {
 	return &mapPieceCompletion{}
@@ -31,3 +38,29 @@ func (me *mapPieceCompletion) Set(pk metainfo.PieceKey, b bool) error {
 	me.m.Store(pk, b)
 	return nil
 }
+
+func (me *mapPieceCompletion) GetAccessTime(pk metainfo.PieceKey) (time.Time, bool, error) {
+	v, ok := me.accessed.Load(pk)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	return v.(time.Time), true, nil
+}
+
+func (me *mapPieceCompletion) SetAccessTime(pk metainfo.PieceKey, t time.Time) error {
+	me.accessed.Store(pk, t)
+	return nil
+}
+
+func (me *mapPieceCompletion) GetVerifiedTime(pk metainfo.PieceKey) (time.Time, bool, error) {
+	v, ok := me.verified.Load(pk)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	return v.(time.Time), true, nil
+}
+
+func (me *mapPieceCompletion) SetVerifiedTime(pk metainfo.PieceKey, t time.Time) error {
+	me.verified.Store(pk, t)
+	return nil
+}
@@ -1,6 +1,7 @@
 package storage_test
 
 import (
+	"path/filepath"
 	"testing"
 
 	"github.com/anacrolix/torrent/storage"
@@ -22,6 +23,28 @@ func BenchmarkMarkComplete(b *testing.B) {
 		b.Cleanup(func() { ci.Close() })
 		bench(b, ci)
 	})
+	b.Run("WriteBackFile", func(b *testing.B) {
+		ci := storage.NewWriteBackCache(storage.NewFile(b.TempDir()), storage.WriteBackCacheOpts{})
+		b.Cleanup(func() { ci.Close() })
+		bench(b, ci)
+	})
+	b.Run("EncryptedFile", func(b *testing.B) {
+		dir := b.TempDir()
+		ci, err := storage.NewEncrypted(storage.NewFile(dir), storage.EncryptedOpts{
+			MasterKey: make([]byte, 32),
+			TagDir:    filepath.Join(dir, "tags"),
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { ci.Close() })
+		bench(b, ci)
+	})
+	b.Run("Memory", func(b *testing.B) {
+		ci := storage.NewMemory(0)
+		b.Cleanup(func() { ci.Close() })
+		bench(b, ci)
+	})
 	b.Run("BoltDb", func(b *testing.B) {
 		ci := storage.NewBoltDB(b.TempDir())
 		b.Cleanup(func() { ci.Close() })
@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Returns storage that holds piece data in memory, shared by all the torrents opened with it.
+// Nothing touches disk, so it suits short-lived streaming and tests. Capacity is the most bytes of
+// piece data held, and is reported through TorrentImpl.Capacity so that only pieces that fit are
+// requested. To make room for new pieces, complete pieces that were least recently read are
+// evicted, and have to be downloaded again if they're wanted. Zero capacity means no limit.
+func NewMemory(capacity int64) ClientImplCloser {
+	m := &memoryClientImpl{
+		capacity: capacity,
+		pieces:   make(map[memoryPieceKey]*memoryPiece),
+	}
+	if capacity != 0 {
+		m.capFunc = func() *int64 {
+			c := capacity
+			return &c
+		}
+	}
+	return m
+}
+
+type memoryClientImpl struct {
+	capacity int64
+	// Shared by all the client's torrents, so their pieces count against the same capacity.
+	capFunc func() *int64
+
+	mu   sync.Mutex
+	used int64
+	// Complete pieces, most recently read first.
+	lru    list.List
+	pieces map[memoryPieceKey]*memoryPiece
+}
+
+type memoryPieceKey struct {
+	t     *memoryTorrentImpl
+	index int
+}
+
+type memoryPiece struct {
+	key      memoryPieceKey
+	data     []byte
+	complete bool
+	// The element in the LRU list, if the piece is complete.
+	lruElem *list.Element
+}
+
+var errMemoryCapacityExceeded = errors.New("memory storage capacity exceeded by incomplete pieces")
+
+func (m *memoryClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (TorrentImpl, error) {
+	t := &memoryTorrentImpl{m: m}
+	ret := TorrentImpl{Piece: t.Piece, Close: t.Close, OnPieceEvicted: t.setOnPieceEvicted}
+	if m.capFunc != nil {
+		ret.Capacity = &m.capFunc
+	}
+	return ret, nil
+}
+
+// Drops all piece data.
+func (m *memoryClientImpl) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.pieces {
+		m.remove(p)
+	}
+	return nil
+}
+
+func (m *memoryClientImpl) remove(p *memoryPiece) {
+	if p.lruElem != nil {
+		m.lru.Remove(p.lruElem)
+		p.lruElem = nil
+	}
+	delete(m.pieces, p.key)
+	m.used -= int64(len(p.data))
+}
+
+// Returns the piece's data, allocating it and evicting complete pieces if necessary. The torrents
+// of the evicted pieces are to be told about them once the lock is released.
+func (m *memoryClientImpl) alloc(key memoryPieceKey, length int64) (p *memoryPiece, evicted []memoryPieceKey, err error) {
+	if p, ok := m.pieces[key]; ok {
+		return p, nil, nil
+	}
+	for m.capacity != 0 && m.used+length > m.capacity {
+		back := m.lru.Back()
+		if back == nil {
+			return nil, evicted, errMemoryCapacityExceeded
+		}
+		victim := back.Value.(*memoryPiece)
+		m.remove(victim)
+		evicted = append(evicted, victim.key)
+	}
+	p = &memoryPiece{key: key, data: make([]byte, length)}
+	m.pieces[key] = p
+	m.used += length
+	return p, evicted, nil
+}
+
+// Tells the torrents of the evicted pieces. The lock must not be held.
+func (m *memoryClientImpl) notifyEvicted(evicted []memoryPieceKey) {
+	for _, key := range evicted {
+		m.mu.Lock()
+		f := key.t.onEvicted
+		m.mu.Unlock()
+		if f != nil {
+			f(key.index)
+		}
+	}
+}
+
+type memoryTorrentImpl struct {
+	m *memoryClientImpl
+	// See TorrentImpl.OnPieceEvicted. Protected by the client lock.
+	onEvicted func(int)
+}
+
+func (t *memoryTorrentImpl) setOnPieceEvicted(f func(int)) {
+	t.m.mu.Lock()
+	defer t.m.mu.Unlock()
+	t.onEvicted = f
+}
+
+func (t *memoryTorrentImpl) Piece(p metainfo.Piece) PieceImpl {
+	return memoryPieceImpl{t, p}
+}
+
+// Drops the torrent's piece data.
+func (t *memoryTorrentImpl) Close() error {
+	m := t.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, p := range m.pieces {
+		if key.t == t {
+			m.remove(p)
+		}
+	}
+	return nil
+}
+
+type memoryPieceImpl struct {
+	t  *memoryTorrentImpl
+	mp metainfo.Piece
+}
+
+var _ interface {
+	PieceImpl
+	io.WriterTo
+} = memoryPieceImpl{}
+
+func (p memoryPieceImpl) key() memoryPieceKey {
+	return memoryPieceKey{p.t, p.mp.Index()}
+}
+
+// Returns the data of a held piece, marking it as recently read.
+func (p memoryPieceImpl) read() []byte {
+	m := p.t.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mp, ok := m.pieces[p.key()]
+	if !ok {
+		return nil
+	}
+	if mp.lruElem != nil {
+		m.lru.MoveToFront(mp.lruElem)
+	}
+	// The slice is never reallocated, so it's safe to use after unlocking.
+	return mp.data
+}
+
+func (p memoryPieceImpl) ReadAt(b []byte, off int64) (n int, err error) {
+	data := p.read()
+	if off >= int64(len(data)) {
+		// The piece was evicted, or never written.
+		return 0, io.EOF
+	}
+	n = copy(b, data[off:])
+	if n < len(b) {
+		err = io.EOF
+	}
+	return
+}
+
+func (p memoryPieceImpl) WriteTo(w io.Writer) (int64, error) {
+	data := p.read()
+	if int64(len(data)) != p.mp.Length() {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+func (p memoryPieceImpl) WriteAt(b []byte, off int64) (n int, err error) {
+	m := p.t.m
+	m.mu.Lock()
+	mp, evicted, err := m.alloc(p.key(), p.mp.Length())
+	if err == nil {
+		n = copy(mp.data[off:], b)
+	}
+	m.mu.Unlock()
+	m.notifyEvicted(evicted)
+	if err == nil && n < len(b) {
+		err = io.ErrShortWrite
+	}
+	return
+}
+
+func (p memoryPieceImpl) MarkComplete() error {
+	m := p.t.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mp, ok := m.pieces[p.key()]
+	if !ok {
+		return errors.New("piece has no data")
+	}
+	if !mp.complete {
+		mp.complete = true
+		mp.lruElem = m.lru.PushFront(mp)
+	}
+	return nil
+}
+
+func (p memoryPieceImpl) MarkNotComplete() error {
+	m := p.t.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mp, ok := m.pieces[p.key()]
+	if ok && mp.complete {
+		mp.complete = false
+		m.lru.Remove(mp.lruElem)
+		mp.lruElem = nil
+	}
+	return nil
+}
+
+func (p memoryPieceImpl) Completion() Completion {
+	m := p.t.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mp, ok := m.pieces[p.key()]
+	return Completion{Complete: ok && mp.complete, Ok: true}
+}
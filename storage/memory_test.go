@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestMemoryEvictsLeastRecentlyRead(t *testing.T) {
+	c := qt.New(t)
+	// Room for two of the four pieces.
+	ci := NewMemory(8 << 10)
+	defer ci.Close()
+	info := writeBackTestInfo(4)
+	ti, err := ci.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ti.Capacity, qt.Not(qt.IsNil))
+	c.Check(*(*ti.Capacity)(), qt.Equals, int64(8<<10))
+	var evicted []int
+	ti.OnPieceEvicted(func(i int) { evicted = append(evicted, i) })
+	ts := Torrent{ti}
+	piece := func(i int) Piece { return ts.Piece(info.Piece(i)) }
+	for i := 0; i < 2; i++ {
+		writePieceChunks(c, piece(i), bytes.Repeat([]byte{byte('a' + i)}, 4<<10))
+		c.Assert(piece(i).MarkComplete(), qt.IsNil)
+	}
+	// Piece 0 is read, so piece 1 is evicted to make room for piece 2.
+	b := make([]byte, 2)
+	_, err = piece(0).ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(string(b), qt.Equals, "aa")
+	writePieceChunks(c, piece(2), bytes.Repeat([]byte{'c'}, 4<<10))
+	c.Check(piece(0).Completion().Complete, qt.IsTrue)
+	c.Check(piece(1).Completion(), qt.Equals, Completion{Complete: false, Ok: true})
+	c.Check(evicted, qt.DeepEquals, []int{1})
+	_, err = piece(1).PieceImpl.ReadAt(b, 0)
+	c.Check(err, qt.Not(qt.IsNil))
+	// Incomplete pieces aren't evicted.
+	c.Assert(piece(0).MarkNotComplete(), qt.IsNil)
+	_, err = piece(3).WriteAt(b, 0)
+	c.Check(err, qt.Equals, errMemoryCapacityExceeded)
+	c.Assert(piece(2).MarkComplete(), qt.IsNil)
+	writePieceChunks(c, piece(3), bytes.Repeat([]byte{'d'}, 4<<10))
+	c.Check(piece(2).Completion().Complete, qt.IsFalse)
+	c.Check(evicted, qt.DeepEquals, []int{1, 2})
+}
+
+func TestMemoryTorrentsShareCapacity(t *testing.T) {
+	c := qt.New(t)
+	ci := NewMemory(4 << 10)
+	defer ci.Close()
+	info := writeBackTestInfo(1)
+	t1, err := ci.OpenTorrent(info, metainfo.Hash{1})
+	c.Assert(err, qt.IsNil)
+	t2, err := ci.OpenTorrent(info, metainfo.Hash{2})
+	c.Assert(err, qt.IsNil)
+	c.Check(t1.Capacity, qt.Equals, t2.Capacity)
+	writePieceChunks(c, t1.Piece(info.Piece(0)), make([]byte, 4<<10))
+	_, err = t2.Piece(info.Piece(0)).WriteAt(make([]byte, 1), 0)
+	c.Check(err, qt.Equals, errMemoryCapacityExceeded)
+	// Closing a torrent frees its pieces.
+	c.Assert(t1.Close(), qt.IsNil)
+	writePieceChunks(c, t2.Piece(info.Piece(0)), make([]byte, 4<<10))
+}
+
+func TestMemoryUnlimited(t *testing.T) {
+	c := qt.New(t)
+	ci := NewMemory(0)
+	defer ci.Close()
+	info := writeBackTestInfo(1)
+	ti, err := ci.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	c.Check(ti.Capacity, qt.IsNil)
+	p := Torrent{ti}.Piece(info.Piece(0))
+	data := bytes.Repeat([]byte("hello"), 1<<10)[:4<<10]
+	writePieceChunks(c, p, data)
+	var buf bytes.Buffer
+	_, err = p.WriteTo(&buf)
+	c.Assert(err, qt.IsNil)
+	c.Check(buf.Bytes(), qt.DeepEquals, data)
+}
@@ -18,8 +18,9 @@ import (
 )
 
 type mmapClientImpl struct {
-	baseDir string
-	pc      PieceCompletion
+	baseDir     string
+	pc          PieceCompletion
+	preallocate Preallocation
 }
 
 func NewMMap(baseDir string) ClientImplCloser {
@@ -33,14 +34,42 @@ func NewMMapWithCompletion(baseDir string, completion PieceCompletion) *mmapClie
 	}
 }
 
+type MMapOpts struct {
+	BaseDir string
+	// Defaults to the piece completion for BaseDir.
+	PieceCompletion PieceCompletion
+	// Files are allocated and mapped in the background when the torrent is opened, and its data
+	// isn't read or written until that's done. Failures are returned by TorrentImpl.Allocated, so
+	// they can be seen before any data is downloaded. Otherwise mapped files are sparse.
+	Preallocate Preallocation
+}
+
+func NewMMapOpts(opts MMapOpts) ClientImplCloser {
+	if opts.PieceCompletion == nil {
+		opts.PieceCompletion = pieceCompletionForDir(opts.BaseDir)
+	}
+	ret := NewMMapWithCompletion(opts.BaseDir, opts.PieceCompletion)
+	ret.preallocate = opts.Preallocate
+	return ret
+}
+
 func (s *mmapClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (_ TorrentImpl, err error) {
-	span, err := mMapTorrent(info, s.baseDir)
 	t := &mmapTorrentStorage{
 		infoHash: infoHash,
-		span:     span,
 		pc:       s.pc,
 	}
-	return TorrentImpl{Piece: t.Piece, Close: t.Close}, err
+	ret := TorrentImpl{Piece: t.Piece, Close: t.Close}
+	ret.VerifiedTimes, _ = s.pc.(PieceVerifiedTimes)
+	if s.preallocate == PreallocateSparse {
+		t.span, err = mMapTorrent(info, s.baseDir, s.preallocate)
+		return ret, err
+	}
+	t.allocation = startAllocation(func() (err error) {
+		t.span, err = mMapTorrent(info, s.baseDir, s.preallocate)
+		return
+	})
+	ret.Allocated = t.allocation.wait
+	return ret, nil
 }
 
 func (s *mmapClientImpl) Close() error {
@@ -49,8 +78,11 @@ func (s *mmapClientImpl) Close() error {
 
 type mmapTorrentStorage struct {
 	infoHash metainfo.Hash
-	span     *mmap_span.MMapSpan
-	pc       PieceCompletionGetSetter
+	// Set once allocation is done.
+	span *mmap_span.MMapSpan
+	pc   PieceCompletionGetSetter
+	// Set if the files are being preallocated and mapped.
+	allocation *allocation
 }
 
 func (ts *mmapTorrentStorage) Piece(p metainfo.Piece) PieceImpl {
@@ -58,12 +90,29 @@ func (ts *mmapTorrentStorage) Piece(p metainfo.Piece) PieceImpl {
 		pc:       ts.pc,
 		p:        p,
 		ih:       ts.infoHash,
-		ReaderAt: io.NewSectionReader(ts.span, p.Offset(), p.Length()),
-		WriterAt: missinggo.NewSectionWriter(ts.span, p.Offset(), p.Length()),
+		ReaderAt: io.NewSectionReader(ts, p.Offset(), p.Length()),
+		WriterAt: missinggo.NewSectionWriter(ts, p.Offset(), p.Length()),
+	}
+}
+
+func (ts *mmapTorrentStorage) ReadAt(b []byte, off int64) (int, error) {
+	err := ts.allocation.wait()
+	if err != nil {
+		return 0, err
 	}
+	return ts.span.ReadAt(b, off)
+}
+
+func (ts *mmapTorrentStorage) WriteAt(b []byte, off int64) (int, error) {
+	err := ts.allocation.wait()
+	if err != nil {
+		return 0, err
+	}
+	return ts.span.WriteAt(b, off)
 }
 
 func (ts *mmapTorrentStorage) Close() error {
+	ts.allocation.wait()
 	errs := ts.span.Close()
 	if len(errs) > 0 {
 		return errs[0]
@@ -101,7 +150,7 @@ func (sp mmapStoragePiece) MarkNotComplete() error {
 	return nil
 }
 
-func mMapTorrent(md *metainfo.Info, location string) (mms *mmap_span.MMapSpan, err error) {
+func mMapTorrent(md *metainfo.Info, location string, preallocate Preallocation) (mms *mmap_span.MMapSpan, err error) {
 	mms = &mmap_span.MMapSpan{}
 	defer func() {
 		if err != nil {
@@ -116,7 +165,7 @@ func mMapTorrent(md *metainfo.Info, location string) (mms *mmap_span.MMapSpan, e
 		}
 		fileName := filepath.Join(location, safeName)
 		var mm mmap.MMap
-		mm, err = mmapFile(fileName, miFile.Length)
+		mm, err = mmapFile(fileName, miFile.Length, preallocate)
 		if err != nil {
 			err = fmt.Errorf("file %q: %s", miFile.DisplayPath(md), err)
 			return
@@ -129,13 +178,17 @@ func mMapTorrent(md *metainfo.Info, location string) (mms *mmap_span.MMapSpan, e
 	return
 }
 
-func mmapFile(name string, size int64) (ret mmap.MMap, err error) {
+func mmapFile(name string, size int64, preallocate Preallocation) (ret mmap.MMap, err error) {
 	dir := filepath.Dir(name)
 	err = os.MkdirAll(dir, 0777)
 	if err != nil {
 		err = fmt.Errorf("making directory %q: %s", dir, err)
 		return
 	}
+	_, err = preallocateFile(name, size, preallocate)
+	if err != nil {
+		return
+	}
 	var file *os.File
 	file, err = os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"time"
+
 	"github.com/anacrolix/log"
 
 	"github.com/anacrolix/torrent/metainfo"
@@ -17,6 +19,22 @@ type PieceCompletion interface {
 	Close() error
 }
 
+// Optionally implemented by a PieceCompletion to persist when complete pieces were last used, so
+// that storage with a capacity keeps evicting the least recently used pieces after a restart.
+type PieceAccessTimes interface {
+	// ok is false if the piece has no access time.
+	GetAccessTime(metainfo.PieceKey) (_ time.Time, ok bool, _ error)
+	SetAccessTime(metainfo.PieceKey, time.Time) error
+}
+
+// Optionally implemented by a PieceCompletion to persist when pieces' data last matched their
+// hashes, so that it isn't all hashed again after a restart.
+type PieceVerifiedTimes interface {
+	// ok is false if the piece has no verified time.
+	GetVerifiedTime(metainfo.PieceKey) (_ time.Time, ok bool, _ error)
+	SetVerifiedTime(metainfo.PieceKey, time.Time) error
+}
+
 func pieceCompletionForDir(dir string) (ret PieceCompletion) {
 	ret, err := NewDefaultPieceCompletionForDir(dir)
 	if err != nil {
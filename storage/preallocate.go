@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// How file-based storage allocates disk space for the files of a torrent when it's opened.
+type Preallocation int
+
+const (
+	// Files are created as data is written to them, and are sparse. This is the default.
+	PreallocateSparse Preallocation = iota
+	// Files are created at their full length and filled with zeroes. This works on any filesystem,
+	// but writes every byte of the torrent up front.
+	PreallocateFull
+	// Disk space is reserved with fallocate(2), without writing data. Only supported on Linux.
+	PreallocateFallocate
+)
+
+func (me Preallocation) String() string {
+	switch me {
+	case PreallocateSparse:
+		return "sparse"
+	case PreallocateFull:
+		return "full"
+	case PreallocateFallocate:
+		return "fallocate"
+	default:
+		return fmt.Sprintf("Preallocation(%d)", int(me))
+	}
+}
+
+// Allocates the file at its full length, creating it if necessary. Existing data is left alone.
+// Returns whether the file was created.
+func preallocateFile(name string, length int64, mode Preallocation) (created bool, err error) {
+	if mode == PreallocateSparse {
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(name), 0777)
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		f, err = os.OpenFile(name, os.O_RDWR, 0666)
+	} else {
+		created = err == nil
+	}
+	if err != nil {
+		return
+	}
+	defer func() {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	switch mode {
+	case PreallocateFull:
+		err = zeroFill(f, fi.Size(), length)
+	case PreallocateFallocate:
+		err = fallocate(f, length)
+	default:
+		err = fmt.Errorf("unknown preallocation mode %v", mode)
+	}
+	if err != nil {
+		err = fmt.Errorf("preallocating %q (%v): %w", name, mode, err)
+	}
+	return
+}
+
+// Writes zeroes to the file from off to length.
+func zeroFill(f io.WriterAt, off, length int64) error {
+	zeroes := make([]byte, 1<<16)
+	for off < length {
+		b := zeroes
+		if length-off < int64(len(b)) {
+			b = b[:length-off]
+		}
+		n, err := f.WriteAt(b, off)
+		if err != nil {
+			return err
+		}
+		off += int64(n)
+	}
+	return nil
+}
+
+// Preallocation that's run in the background, so that opening a torrent doesn't wait for it, as
+// PreallocateFull in particular writes every byte. Access to the data must wait for it, so that it
+// doesn't race with writes.
+type allocation struct {
+	done chan struct{}
+	err  error
+}
+
+func startAllocation(allocate func() error) *allocation {
+	a := &allocation{done: make(chan struct{})}
+	go func() {
+		defer close(a.done)
+		a.err = allocate()
+	}()
+	return a
+}
+
+// Waits for the allocation to finish, and returns its error. A nil allocation is already done.
+func (a *allocation) wait() error {
+	if a == nil {
+		return nil
+	}
+	<-a.done
+	return a.err
+}
@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+func fallocate(f *os.File, length int64) error {
+	if length == 0 {
+		return nil
+	}
+	return syscall.Fallocate(int(f.Fd()), 0, 0, length)
+}
+
+// Whether punchHole frees disk space.
+var canPunchHoles = true
+
+// Deallocates the range of the file, which then reads as zeroes.
+func punchHole(f *os.File, off, length int64) error {
+	const (
+		keepSize  = 0x1
+		punchHole = 0x2
+	)
+	return syscall.Fallocate(int(f.Fd()), punchHole|keepSize, off, length)
+}
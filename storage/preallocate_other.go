@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+func fallocate(f *os.File, length int64) error {
+	return errors.New("fallocate is only supported on Linux")
+}
+
+// Whether punchHole frees disk space.
+var canPunchHoles = false
+
+// Holes can't be punched portably, so the range keeps its disk space until it's rewritten.
+func punchHole(f *os.File, off, length int64) error {
+	return nil
+}
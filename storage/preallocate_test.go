@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func preallocateTestInfo() *metainfo.Info {
+	return &metainfo.Info{
+		Name:        "t",
+		PieceLength: 1 << 16,
+		Pieces:      make([]byte, 2*metainfo.HashSize),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 100 << 10},
+			{Path: []string{"b"}, Length: 28 << 10},
+		},
+	}
+}
+
+func testPreallocate(t *testing.T, mode Preallocation) {
+	c := qt.New(t)
+	td := t.TempDir()
+	info := preallocateTestInfo()
+	// Existing data is kept.
+	c.Assert(os.MkdirAll(filepath.Join(td, "t"), 0777), qt.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(td, "t", "a"), []byte("hello"), 0666), qt.IsNil)
+	s := NewFileOpts(FileOpts{
+		BaseDir:         td,
+		PieceCompletion: NewMapPieceCompletion(),
+		Preallocate:     mode,
+	})
+	defer s.Close()
+	ts, err := s.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ts.Allocated(), qt.IsNil)
+	for _, fi := range info.Files {
+		st, err := os.Stat(filepath.Join(td, "t", fi.Path[0]))
+		c.Assert(err, qt.IsNil)
+		c.Check(st.Size(), qt.Equals, fi.Length)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(td, "t", "a"))
+	c.Assert(err, qt.IsNil)
+	c.Check(string(b[:5]), qt.Equals, "hello")
+	// Files that were only created by preallocation aren't kept when they're deselected.
+	c.Assert(ts.SetFileWanted(1, false), qt.IsNil)
+	_, err = os.Stat(filepath.Join(td, "t", "b"))
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+	c.Assert(ts.SetFileWanted(0, false), qt.IsNil)
+	_, err = os.Stat(filepath.Join(td, "t", "a"))
+	c.Check(err, qt.IsNil)
+	// Selecting the file again allocates it.
+	c.Assert(ts.SetFileWanted(1, true), qt.IsNil)
+	st, err := os.Stat(filepath.Join(td, "t", "b"))
+	c.Assert(err, qt.IsNil)
+	c.Check(st.Size(), qt.Equals, int64(28<<10))
+}
+
+func TestPreallocateFull(t *testing.T) {
+	testPreallocate(t, PreallocateFull)
+}
+
+func TestPreallocateFallocate(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("fallocate is only supported on Linux")
+	}
+	testPreallocate(t, PreallocateFallocate)
+}
+
+func TestPreallocateSparseCreatesNothing(t *testing.T) {
+	c := qt.New(t)
+	td := t.TempDir()
+	s := NewFileOpts(FileOpts{
+		BaseDir:         td,
+		PieceCompletion: NewMapPieceCompletion(),
+	})
+	defer s.Close()
+	_, err := s.OpenTorrent(preallocateTestInfo(), metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	_, err = os.Stat(filepath.Join(td, "t"))
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+}
+
+// Allocation happens in the background, so its failure is reported by Allocated, and data can't be
+// written.
+func TestPreallocateFailureReported(t *testing.T) {
+	c := qt.New(t)
+	td := t.TempDir()
+	// A directory where a file should be can't be allocated.
+	c.Assert(os.MkdirAll(filepath.Join(td, "t", "a"), 0777), qt.IsNil)
+	for _, s := range []ClientImplCloser{
+		NewFileOpts(FileOpts{BaseDir: td, PieceCompletion: NewMapPieceCompletion(), Preallocate: PreallocateFull}),
+		NewMMapOpts(MMapOpts{BaseDir: td, PieceCompletion: NewMapPieceCompletion(), Preallocate: PreallocateFull}),
+	} {
+		info := preallocateTestInfo()
+		ts, err := s.OpenTorrent(info, metainfo.Hash{})
+		c.Assert(err, qt.IsNil)
+		c.Check(ts.Allocated(), qt.Not(qt.IsNil))
+		_, err = ts.Piece(info.Piece(0)).WriteAt([]byte("hello"), 0)
+		c.Check(err, qt.Not(qt.IsNil))
+		c.Check(ts.Close(), qt.IsNil)
+		s.Close()
+	}
+}
+
+func TestMMapPreallocateFull(t *testing.T) {
+	c := qt.New(t)
+	td := t.TempDir()
+	s := NewMMapOpts(MMapOpts{
+		BaseDir:         td,
+		PieceCompletion: NewMapPieceCompletion(),
+		Preallocate:     PreallocateFull,
+	})
+	defer s.Close()
+	ts, err := s.OpenTorrent(preallocateTestInfo(), metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	defer ts.Close()
+	c.Assert(ts.Allocated(), qt.IsNil)
+	st, err := os.Stat(filepath.Join(td, "t", "a"))
+	c.Assert(err, qt.IsNil)
+	c.Check(st.Size(), qt.Equals, int64(100<<10))
+}
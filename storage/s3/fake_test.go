@@ -0,0 +1,157 @@
+package s3Storage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An in-process object store implementing the parts of the S3 API the storage uses. Requests
+// must be signed with creds.
+type fakeS3 struct {
+	bucket string
+	creds  credentials
+	// Limits the keys in each page of listings.
+	maxKeys int
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	requests map[string]int
+	ranges   []string
+}
+
+func newFakeS3(bucket string, creds credentials) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{
+		bucket:   bucket,
+		creds:    creds,
+		maxKeys:  1000,
+		objects:  make(map[string][]byte),
+		requests: make(map[string]int),
+	}
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeS3) writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>fake</Message></Error>", code)
+}
+
+// Signs a copy of the request, and checks the signatures match.
+func (f *fakeS3) checkSignature(r *http.Request) bool {
+	date, err := time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+	req, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		return false
+	}
+	for k, vs := range r.Header {
+		if k != "Authorization" {
+			req.Header[k] = vs
+		}
+	}
+	f.creds.sign(req, date)
+	return req.Header.Get("Authorization") == r.Header.Get("Authorization")
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.checkSignature(r) {
+		f.writeError(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := path, ""
+	if i := strings.IndexByte(path, '/'); i != -1 {
+		bucket, key = path[:i], path[i+1:]
+	}
+	if bucket != f.bucket {
+		f.writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[r.Method]++
+	switch {
+	case key == "" && r.Method == "GET":
+		f.list(w, r)
+	case r.Method == "PUT":
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			f.writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[key] = b
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET":
+		b, ok := f.objects[key]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		rng := r.Header.Get("Range")
+		if rng == "" {
+			w.Write(b)
+			return
+		}
+		f.ranges = append(f.ranges, rng)
+		var first, last int
+		_, err := fmt.Sscanf(rng, "bytes=%d-%d", &first, &last)
+		if err != nil || first > last || first >= len(b) {
+			f.writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		if last >= len(b) {
+			last = len(b) - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(b)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(b[first : last+1])
+	default:
+		f.writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// ListObjectsV2. Continuation tokens are the index of the next key.
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	start, _ := strconv.Atoi(q.Get("continuation-token"))
+	type object struct {
+		Key  string
+		Size int
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []object
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	end := start + f.maxKeys
+	if end < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(end)
+	} else {
+		end = len(keys)
+	}
+	for _, k := range keys[start:end] {
+		result.Contents = append(result.Contents, object{k, len(f.objects[k])})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,370 @@
+package s3Storage
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+type NewClientOpts struct {
+	// The base URL of the S3 API, such as "https://s3.us-east-1.amazonaws.com". Buckets are
+	// addressed by path, which S3-compatible stores generally support.
+	Endpoint string
+	Bucket   string
+	// Prepended to object keys. Each piece is stored in the object "<KeyPrefix><infohash>/<piece
+	// index>" once it's complete.
+	KeyPrefix string
+	// Defaults to "us-east-1".
+	Region string
+	// Requests are unsigned if AccessKeyId is empty.
+	AccessKeyId     string
+	SecretAccessKey string
+	// Incomplete pieces are written to files in this directory, and uploaded whole when they're
+	// marked complete. Defaults to a directory in os.TempDir.
+	BufferDir string
+	// Tracks piece completion outside the object store. If nil, pieces are complete if their object
+	// exists. The objects for a torrent are listed when it's opened.
+	PieceCompletion storage.PieceCompletion
+	// Defaults to http.DefaultClient.
+	HttpClient *http.Client
+}
+
+// Returns storage that keeps piece data in an S3-compatible object store. Ranges of complete pieces
+// are read with ranged GETs.
+func NewClient(opts NewClientOpts) (storage.ClientImplCloser, error) {
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing endpoint: %w", err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("endpoint %q is not an absolute URL", opts.Endpoint)
+	}
+	if opts.Bucket == "" {
+		return nil, errors.New("bucket not set")
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	if opts.BufferDir == "" {
+		opts.BufferDir = filepath.Join(os.TempDir(), "torrent-s3")
+	}
+	if opts.HttpClient == nil {
+		opts.HttpClient = http.DefaultClient
+	}
+	return &client{
+		opts:     opts,
+		endpoint: endpoint,
+		creds: credentials{
+			accessKeyId:     opts.AccessKeyId,
+			secretAccessKey: opts.SecretAccessKey,
+			region:          opts.Region,
+		},
+	}, nil
+}
+
+type client struct {
+	opts     NewClientOpts
+	endpoint *url.URL
+	creds    credentials
+}
+
+func (cl *client) Close() error {
+	if cl.opts.PieceCompletion != nil {
+		return cl.opts.PieceCompletion.Close()
+	}
+	return nil
+}
+
+// An error response from the object store.
+type responseError struct {
+	method     string
+	key        string
+	statusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (me *responseError) Error() string {
+	s := fmt.Sprintf("s3 %s %q: %d %s", me.method, me.key, me.statusCode, http.StatusText(me.statusCode))
+	if me.Code != "" {
+		s += ": " + me.Code
+	}
+	if me.Message != "" {
+		s += ": " + me.Message
+	}
+	return s
+}
+
+func (cl *client) url(key string, query url.Values) *url.URL {
+	u := *cl.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + cl.opts.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = escapePath(u.Path)
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// Performs the request, returning an error for anything but a successful response.
+func (cl *client) do(
+	method, key string, query url.Values, header http.Header, body io.Reader, contentLength int64,
+) (*http.Response, error) {
+	req, err := http.NewRequest(method, cl.url(key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if body != nil {
+		req.ContentLength = contentLength
+	}
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	if cl.creds.accessKeyId != "" {
+		cl.creds.sign(req, time.Now())
+	}
+	resp, err := cl.opts.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		respErr := &responseError{method: method, key: key, statusCode: resp.StatusCode}
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		xml.Unmarshal(b, respErr)
+		return nil, respErr
+	}
+	return resp, nil
+}
+
+func (cl *client) listKeys(prefix string) (keys []string, err error) {
+	var token string
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		var resp *http.Response
+		resp, err = cl.do("GET", "", query, nil, nil, 0)
+		if err != nil {
+			return
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding object list: %w", err)
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated {
+			return
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (cl *client) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	t := &torrent{
+		cl:        cl,
+		infoHash:  infoHash,
+		keyPrefix: cl.opts.KeyPrefix + infoHash.HexString() + "/",
+		bufferDir: filepath.Join(cl.opts.BufferDir, infoHash.HexString()),
+	}
+	if cl.opts.PieceCompletion == nil {
+		keys, err := cl.listKeys(t.keyPrefix)
+		if err != nil {
+			return storage.TorrentImpl{}, fmt.Errorf("listing piece objects: %w", err)
+		}
+		t.complete = make(map[int]struct{}, len(keys))
+		for _, key := range keys {
+			i, err := strconv.Atoi(strings.TrimPrefix(key, t.keyPrefix))
+			if err != nil {
+				continue
+			}
+			t.complete[i] = struct{}{}
+		}
+	}
+	return storage.TorrentImpl{Piece: t.Piece, Close: t.Close}, nil
+}
+
+type torrent struct {
+	cl        *client
+	infoHash  metainfo.Hash
+	keyPrefix string
+	bufferDir string
+
+	mu sync.Mutex
+	// Pieces with objects. Nil if there's a PieceCompletion.
+	complete map[int]struct{}
+}
+
+func (t *torrent) Piece(p metainfo.Piece) storage.PieceImpl {
+	return piece{t, p}
+}
+
+func (t *torrent) Close() error {
+	// Only succeeds if there are no incomplete pieces.
+	os.Remove(t.bufferDir)
+	return nil
+}
+
+type piece struct {
+	t *torrent
+	p metainfo.Piece
+}
+
+func (p piece) key() string {
+	return p.t.keyPrefix + strconv.Itoa(p.p.Index())
+}
+
+func (p piece) bufferPath() string {
+	return filepath.Join(p.t.bufferDir, strconv.Itoa(p.p.Index()))
+}
+
+func (p piece) WriteAt(b []byte, off int64) (int, error) {
+	os.MkdirAll(p.t.bufferDir, 0777)
+	f, err := os.OpenFile(p.bufferPath(), os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.WriteAt(b, off)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+func (p piece) ReadAt(b []byte, off int64) (n int, err error) {
+	if !p.Completion().Complete {
+		f, err := os.Open(p.bufferPath())
+		if errors.Is(err, os.ErrNotExist) {
+			// Nothing has been written yet.
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		return f.ReadAt(b, off)
+	}
+	length := p.p.Length()
+	if off >= length {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > length-off {
+		b = b[:length-off]
+		err = io.EOF
+	}
+	if len(b) == 0 {
+		return
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, off+int64(len(b))-1)}}
+	resp, doErr := p.t.cl.do("GET", p.key(), nil, header, nil, 0)
+	if doErr != nil {
+		return 0, doErr
+	}
+	defer resp.Body.Close()
+	n, readErr := io.ReadFull(resp.Body, b)
+	if readErr != nil {
+		err = readErr
+	}
+	return
+}
+
+// Uploads the buffered piece data, and removes the buffer.
+func (p piece) MarkComplete() error {
+	f, err := os.Open(p.bufferPath())
+	if err != nil {
+		return err
+	}
+	length := p.p.Length()
+	fi, err := f.Stat()
+	if err == nil && fi.Size() < length {
+		err = fmt.Errorf("buffered piece data is %d bytes short", length-fi.Size())
+	}
+	if err == nil {
+		var resp *http.Response
+		resp, err = p.t.cl.do("PUT", p.key(), nil, nil, io.NewSectionReader(f, 0, length), length)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	err = p.setCompletion(true)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p.bufferPath())
+}
+
+// Deletes the piece's object. This is called for every piece that fails its hash check, so there's
+// no request if the piece is known not to have an object.
+func (p piece) MarkNotComplete() error {
+	if c := p.Completion(); c.Ok && !c.Complete {
+		return nil
+	}
+	resp, err := p.t.cl.do("DELETE", p.key(), nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return p.setCompletion(false)
+}
+
+func (p piece) pieceKey() metainfo.PieceKey {
+	return metainfo.PieceKey{InfoHash: p.t.infoHash, Index: p.p.Index()}
+}
+
+func (p piece) setCompletion(complete bool) error {
+	if pc := p.t.cl.opts.PieceCompletion; pc != nil {
+		return pc.Set(p.pieceKey(), complete)
+	}
+	p.t.mu.Lock()
+	defer p.t.mu.Unlock()
+	if complete {
+		p.t.complete[p.p.Index()] = struct{}{}
+	} else {
+		delete(p.t.complete, p.p.Index())
+	}
+	return nil
+}
+
+func (p piece) Completion() storage.Completion {
+	if pc := p.t.cl.opts.PieceCompletion; pc != nil {
+		c, err := pc.Get(p.pieceKey())
+		if err != nil {
+			return storage.Completion{}
+		}
+		return c
+	}
+	p.t.mu.Lock()
+	defer p.t.mu.Unlock()
+	_, ok := p.t.complete[p.p.Index()]
+	return storage.Completion{Complete: ok, Ok: true}
+}
@@ -0,0 +1,183 @@
+package s3Storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	test_storage "github.com/anacrolix/torrent/storage/test"
+)
+
+var testCreds = credentials{
+	accessKeyId:     "AKIDTEST",
+	secretAccessKey: "secret",
+	region:          "us-east-1",
+}
+
+func newTestClient(c *qt.C, opts NewClientOpts) (*fakeS3, storage.ClientImplCloser) {
+	fake, srv := newFakeS3("bucket", testCreds)
+	c.Cleanup(srv.Close)
+	opts.Endpoint = srv.URL
+	opts.Bucket = "bucket"
+	opts.AccessKeyId = testCreds.accessKeyId
+	opts.SecretAccessKey = testCreds.secretAccessKey
+	if opts.BufferDir == "" {
+		opts.BufferDir = c.TempDir()
+	}
+	ci, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+	c.Cleanup(func() { ci.Close() })
+	return fake, ci
+}
+
+func testInfo(numPieces int) *metainfo.Info {
+	return &metainfo.Info{
+		Name:        "t",
+		PieceLength: 4 << 10,
+		// The last piece is short.
+		Length: int64(numPieces)*4<<10 - 100,
+		Pieces: make([]byte, numPieces*metainfo.HashSize),
+	}
+}
+
+func TestPieceLifecycle(t *testing.T) {
+	c := qt.New(t)
+	bufferDir := t.TempDir()
+	fake, ci := newTestClient(c, NewClientOpts{BufferDir: bufferDir, KeyPrefix: "torrents/"})
+	fake.maxKeys = 1
+	info := testInfo(3)
+	ih := metainfo.Hash{1}
+	ti, err := ci.OpenTorrent(info, ih)
+	c.Assert(err, qt.IsNil)
+	ts := storage.Torrent{TorrentImpl: ti}
+	var keys []string
+	for i := 0; i < info.NumPieces(); i++ {
+		mp := info.Piece(i)
+		p := ts.Piece(mp)
+		c.Check(p.Completion(), qt.Equals, storage.Completion{Complete: false, Ok: true})
+		data := bytes.Repeat([]byte{byte('a' + i)}, int(mp.Length()))
+		for off := 0; off < len(data); off += 1 << 10 {
+			end := off + 1<<10
+			if end > len(data) {
+				end = len(data)
+			}
+			_, err := p.WriteAt(data[off:end], int64(off))
+			c.Assert(err, qt.IsNil)
+		}
+		// Incomplete pieces are hashed from the local buffer.
+		h := sha1.New()
+		_, err := p.WriteTo(h)
+		c.Assert(err, qt.IsNil)
+		sum := sha1.Sum(data)
+		c.Check(h.Sum(nil), qt.DeepEquals, sum[:])
+		c.Assert(p.MarkComplete(), qt.IsNil)
+		c.Check(p.Completion(), qt.Equals, storage.Completion{Complete: true, Ok: true})
+		keys = append(keys, "torrents/"+ih.HexString()+"/"+strconv.Itoa(i))
+	}
+	c.Check(fake.requests["PUT"], qt.Equals, 3)
+	for i, key := range keys {
+		c.Check(fake.objects[key], qt.HasLen, int(info.Piece(i).Length()))
+	}
+	// Buffers are removed once uploaded.
+	c.Assert(ts.Close(), qt.IsNil)
+	_, err = os.Stat(filepath.Join(bufferDir, ih.HexString()))
+	c.Check(os.IsNotExist(err), qt.IsTrue)
+
+	// Completion is recovered from the listing, which takes several pages.
+	ti, err = ci.OpenTorrent(info, ih)
+	c.Assert(err, qt.IsNil)
+	ts = storage.Torrent{TorrentImpl: ti}
+	p := ts.Piece(info.Piece(2))
+	c.Check(p.Completion(), qt.Equals, storage.Completion{Complete: true, Ok: true})
+	b := make([]byte, 10)
+	n, err := p.ReadAt(b, 100)
+	c.Assert(err, qt.IsNil)
+	c.Check(n, qt.Equals, 10)
+	c.Check(string(b), qt.Equals, "cccccccccc")
+	c.Check(fake.ranges, qt.DeepEquals, []string{"bytes=100-109"})
+	// Reads past the end of the piece are truncated.
+	b = make([]byte, 200)
+	n, err = p.ReadAt(b, info.Piece(2).Length()-100)
+	c.Assert(err, qt.IsNil)
+	c.Check(n, qt.Equals, 100)
+	c.Check(fake.ranges[1], qt.Equals, "bytes=3896-3995")
+
+	c.Assert(p.MarkNotComplete(), qt.IsNil)
+	c.Check(p.Completion().Complete, qt.IsFalse)
+	c.Check(fake.objects, qt.HasLen, 2)
+	c.Check(fake.requests["DELETE"], qt.Equals, 1)
+	// Pieces without objects don't need deleting.
+	c.Assert(p.MarkNotComplete(), qt.IsNil)
+	c.Assert(ts.Piece(info.Piece(0)).MarkNotComplete(), qt.IsNil)
+	c.Check(fake.requests["DELETE"], qt.Equals, 2)
+	c.Assert(ts.Piece(info.Piece(2)).MarkNotComplete(), qt.IsNil)
+	c.Check(fake.requests["DELETE"], qt.Equals, 2)
+}
+
+func TestSidecarPieceCompletion(t *testing.T) {
+	c := qt.New(t)
+	pc := storage.NewMapPieceCompletion()
+	fake, ci := newTestClient(c, NewClientOpts{PieceCompletion: pc})
+	info := testInfo(1)
+	ti, err := ci.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	// There's no need to list objects.
+	c.Check(fake.requests["GET"], qt.Equals, 0)
+	p := storage.Torrent{TorrentImpl: ti}.Piece(info.Piece(0))
+	_, err = p.WriteAt(make([]byte, info.Piece(0).Length()), 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(p.MarkComplete(), qt.IsNil)
+	comp, err := pc.Get(metainfo.PieceKey{Index: 0})
+	c.Assert(err, qt.IsNil)
+	c.Check(comp, qt.Equals, storage.Completion{Complete: true, Ok: true})
+}
+
+func TestErrorResponse(t *testing.T) {
+	c := qt.New(t)
+	fake, ci := newTestClient(c, NewClientOpts{})
+	info := testInfo(1)
+	ti, err := ci.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	p := storage.Torrent{TorrentImpl: ti}.Piece(info.Piece(0))
+	_, err = p.WriteAt(make([]byte, info.Piece(0).Length()), 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(p.MarkComplete(), qt.IsNil)
+	// The object disappears from the store behind our back.
+	fake.objects = make(map[string][]byte)
+	_, err = p.ReadAt(make([]byte, 1), 0)
+	c.Check(err, qt.ErrorMatches, `s3 GET ".*": 404 Not Found: NoSuchKey: fake`)
+	// Bad credentials are rejected.
+	fake.creds.secretAccessKey = "other"
+	_, err = ci.OpenTorrent(info, metainfo.Hash{})
+	c.Check(err, qt.ErrorMatches, `.*403 Forbidden: SignatureDoesNotMatch.*`)
+}
+
+func TestIncompletePieceNotUploaded(t *testing.T) {
+	c := qt.New(t)
+	fake, ci := newTestClient(c, NewClientOpts{})
+	info := testInfo(1)
+	ti, err := ci.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	p := storage.Torrent{TorrentImpl: ti}.Piece(info.Piece(0))
+	// There's no local data until the piece is written to.
+	_, err = p.ReadAt(make([]byte, 1), 0)
+	c.Check(err, qt.Equals, io.EOF)
+	_, err = p.WriteAt([]byte("hello"), 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(p.MarkComplete(), qt.ErrorMatches, "buffered piece data is .* bytes short")
+	c.Check(fake.requests["PUT"], qt.Equals, 0)
+}
+
+func BenchmarkPieceMarkComplete(b *testing.B) {
+	c := qt.New(b)
+	_, ci := newTestClient(c, NewClientOpts{})
+	test_storage.BenchmarkPieceMarkComplete(b, ci, 1<<20, 4, 0)
+}
@@ -6,6 +6,7 @@ package storage
 import (
 	"path/filepath"
 	"sync"
+	"time"
 
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
@@ -18,7 +19,11 @@ type sqlitePieceCompletion struct {
 	db *sqlite.Conn
 }
 
-var _ PieceCompletion = (*sqlitePieceCompletion)(nil)
+var _ interface {
+	PieceCompletion
+	PieceAccessTimes
+	PieceVerifiedTimes
+} = (*sqlitePieceCompletion)(nil)
 
 func NewSqlitePieceCompletion(dir string) (ret *sqlitePieceCompletion, err error) {
 	p := filepath.Join(dir, ".torrent.db")
@@ -26,7 +31,10 @@ func NewSqlitePieceCompletion(dir string) (ret *sqlitePieceCompletion, err error
 	if err != nil {
 		return
 	}
-	err = sqlitex.ExecScript(db, `create table if not exists piece_completion(infohash, "index", complete, unique(infohash, "index"))`)
+	err = sqlitex.ExecScript(db, `
+		create table if not exists piece_completion(infohash, "index", complete, unique(infohash, "index"));
+		create table if not exists piece_access(infohash, "index", accessed, unique(infohash, "index"));
+		create table if not exists piece_verified(infohash, "index", verified, unique(infohash, "index"));`)
 	if err != nil {
 		db.Close()
 		return
@@ -59,6 +67,54 @@ func (me *sqlitePieceCompletion) Set(pk metainfo.PieceKey, b bool) error {
 		pk.InfoHash.HexString(), pk.Index, b)
 }
 
+func (me *sqlitePieceCompletion) GetAccessTime(pk metainfo.PieceKey) (t time.Time, ok bool, err error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	err = sqlitex.Exec(
+		me.db, `select accessed from piece_access where infohash=? and "index"=?`,
+		func(stmt *sqlite.Stmt) error {
+			t = time.Unix(0, stmt.ColumnInt64(0))
+			ok = true
+			return nil
+		},
+		pk.InfoHash.HexString(), pk.Index)
+	return
+}
+
+func (me *sqlitePieceCompletion) SetAccessTime(pk metainfo.PieceKey, t time.Time) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return sqlitex.Exec(
+		me.db,
+		`insert or replace into piece_access(infohash, "index", accessed) values(?, ?, ?)`,
+		nil,
+		pk.InfoHash.HexString(), pk.Index, t.UnixNano())
+}
+
+func (me *sqlitePieceCompletion) GetVerifiedTime(pk metainfo.PieceKey) (t time.Time, ok bool, err error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	err = sqlitex.Exec(
+		me.db, `select verified from piece_verified where infohash=? and "index"=?`,
+		func(stmt *sqlite.Stmt) error {
+			t = time.Unix(0, stmt.ColumnInt64(0))
+			ok = true
+			return nil
+		},
+		pk.InfoHash.HexString(), pk.Index)
+	return
+}
+
+func (me *sqlitePieceCompletion) SetVerifiedTime(pk metainfo.PieceKey, t time.Time) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return sqlitex.Exec(
+		me.db,
+		`insert or replace into piece_verified(infohash, "index", verified) values(?, ?, ?)`,
+		nil,
+		pk.InfoHash.HexString(), pk.Index, t.UnixNano())
+}
+
 func (me *sqlitePieceCompletion) Close() (err error) {
 	me.mu.Lock()
 	defer me.mu.Unlock()
@@ -0,0 +1,502 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/RoaringBitmap/roaring"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+type WriteBackCacheOpts struct {
+	// The most bytes of piece data held in memory. Pieces are held from their first write until
+	// they're verified and written out, so if this is less than the data being downloaded at once,
+	// pieces have to be written out before they're complete. Defaults to 64 MiB.
+	Capacity int64
+}
+
+// Wraps storage so that received chunks are held in memory until their piece is verified. Pieces
+// are hashed from memory, and verified pieces are written out whole, one at a time, in the
+// background. Reads are served from memory where possible. If the capacity is reached, writes wait
+// for verified pieces to be written out, or failing that the oldest incomplete pieces are written
+// through to the wrapped storage. If writing out a piece fails, its data is kept. Verified pieces
+// are incomplete again, so they're written out once they're verified again, and the torrent is told
+// through TorrentImpl.OnPieceEvicted. Incomplete pieces stay cached, and writes to other pieces go
+// to the wrapped storage, so its errors are seen.
+func NewWriteBackCache(ci ClientImpl, opts WriteBackCacheOpts) ClientImplCloser {
+	if opts.Capacity == 0 {
+		opts.Capacity = 64 << 20
+	}
+	c := &writeBackCache{
+		ci:          ci,
+		capacity:    opts.Capacity,
+		pieces:      make(map[writeBackKey]*writeBackPiece),
+		flusherDone: make(chan struct{}),
+	}
+	c.cond.L = &c.mu
+	go c.flusher()
+	return c
+}
+
+type writeBackCache struct {
+	ci       ClientImpl
+	capacity int64
+
+	mu   sync.Mutex
+	cond sync.Cond
+	used int64
+	// Cached pieces, including those being flushed.
+	pieces map[writeBackKey]*writeBackPiece
+	// Incomplete pieces, oldest first, for writing through when the capacity is reached.
+	dirty list.List
+	// Complete pieces waiting to be written out.
+	flushQueue []*writeBackPiece
+	flushing   int
+	closed     bool
+
+	flusherDone chan struct{}
+}
+
+type writeBackKey struct {
+	t     *writeBackTorrent
+	index int
+}
+
+type writeBackPiece struct {
+	key   writeBackKey
+	under PieceImpl
+	buf   []byte
+	// The bytes of buf that have been written.
+	written roaring.Bitmap
+	// Set when the piece is marked complete. Its data won't change after this.
+	complete bool
+	// Set while the piece is being written out, either by the flusher, or because it's being
+	// evicted. Its data doesn't change, and it stays cached until it's done.
+	flushing bool
+	// The element in the dirty list, if the piece is incomplete.
+	dirtyElem *list.Element
+}
+
+func (e *writeBackPiece) covers(off, n int64) bool {
+	if n == 0 {
+		return true
+	}
+	count := e.written.Rank(uint32(off + n - 1))
+	if off != 0 {
+		count -= e.written.Rank(uint32(off - 1))
+	}
+	return count == uint64(n)
+}
+
+// Copies the cached data over b, which was read from the wrapped storage at off.
+func (e *writeBackPiece) overlay(b []byte, off int64) {
+	if e == nil {
+		return
+	}
+	for i := int64(0); i < int64(len(b)); i++ {
+		if e.written.Contains(uint32(off + i)) {
+			b[i] = e.buf[off+i]
+		}
+	}
+}
+
+// Writes the cached data to the wrapped storage, in a single write if the piece is fully cached.
+func (e *writeBackPiece) writeOut() (err error) {
+	if e.covers(0, int64(len(e.buf))) {
+		_, err = e.under.WriteAt(e.buf, 0)
+		return
+	}
+	it := e.written.Iterator()
+	for it.HasNext() {
+		begin := it.Next()
+		end := begin + 1
+		for it.HasNext() && it.PeekNext() == end {
+			it.Next()
+			end++
+		}
+		_, err = e.under.WriteAt(e.buf[begin:end], int64(begin))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (c *writeBackCache) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (TorrentImpl, error) {
+	ti, err := c.ci.OpenTorrent(info, infoHash)
+	if err != nil {
+		return ti, err
+	}
+	t := &writeBackTorrent{c: c, ti: ti}
+	ret := ti
+	ret.Piece = t.Piece
+	ret.Close = t.Close
+	ret.OnPieceEvicted = t.setOnPieceEvicted
+	return ret, nil
+}
+
+// Writes out all cached data, and closes the wrapped storage if it can be.
+func (c *writeBackCache) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	<-c.flusherDone
+	c.mu.Lock()
+	var err error
+	for c.dirty.Len() != 0 {
+		e := c.dirty.Front().Value.(*writeBackPiece)
+		evictErr := c.evict(e)
+		if evictErr != nil {
+			// There's nowhere left to keep it.
+			c.remove(e)
+			if err == nil {
+				err = fmt.Errorf("writing out piece %v: %w", e.key.index, evictErr)
+			}
+		}
+	}
+	c.mu.Unlock()
+	if closer, ok := c.ci.(io.Closer); ok {
+		closeErr := closer.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Returns the cached piece, making room for it if necessary. Returns nil if the piece can't be
+// cached, in which case operations should go to the wrapped storage.
+func (c *writeBackCache) entry(t *writeBackTorrent, p metainfo.Piece) *writeBackPiece {
+	key := writeBackKey{t, p.Index()}
+	for {
+		if e, ok := c.pieces[key]; ok {
+			return e
+		}
+		length := p.Length()
+		if c.closed || length > c.capacity {
+			return nil
+		}
+		if c.used+length <= c.capacity {
+			e := &writeBackPiece{
+				key:   key,
+				under: t.ti.Piece(p),
+				buf:   make([]byte, length),
+			}
+			e.dirtyElem = c.dirty.PushBack(e)
+			c.pieces[key] = e
+			c.used += length
+			return e
+		}
+		if len(c.flushQueue) != 0 || c.flushing != 0 {
+			c.cond.Wait()
+			continue
+		}
+		if c.dirty.Len() == 0 {
+			return nil
+		}
+		if c.evict(c.dirty.Front().Value.(*writeBackPiece)) != nil {
+			return nil
+		}
+	}
+}
+
+// Returns the cached piece to being incomplete, so its data can change. If the piece is being
+// written out, waits for that to finish and returns nil if the piece is no longer cached.
+func (c *writeBackCache) incompleteEntry(e *writeBackPiece) *writeBackPiece {
+	if e == nil {
+		return e
+	}
+	for e.flushing {
+		c.cond.Wait()
+	}
+	if c.pieces[e.key] != e {
+		return nil
+	}
+	// Writing it out failed, and it was returned to being incomplete.
+	if !e.complete {
+		return e
+	}
+	for i, qe := range c.flushQueue {
+		if qe == e {
+			c.flushQueue = append(c.flushQueue[:i], c.flushQueue[i+1:]...)
+			break
+		}
+	}
+	e.complete = false
+	e.dirtyElem = c.dirty.PushBack(e)
+	return e
+}
+
+// Writes an incomplete piece through to the wrapped storage and drops it from the cache. The cache
+// isn't locked while writing, so other pieces aren't held up, and the piece stays cached until
+// it's done, so that it's read from memory, and writes to it wait. If writing fails, the piece
+// stays cached, and is the last to be evicted again.
+func (c *writeBackCache) evict(e *writeBackPiece) error {
+	c.dirty.Remove(e.dirtyElem)
+	e.dirtyElem = nil
+	e.flushing = true
+	c.flushing++
+	c.mu.Unlock()
+	err := e.writeOut()
+	c.mu.Lock()
+	e.flushing = false
+	c.flushing--
+	if err != nil {
+		log.Printf("write-back cache: error writing out incomplete piece %v: %v", e.key.index, err)
+		e.dirtyElem = c.dirty.PushBack(e)
+		c.cond.Broadcast()
+		return err
+	}
+	c.remove(e)
+	return nil
+}
+
+func (c *writeBackCache) remove(e *writeBackPiece) {
+	if e.dirtyElem != nil {
+		c.dirty.Remove(e.dirtyElem)
+		e.dirtyElem = nil
+	}
+	delete(c.pieces, e.key)
+	c.used -= int64(len(e.buf))
+	c.cond.Broadcast()
+}
+
+func (c *writeBackCache) flusher() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		for len(c.flushQueue) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if len(c.flushQueue) == 0 {
+			close(c.flusherDone)
+			return
+		}
+		e := c.flushQueue[0]
+		c.flushQueue = c.flushQueue[1:]
+		e.flushing = true
+		c.flushing++
+		c.mu.Unlock()
+		err := e.writeOut()
+		if err == nil {
+			err = e.under.MarkComplete()
+		}
+		c.mu.Lock()
+		e.flushing = false
+		c.flushing--
+		if err != nil {
+			log.Printf("write-back cache: error writing out piece %v: %v", e.key.index, err)
+			// The data is kept, but the piece isn't complete anymore, so Completion reports it
+			// from the wrapped storage. Verifying it again queues it to be written out again.
+			e.complete = false
+			e.dirtyElem = c.dirty.PushBack(e)
+			c.cond.Broadcast()
+			if f := e.key.t.onEvicted; f != nil {
+				c.mu.Unlock()
+				f(e.key.index)
+				c.mu.Lock()
+			}
+			continue
+		}
+		c.remove(e)
+	}
+}
+
+type writeBackTorrent struct {
+	c  *writeBackCache
+	ti TorrentImpl
+	// Told of verified pieces that failed to be written out. Protected by the cache lock.
+	onEvicted func(int)
+}
+
+func (t *writeBackTorrent) setOnPieceEvicted(f func(int)) {
+	t.c.mu.Lock()
+	t.onEvicted = f
+	t.c.mu.Unlock()
+	if t.ti.OnPieceEvicted != nil {
+		t.ti.OnPieceEvicted(f)
+	}
+}
+
+func (t *writeBackTorrent) Piece(p metainfo.Piece) PieceImpl {
+	return writeBackPieceImpl{t, p}
+}
+
+// Writes out the torrent's cached pieces before closing the wrapped storage.
+func (t *writeBackTorrent) Close() (err error) {
+	c := t.c
+	c.mu.Lock()
+	for {
+		var evict *writeBackPiece
+		waiting := false
+		for key, e := range c.pieces {
+			if key.t != t {
+				continue
+			}
+			if e.complete || e.flushing {
+				waiting = true
+			} else {
+				evict = e
+				break
+			}
+		}
+		if evict != nil {
+			// This unlocks the cache, so the pieces are looked at again after.
+			evictErr := c.evict(evict)
+			if evictErr != nil {
+				// The torrent is going away, so there's no use keeping it.
+				c.remove(evict)
+				if err == nil {
+					err = fmt.Errorf("writing out piece %v: %w", evict.key.index, evictErr)
+				}
+			}
+			continue
+		}
+		if !waiting {
+			break
+		}
+		c.cond.Wait()
+	}
+	c.mu.Unlock()
+	if t.ti.Close != nil {
+		closeErr := t.ti.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+type writeBackPieceImpl struct {
+	t  *writeBackTorrent
+	mp metainfo.Piece
+}
+
+var _ interface {
+	PieceImpl
+	io.WriterTo
+} = writeBackPieceImpl{}
+
+func (p writeBackPieceImpl) cached() *writeBackPiece {
+	return p.t.c.pieces[writeBackKey{p.t, p.mp.Index()}]
+}
+
+func (p writeBackPieceImpl) under() PieceImpl {
+	return p.t.ti.Piece(p.mp)
+}
+
+func (p writeBackPieceImpl) WriteAt(b []byte, off int64) (int, error) {
+	c := p.t.c
+	c.mu.Lock()
+	e := c.incompleteEntry(c.entry(p.t, p.mp))
+	if e == nil {
+		// The piece may have been written out while waiting.
+		e = c.entry(p.t, p.mp)
+	}
+	if e == nil {
+		c.mu.Unlock()
+		return p.under().WriteAt(b, off)
+	}
+	n := copy(e.buf[off:], b)
+	e.written.AddRange(uint64(off), uint64(off)+uint64(n))
+	c.mu.Unlock()
+	if n < len(b) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+func (p writeBackPieceImpl) ReadAt(b []byte, off int64) (n int, err error) {
+	c := p.t.c
+	c.mu.Lock()
+	e := p.cached()
+	if e != nil && off < int64(len(e.buf)) && e.covers(off, int64(len(b))) {
+		n = copy(b, e.buf[off:])
+		c.mu.Unlock()
+		if n < len(b) {
+			err = io.EOF
+		}
+		return
+	}
+	c.mu.Unlock()
+	// Some of the data is in the wrapped storage, such as if it was written through before the
+	// piece was cached. The cache isn't locked while reading it, so other pieces aren't held up.
+	n, err = p.under().ReadAt(b, off)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Cached data is newer. The piece may have been written out, or cached again, while reading,
+	// but its buffer is never reused.
+	e.overlay(b[:n], off)
+	if cur := p.cached(); cur != e {
+		cur.overlay(b[:n], off)
+	}
+	return
+}
+
+// Hashing reads the whole piece through here, so fully cached pieces are hashed from memory.
+func (p writeBackPieceImpl) WriteTo(w io.Writer) (int64, error) {
+	c := p.t.c
+	c.mu.Lock()
+	e := p.cached()
+	var buf []byte
+	if e != nil && e.covers(0, int64(len(e.buf))) {
+		// The buffer isn't reused, so it's safe to use after unlocking.
+		buf = e.buf
+	}
+	c.mu.Unlock()
+	if buf != nil {
+		n, err := w.Write(buf)
+		return int64(n), err
+	}
+	return io.CopyN(w, io.NewSectionReader(p, 0, p.mp.Length()), p.mp.Length())
+}
+
+func (p writeBackPieceImpl) MarkComplete() error {
+	c := p.t.c
+	c.mu.Lock()
+	e := p.cached()
+	// An incomplete piece may be being evicted.
+	for e != nil && e.flushing && !e.complete {
+		c.cond.Wait()
+		e = p.cached()
+	}
+	if e == nil {
+		c.mu.Unlock()
+		return p.under().MarkComplete()
+	}
+	if !e.complete {
+		e.complete = true
+		c.dirty.Remove(e.dirtyElem)
+		e.dirtyElem = nil
+		c.flushQueue = append(c.flushQueue, e)
+		c.cond.Broadcast()
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// Keeps any cached data, since chunks that were fine will not necessarily be written again.
+func (p writeBackPieceImpl) MarkNotComplete() error {
+	c := p.t.c
+	c.mu.Lock()
+	c.incompleteEntry(p.cached())
+	c.mu.Unlock()
+	return p.under().MarkNotComplete()
+}
+
+func (p writeBackPieceImpl) Completion() Completion {
+	c := p.t.c
+	c.mu.Lock()
+	e := p.cached()
+	complete := e != nil && e.complete
+	c.mu.Unlock()
+	if complete {
+		return Completion{Complete: true, Ok: true}
+	}
+	return p.under().Completion()
+}
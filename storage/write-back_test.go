@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Counts the reads and writes to the wrapped storage.
+type countingClientImpl struct {
+	ClientImpl
+	reads, writes int64
+	// Optional. Called before reads.
+	onRead func()
+	// Optional. Writes fail with the returned error.
+	onWrite func() error
+}
+
+func (me *countingClientImpl) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (TorrentImpl, error) {
+	t, err := me.ClientImpl.OpenTorrent(info, infoHash)
+	piece := t.Piece
+	t.Piece = func(p metainfo.Piece) PieceImpl {
+		return countingPieceImpl{piece(p), me}
+	}
+	return t, err
+}
+
+type countingPieceImpl struct {
+	PieceImpl
+	c *countingClientImpl
+}
+
+func (me countingPieceImpl) ReadAt(b []byte, off int64) (int, error) {
+	atomic.AddInt64(&me.c.reads, 1)
+	if me.c.onRead != nil {
+		me.c.onRead()
+	}
+	return me.PieceImpl.ReadAt(b, off)
+}
+
+func (me countingPieceImpl) WriteAt(b []byte, off int64) (int, error) {
+	atomic.AddInt64(&me.c.writes, 1)
+	if me.c.onWrite != nil {
+		if err := me.c.onWrite(); err != nil {
+			return 0, err
+		}
+	}
+	return me.PieceImpl.WriteAt(b, off)
+}
+
+func writeBackTestInfo(numPieces int) *metainfo.Info {
+	return &metainfo.Info{
+		Name:        "t",
+		PieceLength: 4 << 10,
+		Length:      int64(numPieces) * 4 << 10,
+		Pieces:      make([]byte, numPieces*metainfo.HashSize),
+	}
+}
+
+func writePieceChunks(c *qt.C, p PieceImpl, data []byte) {
+	for off := 0; off < len(data); off += 1 << 10 {
+		n, err := p.WriteAt(data[off:off+1<<10], int64(off))
+		c.Assert(err, qt.IsNil)
+		c.Assert(n, qt.Equals, 1<<10)
+	}
+}
+
+func TestWriteBackCache(t *testing.T) {
+	c := qt.New(t)
+	under := &countingClientImpl{ClientImpl: NewFileWithCompletion(t.TempDir(), NewMapPieceCompletion())}
+	cache := NewWriteBackCache(under, WriteBackCacheOpts{})
+	info := writeBackTestInfo(2)
+	ti, err := cache.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	ts := Torrent{ti}
+	data := bytes.Repeat([]byte("hello"), 1<<10)[:4<<10]
+	p := ts.Piece(info.Piece(0))
+	writePieceChunks(c, p, data)
+	// Hashing and reading are served from memory.
+	h := sha1.New()
+	_, err = p.WriteTo(h)
+	c.Assert(err, qt.IsNil)
+	c.Check(h.Sum(nil), qt.DeepEquals, func() []byte { s := sha1.Sum(data); return s[:] }())
+	b := make([]byte, 5)
+	_, err = p.ReadAt(b, 5)
+	c.Assert(err, qt.IsNil)
+	c.Check(string(b), qt.Equals, "hello")
+	c.Check(atomic.LoadInt64(&under.reads), qt.Equals, int64(0))
+	c.Check(atomic.LoadInt64(&under.writes), qt.Equals, int64(0))
+	c.Assert(p.MarkComplete(), qt.IsNil)
+	c.Check(p.Completion(), qt.Equals, Completion{Complete: true, Ok: true})
+	// Closing the torrent writes out the verified piece in a single write.
+	c.Assert(ts.Close(), qt.IsNil)
+	c.Check(atomic.LoadInt64(&under.writes), qt.Equals, int64(1))
+	ti, err = under.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	up := ti.Piece(info.Piece(0))
+	c.Check(up.Completion().Complete, qt.IsTrue)
+	b = make([]byte, len(data))
+	_, err = up.ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, data)
+	c.Assert(cache.Close(), qt.IsNil)
+}
+
+func TestWriteBackCacheCapacity(t *testing.T) {
+	c := qt.New(t)
+	under := &countingClientImpl{ClientImpl: NewFileWithCompletion(t.TempDir(), NewMapPieceCompletion())}
+	// Only one piece fits.
+	cache := NewWriteBackCache(under, WriteBackCacheOpts{Capacity: 4 << 10})
+	defer cache.Close()
+	info := writeBackTestInfo(2)
+	ti, err := cache.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	ts := Torrent{ti}
+	p0 := ts.Piece(info.Piece(0))
+	p1 := ts.Piece(info.Piece(1))
+	data0 := bytes.Repeat([]byte{'a'}, 4<<10)
+	data1 := bytes.Repeat([]byte{'b'}, 4<<10)
+	// Half of the first piece is cached, and then written through to make room for the second.
+	writePieceChunks(c, p0, data0[:2<<10])
+	c.Check(atomic.LoadInt64(&under.writes), qt.Equals, int64(0))
+	writePieceChunks(c, p1, data1)
+	c.Check(atomic.LoadInt64(&under.writes), qt.Equals, int64(1))
+	// The first piece is cached again for its remaining chunks, and reads combine both.
+	_, err = p0.WriteAt(data0[2<<10:], 2<<10)
+	c.Assert(err, qt.IsNil)
+	b := make([]byte, 4<<10)
+	_, err = p0.ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, data0)
+	b = make([]byte, 4<<10)
+	n, err := p1.ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(n, qt.Equals, 4<<10)
+	c.Check(b, qt.DeepEquals, data1)
+	c.Assert(ts.Close(), qt.IsNil)
+}
+
+func TestWriteBackCacheMarkNotComplete(t *testing.T) {
+	c := qt.New(t)
+	under := &countingClientImpl{ClientImpl: NewFileWithCompletion(t.TempDir(), NewMapPieceCompletion())}
+	cache := NewWriteBackCache(under, WriteBackCacheOpts{})
+	defer cache.Close()
+	info := writeBackTestInfo(1)
+	ti, err := cache.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	p := Torrent{ti}.Piece(info.Piece(0))
+	data := bytes.Repeat([]byte{'x'}, 4<<10)
+	writePieceChunks(c, p, data)
+	c.Assert(p.MarkComplete(), qt.IsNil)
+	// A piece can be marked incomplete again before it's written out, and keeps its data.
+	c.Assert(p.MarkNotComplete(), qt.IsNil)
+	c.Check(p.Completion().Complete, qt.IsFalse)
+	_, err = p.WriteAt([]byte("y"), 0)
+	c.Assert(err, qt.IsNil)
+	b := make([]byte, len(data))
+	_, err = p.ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, append([]byte("y"), data[1:]...))
+	c.Assert(p.MarkComplete(), qt.IsNil)
+	c.Check(p.Completion().Complete, qt.IsTrue)
+	c.Assert(ti.Close(), qt.IsNil)
+	c.Check(atomic.LoadInt64(&under.writes), qt.Equals, int64(1))
+	ti, err = under.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	c.Check(ti.Piece(info.Piece(0)).Completion().Complete, qt.IsTrue)
+}
+
+// Reading from the wrapped storage doesn't hold up other pieces.
+func TestWriteBackCacheReadUnlocked(t *testing.T) {
+	c := qt.New(t)
+	reading := make(chan struct{})
+	unblock := make(chan struct{})
+	under := &countingClientImpl{
+		ClientImpl: NewFileWithCompletion(t.TempDir(), NewMapPieceCompletion()),
+		onRead: func() {
+			close(reading)
+			<-unblock
+		},
+	}
+	cache := NewWriteBackCache(under, WriteBackCacheOpts{})
+	defer cache.Close()
+	info := writeBackTestInfo(2)
+	ti, err := cache.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	ts := Torrent{ti}
+	readDone := make(chan struct{})
+	go func() {
+		// Nothing has been written, so the read fails, but it doesn't matter here.
+		ts.Piece(info.Piece(0)).ReadAt(make([]byte, 5), 0)
+		close(readDone)
+	}()
+	<-reading
+	p1 := ts.Piece(info.Piece(1))
+	writePieceChunks(c, p1, bytes.Repeat([]byte{'a'}, 4<<10))
+	c.Check(p1.Completion().Complete, qt.IsFalse)
+	close(unblock)
+	<-readDone
+	c.Assert(ts.Close(), qt.IsNil)
+}
+
+// Evicting a piece doesn't hold up the cache while it's written out.
+func TestWriteBackCacheEvictUnlocked(t *testing.T) {
+	c := qt.New(t)
+	writing := make(chan struct{})
+	unblock := make(chan struct{})
+	var blocked int32
+	under := &countingClientImpl{
+		ClientImpl: NewFileWithCompletion(t.TempDir(), NewMapPieceCompletion()),
+		onWrite: func() error {
+			if atomic.CompareAndSwapInt32(&blocked, 0, 1) {
+				close(writing)
+				<-unblock
+			}
+			return nil
+		},
+	}
+	// Only one piece fits.
+	cache := NewWriteBackCache(under, WriteBackCacheOpts{Capacity: 4 << 10})
+	defer cache.Close()
+	info := writeBackTestInfo(2)
+	ti, err := cache.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	ts := Torrent{ti}
+	p0 := ts.Piece(info.Piece(0))
+	data0 := bytes.Repeat([]byte{'a'}, 2<<10)
+	writePieceChunks(c, p0, data0)
+	writeDone := make(chan struct{})
+	go func() {
+		defer close(writeDone)
+		// Evicts the first piece to make room.
+		ts.Piece(info.Piece(1)).WriteAt(make([]byte, 1<<10), 0)
+	}()
+	<-writing
+	// The piece being evicted is still read from memory.
+	b := make([]byte, len(data0))
+	_, err = p0.ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, data0)
+	close(unblock)
+	<-writeDone
+	_, err = p0.ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, data0)
+	c.Assert(ts.Close(), qt.IsNil)
+}
+
+// A verified piece that can't be written out isn't reported complete, and is written out when it's
+// verified again.
+func TestWriteBackCacheWriteOutError(t *testing.T) {
+	c := qt.New(t)
+	var failWrites int32 = 1
+	under := &countingClientImpl{
+		ClientImpl: NewFileWithCompletion(t.TempDir(), NewMapPieceCompletion()),
+		onWrite: func() error {
+			if atomic.LoadInt32(&failWrites) != 0 {
+				return errors.New("no space")
+			}
+			return nil
+		},
+	}
+	cache := NewWriteBackCache(under, WriteBackCacheOpts{})
+	defer cache.Close()
+	info := writeBackTestInfo(1)
+	ti, err := cache.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	evicted := make(chan int, 1)
+	ti.OnPieceEvicted(func(i int) { evicted <- i })
+	p := Torrent{ti}.Piece(info.Piece(0))
+	data := bytes.Repeat([]byte{'x'}, 4<<10)
+	writePieceChunks(c, p, data)
+	c.Assert(p.MarkComplete(), qt.IsNil)
+	// The torrent is told the piece isn't complete anymore.
+	c.Check(<-evicted, qt.Equals, 0)
+	c.Check(p.Completion().Complete, qt.IsFalse)
+	// The data is still available.
+	b := make([]byte, len(data))
+	_, err = p.ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, data)
+	atomic.StoreInt32(&failWrites, 0)
+	c.Assert(p.MarkComplete(), qt.IsNil)
+	c.Assert(ti.Close(), qt.IsNil)
+	ti, err = under.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	up := ti.Piece(info.Piece(0))
+	c.Check(up.Completion().Complete, qt.IsTrue)
+	_, err = up.ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, data)
+}
+
+// An incomplete piece that can't be written out to make room is kept, and writes to other pieces go
+// to the wrapped storage, so they see its errors.
+func TestWriteBackCacheEvictError(t *testing.T) {
+	c := qt.New(t)
+	var failWrites int32 = 1
+	under := &countingClientImpl{
+		ClientImpl: NewFileWithCompletion(t.TempDir(), NewMapPieceCompletion()),
+		onWrite: func() error {
+			if atomic.LoadInt32(&failWrites) != 0 {
+				return errors.New("no space")
+			}
+			return nil
+		},
+	}
+	// Only one piece fits.
+	cache := NewWriteBackCache(under, WriteBackCacheOpts{Capacity: 4 << 10})
+	defer cache.Close()
+	info := writeBackTestInfo(2)
+	ti, err := cache.OpenTorrent(info, metainfo.Hash{})
+	c.Assert(err, qt.IsNil)
+	ts := Torrent{ti}
+	p0 := ts.Piece(info.Piece(0))
+	data0 := bytes.Repeat([]byte{'a'}, 2<<10)
+	writePieceChunks(c, p0, data0)
+	_, err = ts.Piece(info.Piece(1)).WriteAt(make([]byte, 1<<10), 0)
+	c.Check(err, qt.ErrorMatches, "no space")
+	b := make([]byte, len(data0))
+	_, err = p0.ReadAt(b, 0)
+	c.Assert(err, qt.IsNil)
+	c.Check(b, qt.DeepEquals, data0)
+	// Closing reports the data that couldn't be written out.
+	c.Check(ti.Close(), qt.ErrorMatches, "writing out piece 0: no space")
+}
@@ -196,7 +196,7 @@ func (t *Torrent) cancelPiecesLocked(begin, end pieceIndex) {
 func (t *Torrent) initFiles() {
 	var offset int64
 	t.files = new([]*File)
-	for _, fi := range t.info.UpvertedFiles() {
+	for i, fi := range t.info.UpvertedFiles() {
 		var path []string
 		if len(fi.PathUTF8) != 0 {
 			path = fi.PathUTF8
@@ -215,6 +215,8 @@ func (t *Torrent) initFiles() {
 			fi,
 			dp,
 			PiecePriorityNone,
+			i,
+			false,
 		})
 		offset += fi.Length
 	}
@@ -260,6 +260,22 @@ func TestClientTransferRateLimitedDownload(t *testing.T) {
 	})
 }
 
+func TestClientTransferSeederReadCache(t *testing.T) {
+	for _, policy := range []torrent.ReadCachePolicy{torrent.ReadCacheARC, torrent.ReadCacheLRU} {
+		t.Run(policy.String(), func(t *testing.T) {
+			testClientTransfer(t, testClientTransferParams{
+				ConfigureSeeder: ConfigureClient{
+					Config: func(cfg *torrent.ClientConfig) {
+						// Only fits one of the greeting torrent's pieces.
+						cfg.ReadCacheCapacity = 5
+						cfg.ReadCachePolicy = policy
+					},
+				},
+			})
+		})
+	}
+}
+
 func testClientTransferSmallCache(t *testing.T, setReadahead bool, readahead int64) {
 	testClientTransfer(t, testClientTransferParams{
 		LeecherStorage: newFileCacheClientStorageFactory(fileCacheClientStorageFactoryParams{
@@ -307,6 +323,22 @@ func TestClientTransferVarious(t *testing.T) {
 	for _, ls := range []leecherStorageTestCase{
 		{"Filecache", newFileCacheClientStorageFactory(fileCacheClientStorageFactoryParams{}), 0},
 		{"Boltdb", storage.NewBoltDB, 0},
+		{"EncryptedFile", func(s string) storage.ClientImplCloser {
+			ci, err := storage.NewEncrypted(storage.NewFile(s), storage.EncryptedOpts{
+				MasterKey: make([]byte, 32),
+				TagDir:    filepath.Join(s, ".tags"),
+			})
+			if err != nil {
+				panic(err)
+			}
+			return ci
+		}, 0},
+		{"Memory", func(string) storage.ClientImplCloser {
+			return storage.NewMemory(0)
+		}, 0},
+		{"WriteBackFile", func(s string) storage.ClientImplCloser {
+			return storage.NewWriteBackCache(storage.NewFile(s), storage.WriteBackCacheOpts{})
+		}, 0},
 		{"SqliteDirect", func(s string) storage.ClientImplCloser {
 			path := filepath.Join(s, "sqlite3.db")
 			var opts sqliteStorage.NewDirectStorageOpts
@@ -11,10 +11,7 @@ import (
 	"math/rand"
 	"net/http"
 	"net/url"
-	"sort"
-	"strings"
 	"sync"
-	"text/tabwriter"
 	"time"
 	"unsafe"
 
@@ -28,14 +25,14 @@ import (
 	"github.com/anacrolix/missinggo/v2"
 	"github.com/anacrolix/missinggo/v2/bitmap"
 	"github.com/anacrolix/missinggo/v2/prioritybitmap"
-	"github.com/anacrolix/multiless"
-	"github.com/davecgh/go-spew/spew"
+	"github.com/google/btree"
 	"github.com/pion/datachannel"
 
 	"github.com/anacrolix/torrent/bencode"
 	"github.com/anacrolix/torrent/common"
 	"github.com/anacrolix/torrent/metainfo"
 	pp "github.com/anacrolix/torrent/peer_protocol"
+	request_strategy "github.com/anacrolix/torrent/request-strategy"
 	"github.com/anacrolix/torrent/segments"
 	"github.com/anacrolix/torrent/storage"
 	"github.com/anacrolix/torrent/tracker"
@@ -48,7 +45,12 @@ import (
 type Torrent struct {
 	// Torrent-level aggregate statistics. First in struct to ensure 64-bit
 	// alignment. See #262.
-	stats  ConnStats
+	stats ConnStats
+	// Timings of storage operations. Also need 64-bit alignment.
+	storageWrites durationSummary
+	storageReads  durationSummary
+	storageHashes durationSummary
+
 	cl     *Client
 	logger log.Logger
 
@@ -56,6 +58,12 @@ type Torrent struct {
 	dataDownloadDisallowed bool
 	dataUploadDisallowed   bool
 	userOnWriteChunkErr    func(error)
+	// Request pieces in index order within each priority.
+	sequential bool
+	// Overrides the Client's request strategy if not nil.
+	requestStrategy request_strategy.Strategy
+	// The Torrent's share of download capacity relative to other Torrents. See SetDownloadWeight.
+	downloadWeight int
 
 	closed   missinggo.Event
 	infoHash metainfo.Hash
@@ -76,6 +84,8 @@ type Torrent struct {
 	storage *storage.Torrent
 	// Read-locked for using storage, and write-locked for Closing.
 	storageLock sync.RWMutex
+	// Serializes telling the storage which files are wanted.
+	fileWantedMu sync.Mutex
 
 	// TODO: Only announce stuff is used?
 	metainfo metainfo.MetaInfo
@@ -106,6 +116,12 @@ type Torrent struct {
 	trackerAnnouncers map[string]torrentTrackerAnnouncer
 	// How many times we've initiated a DHT announce. TODO: Move into stats.
 	numDHTAnnounces int
+	// Results of hashing pieces, excluding initial checks.
+	numPiecesHashedGood int64
+	numPiecesHashedBad  int64
+	// When the info was set. Pieces that haven't been verified since are scrubbed over the
+	// following ClientConfig.ScrubInterval.
+	scrubEpoch time.Time
 
 	// Name used if the info name isn't available. Should be cleared when the
 	// Info does become available.
@@ -121,16 +137,29 @@ type Torrent struct {
 	metadataCompletedChunks []bool
 	metadataChanged         sync.Cond
 
-	// Set when .Info is obtained.
+	// Set when .Info is obtained, and the storage has finished allocating.
 	gotMetainfo missinggo.Event
+	// Set while the storage allocates space in the background. Nothing is requested until it's
+	// done.
+	storageAllocating bool
+	// Set when the storage has finished allocating, after storageAllocationErr is set.
+	storageAllocated     missinggo.Event
+	storageAllocationErr error
 
 	readers                map[*reader]struct{}
 	_readerNowPieces       bitmap.Bitmap
 	_readerReadaheadPieces bitmap.Bitmap
 
+	// Deadlines set with SetPieceDeadline.
+	pieceDeadlines map[pieceIndex]time.Time
+	// The deadlines that have been reported missed, so they're only reported once.
+	missedPieceDeadlines map[pieceIndex]time.Time
+
 	// A cache of pieces we need to get. Calculated from various piece and
 	// file priorities and completion states elsewhere.
 	_pendingPieces prioritybitmap.PriorityBitmap
+	// The pending pieces in request order. See updatePieceRequestOrder.
+	requestOrder *btree.BTree
 	// A cache of completed piece indices.
 	_completedPieces roaring.Bitmap
 	// Pieces that need to be hashed.
@@ -166,6 +195,7 @@ func (t *Torrent) decPieceAvailability(i pieceIndex) {
 		panic(p.availability)
 	}
 	p.availability--
+	t.updatePieceRequestOrder(i)
 }
 
 func (t *Torrent) incPieceAvailability(i pieceIndex) {
@@ -173,6 +203,7 @@ func (t *Torrent) incPieceAvailability(i pieceIndex) {
 	if t.haveInfo() {
 		p := t.piece(i)
 		p.availability++
+		t.updatePieceRequestOrder(i)
 	}
 }
 
@@ -408,8 +439,21 @@ func (t *Torrent) setInfo(info *metainfo.Info) error {
 		var err error
 		t.storage, err = t.storageOpener.OpenTorrent(info, t.infoHash)
 		if err != nil {
+			// This includes failures to allocate storage, which should be seen before downloading
+			// starts.
+			t.cl.publishEvent(StorageErrorEvent{t, -1, err})
 			return fmt.Errorf("error opening torrent storage: %s", err)
 		}
+		if t.storage.OnPieceEvicted != nil {
+			// Eviction can happen during calls to the storage made with the Client locked.
+			t.storage.OnPieceEvicted(func(i int) {
+				go t.pieceEvicted(i)
+			})
+		}
+		if t.storage.Allocated != nil {
+			t.storageAllocating = true
+			go t.waitStorageAllocated(t.storage.Allocated)
+		}
 	}
 	t.nameMu.Lock()
 	t.info = info
@@ -422,8 +466,61 @@ func (t *Torrent) setInfo(info *metainfo.Info) error {
 	return nil
 }
 
+// Storage can allocate space in the background after being opened. Nothing is requested until it's
+// done, and GotInfo isn't closed until then, so that failures are seen before downloading starts.
+// If allocation fails there's nowhere to put data, so downloading is disallowed. Otherwise the
+// storage may have found complete pieces.
+func (t *Torrent) waitStorageAllocated(allocated func() error) {
+	err := allocated()
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.storageAllocating = false
+	defer func() {
+		t.storageAllocationErr = err
+		t.storageAllocated.Set()
+		t.gotMetainfo.Set()
+	}()
+	if t.closed.IsSet() {
+		return
+	}
+	if err == nil {
+		for i := range t.pieces {
+			t.updatePieceCompletion(i)
+		}
+		t.updateRequesting()
+		return
+	}
+	err = fmt.Errorf("allocating torrent storage: %w", err)
+	t.logger.WithDefaultLevel(log.Warning).Print(err)
+	t.cl.publishEvent(StorageErrorEvent{t, -1, err})
+	t.disallowDataDownloadLocked()
+}
+
+// Waits for the storage to finish allocating, if it does so in the background, and returns the
+// error if it failed. The Client lock must not be held.
+func (t *Torrent) waitStorageAllocation() error {
+	t.cl.lock()
+	background := t.storage != nil && t.storage.Allocated != nil
+	done := t.storageAllocated.C()
+	closed := t.closed.C()
+	t.cl.unlock()
+	if !background {
+		return nil
+	}
+	select {
+	case <-done:
+	case <-closed:
+		return errors.New("torrent closed")
+	}
+	t.cl.lock()
+	defer t.cl.unlock()
+	return t.storageAllocationErr
+}
+
 // This seems to be all the follow-up tasks after info is set, that can't fail.
 func (t *Torrent) onSetInfo() {
+	// Pieces found complete below are queued for scrubbing from here.
+	t.scrubEpoch = time.Now()
 	t.iterPeers(func(p *Peer) {
 		p.onGotInfo(t.info)
 	})
@@ -436,13 +533,20 @@ func (t *Torrent) onSetInfo() {
 		}
 		p.availability = int64(t.pieceAvailabilityFromPeers(i))
 		t.updatePieceCompletion(pieceIndex(i))
+		if t.pieceComplete(i) {
+			t.loadPieceVerified(i)
+		}
 		if !p.storageCompletionOk {
 			// t.logger.Printf("piece %s completion unknown, queueing check", p)
 			t.queuePieceCheck(pieceIndex(i))
 		}
 	}
+	t.updateRequesting()
 	t.cl.event.Broadcast()
-	t.gotMetainfo.Set()
+	t.cl.publishEvent(MetadataReceivedEvent{t})
+	if !t.storageAllocating {
+		t.gotMetainfo.Set()
+	}
 	t.updateWantPeersEvent()
 	t.pendingRequests = make(map[Request]int)
 	t.tryCreateMorePieceHashers()
@@ -549,18 +653,9 @@ func (t *Torrent) newMetadataExtensionMessage(c *PeerConn, msgType pp.ExtendedMe
 	}
 }
 
-type pieceAvailabilityRun struct {
-	count        pieceIndex
-	availability int64
-}
-
-func (me pieceAvailabilityRun) String() string {
-	return fmt.Sprintf("%v(%v)", me.count, me.availability)
-}
-
-func (t *Torrent) pieceAvailabilityRuns() (ret []pieceAvailabilityRun) {
+func (t *Torrent) pieceAvailabilityRuns() (ret []PieceAvailabilityRun) {
 	rle := missinggo.NewRunLengthEncoder(func(el interface{}, count uint64) {
-		ret = append(ret, pieceAvailabilityRun{availability: el.(int64), count: int(count)})
+		ret = append(ret, PieceAvailabilityRun{Availability: el.(int64), Length: int(count)})
 	})
 	for i := range t.pieces {
 		rle.Append(t.pieces[i].availability, 1)
@@ -623,92 +718,6 @@ func (psr PieceStateRun) String() (ret string) {
 	return
 }
 
-func (t *Torrent) writeStatus(w io.Writer) {
-	fmt.Fprintf(w, "Infohash: %s\n", t.infoHash.HexString())
-	fmt.Fprintf(w, "Metadata length: %d\n", t.metadataSize())
-	if !t.haveInfo() {
-		fmt.Fprintf(w, "Metadata have: ")
-		for _, h := range t.metadataCompletedChunks {
-			fmt.Fprintf(w, "%c", func() rune {
-				if h {
-					return 'H'
-				} else {
-					return '.'
-				}
-			}())
-		}
-		fmt.Fprintln(w)
-	}
-	fmt.Fprintf(w, "Piece length: %s\n",
-		func() string {
-			if t.haveInfo() {
-				return fmt.Sprintf("%v (%v chunks)",
-					t.usualPieceSize(),
-					float64(t.usualPieceSize())/float64(t.chunkSize))
-			} else {
-				return "no info"
-			}
-		}(),
-	)
-	if t.info != nil {
-		fmt.Fprintf(w, "Num Pieces: %d (%d completed)\n", t.numPieces(), t.numPiecesCompleted())
-		fmt.Fprintf(w, "Piece States: %s\n", t.pieceStateRuns())
-		fmt.Fprintf(w, "Piece availability: %v\n", strings.Join(func() (ret []string) {
-			for _, run := range t.pieceAvailabilityRuns() {
-				ret = append(ret, run.String())
-			}
-			return
-		}(), " "))
-	}
-	fmt.Fprintf(w, "Reader Pieces:")
-	t.forReaderOffsetPieces(func(begin, end pieceIndex) (again bool) {
-		fmt.Fprintf(w, " %d:%d", begin, end)
-		return true
-	})
-	fmt.Fprintln(w)
-
-	fmt.Fprintf(w, "Enabled trackers:\n")
-	func() {
-		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
-		fmt.Fprintf(tw, "    URL\tExtra\n")
-		for _, ta := range slices.Sort(slices.FromMapElems(t.trackerAnnouncers), func(l, r torrentTrackerAnnouncer) bool {
-			lu := l.URL()
-			ru := r.URL()
-			var luns, runs url.URL = *lu, *ru
-			luns.Scheme = ""
-			runs.Scheme = ""
-			var ml missinggo.MultiLess
-			ml.StrictNext(luns.String() == runs.String(), luns.String() < runs.String())
-			ml.StrictNext(lu.String() == ru.String(), lu.String() < ru.String())
-			return ml.Less()
-		}).([]torrentTrackerAnnouncer) {
-			fmt.Fprintf(tw, "    %q\t%v\n", ta.URL(), ta.statusLine())
-		}
-		tw.Flush()
-	}()
-
-	fmt.Fprintf(w, "DHT Announces: %d\n", t.numDHTAnnounces)
-
-	spew.NewDefaultConfig()
-	spew.Fdump(w, t.statsLocked())
-
-	peers := t.peersAsSlice()
-	sort.Slice(peers, func(_i, _j int) bool {
-		i := peers[_i]
-		j := peers[_j]
-		if less, ok := multiless.New().EagerSameLess(
-			i.downloadRate() == j.downloadRate(), i.downloadRate() < j.downloadRate(),
-		).LessOk(); ok {
-			return less
-		}
-		return worseConn(i, j)
-	})
-	for i, c := range peers {
-		fmt.Fprintf(w, "%2d. ", i+1)
-		c.writeStatus(w, t)
-	}
-}
-
 func (t *Torrent) haveInfo() bool {
 	return t.info != nil
 }
@@ -811,6 +820,7 @@ func (t *Torrent) close() (err error) {
 	t.cl.event.Broadcast()
 	t.pieceStateChanges.Close()
 	t.updateWantPeersEvent()
+	t.updateRequesting()
 	return
 }
 
@@ -826,6 +836,7 @@ func (t *Torrent) offsetRequest(off int64) (req Request, ok bool) {
 
 func (t *Torrent) writeChunk(piece int, begin int64, data []byte) (err error) {
 	defer perf.ScopeTimerErr(&err)()
+	defer t.storageWrites.timeSince(time.Now())
 	n, err := t.pieces[piece].Storage().WriteAt(data, begin)
 	if err == nil && n != len(data) {
 		err = io.ErrShortWrite
@@ -848,6 +859,7 @@ func (t *Torrent) pieceNumChunks(piece pieceIndex) pp.Integer {
 
 func (t *Torrent) pendAllChunkSpecs(pieceIndex pieceIndex) {
 	t.pieces[pieceIndex]._dirtyChunks.Clear()
+	t.updatePieceRequestOrder(pieceIndex)
 }
 
 func (t *Torrent) pieceLength(piece pieceIndex) pp.Integer {
@@ -865,8 +877,15 @@ func (t *Torrent) pieceLength(piece pieceIndex) pp.Integer {
 }
 
 func (t *Torrent) hashPiece(piece pieceIndex) (ret metainfo.Hash, err error) {
+	return t.hashPieceThrough(piece, nil)
+}
+
+// Hashes the piece's data from storage. If wrap is not nil, the data is written to the hash through
+// the writer it returns.
+func (t *Torrent) hashPieceThrough(piece pieceIndex, wrap func(io.Writer) io.Writer) (ret metainfo.Hash, err error) {
 	p := t.piece(piece)
 	p.waitNoPendingWrites()
+	defer t.storageHashes.timeSince(time.Now())
 	storagePiece := t.pieces[piece].Storage()
 
 	//Does the backend want to do its own hashing?
@@ -879,13 +898,17 @@ func (t *Torrent) hashPiece(piece pieceIndex) (ret metainfo.Hash, err error) {
 	}
 
 	hash := pieceHash.New()
+	var w io.Writer = hash
+	if wrap != nil {
+		w = wrap(hash)
+	}
 	const logPieceContents = false
 	if logPieceContents {
 		var examineBuf bytes.Buffer
-		_, err = storagePiece.WriteTo(io.MultiWriter(hash, &examineBuf))
+		_, err = storagePiece.WriteTo(io.MultiWriter(w, &examineBuf))
 		log.Printf("hashed %q with copy err %v", examineBuf.Bytes(), err)
 	} else {
-		_, err = storagePiece.WriteTo(hash)
+		_, err = storagePiece.WriteTo(w)
 	}
 	missinggo.CopyExact(&ret, hash.Sum(nil))
 	return
@@ -981,7 +1004,9 @@ func (t *Torrent) worstBadConn() *PeerConn {
 	heap.Init(&wcs)
 	for wcs.Len() != 0 {
 		c := heap.Pop(&wcs).(*PeerConn)
-		if c._stats.ChunksReadWasted.Int64() >= 6 && c._stats.ChunksReadWasted.Int64() > c._stats.ChunksReadUseful.Int64() {
+		// Chunks we asked several peers for aren't the fault of the peers that were beaten to it.
+		wasted := c._stats.ChunksReadWasted.Int64() - c._stats.ChunksReadDuplicate.Int64()
+		if wasted >= 6 && wasted > c._stats.ChunksReadUseful.Int64() {
 			return c
 		}
 		// If the connection is in the worst half of the established
@@ -1081,16 +1106,18 @@ func (t *Torrent) updatePiecePriority(piece pieceIndex) {
 	p := &t.pieces[piece]
 	newPrio := p.uncachedPriority()
 	// t.logger.Printf("torrent %p: piece %d: uncached priority: %v", t, piece, newPrio)
+	var changed bool
 	if newPrio == PiecePriorityNone {
-		if !t._pendingPieces.Remove(int(piece)) {
-			return
-		}
+		changed = t._pendingPieces.Remove(int(piece))
 	} else {
-		if !t._pendingPieces.Set(int(piece), newPrio.BitmapPriority()) {
-			return
-		}
+		changed = t._pendingPieces.Set(int(piece), newPrio.BitmapPriority())
+	}
+	t.updatePieceRequestOrder(piece)
+	if !changed {
+		return
 	}
 	t.piecePriorityChanged(piece)
+	t.updateRequesting()
 }
 
 func (t *Torrent) updateAllPiecePriorities() {
@@ -1105,6 +1132,37 @@ func (t *Torrent) updatePiecePriorities(begin, end pieceIndex) {
 	}
 }
 
+// Tells the storage whether the file is wanted, if it cares. The Client lock must not be held, as
+// the storage may move the file's data. Calls are serialized, and pass on the file's priority at
+// the time, so the storage ends up with the latest however calls interleave.
+func (t *Torrent) setFileWanted(f *File) {
+	t.fileWantedMu.Lock()
+	defer t.fileWantedMu.Unlock()
+	t.cl.lock()
+	wanted := f.prio != PiecePriorityNone
+	closed := t.closed.IsSet()
+	t.cl.unlock()
+	if wanted != f.storageUnwanted {
+		// The storage already has it.
+		return
+	}
+	if closed || t.storage == nil || t.storage.SetFileWanted == nil {
+		return
+	}
+	t.storageLock.RLock()
+	err := t.storage.SetFileWanted(f.index, wanted)
+	t.storageLock.RUnlock()
+	if err == nil {
+		f.storageUnwanted = !wanted
+		return
+	}
+	t.cl.lock()
+	defer t.cl.unlock()
+	err = fmt.Errorf("setting storage file %v wanted=%v: %w", f.index, wanted, err)
+	t.logger.WithDefaultLevel(log.Warning).Print(err)
+	t.cl.publishEvent(StorageErrorEvent{t, -1, err})
+}
+
 // Returns the range of pieces [begin, end) that contains the extent of bytes.
 func (t *Torrent) byteRegionPieces(off, size int64) (begin, end pieceIndex) {
 	if off >= *t.length {
@@ -1161,17 +1219,35 @@ func (t *Torrent) pendRequest(req Request) {
 	t.pieces[req.Index].pendChunkIndex(ci)
 }
 
-func (t *Torrent) pieceCompletionChanged(piece pieceIndex) {
+func (t *Torrent) pieceCompletionChanged(piece pieceIndex, wasComplete bool) {
 	t.tickleReaders()
 	t.cl.event.Broadcast()
 	if t.pieceComplete(piece) {
 		t.onPieceCompleted(piece)
+		t.queueScrub(piece)
+		// Only the Ok flag changed if the piece was already complete, such as when its existing
+		// data is verified again.
+		if !wasComplete {
+			t.publishCompletionEvents(piece)
+		}
 	} else {
 		t.onIncompletePiece(piece)
 	}
 	t.updatePiecePriority(piece)
 }
 
+// Publishes events for files and the torrent that were completed by the given piece.
+func (t *Torrent) publishCompletionEvents(piece pieceIndex) {
+	for _, f := range t.piece(piece).files {
+		if f.bytesLeft() == 0 {
+			t.cl.publishEvent(FileCompletedEvent{f})
+		}
+	}
+	if t.haveAllPieces() {
+		t.cl.publishEvent(TorrentCompletedEvent{t})
+	}
+}
+
 func (t *Torrent) numReceivedConns() (ret int) {
 	for c := range t.conns {
 		if c.Discovery == PeerSourceIncoming {
@@ -1228,6 +1304,16 @@ func (t *Torrent) putPieceInclination(pi []int) {
 	pieceInclinationsPut.Add(1)
 }
 
+// The storage removed the piece's data, so stop advertising it.
+func (t *Torrent) pieceEvicted(piece pieceIndex) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	if t.closed.IsSet() || !t.haveInfo() || piece >= t.numPieces() {
+		return
+	}
+	t.updatePieceCompletion(piece)
+}
+
 func (t *Torrent) updatePieceCompletion(piece pieceIndex) bool {
 	p := t.piece(piece)
 	uncached := t.pieceCompleteUncached(piece)
@@ -1246,7 +1332,7 @@ func (t *Torrent) updatePieceCompletion(piece pieceIndex) bool {
 	}
 	if changed {
 		log.Fstr("piece %d completion changed: %+v -> %+v", piece, cached, uncached).SetLevel(log.Debug).Log(t.logger)
-		t.pieceCompletionChanged(piece)
+		t.pieceCompletionChanged(piece, cached.Complete)
 	}
 	return changed
 }
@@ -1257,7 +1343,9 @@ func (t *Torrent) readAt(b []byte, off int64) (n int, err error) {
 		p := &t.pieces[off/t.info.PieceLength]
 		p.waitNoPendingWrites()
 		var n1 int
+		started := time.Now()
 		n1, err = p.Storage().ReadAt(b, off-p.Info().Offset())
+		t.storageReads.timeSince(started)
 		if n1 == 0 {
 			break
 		}
@@ -1367,6 +1455,7 @@ func (t *Torrent) deletePeerConn(c *PeerConn) (ret bool) {
 	}
 	_, ret = t.conns[c]
 	delete(t.conns, c)
+	t.updateRequesting()
 	// Avoid adding a drop event more than once. Probably we should track whether we've generated
 	// the drop event against the PexConnState instead.
 	if ret {
@@ -1677,7 +1766,7 @@ func (t *Torrent) dhtAnnouncer(s DhtServer) {
 	defer cl.unlock()
 	for {
 		for {
-			if t.closed.IsSet() {
+			if t.closed.IsSet() || !cl.hasDhtServer(s) {
 				return
 			}
 			if !t.wantPeers() {
@@ -1808,6 +1897,7 @@ func (t *Torrent) addPeerConn(c *PeerConn) (err error) {
 		panic(len(t.conns))
 	}
 	t.conns[c] = struct{}{}
+	t.updateRequesting()
 	if !t.cl.config.DisablePEX && !c.PeerExtensionBytes.SupportsExtended() {
 		t.pex.Add(c) // as no further extended handshake expected
 	}
@@ -1833,6 +1923,10 @@ func (t *Torrent) wantConns() bool {
 func (t *Torrent) SetMaxEstablishedConns(max int) (oldMax int) {
 	t.cl.lock()
 	defer t.cl.unlock()
+	return t.setMaxEstablishedConns(max)
+}
+
+func (t *Torrent) setMaxEstablishedConns(max int) (oldMax int) {
 	oldMax = t.maxEstablishedConns
 	t.maxEstablishedConns = max
 	wcs := slices.HeapInterface(slices.FromMapKeys(t.conns), func(l, r *PeerConn) bool {
@@ -1853,16 +1947,22 @@ func (t *Torrent) pieceHashed(piece pieceIndex, passed bool, hashIoErr error) {
 	if t.closed.IsSet() {
 		return
 	}
+	t.cl.publishEvent(PieceHashedEvent{t, piece, passed, hashIoErr})
+	if hashIoErr != nil {
+		t.cl.publishEvent(StorageErrorEvent{t, piece, hashIoErr})
+	}
 
 	// Don't score the first time a piece is hashed, it could be an initial check.
 	if p.storageCompletionOk {
 		if passed {
 			pieceHashedCorrect.Add(1)
+			t.numPiecesHashedGood++
 		} else {
 			log.Fmsg(
 				"piece %d failed hash: %d connections contributed", piece, len(p.dirtiers),
 			).AddValues(t, p).SetLevel(log.Debug).Log(t.logger)
 			pieceHashedNotCorrect.Add(1)
+			t.numPiecesHashedBad++
 		}
 	}
 
@@ -1874,6 +1974,8 @@ func (t *Torrent) pieceHashed(piece pieceIndex, passed bool, hashIoErr error) {
 	}()
 
 	if passed {
+		verified := time.Now()
+		p.lastVerified = verified
 		if len(p.dirtiers) != 0 {
 			// Don't increment stats above connection-level for every involved connection.
 			t.allStats((*ConnStats).incrementPiecesDirtiedGood)
@@ -1884,10 +1986,14 @@ func (t *Torrent) pieceHashed(piece pieceIndex, passed bool, hashIoErr error) {
 		t.clearPieceTouchers(piece)
 		t.cl.unlock()
 		err := p.Storage().MarkComplete()
+		if err == nil {
+			t.persistPieceVerified(piece, verified)
+		}
+		t.cl.lock()
 		if err != nil {
 			t.logger.Printf("%T: error marking piece complete %d: %s", t.storage, piece, err)
+			t.cl.publishEvent(StorageErrorEvent{t, piece, err})
 		}
-		t.cl.lock()
 
 		if t.closed.IsSet() {
 			return
@@ -1930,6 +2036,7 @@ func (t *Torrent) pieceHashed(piece pieceIndex, passed bool, hashIoErr error) {
 			if len(bannableTouchers) >= 1 {
 				c := bannableTouchers[0]
 				t.cl.banPeerIP(c.remoteIp())
+				t.cl.publishEvent(PeerBannedEvent{t, c.remoteIp()})
 				c.drop()
 			}
 		}
@@ -1937,6 +2044,36 @@ func (t *Torrent) pieceHashed(piece pieceIndex, passed bool, hashIoErr error) {
 		p.Storage().MarkNotComplete()
 	}
 	t.updatePieceCompletion(piece)
+	// Pieces that were already complete are due again from when they were verified.
+	t.queueScrub(piece)
+}
+
+// Loads when the piece's data last matched its hash, if the storage persists it.
+func (t *Torrent) loadPieceVerified(piece pieceIndex) {
+	if t.storage == nil || t.storage.VerifiedTimes == nil {
+		return
+	}
+	at, ok, err := t.storage.VerifiedTimes.GetVerifiedTime(metainfo.PieceKey{InfoHash: t.infoHash, Index: piece})
+	if err != nil {
+		t.logger.WithDefaultLevel(log.Warning).Printf("error loading verified time of piece %d: %v", piece, err)
+		return
+	}
+	if ok {
+		t.piece(piece).lastVerified = at
+		t.queueScrub(piece)
+	}
+}
+
+// Persists when the piece's data matched its hash, if the storage can, so it isn't hashed again
+// too soon after a restart. The client lock isn't required.
+func (t *Torrent) persistPieceVerified(piece pieceIndex, at time.Time) {
+	if t.storage.VerifiedTimes == nil {
+		return
+	}
+	err := t.storage.VerifiedTimes.SetVerifiedTime(metainfo.PieceKey{InfoHash: t.infoHash, Index: piece}, at)
+	if err != nil {
+		t.logger.WithDefaultLevel(log.Warning).Printf("error persisting verified time of piece %d: %v", piece, err)
+	}
 }
 
 func (t *Torrent) cancelRequestsForPiece(piece pieceIndex) {
@@ -1947,6 +2084,7 @@ func (t *Torrent) cancelRequestsForPiece(piece pieceIndex) {
 }
 
 func (t *Torrent) onPieceCompleted(piece pieceIndex) {
+	t.clearPieceDeadline(piece)
 	t.pendAllChunkSpecs(piece)
 	t.cancelRequestsForPiece(piece)
 	for conn := range t.conns {
@@ -1957,6 +2095,9 @@ func (t *Torrent) onPieceCompleted(piece pieceIndex) {
 
 // Called when a piece is found to be not complete.
 func (t *Torrent) onIncompletePiece(piece pieceIndex) {
+	if rc := t.cl.readCache; rc != nil {
+		rc.invalidatePiece(readCacheKey{t, piece})
+	}
 	if t.pieceAllDirty(piece) {
 		t.pendAllChunkSpecs(piece)
 	}
@@ -2128,6 +2269,7 @@ func (t *Torrent) piece(i int) *Piece {
 }
 
 func (t *Torrent) onWriteChunkErr(err error) {
+	t.cl.publishEvent(StorageErrorEvent{t, -1, err})
 	if t.userOnWriteChunkErr != nil {
 		go t.userOnWriteChunkErr(err)
 		return
@@ -2147,6 +2289,7 @@ func (t *Torrent) disallowDataDownloadLocked() {
 	t.iterPeers(func(c *Peer) {
 		c.updateRequests()
 	})
+	t.updateRequesting()
 	t.tickleReaders()
 }
 
@@ -2158,6 +2301,7 @@ func (t *Torrent) AllowDataDownload() {
 	t.iterPeers(func(c *Peer) {
 		c.updateRequests()
 	})
+	t.updateRequesting()
 }
 
 // Enables uploading data, if it was disabled.
@@ -2180,6 +2324,40 @@ func (t *Torrent) DisallowDataUpload() {
 	}
 }
 
+// Sets whether pieces are requested in index order within each priority, instead of rarest first.
+// This allows processing the start of the data before the rest is complete. Pieces within a small
+// window are still ordered rarest first, so the Torrent stays of some use to the swarm.
+func (t *Torrent) SetSequential(sequential bool) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.sequential = sequential
+	t.cl.tickleRequester()
+}
+
+// Sets the Torrent's share of the Client's download capacity, relative to other Torrents. The
+// default weight is 1. Peers of Torrents with lower weights than the highest of the Torrents
+// downloading are given proportionally fewer outstanding requests, but at least one, so Torrents
+// share the bandwidth they compete for roughly by weight. Storage capacity and
+// ClientConfig.MaxUnverifiedBytes, which limit the pieces that can be requested at once, are shared
+// in proportion to weights amongst pieces of the same priority, so a large Torrent can't starve the
+// others.
+func (t *Torrent) SetDownloadWeight(weight int) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.downloadWeight = weight
+	t.cl.tickleRequester()
+}
+
+// Sets the strategy that determines the requests made to the Torrent's peers, overriding
+// ClientConfig.RequestStrategy. Pass nil to use the Client's strategy again. The strategy is run
+// after the Client's, with the storage capacity and MaxUnverifiedBytes that are left over.
+func (t *Torrent) SetRequestStrategy(s request_strategy.Strategy) {
+	t.cl.lock()
+	defer t.cl.unlock()
+	t.requestStrategy = s
+	t.cl.tickleRequester()
+}
+
 // Sets a handler that is called if there's an error writing a chunk to local storage. By default,
 // or if nil, a critical message is logged, and data download is disabled.
 func (t *Torrent) SetOnWriteChunkError(f func(error)) {
@@ -2247,6 +2425,7 @@ func (t *Torrent) addWebSeed(url string) {
 	}
 	t.webSeeds[url] = &ws.peer
 	ws.peer.onPeerHasAllPieces()
+	t.updateRequesting()
 }
 
 func (t *Torrent) peerIsActive(p *Peer) (active bool) {
@@ -18,6 +18,7 @@ import (
 	"github.com/anacrolix/torrent/internal/testutil"
 	"github.com/anacrolix/torrent/metainfo"
 	pp "github.com/anacrolix/torrent/peer_protocol"
+	request_strategy "github.com/anacrolix/torrent/request-strategy"
 	"github.com/anacrolix/torrent/storage"
 )
 
@@ -212,3 +213,53 @@ func TestTorrentMetainfoIncompleteMetadata(t *testing.T) {
 	assert.False(t, tt.haveAllMetadataPieces())
 	assert.Nil(t, tt.Metainfo().InfoBytes)
 }
+
+func TestTorrentSequential(t *testing.T) {
+	cl, err := NewClient(TestingConfig(t))
+	require.NoError(t, err)
+	defer cl.Close()
+	spec := TorrentSpecFromMetaInfo(testutil.GreetingMetaInfo())
+	spec.Sequential = true
+	tt, _, err := cl.AddTorrentSpec(spec)
+	require.NoError(t, err)
+	cl.lock()
+	assert.True(t, tt.sequential)
+	cl.unlock()
+	tt.SetSequential(false)
+	cl.lock()
+	assert.False(t, tt.sequential)
+	cl.unlock()
+}
+
+func TestTorrentRequestStrategy(t *testing.T) {
+	// Sends the number of torrents in each run of the strategy.
+	recordingStrategy := func(c chan int) request_strategy.StrategyFunc {
+		return func(input request_strategy.Input) map[request_strategy.PeerId]request_strategy.PeerNextRequestState {
+			select {
+			case c <- len(input.Torrents):
+			default:
+			}
+			return request_strategy.Run(input)
+		}
+	}
+	clientRuns := make(chan int, 1)
+	torrentRuns := make(chan int, 1)
+	cfg := TestingConfig(t)
+	cfg.RequestStrategy = recordingStrategy(clientRuns)
+	cl, err := NewClient(cfg)
+	require.NoError(t, err)
+	defer cl.Close()
+	// Torrents that can't make requests are skipped, so this one needs wanted pieces and a peer.
+	spec := TorrentSpecFromMetaInfo(testutil.GreetingMetaInfo())
+	spec.Webseeds = []string{"http://127.0.0.1:1/"}
+	tt, _, err := cl.AddTorrentSpec(spec)
+	require.NoError(t, err)
+	tt.DownloadAll()
+	<-clientRuns
+	assert.Equal(t, 1, <-clientRuns)
+	tt.SetRequestStrategy(recordingStrategy(torrentRuns))
+	<-torrentRuns
+	assert.Equal(t, 1, <-torrentRuns)
+	<-clientRuns
+	assert.Equal(t, 0, <-clientRuns)
+}
@@ -0,0 +1,165 @@
+// Package torrenthttp serves the files of a Client's torrents over HTTP, for streaming media and
+// the like.
+package torrenthttp
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// The default for NewHandlerOpts.MaxReadahead.
+const DefaultMaxReadahead = 32 << 20
+
+type NewHandlerOpts struct {
+	// The most data to prioritize ahead of the read position of a request. A request for a range
+	// smaller than this only prioritizes the range. Defaults to DefaultMaxReadahead.
+	MaxReadahead int64
+}
+
+// An http.Handler that serves /<infohash>/<file path> for a Client's torrents, with support for
+// range requests. Data is read through a torrent.Reader, so the pieces for the requested range are
+// prioritized while the request is active, and interest is dropped when the client goes away.
+//
+// /<infohash>.m3u serves an M3U playlist of the torrent's audio and video files, or all its files if
+// it has none. Entries are relative to the playlist, so the handler can be mounted under a prefix.
+type Handler struct {
+	cl   *torrent.Client
+	opts NewHandlerOpts
+}
+
+func NewHandler(cl *torrent.Client, opts NewHandlerOpts) *Handler {
+	if opts.MaxReadahead == 0 {
+		opts.MaxReadahead = DefaultMaxReadahead
+	}
+	return &Handler{cl, opts}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	if ihHex := strings.TrimSuffix(p, ".m3u"); ihHex != p && !strings.Contains(ihHex, "/") {
+		t, ok := h.torrent(w, r, ihHex)
+		if ok {
+			servePlaylist(w, r, t)
+		}
+		return
+	}
+	i := strings.IndexByte(p, '/')
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	t, ok := h.torrent(w, r, p[:i])
+	if !ok {
+		return
+	}
+	filePath := p[i+1:]
+	for fileIndex, f := range t.Files() {
+		if f.DisplayPath() == filePath {
+			h.serveFile(w, r, f, fileIndex)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// Returns the torrent for the infohash once it has info, or writes an error response.
+func (h *Handler) torrent(w http.ResponseWriter, r *http.Request, ihHex string) (*torrent.Torrent, bool) {
+	var ih metainfo.Hash
+	if err := ih.FromHexString(ihHex); err != nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	t, ok := h.cl.Torrent(ih)
+	if !ok {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	select {
+	case <-t.GotInfo():
+		return t, true
+	case <-t.Closed():
+		http.NotFound(w, r)
+	case <-r.Context().Done():
+	}
+	return nil, false
+}
+
+// Reads are cancelled with the request, so that the reader is released promptly when the client
+// disconnects.
+type contextReader struct {
+	torrent.Reader
+	ctx context.Context
+}
+
+func (me contextReader) Read(b []byte) (int, error) {
+	return me.ReadContext(me.ctx, b)
+}
+
+func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, f *torrent.File, fileIndex int) {
+	reader := f.NewReader()
+	defer reader.Close()
+	reader.SetResponsive()
+	reader.SetReadahead(h.readahead(r, f.Length()))
+	// Torrent data for an infohash never changes, so the ETag can be derived from it alone.
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, f.Torrent().InfoHash().HexString(), fileIndex))
+	if w.Header().Get("Content-Type") == "" {
+		// Avoid http.ServeContent sniffing, which would block on data that may not be available.
+		ct := mime.TypeByExtension(path.Ext(f.DisplayPath()))
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", ct)
+	}
+	http.ServeContent(w, r, path.Base(f.DisplayPath()), time.Time{}, contextReader{reader, r.Context()})
+}
+
+// Returns the readahead for a request, from the length of the first requested range if there is
+// one.
+func (h *Handler) readahead(r *http.Request, size int64) int64 {
+	ra := h.opts.MaxReadahead
+	if l, ok := firstRangeLength(r.Header.Get("Range"), size); ok && l < ra {
+		ra = l
+	}
+	return ra
+}
+
+// Parses the length of the first range of a Range header value for content of the given size.
+func firstRangeLength(header string, size int64) (int64, bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return 0, false
+	}
+	spec := strings.TrimSpace(strings.SplitN(header[len(prefix):], ",", 2)[0])
+	var start, end int64
+	switch {
+	case strings.HasPrefix(spec, "-"):
+		// A suffix range.
+		if _, err := fmt.Sscanf(spec, "-%d", &end); err != nil {
+			return 0, false
+		}
+		return end, true
+	case strings.HasSuffix(spec, "-"):
+		if _, err := fmt.Sscanf(spec, "%d-", &start); err != nil || start > size {
+			return 0, false
+		}
+		return size - start, true
+	default:
+		if _, err := fmt.Sscanf(spec, "%d-%d", &start, &end); err != nil || end < start {
+			return 0, false
+		}
+		return end - start + 1, true
+	}
+}
@@ -0,0 +1,124 @@
+package torrenthttp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/internal/testutil"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func newTestServer(c *qt.C, dataDir string) (*torrent.Client, *httptest.Server) {
+	cfg := torrent.TestingConfig(c.TB)
+	cfg.DataDir = dataDir
+	cl, err := torrent.NewClient(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Cleanup(cl.Close)
+	s := httptest.NewServer(NewHandler(cl, NewHandlerOpts{}))
+	c.Cleanup(s.Close)
+	return cl, s
+}
+
+func get(c *qt.C, url string, header http.Header) (*http.Response, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	c.Assert(err, qt.IsNil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, qt.IsNil)
+	return resp, string(b)
+}
+
+func TestServeFile(t *testing.T) {
+	c := qt.New(t)
+	greetingDataDir, greetingMetainfo := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDataDir)
+	cl, s := newTestServer(c, greetingDataDir)
+	tt, err := cl.AddTorrent(greetingMetainfo)
+	c.Assert(err, qt.IsNil)
+	fileURL := s.URL + "/" + tt.InfoHash().HexString() + "/" + testutil.GreetingFileName
+
+	resp, body := get(c, fileURL, nil)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Check(body, qt.Equals, testutil.GreetingFileContents)
+	c.Check(resp.Header.Get("Content-Type"), qt.Equals, "application/octet-stream")
+	c.Check(resp.Header.Get("Accept-Ranges"), qt.Equals, "bytes")
+	etag := resp.Header.Get("ETag")
+	c.Check(etag, qt.Equals, `"`+tt.InfoHash().HexString()+`-0"`)
+
+	resp, body = get(c, fileURL, http.Header{"Range": {"bytes=2-5"}})
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusPartialContent)
+	c.Check(body, qt.Equals, testutil.GreetingFileContents[2:6])
+	c.Check(resp.Header.Get("Content-Range"), qt.Equals, fmt.Sprintf("bytes 2-5/%d", len(testutil.GreetingFileContents)))
+
+	resp, _ = get(c, fileURL, http.Header{"If-None-Match": {etag}})
+	c.Check(resp.StatusCode, qt.Equals, http.StatusNotModified)
+
+	resp, _ = get(c, s.URL+"/"+tt.InfoHash().HexString()+"/nope", nil)
+	c.Check(resp.StatusCode, qt.Equals, http.StatusNotFound)
+	resp, _ = get(c, s.URL+"/"+metainfo.Hash{}.HexString()+"/greeting", nil)
+	c.Check(resp.StatusCode, qt.Equals, http.StatusNotFound)
+}
+
+func TestPlaylist(t *testing.T) {
+	c := qt.New(t)
+	cl, s := newTestServer(c, c.TempDir())
+	info := metainfo.Info{
+		Name:        "album",
+		PieceLength: 1 << 14,
+		Pieces:      make([]byte, metainfo.HashSize),
+		Files: []metainfo.FileInfo{
+			{Path: []string{"cover.jpg"}, Length: 2},
+			{Path: []string{"disc 1", "01 intro.mp3"}, Length: 3},
+			{Path: []string{"disc 1", "02 outro.mp3"}, Length: 4},
+		},
+	}
+	var mi metainfo.MetaInfo
+	var err error
+	mi.InfoBytes, err = bencode.Marshal(info)
+	c.Assert(err, qt.IsNil)
+	tt, err := cl.AddTorrent(&mi)
+	c.Assert(err, qt.IsNil)
+	ih := tt.InfoHash().HexString()
+	resp, body := get(c, s.URL+"/"+ih+".m3u", nil)
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Check(resp.Header.Get("Content-Type"), qt.Equals, "audio/x-mpegurl")
+	c.Check(body, qt.Equals, "#EXTM3U\n"+
+		"#EXTINF:-1,disc 1/01 intro.mp3\n"+
+		ih+"/disc%201/01%20intro.mp3\n"+
+		"#EXTINF:-1,disc 1/02 outro.mp3\n"+
+		ih+"/disc%201/02%20outro.mp3\n")
+}
+
+func TestFirstRangeLength(t *testing.T) {
+	c := qt.New(t)
+	for _, tc := range []struct {
+		header string
+		length int64
+		ok     bool
+	}{
+		{"", 0, false},
+		{"bytes=0-99", 100, true},
+		{"bytes=100-", 900, true},
+		{"bytes=-50", 50, true},
+		{"bytes=10-19, 30-39", 10, true},
+		{"bytes=9-0", 0, false},
+		{"items=0-9", 0, false},
+	} {
+		l, ok := firstRangeLength(tc.header, 1000)
+		c.Check(ok, qt.Equals, tc.ok, qt.Commentf("%q", tc.header))
+		c.Check(l, qt.Equals, tc.length, qt.Commentf("%q", tc.header))
+	}
+}
@@ -0,0 +1,51 @@
+package torrenthttp
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/anacrolix/torrent"
+)
+
+func isMediaFile(f *torrent.File) bool {
+	ct := mime.TypeByExtension(path.Ext(f.DisplayPath()))
+	return strings.HasPrefix(ct, "audio/") || strings.HasPrefix(ct, "video/")
+}
+
+// Returns the URL path of a file relative to the torrent's playlist.
+func fileURLPath(t *torrent.Torrent, f *torrent.File) string {
+	segs := strings.Split(f.DisplayPath(), "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	return t.InfoHash().HexString() + "/" + strings.Join(segs, "/")
+}
+
+func servePlaylist(w http.ResponseWriter, r *http.Request, t *torrent.Torrent) {
+	files := t.Files()
+	var media []*torrent.File
+	for _, f := range files {
+		if isMediaFile(f) {
+			media = append(media, f)
+		}
+	}
+	if len(media) != 0 {
+		files = media
+	}
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	if r.Method == "HEAD" {
+		return
+	}
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	fmt.Fprintln(bw, "#EXTM3U")
+	for _, f := range files {
+		fmt.Fprintf(bw, "#EXTINF:-1,%s\n", f.DisplayPath())
+		fmt.Fprintln(bw, fileURLPath(t, f))
+	}
+}
@@ -18,9 +18,11 @@ import (
 // Announces a torrent to a tracker at regular intervals, when peers are
 // required.
 type trackerScraper struct {
-	u            url.URL
-	t            *Torrent
-	lastAnnounce trackerAnnounceResult
+	// Timings of announce requests to the tracker. First in struct to ensure 64-bit alignment.
+	announceDurations durationSummary
+	u                 url.URL
+	t                 *Torrent
+	lastAnnounce      trackerAnnounceResult
 }
 
 type torrentTrackerAnnouncer interface {
@@ -143,6 +145,7 @@ func (me *trackerScraper) announce(ctx context.Context, event tracker.AnnounceEv
 	ctx, cancel := context.WithTimeout(ctx, tracker.DefaultTrackerAnnounceTimeout)
 	defer cancel()
 	me.t.logger.WithDefaultLevel(log.Debug).Printf("announcing to %q: %#v", me.u.String(), req)
+	started := time.Now()
 	res, err := tracker.Announce{
 		Context:    ctx,
 		HTTPProxy:  me.t.cl.config.HTTPProxy,
@@ -155,6 +158,7 @@ func (me *trackerScraper) announce(ctx context.Context, event tracker.AnnounceEv
 		ClientIp4:  krpc.NodeAddr{IP: me.t.cl.config.PublicIp4},
 		ClientIp6:  krpc.NodeAddr{IP: me.t.cl.config.PublicIp6},
 	}.Do()
+	me.announceDurations.timeSince(started)
 	me.t.logger.WithDefaultLevel(log.Debug).Printf("announce to %q returned %#v: %v", me.u.String(), res, err)
 	if err != nil {
 		ret.Err = fmt.Errorf("announcing: %w", err)
@@ -205,6 +209,13 @@ func (me *trackerScraper) Run() {
 		e = tracker.None
 		me.t.cl.lock()
 		me.lastAnnounce = ar
+		me.t.cl.publishEvent(TrackerAnnounceEvent{
+			Torrent:  me.t,
+			URL:      me.u,
+			NumPeers: ar.NumPeers,
+			Interval: ar.Interval,
+			Err:      ar.Err,
+		})
 		me.t.cl.unlock()
 
 	recalculate:
@@ -217,6 +228,7 @@ func (me *trackerScraper) Run() {
 		me.t.cl.lock()
 		wantPeers := me.t.wantPeersEvent.C()
 		closed := me.t.closed.C()
+		reannounce := me.t.cl.reannounce.Signaled()
 		me.t.cl.unlock()
 
 		// If we want peers, reduce the interval to the minimum if it's appropriate.
@@ -239,6 +251,7 @@ func (me *trackerScraper) Run() {
 		case <-reconsider:
 			// Recalculate the interval.
 			goto recalculate
+		case <-reannounce:
 		case <-time.After(time.Until(ar.Completed.Add(interval))):
 		}
 	}
@@ -0,0 +1,131 @@
+// Package transmission implements the commonly used parts of the Transmission RPC protocol on top of
+// a torrent.Client, so that tools written for Transmission can control it. See
+// https://github.com/transmission/transmission/blob/main/docs/rpc-spec.md.
+package transmission
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+const (
+	SessionIdHeader = "X-Transmission-Session-Id"
+
+	rpcVersion        = 15
+	rpcVersionMinimum = 1
+)
+
+type NewHandlerOpts struct {
+	// Reported to clients as the download directory. Not used otherwise.
+	DownloadDir string
+	// Called to delete a torrent's data for torrent-remove with delete-local-data. The torrent has
+	// already been dropped. If nil, such requests fail.
+	DeleteData func(t *torrent.Torrent) error
+}
+
+// An http.Handler that serves Transmission RPC requests for a Client. Transmission torrent IDs are
+// assigned to the Client's torrents as they're first seen by the Handler.
+type Handler struct {
+	cl        *torrent.Client
+	opts      NewHandlerOpts
+	sessionId string
+	started   time.Time
+
+	mu       sync.Mutex
+	nextId   int
+	torrents map[metainfo.Hash]*torrentState
+	byId     map[int]metainfo.Hash
+}
+
+func NewHandler(cl *torrent.Client, opts NewHandlerOpts) *Handler {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return &Handler{
+		cl:        cl,
+		opts:      opts,
+		sessionId: hex.EncodeToString(b[:]),
+		started:   time.Now(),
+		nextId:    1,
+		torrents:  make(map[metainfo.Hash]*torrentState),
+		byId:      make(map[int]metainfo.Hash),
+	}
+}
+
+type request struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       *int            `json:"tag,omitempty"`
+}
+
+type response struct {
+	Result    string      `json:"result"`
+	Arguments interface{} `json:"arguments"`
+	Tag       *int        `json:"tag,omitempty"`
+}
+
+type methodFunc func(h *Handler, args json.RawMessage) (interface{}, error)
+
+var methods = map[string]methodFunc{
+	"torrent-add":       (*Handler).torrentAdd,
+	"torrent-get":       (*Handler).torrentGet,
+	"torrent-set":       (*Handler).torrentSet,
+	"torrent-start":     (*Handler).torrentStart,
+	"torrent-start-now": (*Handler).torrentStart,
+	"torrent-stop":      (*Handler).torrentStop,
+	"torrent-remove":    (*Handler).torrentRemove,
+	"session-get":       (*Handler).sessionGet,
+	"session-set":       (*Handler).sessionSet,
+	"session-stats":     (*Handler).sessionStats,
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Clients are expected to retry with the session ID from the conflict response. This guards
+	// against cross-site request forgery.
+	if r.Header.Get(SessionIdHeader) != h.sessionId {
+		w.Header().Set(SessionIdHeader, h.sessionId)
+		http.Error(w, fmt.Sprintf("invalid session ID. Set %s to %q.", SessionIdHeader, h.sessionId), http.StatusConflict)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req request
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("decoding request: %v", err), http.StatusBadRequest)
+		return
+	}
+	resp := response{
+		Result:    "success",
+		Arguments: struct{}{},
+		Tag:       req.Tag,
+	}
+	if f, ok := methods[req.Method]; !ok {
+		resp.Result = "method name not recognized"
+	} else {
+		args := req.Arguments
+		if len(args) == 0 {
+			args = json.RawMessage("{}")
+		}
+		ret, err := f(h, args)
+		if err != nil {
+			resp.Result = err.Error()
+		} else if ret != nil {
+			resp.Arguments = ret
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,172 @@
+package transmission
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/internal/testutil"
+)
+
+type rpcClient struct {
+	c         *qt.C
+	url       string
+	sessionId string
+}
+
+// Makes an RPC call, performing the session ID handshake if necessary, and returns the result and
+// arguments.
+func (me *rpcClient) call(method string, args interface{}) (string, map[string]interface{}) {
+	b, err := json.Marshal(map[string]interface{}{
+		"method":    method,
+		"arguments": args,
+	})
+	me.c.Assert(err, qt.IsNil)
+	for {
+		req, err := http.NewRequest("POST", me.url, bytes.NewReader(b))
+		me.c.Assert(err, qt.IsNil)
+		req.Header.Set(SessionIdHeader, me.sessionId)
+		resp, err := http.DefaultClient.Do(req)
+		me.c.Assert(err, qt.IsNil)
+		if resp.StatusCode == http.StatusConflict {
+			resp.Body.Close()
+			me.c.Assert(resp.Header.Get(SessionIdHeader), qt.Not(qt.Equals), me.sessionId)
+			me.sessionId = resp.Header.Get(SessionIdHeader)
+			continue
+		}
+		me.c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+		var ret struct {
+			Result    string                 `json:"result"`
+			Arguments map[string]interface{} `json:"arguments"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&ret)
+		resp.Body.Close()
+		me.c.Assert(err, qt.IsNil)
+		return ret.Result, ret.Arguments
+	}
+}
+
+func newTestHandler(c *qt.C, dataDir string) (*torrent.Client, *rpcClient) {
+	cfg := torrent.TestingConfig(c.TB)
+	cfg.DataDir = dataDir
+	cl, err := torrent.NewClient(cfg)
+	c.Assert(err, qt.IsNil)
+	c.Cleanup(cl.Close)
+	s := httptest.NewServer(NewHandler(cl, NewHandlerOpts{DownloadDir: dataDir}))
+	c.Cleanup(s.Close)
+	return cl, &rpcClient{c: c, url: s.URL}
+}
+
+func TestSessionIdRequired(t *testing.T) {
+	c := qt.New(t)
+	_, rc := newTestHandler(c, c.TempDir())
+	resp, err := http.Post(rc.url, "application/json", bytes.NewReader([]byte(`{"method":"session-get"}`)))
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, qt.Equals, http.StatusConflict)
+	c.Check(resp.Header.Get(SessionIdHeader), qt.Not(qt.Equals), "")
+	result, args := rc.call("session-get", nil)
+	c.Check(result, qt.Equals, "success")
+	c.Check(args["session-id"], qt.Equals, rc.sessionId)
+	result, _ = rc.call("no-such-method", nil)
+	c.Check(result, qt.Not(qt.Equals), "success")
+}
+
+func TestTorrentLifecycle(t *testing.T) {
+	c := qt.New(t)
+	greetingDataDir, greetingMetainfo := testutil.GreetingTestTorrent()
+	defer os.RemoveAll(greetingDataDir)
+	cl, rc := newTestHandler(c, greetingDataDir)
+	var buf bytes.Buffer
+	c.Assert(greetingMetainfo.Write(&buf), qt.IsNil)
+	addArgs := map[string]interface{}{
+		"metainfo": base64.StdEncoding.EncodeToString(buf.Bytes()),
+		"paused":   true,
+	}
+	result, args := rc.call("torrent-add", addArgs)
+	c.Assert(result, qt.Equals, "success")
+	added := args["torrent-added"].(map[string]interface{})
+	c.Check(added["id"], qt.Equals, 1.0)
+	c.Check(added["name"], qt.Equals, testutil.GreetingFileName)
+	c.Check(added["hashString"], qt.Equals, greetingMetainfo.HashInfoBytes().HexString())
+	result, args = rc.call("torrent-add", addArgs)
+	c.Assert(result, qt.Equals, "success")
+	c.Check(args["torrent-duplicate"], qt.Not(qt.IsNil))
+
+	get := func(fields ...string) map[string]interface{} {
+		result, args := rc.call("torrent-get", map[string]interface{}{
+			"ids":    []interface{}{1},
+			"fields": fields,
+		})
+		c.Assert(result, qt.Equals, "success")
+		torrents := args["torrents"].([]interface{})
+		c.Assert(torrents, qt.HasLen, 1)
+		return torrents[0].(map[string]interface{})
+	}
+	tg := get("id", "name", "status", "totalSize", "downloadDir", "noSuchField")
+	c.Check(tg["status"], qt.Equals, float64(statusStopped))
+	c.Check(tg["totalSize"], qt.Equals, float64(len(testutil.GreetingFileContents)))
+	c.Check(tg["downloadDir"], qt.Equals, greetingDataDir)
+	c.Check(tg, qt.Not(qt.Contains), "noSuchField")
+
+	result, _ = rc.call("torrent-start", map[string]interface{}{"ids": 1})
+	c.Assert(result, qt.Equals, "success")
+	tt := cl.Torrents()[0]
+	<-tt.GotInfo()
+	c.Check(get("status")["status"], qt.Not(qt.Equals), float64(statusStopped))
+
+	result, _ = rc.call("torrent-set", map[string]interface{}{
+		"ids":            []interface{}{tt.InfoHash().HexString()},
+		"files-unwanted": []int{0},
+		"priority-high":  []int{0},
+	})
+	c.Assert(result, qt.Equals, "success")
+	tg = get("wanted", "priorities")
+	c.Check(tg["wanted"], qt.DeepEquals, []interface{}{false})
+	c.Check(tg["priorities"], qt.DeepEquals, []interface{}{1.0})
+	c.Check(tt.Files()[0].Priority(), qt.Equals, torrent.PiecePriorityNone)
+	result, _ = rc.call("torrent-set", map[string]interface{}{
+		"ids":          1,
+		"files-wanted": []int{},
+	})
+	c.Assert(result, qt.Equals, "success")
+	c.Check(tt.Files()[0].Priority(), qt.Equals, torrent.PiecePriorityHigh)
+
+	result, _ = rc.call("torrent-remove", map[string]interface{}{"ids": 1, "delete-local-data": true})
+	c.Check(result, qt.Not(qt.Equals), "success")
+	result, _ = rc.call("torrent-remove", map[string]interface{}{"ids": 1})
+	c.Assert(result, qt.Equals, "success")
+	c.Check(cl.Torrents(), qt.HasLen, 0)
+	result, args = rc.call("torrent-get", map[string]interface{}{"fields": []string{"id"}})
+	c.Assert(result, qt.Equals, "success")
+	c.Check(args["torrents"], qt.HasLen, 0)
+}
+
+func TestSessionSetSpeedLimits(t *testing.T) {
+	c := qt.New(t)
+	cl, rc := newTestHandler(c, c.TempDir())
+	result, args := rc.call("session-get", nil)
+	c.Assert(result, qt.Equals, "success")
+	c.Check(args["speed-limit-down-enabled"], qt.IsFalse)
+	result, _ = rc.call("session-set", map[string]interface{}{
+		"speed-limit-down":         100,
+		"speed-limit-down-enabled": true,
+	})
+	c.Assert(result, qt.Equals, "success")
+	c.Check(float64(cl.Config().DownloadRateLimiter.Limit()), qt.Equals, 100.0*speedUnitBytes)
+	result, args = rc.call("session-get", nil)
+	c.Assert(result, qt.Equals, "success")
+	c.Check(args["speed-limit-down"], qt.Equals, 100.0)
+	c.Check(args["speed-limit-down-enabled"], qt.IsTrue)
+	c.Check(args["speed-limit-up-enabled"], qt.IsFalse)
+	result, args = rc.call("session-stats", nil)
+	c.Assert(result, qt.Equals, "success")
+	c.Check(args["torrentCount"], qt.Equals, 0.0)
+}
@@ -0,0 +1,118 @@
+package transmission
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// How long since a torrent transferred data that it's considered "recently-active".
+const recentlyActivePeriod = time.Minute
+
+// What the Handler tracks for each torrent, beyond what's available from the Client.
+type torrentState struct {
+	id      int
+	added   time.Time
+	stopped bool
+	rates   rateTracker
+	// Transmission file priorities, kept so that they survive toggling whether a file is wanted.
+	filePriorities []int
+	// Whether files have been selected by torrent-add or torrent-set.
+	filesSelected bool
+}
+
+// Assigns IDs to torrents not yet seen, forgets torrents no longer in the Client, and updates
+// transfer rates. Returns the Client's torrents ordered by ID. h.mu must be held.
+func (h *Handler) syncTorrents() (ret []*torrent.Torrent) {
+	present := make(map[metainfo.Hash]struct{})
+	now := time.Now()
+	for _, t := range h.cl.Torrents() {
+		ih := t.InfoHash()
+		present[ih] = struct{}{}
+		stats := t.Stats()
+		h.torrentState(ih).rates.update(now, stats.BytesReadData.Int64(), stats.BytesWrittenData.Int64())
+		ret = append(ret, t)
+	}
+	for ih, ts := range h.torrents {
+		if _, ok := present[ih]; !ok {
+			delete(h.torrents, ih)
+			delete(h.byId, ts.id)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return h.torrents[ret[i].InfoHash()].id < h.torrents[ret[j].InfoHash()].id
+	})
+	return
+}
+
+// Returns the state for a torrent, creating it if necessary. h.mu must be held.
+func (h *Handler) torrentState(ih metainfo.Hash) *torrentState {
+	ts, ok := h.torrents[ih]
+	if !ok {
+		ts = &torrentState{
+			id:    h.nextId,
+			added: time.Now(),
+		}
+		h.nextId++
+		h.torrents[ih] = ts
+		h.byId[ts.id] = ih
+	}
+	return ts
+}
+
+// Resolves the "ids" argument: absent for all torrents, a single ID or hash, a list of IDs and
+// hashes, or "recently-active". h.mu must be held.
+func (h *Handler) selectTorrents(ids json.RawMessage) ([]*torrent.Torrent, error) {
+	all := h.syncTorrents()
+	if len(ids) == 0 {
+		return all, nil
+	}
+	var s string
+	if json.Unmarshal(ids, &s) == nil && s == "recently-active" {
+		var ret []*torrent.Torrent
+		now := time.Now()
+		for _, t := range all {
+			if now.Sub(h.torrents[t.InfoHash()].rates.lastActive) < recentlyActivePeriod {
+				ret = append(ret, t)
+			}
+		}
+		return ret, nil
+	}
+	var list []interface{}
+	if json.Unmarshal(ids, &list) != nil {
+		var single interface{}
+		if err := json.Unmarshal(ids, &single); err != nil {
+			return nil, fmt.Errorf("decoding ids: %w", err)
+		}
+		list = []interface{}{single}
+	}
+	want := make(map[metainfo.Hash]struct{})
+	for _, id := range list {
+		switch id := id.(type) {
+		case float64:
+			if ih, ok := h.byId[int(id)]; ok {
+				want[ih] = struct{}{}
+			}
+		case string:
+			var ih metainfo.Hash
+			if err := ih.FromHexString(strings.ToLower(id)); err != nil {
+				return nil, fmt.Errorf("invalid torrent hash %q: %w", id, err)
+			}
+			want[ih] = struct{}{}
+		default:
+			return nil, fmt.Errorf("invalid torrent id %v", id)
+		}
+	}
+	var ret []*torrent.Torrent
+	for _, t := range all {
+		if _, ok := want[t.InfoHash()]; ok {
+			ret = append(ret, t)
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,39 @@
+package transmission
+
+import (
+	"time"
+)
+
+// The minimum time between samples used to calculate a rate, so that frequent polling doesn't make
+// rates jumpy.
+const rateSampleInterval = time.Second
+
+// Derives transfer rates from cumulative byte counts sampled when torrents are queried.
+type rateTracker struct {
+	lastSample time.Time
+	lastDown   int64
+	lastUp     int64
+	down, up   float64
+	lastActive time.Time
+}
+
+// Updates the rates, in bytes per second, with the current cumulative counts.
+func (me *rateTracker) update(now time.Time, down, up int64) {
+	if me.lastSample.IsZero() {
+		me.lastSample = now
+		me.lastDown = down
+		me.lastUp = up
+		return
+	}
+	elapsed := now.Sub(me.lastSample)
+	if elapsed >= rateSampleInterval {
+		me.down = float64(down-me.lastDown) / elapsed.Seconds()
+		me.up = float64(up-me.lastUp) / elapsed.Seconds()
+		if down != me.lastDown || up != me.lastUp {
+			me.lastActive = now
+		}
+		me.lastSample = now
+		me.lastDown = down
+		me.lastUp = up
+	}
+}
@@ -0,0 +1,143 @@
+package transmission
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/version"
+)
+
+// Transmission speeds are in kB/s.
+const speedUnitBytes = 1000
+
+// Returns the Transmission speed limit and whether it's enabled for a rate limiter.
+func speedLimit(l *rate.Limiter) (int64, bool) {
+	if l == nil || l.Limit() == rate.Inf {
+		return 0, false
+	}
+	return int64(math.Round(float64(l.Limit()) / speedUnitBytes)), true
+}
+
+func newSpeedLimiter(kBps int64, enabled bool, burst int) *rate.Limiter {
+	if !enabled {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(kBps*speedUnitBytes), burst)
+}
+
+func (h *Handler) sessionGet(json.RawMessage) (interface{}, error) {
+	cfg := h.cl.Config()
+	down, downEnabled := speedLimit(cfg.DownloadRateLimiter)
+	up, upEnabled := speedLimit(cfg.UploadRateLimiter)
+	return map[string]interface{}{
+		"version":                  version.DefaultExtendedHandshakeClientVersion,
+		"rpc-version":              rpcVersion,
+		"rpc-version-minimum":      rpcVersionMinimum,
+		"session-id":               h.sessionId,
+		"download-dir":             h.opts.DownloadDir,
+		"peer-port":                h.cl.LocalPort(),
+		"speed-limit-down":         down,
+		"speed-limit-down-enabled": downEnabled,
+		"speed-limit-up":           up,
+		"speed-limit-up-enabled":   upEnabled,
+		"dht-enabled":              !cfg.NoDHT,
+		"pex-enabled":              !cfg.DisablePEX,
+		"utp-enabled":              !cfg.DisableUTP,
+		"encryption":               "preferred",
+		"start-added-torrents":     true,
+		"units": map[string]interface{}{
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes":  speedUnitBytes,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"size-bytes":   1000,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+			"memory-bytes": 1024,
+		},
+	}, nil
+}
+
+func (h *Handler) sessionSet(rawArgs json.RawMessage) (interface{}, error) {
+	var args struct {
+		SpeedLimitDown        *int64 `json:"speed-limit-down"`
+		SpeedLimitDownEnabled *bool  `json:"speed-limit-down-enabled"`
+		SpeedLimitUp          *int64 `json:"speed-limit-up"`
+		SpeedLimitUpEnabled   *bool  `json:"speed-limit-up-enabled"`
+		PeerPort              *int   `json:"peer-port"`
+	}
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	return nil, h.cl.UpdateConfig(func(cfg *torrent.ClientConfig) {
+		if args.SpeedLimitDown != nil || args.SpeedLimitDownEnabled != nil {
+			limit, enabled := speedLimit(cfg.DownloadRateLimiter)
+			if args.SpeedLimitDown != nil {
+				limit = *args.SpeedLimitDown
+			}
+			if args.SpeedLimitDownEnabled != nil {
+				enabled = *args.SpeedLimitDownEnabled
+			}
+			cfg.DownloadRateLimiter = newSpeedLimiter(limit, enabled, 1<<20)
+		}
+		if args.SpeedLimitUp != nil || args.SpeedLimitUpEnabled != nil {
+			limit, enabled := speedLimit(cfg.UploadRateLimiter)
+			if args.SpeedLimitUp != nil {
+				limit = *args.SpeedLimitUp
+			}
+			if args.SpeedLimitUpEnabled != nil {
+				enabled = *args.SpeedLimitUpEnabled
+			}
+			cfg.UploadRateLimiter = newSpeedLimiter(limit, enabled, 256<<10)
+		}
+		if args.PeerPort != nil {
+			cfg.ListenPort = *args.PeerPort
+		}
+	})
+}
+
+type sessionStatsJSON struct {
+	UploadedBytes   int64 `json:"uploadedBytes"`
+	DownloadedBytes int64 `json:"downloadedBytes"`
+	FilesAdded      int   `json:"filesAdded"`
+	SessionCount    int   `json:"sessionCount"`
+	SecondsActive   int64 `json:"secondsActive"`
+}
+
+func (h *Handler) sessionStats(json.RawMessage) (interface{}, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var active, paused int
+	var down, up float64
+	torrents := h.syncTorrents()
+	for _, t := range torrents {
+		ts := h.torrents[t.InfoHash()]
+		if ts.stopped {
+			paused++
+		} else {
+			active++
+		}
+		down += ts.rates.down
+		up += ts.rates.up
+	}
+	connStats := h.cl.ConnStats()
+	// Nothing is persisted across sessions, so the cumulative stats are the current ones.
+	stats := sessionStatsJSON{
+		UploadedBytes:   connStats.BytesWrittenData.Int64(),
+		DownloadedBytes: connStats.BytesReadData.Int64(),
+		FilesAdded:      h.nextId - 1,
+		SessionCount:    1,
+		SecondsActive:   int64(time.Since(h.started) / time.Second),
+	}
+	return map[string]interface{}{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": paused,
+		"torrentCount":       len(torrents),
+		"downloadSpeed":      int64(down),
+		"uploadSpeed":        int64(up),
+		"cumulative-stats":   stats,
+		"current-stats":      stats,
+	}, nil
+}
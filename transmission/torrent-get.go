@@ -0,0 +1,281 @@
+package transmission
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/anacrolix/torrent"
+)
+
+// Transmission torrent status values.
+const (
+	statusStopped      = 0
+	statusCheckWait    = 1
+	statusCheck        = 2
+	statusDownloadWait = 3
+	statusDownload     = 4
+	statusSeedWait     = 5
+	statusSeed         = 6
+)
+
+type fileJSON struct {
+	Name           string `json:"name"`
+	Length         int64  `json:"length"`
+	BytesCompleted int64  `json:"bytesCompleted"`
+}
+
+type fileStatsJSON struct {
+	BytesCompleted int64 `json:"bytesCompleted"`
+	Wanted         bool  `json:"wanted"`
+	Priority       int   `json:"priority"`
+}
+
+type trackerJSON struct {
+	Announce string `json:"announce"`
+	Id       int    `json:"id"`
+	Tier     int    `json:"tier"`
+}
+
+// Values computed for a torrent, from which requested fields are taken.
+type torrentValues struct {
+	t           *torrent.Torrent
+	ts          *torrentState
+	stats       torrent.TorrentStats
+	downloadDir string
+	// Only set if the torrent has info.
+	files          []*torrent.File
+	sizeWhenDone   int64
+	leftUntilDone  int64
+	bytesCompleted int64
+}
+
+func newTorrentValues(t *torrent.Torrent, ts *torrentState, downloadDir string) (ret torrentValues) {
+	ret.t = t
+	ret.ts = ts
+	ret.downloadDir = downloadDir
+	ret.stats = t.Stats()
+	if t.Info() == nil {
+		return
+	}
+	ret.files = t.Files()
+	ts.initFilePriorities(ret.files)
+	ret.bytesCompleted = t.BytesCompleted()
+	for _, f := range ret.files {
+		if f.Priority() == torrent.PiecePriorityNone {
+			continue
+		}
+		ret.sizeWhenDone += f.Length()
+		ret.leftUntilDone += f.Length() - f.BytesCompleted()
+	}
+	return
+}
+
+func (me torrentValues) status() int {
+	switch {
+	case me.ts.stopped:
+		return statusStopped
+	case me.files == nil:
+		return statusDownload
+	}
+	for _, r := range me.t.PieceStateRuns() {
+		if r.Checking {
+			return statusCheck
+		}
+	}
+	if me.leftUntilDone == 0 {
+		return statusSeed
+	}
+	return statusDownload
+}
+
+func (me torrentValues) percentDone() float64 {
+	if me.files == nil {
+		return 0
+	}
+	if me.sizeWhenDone == 0 {
+		return 1
+	}
+	return float64(me.sizeWhenDone-me.leftUntilDone) / float64(me.sizeWhenDone)
+}
+
+// Seconds until the wanted data is complete, -1 if unknown, or -2 if it can't be estimated.
+func (me torrentValues) eta() int64 {
+	if me.files == nil {
+		return -1
+	}
+	if me.leftUntilDone == 0 {
+		return 0
+	}
+	if me.ts.rates.down <= 0 {
+		return -2
+	}
+	return int64(float64(me.leftUntilDone) / me.ts.rates.down)
+}
+
+func (me torrentValues) uploadRatio() float64 {
+	down := me.stats.BytesReadUsefulData.Int64()
+	if down == 0 {
+		return -1
+	}
+	return float64(me.stats.BytesWrittenData.Int64()) / float64(down)
+}
+
+func (me torrentValues) trackers() (ret []trackerJSON) {
+	ret = []trackerJSON{}
+	mi := me.t.Metainfo()
+	for tier, urls := range mi.UpvertedAnnounceList() {
+		for _, u := range urls {
+			ret = append(ret, trackerJSON{Announce: u, Id: len(ret), Tier: tier})
+		}
+	}
+	return
+}
+
+// Returns the value for a torrent-get field, and false if the field isn't supported.
+func (me torrentValues) field(name string) (interface{}, bool) {
+	t := me.t
+	switch name {
+	case "id":
+		return me.ts.id, true
+	case "hashString":
+		return t.InfoHash().HexString(), true
+	case "name":
+		return t.Name(), true
+	case "addedDate":
+		return me.ts.added.Unix(), true
+	case "status":
+		return me.status(), true
+	case "error":
+		return 0, true
+	case "errorString":
+		return "", true
+	case "isFinished":
+		return false, true
+	case "isStalled":
+		return false, true
+	case "queuePosition":
+		return me.ts.id, true
+	case "metadataPercentComplete":
+		if me.files == nil {
+			return 0, true
+		}
+		return 1, true
+	case "totalSize":
+		if me.files == nil {
+			return 0, true
+		}
+		return t.Length(), true
+	case "sizeWhenDone":
+		return me.sizeWhenDone, true
+	case "leftUntilDone":
+		return me.leftUntilDone, true
+	case "haveValid":
+		return me.bytesCompleted, true
+	case "haveUnchecked", "corruptEver":
+		return 0, true
+	case "percentDone":
+		return me.percentDone(), true
+	case "downloadedEver":
+		return me.stats.BytesReadData.Int64(), true
+	case "uploadedEver":
+		return me.stats.BytesWrittenData.Int64(), true
+	case "uploadRatio":
+		return me.uploadRatio(), true
+	case "rateDownload":
+		return int64(me.ts.rates.down), true
+	case "rateUpload":
+		return int64(me.ts.rates.up), true
+	case "eta":
+		return me.eta(), true
+	case "peersConnected":
+		return me.stats.ActivePeers, true
+	case "peersSendingToUs", "peersGettingFromUs":
+		// Not tracked separately.
+		return me.stats.ActivePeers, true
+	case "pieceCount":
+		if me.files == nil {
+			return 0, true
+		}
+		return t.NumPieces(), true
+	case "pieceSize":
+		if me.files == nil {
+			return 0, true
+		}
+		return t.Info().PieceLength, true
+	case "downloadDir":
+		return me.downloadDir, true
+	case "files":
+		ret := []fileJSON{}
+		for _, f := range me.files {
+			ret = append(ret, fileJSON{
+				Name:           f.DisplayPath(),
+				Length:         f.Length(),
+				BytesCompleted: f.BytesCompleted(),
+			})
+		}
+		return ret, true
+	case "fileStats":
+		ret := []fileStatsJSON{}
+		for i, f := range me.files {
+			ret = append(ret, fileStatsJSON{
+				BytesCompleted: f.BytesCompleted(),
+				Wanted:         f.Priority() != torrent.PiecePriorityNone,
+				Priority:       me.ts.filePriorities[i],
+			})
+		}
+		return ret, true
+	case "wanted":
+		ret := []bool{}
+		for _, f := range me.files {
+			ret = append(ret, f.Priority() != torrent.PiecePriorityNone)
+		}
+		return ret, true
+	case "priorities":
+		ret := []int{}
+		for i := range me.files {
+			ret = append(ret, me.ts.filePriorities[i])
+		}
+		return ret, true
+	case "trackers":
+		return me.trackers(), true
+	case "magnetLink":
+		mi := t.Metainfo()
+		ih := t.InfoHash()
+		return mi.Magnet(&ih, t.Info()).String(), true
+	default:
+		return nil, false
+	}
+}
+
+func (h *Handler) torrentGet(rawArgs json.RawMessage) (interface{}, error) {
+	var args struct {
+		idsArgs
+		Fields []string `json:"fields"`
+	}
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	if len(args.Fields) == 0 {
+		return nil, errors.New("no fields specified")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	selected, err := h.selectTorrents(args.Ids)
+	if err != nil {
+		return nil, err
+	}
+	ret := []map[string]interface{}{}
+	for _, t := range selected {
+		tv := newTorrentValues(t, h.torrents[t.InfoHash()], h.opts.DownloadDir)
+		m := make(map[string]interface{}, len(args.Fields))
+		for _, name := range args.Fields {
+			if v, ok := tv.field(name); ok {
+				m[name] = v
+			}
+		}
+		ret = append(ret, m)
+	}
+	return map[string]interface{}{
+		"torrents": ret,
+	}, nil
+}
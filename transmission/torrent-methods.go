@@ -0,0 +1,343 @@
+package transmission
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/types"
+)
+
+const maxMetainfoSize = 10 << 20
+
+var metainfoHttpClient = &http.Client{Timeout: time.Minute}
+
+// File selection arguments shared by torrent-add and torrent-set. Nil lists are absent. For
+// torrent-set, an empty list means all files.
+type fileArgs struct {
+	FilesWanted    []int `json:"files-wanted"`
+	FilesUnwanted  []int `json:"files-unwanted"`
+	PriorityHigh   []int `json:"priority-high"`
+	PriorityLow    []int `json:"priority-low"`
+	PriorityNormal []int `json:"priority-normal"`
+}
+
+func (me fileArgs) empty() bool {
+	return me.FilesWanted == nil && me.FilesUnwanted == nil &&
+		me.PriorityHigh == nil && me.PriorityLow == nil && me.PriorityNormal == nil
+}
+
+// Transmission has low, normal and high file priorities. Low is treated as normal, since there's
+// no equivalent piece priority.
+func libPriority(prio int) types.PiecePriority {
+	if prio > 0 {
+		return torrent.PiecePriorityHigh
+	}
+	return torrent.PiecePriorityNormal
+}
+
+func transmissionPriority(prio types.PiecePriority) int {
+	if prio >= torrent.PiecePriorityHigh {
+		return 1
+	}
+	return 0
+}
+
+// Initializes the Transmission file priorities from the files, if they haven't been already.
+func (ts *torrentState) initFilePriorities(files []*torrent.File) {
+	if ts.filePriorities != nil {
+		return
+	}
+	ts.filePriorities = make([]int, len(files))
+	for i, f := range files {
+		ts.filePriorities[i] = transmissionPriority(f.Priority())
+	}
+}
+
+// Applies file selections to a torrent with info. h.mu must be held.
+func (h *Handler) applyFileArgs(t *torrent.Torrent, ts *torrentState, args fileArgs) error {
+	files := t.Files()
+	ts.initFilePriorities(files)
+	ts.filesSelected = true
+	wanted := make([]bool, len(files))
+	for i, f := range files {
+		wanted[i] = f.Priority() != torrent.PiecePriorityNone
+	}
+	for _, s := range []struct {
+		indices []int
+		apply   func(i int)
+	}{
+		{args.PriorityHigh, func(i int) { ts.filePriorities[i] = 1 }},
+		{args.PriorityLow, func(i int) { ts.filePriorities[i] = -1 }},
+		{args.PriorityNormal, func(i int) { ts.filePriorities[i] = 0 }},
+		{args.FilesWanted, func(i int) { wanted[i] = true }},
+		{args.FilesUnwanted, func(i int) { wanted[i] = false }},
+	} {
+		if s.indices == nil {
+			continue
+		}
+		if len(s.indices) == 0 {
+			for i := range files {
+				s.apply(i)
+			}
+			continue
+		}
+		for _, i := range s.indices {
+			if i < 0 || i >= len(files) {
+				return fmt.Errorf("file index %v out of range", i)
+			}
+			s.apply(i)
+		}
+	}
+	for i, f := range files {
+		if wanted[i] {
+			f.SetPriority(libPriority(ts.filePriorities[i]))
+		} else {
+			f.SetPriority(torrent.PiecePriorityNone)
+		}
+	}
+	return nil
+}
+
+func setStopped(t *torrent.Torrent, ts *torrentState, stopped bool) {
+	ts.stopped = stopped
+	if stopped {
+		t.DisallowDataDownload()
+		t.DisallowDataUpload()
+	} else {
+		t.AllowDataDownload()
+		t.AllowDataUpload()
+	}
+}
+
+type torrentAddArgs struct {
+	fileArgs
+	Filename string `json:"filename"`
+	// Base64 encoded metainfo.
+	Metainfo string `json:"metainfo"`
+	Paused   bool   `json:"paused"`
+}
+
+type addedTorrent struct {
+	Id         int    `json:"id"`
+	Name       string `json:"name"`
+	HashString string `json:"hashString"`
+}
+
+// Returns the spec for the torrent-add arguments, fetching the metainfo if necessary.
+func addSpec(args torrentAddArgs) (*torrent.TorrentSpec, error) {
+	if args.Metainfo != "" {
+		b, err := base64.StdEncoding.DecodeString(args.Metainfo)
+		if err != nil {
+			return nil, fmt.Errorf("decoding metainfo: %w", err)
+		}
+		mi, err := metainfo.Load(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("loading metainfo: %w", err)
+		}
+		return torrent.TorrentSpecFromMetaInfoErr(mi)
+	}
+	switch {
+	case args.Filename == "":
+		return nil, errors.New(`no "filename" or "metainfo" given`)
+	case strings.HasPrefix(args.Filename, "magnet:"):
+		return torrent.TorrentSpecFromMagnetUri(args.Filename)
+	case strings.HasPrefix(args.Filename, "http://"), strings.HasPrefix(args.Filename, "https://"):
+		resp, err := metainfoHttpClient.Get(args.Filename)
+		if err != nil {
+			return nil, fmt.Errorf("fetching torrent file: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching torrent file: unexpected status %q", resp.Status)
+		}
+		mi, err := metainfo.Load(io.LimitReader(resp.Body, maxMetainfoSize))
+		if err != nil {
+			return nil, fmt.Errorf("loading metainfo: %w", err)
+		}
+		return torrent.TorrentSpecFromMetaInfoErr(mi)
+	default:
+		// Loading local paths given by remote clients isn't supported.
+		return nil, fmt.Errorf("unsupported filename %q", args.Filename)
+	}
+}
+
+func (h *Handler) torrentAdd(rawArgs json.RawMessage) (interface{}, error) {
+	var args torrentAddArgs
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	// Fetching metainfo can be slow, so do it before taking the lock.
+	spec, err := addSpec(args)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if t, ok := h.cl.Torrent(spec.InfoHash); ok {
+		return map[string]addedTorrent{
+			"torrent-duplicate": h.addedTorrent(t),
+		}, nil
+	}
+	t, _, err := h.cl.AddTorrentSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	ts := h.torrentState(t.InfoHash())
+	if args.Paused {
+		setStopped(t, ts, true)
+	}
+	if t.Info() != nil {
+		err = h.selectFiles(t, ts, args.fileArgs)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		go h.selectFilesOnInfo(t, args.fileArgs)
+	}
+	return map[string]addedTorrent{
+		"torrent-added": h.addedTorrent(t),
+	}, nil
+}
+
+func (h *Handler) addedTorrent(t *torrent.Torrent) addedTorrent {
+	return addedTorrent{
+		Id:         h.torrentState(t.InfoHash()).id,
+		Name:       t.Name(),
+		HashString: t.InfoHash().HexString(),
+	}
+}
+
+// Wants all files of a newly added torrent, except as given by args. h.mu must be held.
+func (h *Handler) selectFiles(t *torrent.Torrent, ts *torrentState, args fileArgs) error {
+	for _, f := range t.Files() {
+		f.SetPriority(torrent.PiecePriorityNormal)
+	}
+	return h.applyFileArgs(t, ts, args)
+}
+
+// Selects files once a torrent added without info gets it.
+func (h *Handler) selectFilesOnInfo(t *torrent.Torrent, args fileArgs) {
+	select {
+	case <-t.GotInfo():
+	case <-t.Closed():
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ts, ok := h.torrents[t.InfoHash()]
+	if !ok || ts.filesSelected {
+		// Removed, or files were already selected with torrent-set.
+		return
+	}
+	err := h.selectFiles(t, ts, args)
+	if err != nil {
+		log.Printf("error applying torrent-add file arguments to %v: %v", t, err)
+	}
+}
+
+type torrentSetArgs struct {
+	fileArgs
+	Ids        json.RawMessage `json:"ids"`
+	TrackerAdd []string        `json:"trackerAdd"`
+}
+
+func (h *Handler) torrentSet(rawArgs json.RawMessage) (interface{}, error) {
+	var args torrentSetArgs
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	torrents, err := h.selectTorrents(args.Ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range torrents {
+		if len(args.TrackerAdd) != 0 {
+			t.AddTrackers([][]string{args.TrackerAdd})
+		}
+		if args.empty() {
+			continue
+		}
+		if t.Info() == nil {
+			return nil, fmt.Errorf("torrent %v: metadata not yet available", t.InfoHash())
+		}
+		err := h.applyFileArgs(t, h.torrents[t.InfoHash()], args.fileArgs)
+		if err != nil {
+			return nil, fmt.Errorf("torrent %v: %w", t.InfoHash(), err)
+		}
+	}
+	return nil, nil
+}
+
+type idsArgs struct {
+	Ids json.RawMessage `json:"ids"`
+}
+
+func (h *Handler) setSelectedStopped(rawArgs json.RawMessage, stopped bool) error {
+	var args idsArgs
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	torrents, err := h.selectTorrents(args.Ids)
+	if err != nil {
+		return err
+	}
+	for _, t := range torrents {
+		setStopped(t, h.torrents[t.InfoHash()], stopped)
+	}
+	return nil
+}
+
+func (h *Handler) torrentStart(rawArgs json.RawMessage) (interface{}, error) {
+	return nil, h.setSelectedStopped(rawArgs, false)
+}
+
+func (h *Handler) torrentStop(rawArgs json.RawMessage) (interface{}, error) {
+	return nil, h.setSelectedStopped(rawArgs, true)
+}
+
+func (h *Handler) torrentRemove(rawArgs json.RawMessage) (interface{}, error) {
+	var args struct {
+		idsArgs
+		DeleteLocalData bool `json:"delete-local-data"`
+	}
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return nil, err
+	}
+	if args.DeleteLocalData && h.opts.DeleteData == nil {
+		return nil, errors.New("deleting local data is not supported")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	torrents, err := h.selectTorrents(args.Ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range torrents {
+		t.Drop()
+		ih := t.InfoHash()
+		delete(h.byId, h.torrents[ih].id)
+		delete(h.torrents, ih)
+		if args.DeleteLocalData {
+			err := h.opts.DeleteData(t)
+			if err != nil {
+				return nil, fmt.Errorf("deleting data for %v: %w", ih, err)
+			}
+		}
+	}
+	return nil, nil
+}